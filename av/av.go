@@ -105,3 +105,22 @@ type WriteCloser interface {
 	io.Closer
 	Writer
 }
+
+// WriterStats tells how a writer keeps up with the packets written to it.
+type WriterStats struct {
+	Protocol   string
+	BytesSent  uint64
+	QueueDepth int
+	Dropped    uint64
+}
+
+// BatchWriter is implemented by writers that send several packets at once
+// more cheaply than one by one.
+type BatchWriter interface {
+	WriteBatch(pkts []*Packet) error
+}
+
+// StatsWriter is implemented by writers that report WriterStats.
+type StatsWriter interface {
+	Stats() WriterStats
+}
@@ -0,0 +1,71 @@
+package av
+
+import (
+	"math/bits"
+	"sync"
+	"sync/atomic"
+)
+
+const (
+	minBufferShift = 8
+	maxBufferShift = 24
+)
+
+var bufferPools [maxBufferShift - minBufferShift + 1]sync.Pool
+
+// Buffer is a pooled, reference-counted byte slice. A new Buffer holds one
+// reference; it goes back to the pool when the last reference is released,
+// after which its bytes must not be used any more.
+type Buffer struct {
+	refs  atomic.Int32
+	data  []byte
+	class int
+}
+
+func bufferClass(size int) int {
+	if size <= 1<<minBufferShift {
+		return 0
+	}
+	return bits.Len(uint(size-1)) - minBufferShift
+}
+
+// NewBuffer returns a Buffer of size bytes. Sizes up to 16 MiB, the largest
+// RTMP message, are served from a pool.
+func NewBuffer(size int) *Buffer {
+	class := bufferClass(size)
+	if class >= len(bufferPools) {
+		b := &Buffer{data: make([]byte, size), class: -1}
+		b.refs.Store(1)
+		return b
+	}
+	b, ok := bufferPools[class].Get().(*Buffer)
+	if !ok {
+		b = &Buffer{
+			data:  make([]byte, 1<<(class+minBufferShift)),
+			class: class,
+		}
+	}
+	b.data = b.data[:size]
+	b.refs.Store(1)
+	return b
+}
+
+func (b *Buffer) Bytes() []byte {
+	return b.data
+}
+
+func (b *Buffer) Retain() {
+	b.refs.Add(1)
+}
+
+func (b *Buffer) Release() {
+	switch refs := b.refs.Add(-1); {
+	case refs > 0:
+	case refs == 0:
+		if b.class >= 0 {
+			bufferPools[b.class].Put(b)
+		}
+	default:
+		panic("av: buffer released more times than retained")
+	}
+}
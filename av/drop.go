@@ -0,0 +1,217 @@
+package av
+
+// DropPolicy decides which packets a slow consumer loses. A policy keeps
+// state per consumer, so every queue needs its own.
+type DropPolicy interface {
+	// Accept reports whether p should be queued at all, for example
+	// because it depends on frames that were dropped before.
+	Accept(p *Packet) bool
+	// Drop removes packets from the full queue que, releasing them, and
+	// returns how many it removed.
+	Drop(que chan *Packet) int
+}
+
+// Enqueue retains p and queues it, making room with policy while que is
+// full. It returns the number of packets that were dropped, p included.
+// Calls for the same queue must not run concurrently.
+func Enqueue(que chan *Packet, p *Packet, policy DropPolicy) (dropped int) {
+	p.Retain()
+	for {
+		// dropping may have removed the frames p depends on
+		if !policy.Accept(p) {
+			p.Release()
+			return dropped + 1
+		}
+		select {
+		case que <- p:
+			return
+		default:
+		}
+		n := policy.Drop(que)
+		if n == 0 {
+			p.Release()
+			return dropped + 1
+		}
+		dropped += n
+	}
+}
+
+// DropOldest discards up to n of the oldest packets, whatever they are.
+type DropOldest int
+
+func (DropOldest) Accept(*Packet) bool { return true }
+
+func (d DropOldest) Drop(que chan *Packet) int {
+	return DropNPacket(que, int(d))
+}
+
+type GOPDropPolicy struct {
+	keepAudio bool
+	// waitKey is set when video was dropped up to the end of the queue,
+	// until which further inter frames cannot be decoded.
+	waitKey bool
+	pkts    []*Packet
+}
+
+type GOPDropConf func(*GOPDropPolicy)
+
+// WithKeepAudio only drops video, so that the sound keeps playing while
+// the picture skips ahead.
+func WithKeepAudio() GOPDropConf {
+	return func(g *GOPDropPolicy) {
+		g.keepAudio = true
+	}
+}
+
+// NewGOPDropPolicy returns a policy that drops disposable frames first,
+// then skips ahead to the latest queued keyframe. Sequence headers and
+// metadata are never dropped.
+func NewGOPDropPolicy(conf ...GOPDropConf) *GOPDropPolicy {
+	g := new(GOPDropPolicy)
+	for _, c := range conf {
+		c(g)
+	}
+	return g
+}
+
+func (g *GOPDropPolicy) Accept(p *Packet) bool {
+	if !g.waitKey || !p.IsVideo || isSeqHeader(p) {
+		return true
+	}
+	if isKeyFrame(p) {
+		g.waitKey = false
+		return true
+	}
+	return false
+}
+
+func (g *GOPDropPolicy) Drop(que chan *Packet) (n int) {
+	g.pkts = g.pkts[:0]
+DRAIN:
+	for range cap(que) {
+		select {
+		case p, ok := <-que:
+			if !ok {
+				break DRAIN
+			}
+			g.pkts = append(g.pkts, p)
+		default:
+			break DRAIN
+		}
+	}
+
+	n = g.filter(func(_ int, p *Packet) bool { return isDisposable(p) })
+	if n == 0 {
+		key := -1
+		for i, p := range g.pkts {
+			if isKeyFrame(p) && !isSeqHeader(p) {
+				key = i
+			}
+		}
+		n = g.filter(func(i int, p *Packet) bool { return i < key && g.skippable(p) })
+		if n == 0 {
+			// the queue holds at most one GOP, skip all of it
+			g.waitKey = true
+			n = g.filter(func(_ int, p *Packet) bool { return g.skippable(p) })
+		}
+	}
+	if n == 0 {
+		// nothing but audio that is to be kept: lose the older half of it
+		var audio int
+		for _, p := range g.pkts {
+			if p.IsAudio && !isSeqHeader(p) {
+				audio++
+			}
+		}
+		n = g.filter(func(_ int, p *Packet) bool {
+			if p.IsAudio && !isSeqHeader(p) && audio > 0 {
+				audio -= 2
+				return true
+			}
+			return false
+		})
+	}
+
+	for _, p := range g.pkts {
+		que <- p
+	}
+	clear(g.pkts)
+	return n
+}
+
+// filter drops the queued packets drop reports true for, in order.
+func (g *GOPDropPolicy) filter(drop func(i int, p *Packet) bool) (n int) {
+	kept := g.pkts[:0]
+	for i, p := range g.pkts {
+		if drop(i, p) {
+			p.Release()
+			n++
+			continue
+		}
+		kept = append(kept, p)
+	}
+	clear(g.pkts[len(kept):])
+	g.pkts = kept
+	return
+}
+
+func (g *GOPDropPolicy) skippable(p *Packet) bool {
+	if p.IsMetadata || isSeqHeader(p) {
+		return false
+	}
+	return p.IsVideo || p.IsAudio && !g.keepAudio
+}
+
+func isSeqHeader(p *Packet) bool {
+	// flv tag headers are both video and audio headers.
+	if p.IsVideo {
+		h, ok := p.Header.(VideoPacketHeader)
+		return ok && h.IsSeq()
+	}
+	if p.IsAudio {
+		h, ok := p.Header.(AudioPacketHeader)
+		return ok && h.SoundFormat() == SOUND_AAC && h.AACPacketType() == AAC_SEQHDR
+	}
+	return false
+}
+
+func isKeyFrame(p *Packet) bool {
+	if !p.IsVideo {
+		return false
+	}
+	vh, ok := p.Header.(VideoPacketHeader)
+	return ok && vh.IsKeyFrame()
+}
+
+// isDisposable reports whether no other frame depends on the video frame
+// p: a disposable frame, or an H.264 frame whose slices are all
+// non-reference.
+func isDisposable(p *Packet) bool {
+	if !p.IsVideo || len(p.Data) < 1 {
+		return false
+	}
+	frameType, codecID := p.Data[0]>>4, p.Data[0]&0x0f
+	if frameType == FRAME_DISPO {
+		return true
+	}
+	if frameType != FRAME_INTER || codecID != CODEC_AVC || len(p.Data) < 5 || p.Data[1] != AVC_NALU {
+		return false
+	}
+	var slices int
+	for b := p.Data[5:]; len(b) >= 5; {
+		size := int(b[0])<<24 | int(b[1])<<16 | int(b[2])<<8 | int(b[3])
+		if size <= 0 || size > len(b)-4 {
+			return false
+		}
+		nal := b[4]
+		switch nal & 0x1f {
+		case 1, 5:
+			if nal&0x60 != 0 {
+				return false
+			}
+			slices++
+		}
+		b = b[4+size:]
+	}
+	return slices > 0
+}
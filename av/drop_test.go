@@ -0,0 +1,163 @@
+package av
+
+import "testing"
+
+type videoHeader struct {
+	key, seq bool
+}
+
+func (h videoHeader) IsKeyFrame() bool       { return h.key }
+func (h videoHeader) IsSeq() bool            { return h.seq }
+func (h videoHeader) CodecID() uint8         { return CODEC_AVC }
+func (h videoHeader) CompositionTime() int32 { return 0 }
+
+type audioHeader struct{}
+
+func (audioHeader) SoundFormat() uint8   { return SOUND_AAC }
+func (audioHeader) AACPacketType() uint8 { return AAC_RAW }
+
+const (
+	seq = iota
+	key
+	inter
+	nonRef
+	dispo
+	audio
+	meta
+)
+
+func newPacket(kind int, ts uint32) *Packet {
+	p := &Packet{TimeStamp: ts}
+	switch kind {
+	case seq:
+		p.IsVideo, p.Header = true, videoHeader{key: true, seq: true}
+		p.Data = []byte{0x17, AVC_SEQHDR, 0, 0, 0}
+	case key:
+		p.IsVideo, p.Header = true, videoHeader{key: true}
+		p.Data = []byte{0x17, AVC_NALU, 0, 0, 0, 0, 0, 0, 2, 0x65, 0}
+	case inter:
+		p.IsVideo, p.Header = true, videoHeader{}
+		p.Data = []byte{0x27, AVC_NALU, 0, 0, 0, 0, 0, 0, 2, 0x41, 0}
+	case nonRef:
+		p.IsVideo, p.Header = true, videoHeader{}
+		p.Data = []byte{0x27, AVC_NALU, 0, 0, 0, 0, 0, 0, 2, 0x01, 0}
+	case dispo:
+		p.IsVideo, p.Header = true, videoHeader{}
+		p.Data = []byte{0x32}
+	case audio:
+		p.IsAudio, p.Header = true, audioHeader{}
+	case meta:
+		p.IsMetadata = true
+	}
+	return p
+}
+
+func kindOf(p *Packet) int {
+	switch {
+	case p.IsMetadata:
+		return meta
+	case p.IsAudio:
+		return audio
+	case isSeqHeader(p):
+		return seq
+	case isKeyFrame(p):
+		return key
+	case p.Data[0]>>4 == FRAME_DISPO:
+		return dispo
+	case p.Data[9]&0x60 == 0:
+		return nonRef
+	}
+	return inter
+}
+
+func fill(kinds ...int) chan *Packet {
+	que := make(chan *Packet, len(kinds))
+	for i, k := range kinds {
+		que <- newPacket(k, uint32(i))
+	}
+	return que
+}
+
+func drain(que chan *Packet) (kinds []int) {
+	for len(que) > 0 {
+		kinds = append(kinds, kindOf(<-que))
+	}
+	return
+}
+
+func checkKinds(t *testing.T, got, want []int) {
+	t.Helper()
+	if len(got) != len(want) {
+		t.Fatalf("got %v, want %v", got, want)
+	}
+	for i := range want {
+		if got[i] != want[i] {
+			t.Fatalf("got %v, want %v", got, want)
+		}
+	}
+}
+
+func TestGOPDropPolicy(t *testing.T) {
+	tests := []struct {
+		name      string
+		keepAudio bool
+		queue     []int
+		want      []int
+	}{
+		{
+			name:  "disposable first",
+			queue: []int{seq, key, inter, nonRef, audio, dispo, inter},
+			want:  []int{seq, key, inter, audio, inter},
+		},
+		{
+			name:  "skip to keyframe",
+			queue: []int{meta, seq, key, inter, audio, seq, inter, key, inter},
+			want:  []int{meta, seq, seq, key, inter},
+		},
+		{
+			name:      "skip to keyframe keeping audio",
+			keepAudio: true,
+			queue:     []int{key, audio, inter, audio, key, audio},
+			want:      []int{audio, audio, key, audio},
+		},
+		{
+			name:  "skip whole gop",
+			queue: []int{seq, key, inter, audio, inter},
+			want:  []int{seq},
+		},
+		{
+			name:      "older half of audio",
+			keepAudio: true,
+			queue:     []int{meta, audio, audio, audio, audio},
+			want:      []int{meta, audio, audio},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var conf []GOPDropConf
+			if tt.keepAudio {
+				conf = append(conf, WithKeepAudio())
+			}
+			que := fill(tt.queue...)
+			n := NewGOPDropPolicy(conf...).Drop(que)
+			if n != len(tt.queue)-len(tt.want) {
+				t.Errorf("dropped %d, want %d", n, len(tt.queue)-len(tt.want))
+			}
+			checkKinds(t, drain(que), tt.want)
+		})
+	}
+}
+
+func TestEnqueueWaitsForKeyFrame(t *testing.T) {
+	policy := NewGOPDropPolicy()
+	que := fill(seq, key, inter, inter, inter)
+	var dropped int
+	for _, k := range []int{inter, audio, inter, seq, key, inter} {
+		dropped += Enqueue(que, newPacket(k, 0), policy)
+	}
+	// the gop was skipped, and the inter frames that followed it too
+	if dropped != 6 {
+		t.Errorf("dropped %d, want 6", dropped)
+	}
+	checkKinds(t, drain(que), []int{seq, audio, seq, key, inter})
+}
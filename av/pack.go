@@ -15,6 +15,33 @@ type Packet struct {
 	StreamID   uint32
 	Header     PacketHeader
 	Data       []byte
+
+	buf *Buffer
+}
+
+// SetBuffer makes b back the packet data. The packet takes over the
+// reference held by the caller.
+func (p *Packet) SetBuffer(b *Buffer) {
+	p.buf = b
+	p.Data = b.Bytes()
+}
+
+// Retain takes another reference on the packet data. Consumers that keep a
+// packet after Write returns, for example in a queue or a cache, must
+// retain it and release it once done.
+func (p *Packet) Retain() *Packet {
+	if p.buf != nil {
+		p.buf.Retain()
+	}
+	return p
+}
+
+// Release drops a reference taken by Retain or held by the producer.
+// Packets that are not backed by a pooled Buffer ignore it.
+func (p *Packet) Release() {
+	if p.buf != nil {
+		p.buf.Release()
+	}
 }
 
 func (p *Packet) Type() uint8 {
@@ -27,6 +54,8 @@ func (p *Packet) Type() uint8 {
 	}
 }
 
+// Clone returns a shallow copy of p that shares its data. The copy does not
+// hold a reference of its own.
 func (p *Packet) Clone() *Packet {
 	tp := *p
 	return &tp
@@ -36,6 +65,7 @@ func (p *Packet) DeepClone() *Packet {
 	tp := *p
 	tp.Data = make([]byte, len(p.Data))
 	copy(tp.Data, p.Data)
+	tp.buf = nil
 	return &tp
 }
 
@@ -48,10 +78,11 @@ func DropPacket(pktQue chan *Packet) (n int) {
 func DropNPacket(pktQue chan *Packet, dn int) (n int) {
 	for {
 		select {
-		case _, ok := <-pktQue:
+		case p, ok := <-pktQue:
 			if !ok {
 				return
 			}
+			p.Release()
 			n++
 			if n == dn {
 				return
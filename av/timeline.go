@@ -0,0 +1,20 @@
+package av
+
+// Timeline extends 32-bit millisecond timestamps, which wrap after about 49
+// days, to 64 bits. Timestamps may go backwards by less than 2^31 ms.
+type Timeline struct {
+	started bool
+	last    uint32
+	ext     int64
+}
+
+func (t *Timeline) Extend(ts uint32) int64 {
+	if !t.started {
+		t.started = true
+		t.ext = int64(ts)
+	} else {
+		t.ext += int64(int32(ts - t.last))
+	}
+	t.last = ts
+	return t.ext
+}
@@ -1,49 +1,114 @@
 package cache
 
 import (
+	"time"
+
 	"github.com/zijiren233/livelib/av"
 )
 
+// JoinMode decides where in the cache new players start.
+type JoinMode int
+
+const (
+	// JoinCached starts at the oldest cached keyframe.
+	JoinCached JoinMode = iota
+	// JoinLiveEdge starts at the newest cached keyframe.
+	JoinLiveEdge
+)
+
 type Cache struct {
 	gop      *GopCache
 	videoSeq *SpecialCache
 	audioSeq *SpecialCache
 	metadata *SpecialCache
+	join     JoinMode
+}
+
+type CacheConf func(*Cache)
+
+// WithGOPs keeps the last n GOPs, one by default.
+func WithGOPs(n int) CacheConf {
+	return func(c *Cache) {
+		c.gop.maxGOPs = max(n, 1)
+	}
+}
+
+// WithDuration keeps as many GOPs as it takes to cover d, instead of a
+// fixed number.
+func WithDuration(d time.Duration) CacheConf {
+	return func(c *Cache) {
+		c.gop.duration = d.Milliseconds()
+	}
+}
+
+// WithMaxBytes limits the size of the cached GOPs. Older GOPs are dropped
+// to stay within it, a single GOP that does not fit is not cached.
+func WithMaxBytes(n int) CacheConf {
+	return func(c *Cache) {
+		c.gop.maxBytes = n
+	}
 }
 
-func NewCache() *Cache {
-	return &Cache{
+// WithMaxGOPFrames limits the video frames of a GOP, DefaultMaxGOPFrames by
+// default. A GOP that has more is not cached, n <= 0 lifts the limit.
+func WithMaxGOPFrames(n int) CacheConf {
+	return func(c *Cache) {
+		c.gop.maxFrames = n
+	}
+}
+
+// WithJoinMode sets where Send starts, JoinCached by default.
+func WithJoinMode(mode JoinMode) CacheConf {
+	return func(c *Cache) {
+		c.join = mode
+	}
+}
+
+func NewCache(conf ...CacheConf) *Cache {
+	c := &Cache{
 		gop:      NewGopCache(),
 		videoSeq: NewSpecialCache(),
 		audioSeq: NewSpecialCache(),
 		metadata: NewSpecialCache(),
 	}
+	for _, cf := range conf {
+		cf(c)
+	}
+	return c
 }
 
-func (cache *Cache) Write(p *av.Packet) {
+// Write caches p. It returns ErrGopTooBig when a GOP was dropped for not
+// fitting the budget.
+func (cache *Cache) Write(p *av.Packet) error {
 	if p.IsMetadata {
 		cache.metadata.Write(p)
-		return
+		return nil
 	} else if p.IsAudio {
 		ah, ok := p.Header.(av.AudioPacketHeader)
 		if ok &&
 			ah.SoundFormat() == av.SOUND_AAC &&
 			ah.AACPacketType() == av.AAC_SEQHDR {
 			cache.audioSeq.Write(p)
+			return nil
 		}
-		return
+		return cache.gop.Write(p)
 	} else {
 		vh, ok := p.Header.(av.VideoPacketHeader)
 		if ok && vh.IsSeq() {
 			cache.videoSeq.Write(p)
-			return
-		} else {
-			cache.gop.Write(p)
+			return nil
 		}
+		return cache.gop.Write(p)
 	}
 }
 
 func (cache *Cache) Send(w av.WriteCloser) error {
+	return cache.SendMode(w, cache.join)
+}
+
+// SendMode writes the headers and the cached GOPs to w, starting where mode
+// says.
+func (cache *Cache) SendMode(w av.WriteCloser, mode JoinMode) error {
 	if err := cache.metadata.Send(w); err != nil {
 		return err
 	}
@@ -56,9 +121,39 @@ func (cache *Cache) Send(w av.WriteCloser) error {
 		return err
 	}
 
-	if err := cache.gop.Send(w); err != nil {
-		return err
+	if mode == JoinLiveEdge {
+		return cache.gop.SendLiveEdge(w)
 	}
+	return cache.gop.Send(w)
+}
+
+// Headers returns the cached metadata and sequence headers.
+func (cache *Cache) Headers() []*av.Packet {
+	var headers []*av.Packet
+	for _, s := range []*SpecialCache{cache.metadata, cache.videoSeq, cache.audioSeq} {
+		if s.isComplete {
+			headers = append(headers, s.p)
+		}
+	}
+	return headers
+}
+
+// Reset drops the cached GOPs and keeps the headers.
+func (cache *Cache) Reset() {
+	cache.gop.reset()
+}
+
+// HasKeyFrame reports whether Send starts with a keyframe.
+func (cache *Cache) HasKeyFrame() bool {
+	return cache.gop.HasKeyFrame()
+}
+
+// HasVideo reports whether a video sequence header was seen.
+func (cache *Cache) HasVideo() bool {
+	return cache.videoSeq.isComplete
+}
 
-	return nil
+// Size returns the number of packets and bytes in the cached GOPs.
+func (cache *Cache) Size() (packets, bytes int) {
+	return cache.gop.Size()
 }
@@ -0,0 +1,156 @@
+package cache
+
+import (
+	"errors"
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/zijiren233/livelib/av"
+	"github.com/zijiren233/livelib/container/flv"
+)
+
+func newPacket(kind byte, ts uint32, size int) *av.Packet {
+	p := &av.Packet{TimeStamp: ts}
+	switch kind {
+	case 's':
+		p.IsVideo, p.Data = true, []byte{0x17, 0, 0, 0, 0}
+	case 'k':
+		p.IsVideo, p.Data = true, []byte{0x17, 1, 0, 0, 0}
+	case 'i':
+		p.IsVideo, p.Data = true, []byte{0x27, 1, 0, 0, 0}
+	case 'a':
+		p.IsAudio, p.Data = true, []byte{0xaf, 1}
+	}
+	p.Data = append(p.Data, make([]byte, size)...)
+	if err := flv.NewDemuxer().DemuxH(p); err != nil {
+		panic(err)
+	}
+	return p
+}
+
+type collector []string
+
+func (c *collector) Write(p *av.Packet) error {
+	kind := "a"
+	if p.IsVideo {
+		switch vh := p.Header.(av.VideoPacketHeader); {
+		case vh.IsSeq():
+			kind = "s"
+		case vh.IsKeyFrame():
+			kind = "k"
+		default:
+			kind = "i"
+		}
+	}
+	*c = append(*c, fmt.Sprint(kind, p.TimeStamp))
+	return nil
+}
+
+func (c *collector) Close() error { return nil }
+
+// write feeds a stream of a keyframe every 200ms, with a video and an
+// audio packet every 40ms in between.
+func write(t *testing.T, c *Cache, until uint32) {
+	t.Helper()
+	c.Write(newPacket('s', 0, 0))
+	for ts := uint32(0); ts <= until; ts += 40 {
+		kind := byte('i')
+		if ts%200 == 0 {
+			kind = 'k'
+		}
+		if err := c.Write(newPacket(kind, ts, 0)); err != nil {
+			t.Fatal(err)
+		}
+		if err := c.Write(newPacket('a', ts+20, 0)); err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+func sent(c *Cache, mode JoinMode) string {
+	var col collector
+	c.SendMode(&col, mode)
+	return fmt.Sprint(col)
+}
+
+func TestCacheDepth(t *testing.T) {
+	tests := []struct {
+		name string
+		conf []CacheConf
+		mode JoinMode
+		want string
+	}{
+		{
+			name: "one gop with audio",
+			want: "[s0 k400 a420 i440 a460]",
+		},
+		{
+			name: "gops",
+			conf: []CacheConf{WithGOPs(2)},
+			want: "[s0 k200 a220 i240 a260 i280 a300 i320 a340 i360 a380 k400 a420 i440 a460]",
+		},
+		{
+			name: "live edge",
+			conf: []CacheConf{WithGOPs(2)},
+			mode: JoinLiveEdge,
+			want: "[s0 k400 a420 i440 a460]",
+		},
+		{
+			name: "duration",
+			conf: []CacheConf{WithDuration(100 * time.Millisecond)},
+			want: "[s0 k200 a220 i240 a260 i280 a300 i320 a340 i360 a380 k400 a420 i440 a460]",
+		},
+		{
+			name: "byte budget",
+			conf: []CacheConf{WithGOPs(3), WithMaxBytes(80)},
+			want: "[s0 k200 a220 i240 a260 i280 a300 i320 a340 i360 a380 k400 a420 i440 a460]",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			c := NewCache(tt.conf...)
+			write(t, c, 440)
+			if got := sent(c, tt.mode); got != tt.want {
+				t.Fatalf("got %s, want %s", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestCacheMaxGOPFrames(t *testing.T) {
+	c := NewCache(WithMaxGOPFrames(5))
+	// five video frames and five audio packets per GOP fit.
+	write(t, c, 360)
+	if err := c.Write(newPacket('i', 390, 0)); !errors.Is(err, ErrGopTooBig) {
+		t.Fatalf("Write() = %v", err)
+	}
+}
+
+func TestCacheGopTooBig(t *testing.T) {
+	c := NewCache(WithMaxBytes(100))
+	write(t, c, 0)
+	if err := c.Write(newPacket('i', 40, 100)); !errors.Is(err, ErrGopTooBig) {
+		t.Fatalf("Write() = %v", err)
+	}
+	if c.HasKeyFrame() {
+		t.Fatal("oversized gop kept")
+	}
+	// audio and inter frames wait for the next keyframe
+	c.Write(newPacket('a', 60, 0))
+	c.Write(newPacket('k', 200, 0))
+	c.Write(newPacket('a', 220, 0))
+	if got, want := sent(c, JoinCached), "[s0 k200 a220]"; got != want {
+		t.Fatalf("got %s, want %s", got, want)
+	}
+}
+
+func TestCacheAudioOnly(t *testing.T) {
+	c := NewCache()
+	for ts := uint32(0); ts <= 2100; ts += 700 {
+		c.Write(newPacket('a', ts, 0))
+	}
+	if got, want := sent(c, JoinCached), "[a1400 a2100]"; got != want {
+		t.Fatalf("got %s, want %s", got, want)
+	}
+}
@@ -6,70 +6,172 @@ import (
 	"github.com/zijiren233/livelib/av"
 )
 
-var (
-	maxGOPCap    int = 1024
-	ErrGopTooBig     = errors.New("gop to big")
-)
+var ErrGopTooBig = errors.New("gop to big")
+
+// DefaultMaxGOPFrames is how many video frames a cached GOP holds at most.
+const DefaultMaxGOPFrames = 1024
+
+// audioGOPDuration is how much audio of a stream without video counts as
+// one GOP, in milliseconds.
+const audioGOPDuration = 1000
 
-type array struct {
-	packets    []*av.Packet
-	isComplete bool
+// gop is a keyframe and the video and audio packets following it.
+type gop struct {
+	packets []*av.Packet
+	bytes   int
+	// frames counts the video packets, audio is only bounded by bytes.
+	frames int
+	start  uint32
 }
 
-func newArray() *array {
-	return &array{
-		packets:    make([]*av.Packet, 0, maxGOPCap),
-		isComplete: false,
+func (g *gop) release() {
+	for _, p := range g.packets {
+		p.Release()
 	}
+	clear(g.packets)
 }
 
-func (a *array) reset() {
-	a.packets = a.packets[:0]
-	a.isComplete = false
+// GopCache keeps the last GOPs of a stream, audio included, so that new
+// players can start decoding right away.
+type GopCache struct {
+	gops []*gop
+	// video is set once a video frame was seen, until then audio is cached
+	// in GOPs of audioGOPDuration.
+	video bool
+	bytes int
+	last  uint32
+
+	maxGOPs   int
+	duration  int64
+	maxBytes  int
+	maxFrames int
 }
 
-func (a *array) write(packet *av.Packet) error {
-	if len(a.packets) >= maxGOPCap {
-		return ErrGopTooBig
+func NewGopCache() *GopCache {
+	return &GopCache{
+		maxGOPs:   1,
+		maxFrames: DefaultMaxGOPFrames,
 	}
-	IsKeyFrame := packet.Header.(av.VideoPacketHeader).IsKeyFrame()
-	if !a.isComplete && !IsKeyFrame {
+}
+
+func (g *GopCache) current() *gop {
+	if len(g.gops) == 0 {
 		return nil
 	}
-	if IsKeyFrame {
-		a.reset()
-		a.isComplete = true
-	}
-	a.packets = append(a.packets, packet)
-	return nil
+	return g.gops[len(g.gops)-1]
 }
 
-func (a *array) send(w av.WriteCloser) error {
-	if !a.isComplete {
+// Write adds p to the current GOP, or starts a new one at a keyframe. A GOP
+// that grows beyond the frame or byte budget is dropped together with the
+// older ones, and caching resumes at the next keyframe.
+func (g *GopCache) Write(p *av.Packet) error {
+	var start bool
+	if p.IsVideo {
+		vh, ok := p.Header.(av.VideoPacketHeader)
+		if !ok {
+			return nil
+		}
+		if !g.video {
+			g.video = true
+			g.reset()
+		}
+		start = vh.IsKeyFrame()
+	} else if !g.video {
+		cur := g.current()
+		start = cur == nil || int64(int32(p.TimeStamp-cur.start)) >= audioGOPDuration
+	}
+
+	cur := g.current()
+	if start {
+		cur = &gop{start: p.TimeStamp}
+		g.gops = append(g.gops, cur)
+	} else if cur == nil {
 		return nil
 	}
-	for _, packet := range a.packets {
-		if err := w.Write(packet); err != nil {
-			return err
-		}
+	if p.IsVideo && g.maxFrames > 0 && cur.frames >= g.maxFrames ||
+		g.maxBytes > 0 && cur.bytes+len(p.Data) > g.maxBytes {
+		g.reset()
+		return ErrGopTooBig
 	}
+	if p.IsVideo {
+		cur.frames++
+	}
+	cur.packets = append(cur.packets, p.Retain())
+	cur.bytes += len(p.Data)
+	g.bytes += len(p.Data)
+	g.last = p.TimeStamp
+	g.trim()
 	return nil
 }
 
-type GopCache struct {
-	gop *array
+// trim drops the oldest GOPs the depth and byte budget do not leave room
+// for.
+func (g *GopCache) trim() {
+	for len(g.gops) > 1 {
+		var drop bool
+		switch {
+		case g.maxBytes > 0 && g.bytes > g.maxBytes:
+			drop = true
+		case g.duration > 0:
+			// keep the GOPs needed to cover the duration
+			drop = int64(int32(g.last-g.gops[1].start)) >= g.duration
+		default:
+			drop = len(g.gops) > g.maxGOPs
+		}
+		if !drop {
+			return
+		}
+		g.bytes -= g.gops[0].bytes
+		g.gops[0].release()
+		g.gops[0] = nil
+		g.gops = g.gops[1:]
+	}
 }
 
-func NewGopCache() *GopCache {
-	return &GopCache{
-		gop: newArray(),
+func (g *GopCache) reset() {
+	for _, gop := range g.gops {
+		gop.release()
 	}
+	clear(g.gops)
+	g.gops = g.gops[:0]
+	g.bytes = 0
 }
 
-func (g *GopCache) Write(p *av.Packet) {
-	g.gop.write(p)
+// Send writes all cached GOPs to w.
+func (g *GopCache) Send(w av.WriteCloser) error {
+	for _, gop := range g.gops {
+		for _, p := range gop.packets {
+			if err := w.Write(p); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
 }
 
-func (g *GopCache) Send(w av.WriteCloser) error {
-	return g.gop.send(w)
+// SendLiveEdge writes the newest GOP to w.
+func (g *GopCache) SendLiveEdge(w av.WriteCloser) error {
+	cur := g.current()
+	if cur == nil {
+		return nil
+	}
+	for _, p := range cur.packets {
+		if err := w.Write(p); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// HasKeyFrame reports whether a GOP is cached.
+func (g *GopCache) HasKeyFrame() bool {
+	return g.video && len(g.gops) > 0
+}
+
+// Size returns the number of packets and bytes cached.
+func (g *GopCache) Size() (packets, bytes int) {
+	for _, gop := range g.gops {
+		packets += len(gop.packets)
+	}
+	return packets, g.bytes
 }
@@ -19,6 +19,11 @@ func NewSpecialCache() *SpecialCache {
 }
 
 func (s *SpecialCache) Write(p *av.Packet) {
+	// retain first, p may share its buffer with the cached packet
+	p.Retain()
+	if s.p != nil {
+		s.p.Release()
+	}
 	s.isComplete = true
 	s.p = p
 }
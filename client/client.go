@@ -14,7 +14,10 @@ import (
 
 type Client struct {
 	connClient *core.ConnClient
-	method     string
+	// reader is set instead of connClient when playing an http-flv or hls
+	// url.
+	reader av.ReadCloser
+	method string
 
 	pulling, inPublication bool
 
@@ -28,6 +31,8 @@ var (
 	ErrMethodNotSupport = errors.New("method not support")
 )
 
+// Dial connects to the rtmp url, or with av.PLAY also requests the http-flv
+// url, which is requested again whenever it fails, or the hls url.
 func Dial(url, method string) (*Client, error) {
 	if method != av.PUBLISH && method != av.PLAY {
 		return nil, ErrMethodNotSupport
@@ -35,8 +40,24 @@ func Dial(url, method string) (*Client, error) {
 	c := &Client{method: method, gopSize: 30}
 	switch method {
 	case av.PUBLISH:
+		if IsFLVURL(url) || IsHLSURL(url) {
+			return nil, ErrMethodNotSupport
+		}
 	case av.PLAY:
 		c.players = &rwmap.RWMap[av.WriteCloser, *packWriter]{}
+		var err error
+		switch {
+		case IsHLSURL(url):
+			c.reader, err = DialHLS(context.Background(), url)
+		case IsFLVURL(url):
+			c.reader, err = DialFLV(context.Background(), url, WithReconnect(-1, DefaultReconnectDelay))
+		}
+		if err != nil {
+			return nil, err
+		}
+		if c.reader != nil {
+			return c, nil
+		}
 	}
 	connClient := core.NewConnClient()
 	if err := connClient.Start(url, c.method); err != nil {
@@ -47,10 +68,16 @@ func Dial(url, method string) (*Client, error) {
 }
 
 func (c *Client) Close() error {
+	if c.reader != nil {
+		return c.reader.Close()
+	}
 	return c.connClient.Close()
 }
 
 func (c *Client) Flush() error {
+	if c.reader != nil {
+		return nil
+	}
 	return c.connClient.Flush()
 }
 
@@ -91,7 +118,12 @@ func (c *Client) PullStart(ctx context.Context) (err error) {
 
 	cache := cache.NewCache()
 
-	puller := rtmp.NewReader(c.connClient)
+	var puller av.Reader
+	if c.reader != nil {
+		puller = c.reader
+	} else {
+		puller = rtmp.NewReader(c.connClient)
+	}
 
 	for {
 		select {
@@ -122,6 +154,7 @@ func (c *Client) PullStart(ctx context.Context) (err error) {
 			}
 			return true
 		})
+		p.Release()
 	}
 }
 
@@ -0,0 +1,156 @@
+package client
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/zijiren233/livelib/av"
+	"github.com/zijiren233/livelib/container/flv"
+)
+
+const DefaultReconnectDelay = time.Second
+
+var ErrNotFLVURL = errors.New("not an http-flv url")
+
+// IsFLVURL reports whether url is an http(s) url other than an m3u8
+// playlist, which is pulled as http-flv rather than rtmp or hls.
+func IsFLVURL(url string) bool {
+	return (strings.HasPrefix(url, "http://") || strings.HasPrefix(url, "https://")) && !IsHLSURL(url)
+}
+
+// FLVReader reads the http-flv stream at a url. With reconnects enabled a
+// failed stream is requested again, and the timestamps of the new response
+// continue from the last packet read.
+type FLVReader struct {
+	url        string
+	httpClient *http.Client
+	reconnects int
+	delay      time.Duration
+
+	ctx    context.Context
+	cancel context.CancelFunc
+
+	mu   sync.Mutex
+	body io.ReadCloser
+	r    *flv.Reader
+
+	// rebase is set after a reconnect until the first packet of the new
+	// response, which fixes offset.
+	rebase bool
+	offset uint32
+	last   uint32
+}
+
+type FLVReaderConf func(*FLVReader)
+
+// WithHTTPClient sets the client the stream is requested with,
+// http.DefaultClient by default.
+func WithHTTPClient(c *http.Client) FLVReaderConf {
+	return func(r *FLVReader) {
+		r.httpClient = c
+	}
+}
+
+// WithReconnect requests the stream again, at most n times in a row and
+// delay apart, when it fails. n < 0 reconnects until the reader is closed.
+func WithReconnect(n int, delay time.Duration) FLVReaderConf {
+	return func(r *FLVReader) {
+		r.reconnects = n
+		r.delay = delay
+	}
+}
+
+// DialFLV requests the http-flv stream at url. ctx bounds the whole life of
+// the reader, not only the first request.
+func DialFLV(ctx context.Context, url string, conf ...FLVReaderConf) (*FLVReader, error) {
+	if !IsFLVURL(url) {
+		return nil, ErrNotFLVURL
+	}
+	r := &FLVReader{
+		url:        url,
+		httpClient: http.DefaultClient,
+		delay:      DefaultReconnectDelay,
+	}
+	for _, c := range conf {
+		c(r)
+	}
+	r.ctx, r.cancel = context.WithCancel(ctx)
+	if err := r.connect(); err != nil {
+		r.cancel()
+		return nil, err
+	}
+	return r, nil
+}
+
+func (r *FLVReader) connect() error {
+	req, err := http.NewRequestWithContext(r.ctx, http.MethodGet, r.url, nil)
+	if err != nil {
+		return err
+	}
+	resp, err := r.httpClient.Do(req)
+	if err != nil {
+		return err
+	}
+	if resp.StatusCode != http.StatusOK {
+		resp.Body.Close()
+		return fmt.Errorf("get %s: %s", r.url, resp.Status)
+	}
+	r.mu.Lock()
+	r.body = resp.Body
+	r.mu.Unlock()
+	r.r = flv.NewReader(resp.Body)
+	return nil
+}
+
+func (r *FLVReader) Read() (*av.Packet, error) {
+	for {
+		p, err := r.r.Read()
+		if err == nil {
+			if r.rebase {
+				r.rebase = false
+				r.offset = r.last - p.TimeStamp
+			}
+			p.TimeStamp += r.offset
+			r.last = p.TimeStamp
+			return p, nil
+		}
+		if r.ctx.Err() != nil {
+			return nil, av.ErrClosed
+		}
+		if err = r.reconnect(err); err != nil {
+			return nil, err
+		}
+	}
+}
+
+// reconnect requests the stream again after it failed with err, and
+// returns err when it runs out of attempts.
+func (r *FLVReader) reconnect(err error) error {
+	r.body.Close()
+	for i := 0; r.reconnects < 0 || i < r.reconnects; i++ {
+		select {
+		case <-r.ctx.Done():
+			return av.ErrClosed
+		case <-time.After(r.delay):
+		}
+		if err = r.connect(); err == nil {
+			r.rebase = true
+			return nil
+		}
+	}
+	return err
+}
+
+// Close interrupts a blocked Read.
+func (r *FLVReader) Close() error {
+	r.cancel()
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return r.body.Close()
+}
@@ -0,0 +1,96 @@
+package client
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/zijiren233/livelib/av"
+	"github.com/zijiren233/livelib/container/flv"
+)
+
+func keyframe(ts uint32) *av.Packet {
+	return &av.Packet{IsVideo: true, TimeStamp: ts, Data: []byte{0x17, 1, 0, 0, 0, 2}}
+}
+
+func TestFLVReaderReconnect(t *testing.T) {
+	var requests atomic.Int32
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if n := requests.Add(1); n == 2 || n > 3 {
+			http.Error(w, "unavailable", http.StatusServiceUnavailable)
+			return
+		}
+		// every response restarts from zero and ends after two tags.
+		fw := flv.NewWriter(w)
+		fw.Write(keyframe(0))
+		fw.Write(keyframe(40))
+	}))
+	defer srv.Close()
+
+	r, err := DialFLV(context.Background(), srv.URL+"/live/a.flv", WithReconnect(2, time.Millisecond))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer r.Close()
+	var ts []uint32
+	for {
+		p, err := r.Read()
+		if err != nil {
+			if requests.Load() != 5 {
+				t.Errorf("gave up after %d requests: %v", requests.Load(), err)
+			}
+			break
+		}
+		ts = append(ts, p.TimeStamp)
+	}
+	// the second request fails and the third continues the timestamps,
+	// the fourth and fifth fail and end the reader.
+	want := []uint32{0, 40, 40, 80}
+	if len(ts) != len(want) {
+		t.Fatalf("timestamps %v, want %v", ts, want)
+	}
+	for i := range want {
+		if ts[i] != want[i] {
+			t.Fatalf("timestamps %v, want %v", ts, want)
+		}
+	}
+}
+
+func TestFLVReaderClose(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		flv.NewWriter(w).Write(keyframe(0))
+		w.(http.Flusher).Flush()
+		<-r.Context().Done()
+	}))
+	defer srv.Close()
+
+	if _, err := DialFLV(context.Background(), "rtmp://127.0.0.1/live/a"); !errors.Is(err, ErrNotFLVURL) {
+		t.Errorf("DialFLV(rtmp) = %v", err)
+	}
+	r, err := DialFLV(context.Background(), srv.URL, WithReconnect(-1, time.Millisecond))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := r.Read(); err != nil {
+		t.Fatal(err)
+	}
+	errc := make(chan error, 1)
+	go func() {
+		_, err := r.Read()
+		errc <- err
+	}()
+	time.Sleep(10 * time.Millisecond)
+	r.Close()
+	select {
+	case err := <-errc:
+		if !errors.Is(err, av.ErrClosed) {
+			t.Errorf("Read after Close = %v", err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("Close did not interrupt Read")
+	}
+}
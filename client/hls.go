@@ -0,0 +1,350 @@
+package client
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/zijiren233/livelib/av"
+	"github.com/zijiren233/livelib/container/ts"
+	"github.com/zijiren233/livelib/protocol/hls"
+)
+
+const (
+	// liveEdgeSegments is how many segments from the end of a live playlist
+	// the reader starts at, like players do.
+	liveEdgeSegments = 3
+	// maxTimestampJump is the largest difference between the timestamps of
+	// consecutive segments that is not taken as a discontinuity.
+	maxTimestampJump = 10 * time.Second
+	// maxLate is how far behind real time the packets can fall before the
+	// pacing clock is reset, rather than catching up in a burst.
+	maxLate = 500 * time.Millisecond
+	// playlistRetries is how many times a playlist that failed to load is
+	// requested again, a target duration apart, before the reader fails.
+	playlistRetries = 3
+	// minPollInterval is the shortest target duration a playlist is polled
+	// at, for the ones that claim zero.
+	minPollInterval = time.Second
+)
+
+var ErrNoVariant = errors.New("no variant within the bandwidth")
+
+// IsHLSURL reports whether url is an http(s) url of an m3u8 playlist.
+func IsHLSURL(rawURL string) bool {
+	u, err := url.Parse(rawURL)
+	if err != nil || (u.Scheme != "http" && u.Scheme != "https") {
+		return false
+	}
+	return strings.HasSuffix(u.Path, ".m3u8")
+}
+
+// HLSReader reads a live hls stream: it polls the media playlist, or the
+// variant it picked from a master playlist, and demuxes the new segments
+// in order. The packets are returned at the pace of their timestamps, which
+// are made continuous across discontinuities, skipped segments and restarts
+// of the stream.
+type HLSReader struct {
+	playlist     *url.URL
+	httpClient   *http.Client
+	maxBandwidth int
+
+	ctx    context.Context
+	cancel context.CancelFunc
+
+	segments chan []*av.Packet
+	// err is why segments was closed.
+	err error
+
+	pending []*av.Packet
+	start   time.Time
+	startTS uint32
+}
+
+type HLSReaderConf func(*HLSReader)
+
+// WithHLSHTTPClient sets the client the playlists and segments are
+// requested with, http.DefaultClient by default.
+func WithHLSHTTPClient(c *http.Client) HLSReaderConf {
+	return func(r *HLSReader) {
+		r.httpClient = c
+	}
+}
+
+// WithMaxBandwidth picks the variant of a master playlist with the highest
+// bandwidth up to bps, rather than the highest.
+func WithMaxBandwidth(bps int) HLSReaderConf {
+	return func(r *HLSReader) {
+		r.maxBandwidth = bps
+	}
+}
+
+// DialHLS requests the playlist at url, a master or media playlist. ctx
+// bounds the whole life of the reader, not only the first request.
+func DialHLS(ctx context.Context, rawURL string, conf ...HLSReaderConf) (*HLSReader, error) {
+	u, err := url.Parse(rawURL)
+	if err != nil {
+		return nil, err
+	}
+	r := &HLSReader{
+		playlist:   u,
+		httpClient: http.DefaultClient,
+		segments:   make(chan []*av.Packet, 1),
+	}
+	for _, c := range conf {
+		c(r)
+	}
+	r.ctx, r.cancel = context.WithCancel(ctx)
+	pl, err := r.load()
+	if err == nil && len(pl.Variants) > 0 {
+		err = r.pickVariant(pl.Variants)
+		if err == nil {
+			pl, err = r.load()
+		}
+		if err == nil && len(pl.Variants) > 0 {
+			err = hls.ErrNotPlaylist
+		}
+	}
+	if err != nil {
+		r.cancel()
+		return nil, err
+	}
+	go r.run(pl)
+	return r, nil
+}
+
+func (r *HLSReader) pickVariant(variants []hls.Variant) error {
+	best := -1
+	for i, v := range variants {
+		if r.maxBandwidth > 0 && v.Bandwidth > r.maxBandwidth {
+			continue
+		}
+		if best < 0 || v.Bandwidth > variants[best].Bandwidth {
+			best = i
+		}
+	}
+	if best < 0 {
+		return ErrNoVariant
+	}
+	u, err := r.playlist.Parse(variants[best].URI)
+	if err != nil {
+		return err
+	}
+	r.playlist = u
+	return nil
+}
+
+func (r *HLSReader) get(u *url.URL) (io.ReadCloser, error) {
+	req, err := http.NewRequestWithContext(r.ctx, http.MethodGet, u.String(), nil)
+	if err != nil {
+		return nil, err
+	}
+	resp, err := r.httpClient.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode != http.StatusOK {
+		resp.Body.Close()
+		return nil, fmt.Errorf("get %s: %s", u, resp.Status)
+	}
+	return resp.Body, nil
+}
+
+func (r *HLSReader) load() (*hls.Playlist, error) {
+	body, err := r.get(r.playlist)
+	if err != nil {
+		return nil, err
+	}
+	defer body.Close()
+	return hls.ParsePlaylist(body)
+}
+
+func (r *HLSReader) segment(d *ts.Demuxer, s hls.Segment) ([]*av.Packet, error) {
+	u, err := r.playlist.Parse(s.URI)
+	if err != nil {
+		return nil, err
+	}
+	body, err := r.get(u)
+	if err != nil {
+		return nil, err
+	}
+	defer body.Close()
+	return d.Demux(body)
+}
+
+// run downloads the segments of the playlist until it ends, still fails to
+// load after playlistRetries retries or the reader is closed.
+func (r *HLSReader) run(pl *hls.Playlist) {
+	defer close(r.segments)
+	var (
+		demuxer = ts.NewDemuxer()
+		clock   timeline
+		next    int64 = -1
+		// skipped is set when the segments before the next one are lost.
+		skipped bool
+	)
+	for {
+		segments := pl.Segments
+		if next < 0 && !pl.End {
+			segments = segments[max(0, len(segments)-liveEdgeSegments):]
+		}
+		found := false
+		for _, s := range segments {
+			if next >= 0 && s.Sequence < next {
+				continue
+			}
+			found = true
+			if next >= 0 && s.Sequence > next {
+				skipped = true
+			}
+			next = s.Sequence + 1
+			packets, err := r.segment(demuxer, s)
+			if r.ctx.Err() != nil {
+				return
+			}
+			if err != nil && len(packets) == 0 {
+				skipped = true
+				continue
+			}
+			sort.SliceStable(packets, func(i, j int) bool { return packets[i].TimeStamp < packets[j].TimeStamp })
+			clock.rebase(packets, s.Duration, s.Discontinuity || skipped)
+			skipped = false
+			select {
+			case r.segments <- packets:
+			case <-r.ctx.Done():
+				return
+			}
+		}
+		if pl.End {
+			r.err = io.EOF
+			return
+		}
+
+		// poll again after a target duration when the playlist changed,
+		// half of one when it did not.
+		wait := pollInterval(pl)
+		if !found {
+			wait /= 2
+		}
+		for retries := 0; ; retries++ {
+			select {
+			case <-r.ctx.Done():
+				return
+			case <-time.After(wait):
+			}
+			reloaded, err := r.load()
+			if err == nil {
+				pl = reloaded
+				break
+			}
+			if retries == playlistRetries {
+				r.err = err
+				return
+			}
+			wait = pollInterval(pl)
+		}
+		if n := len(pl.Segments); n > 0 && pl.Segments[n-1].Sequence+1 < next {
+			// the stream restarted with new sequence numbers.
+			next, skipped = -1, true
+		}
+	}
+}
+
+// pollInterval is the target duration of pl, or the duration of its last
+// segment without one, and at least minPollInterval.
+func pollInterval(pl *hls.Playlist) time.Duration {
+	d := pl.TargetDuration
+	if n := len(pl.Segments); d <= 0 && n > 0 {
+		d = pl.Segments[n-1].Duration
+	}
+	return max(d, minPollInterval)
+}
+
+// timeline makes the timestamps of the segments continuous: the first
+// segment starts at zero, and a segment after a discontinuity starts where
+// the one before ended.
+type timeline struct {
+	started bool
+	offset  int64
+	// next is where the next segment is expected to start.
+	next int64
+}
+
+func (t *timeline) rebase(packets []*av.Packet, duration time.Duration, discontinuity bool) {
+	if len(packets) == 0 {
+		return
+	}
+	first := int64(packets[0].TimeStamp)
+	switch {
+	case !t.started:
+		t.started = true
+		t.offset = -first
+	case discontinuity, abs(first+t.offset-t.next) > maxTimestampJump.Milliseconds():
+		t.offset = t.next - first
+	}
+	last := int64(0)
+	for _, p := range packets {
+		ts := max(int64(p.TimeStamp)+t.offset, 0)
+		p.TimeStamp = uint32(ts)
+		last = max(last, ts)
+	}
+	t.next = max(first+t.offset+duration.Milliseconds(), last+1)
+}
+
+func abs(n int64) int64 {
+	if n < 0 {
+		return -n
+	}
+	return n
+}
+
+// Read returns the next packet once real time reaches its timestamp.
+func (r *HLSReader) Read() (*av.Packet, error) {
+	for len(r.pending) == 0 {
+		select {
+		case packets, ok := <-r.segments:
+			if !ok {
+				if r.ctx.Err() != nil {
+					return nil, av.ErrClosed
+				}
+				return nil, r.err
+			}
+			r.pending = packets
+		case <-r.ctx.Done():
+			return nil, av.ErrClosed
+		}
+	}
+	p := r.pending[0]
+	r.pending[0] = nil
+	r.pending = r.pending[1:]
+
+	now := time.Now()
+	if r.start.IsZero() || p.TimeStamp < r.startTS {
+		r.start, r.startTS = now, p.TimeStamp
+	}
+	at := r.start.Add(time.Duration(p.TimeStamp-r.startTS) * time.Millisecond)
+	if wait := at.Sub(now); wait > 0 {
+		t := time.NewTimer(wait)
+		defer t.Stop()
+		select {
+		case <-t.C:
+		case <-r.ctx.Done():
+			return nil, av.ErrClosed
+		}
+	} else if -wait > maxLate {
+		r.start = now.Add(-time.Duration(p.TimeStamp-r.startTS) * time.Millisecond)
+	}
+	return p, nil
+}
+
+// Close interrupts a blocked Read.
+func (r *HLSReader) Close() error {
+	r.cancel()
+	return nil
+}
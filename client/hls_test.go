@@ -0,0 +1,174 @@
+package client
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"path"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/zijiren233/livelib/av"
+	"github.com/zijiren233/livelib/container/flv"
+	"github.com/zijiren233/livelib/protocol/hls"
+)
+
+func flvTag(video bool, ts uint32, data ...byte) *av.Packet {
+	p := &av.Packet{IsVideo: video, IsAudio: !video, TimeStamp: ts, Data: data}
+	flv.NewDemuxer().DemuxH(p)
+	return p
+}
+
+// segments cuts n segments of 200ms, with a keyframe and four frames of
+// video and aac audio each, from the timestamp start.
+func segments(t *testing.T, start uint32, n int) [][]byte {
+	t.Helper()
+	var (
+		mu   sync.Mutex
+		segs [][]byte
+	)
+	source := hls.NewSource(
+		// the last frame of a gop is 160ms after the keyframe.
+		hls.WithSegmentDuration(160*time.Millisecond),
+		hls.WithSegmentFunc(func(item *hls.TSItem) {
+			mu.Lock()
+			segs = append(segs, item.Data)
+			mu.Unlock()
+		}),
+	)
+	done := make(chan struct{})
+	go func() {
+		source.SendPacket(context.Background())
+		close(done)
+	}()
+	sps := []byte{0x67, 0x42, 0xc0, 0x1e, 0xda}
+	pps := []byte{0x68, 0xce, 0x3c, 0x80}
+	seq := append([]byte{0x17, 0, 0, 0, 0, 1, 0x42, 0xc0, 0x1e, 0xff, 0xe1, 0, byte(len(sps))}, sps...)
+	seq = append(append(seq, 1, 0, byte(len(pps))), pps...)
+	source.Write(flvTag(true, start, seq...))
+	source.Write(flvTag(false, start, 0xaf, 0, 0x12, 0x10))
+	for i := range (n + 1) * 5 {
+		ts := start + uint32(i*40)
+		nalu := []byte{0x41, 0x9a, byte(i)}
+		frame := byte(0x27)
+		if i%5 == 0 {
+			frame = 0x17
+			nalu = append([]byte{0x65}, bytes.Repeat([]byte{0x88}, 400)...)
+		}
+		source.Write(flvTag(true, ts, append(binary.BigEndian.AppendUint32([]byte{frame, 1, 0, 0, 0}, uint32(len(nalu))), nalu...)...))
+		source.Write(flvTag(false, ts, 0xaf, 1, byte(i), 0x21))
+	}
+	source.Close()
+	<-done
+	if len(segs) < n {
+		t.Fatalf("cut %d segments, want %d", len(segs), n)
+	}
+	return segs[:n]
+}
+
+func TestHLSReader(t *testing.T) {
+	// segments 0 to 2 of one encoder, 4 and 5 of another after segment 3 was
+	// lost. The first reload of the playlist fails.
+	segs := append(segments(t, 0, 3), nil)
+	segs = append(segs, segments(t, 90000, 2)...)
+	var (
+		polls    atomic.Int32
+		variants sync.Map
+	)
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch file := path.Base(r.URL.Path); {
+		case r.URL.Path == "/live/master.m3u8":
+			io.WriteString(w, "#EXTM3U\n#EXT-X-STREAM-INF:BANDWIDTH=800000\nlow/index.m3u8\n#EXT-X-STREAM-INF:BANDWIDTH=2000000\nhigh/index.m3u8\n")
+		case file == "index.m3u8":
+			variants.Store(r.URL.Path, true)
+			seq, end := 0, 3
+			switch polls.Add(1) {
+			case 1:
+			case 2:
+				http.Error(w, "unavailable", http.StatusServiceUnavailable)
+				return
+			default:
+				seq, end = 4, 6
+			}
+			fmt.Fprintf(w, "#EXTM3U\n#EXT-X-TARGETDURATION:1\n#EXT-X-MEDIA-SEQUENCE:%d\n", seq)
+			for i := seq; i < end; i++ {
+				fmt.Fprintf(w, "#EXTINF:0.200,\nseg%d.ts\n", i)
+			}
+			if seq > 0 {
+				io.WriteString(w, "#EXT-X-ENDLIST\n")
+			}
+		default:
+			var i int
+			fmt.Sscanf(file, "seg%d.ts", &i)
+			w.Write(segs[i])
+		}
+	}))
+	defer srv.Close()
+
+	start := time.Now()
+	r, err := DialHLS(context.Background(), srv.URL+"/live/master.m3u8", WithMaxBandwidth(1000000))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer r.Close()
+	var (
+		video, keyframes int
+		last             uint32
+	)
+	for {
+		p, err := r.Read()
+		if err != nil {
+			if !errors.Is(err, io.EOF) {
+				t.Fatal(err)
+			}
+			break
+		}
+		if !p.IsVideo {
+			continue
+		}
+		if video == 0 && !p.Header.(av.VideoPacketHeader).IsSeq() {
+			t.Error("first video packet is not the sequence header")
+		}
+		if video > 0 && (p.TimeStamp < last || p.TimeStamp > last+300) {
+			t.Errorf("video timestamp %d after %d", p.TimeStamp, last)
+		}
+		if p.Header.(av.VideoPacketHeader).IsKeyFrame() && !p.Header.(av.VideoPacketHeader).IsSeq() {
+			keyframes++
+		}
+		video++
+		last = p.TimeStamp
+	}
+	if keyframes != 5 {
+		t.Errorf("read %d keyframes, want 5", keyframes)
+	}
+	if _, ok := variants.Load("/live/low/index.m3u8"); !ok {
+		t.Error("did not pick the variant within the bandwidth")
+	}
+	// five segments of 200ms, paced.
+	if elapsed := time.Since(start); elapsed < 800*time.Millisecond {
+		t.Errorf("read in %v, not paced", elapsed)
+	}
+}
+
+func TestPollInterval(t *testing.T) {
+	tests := []struct {
+		pl   hls.Playlist
+		want time.Duration
+	}{
+		{hls.Playlist{TargetDuration: 4 * time.Second}, 4 * time.Second},
+		{hls.Playlist{Segments: []hls.Segment{{Duration: time.Second}, {Duration: 2 * time.Second}}}, 2 * time.Second},
+		{hls.Playlist{}, minPollInterval},
+	}
+	for _, tt := range tests {
+		if got := pollInterval(&tt.pl); got != tt.want {
+			t.Errorf("pollInterval(%+v) = %v, want %v", tt.pl, got, tt.want)
+		}
+	}
+}
@@ -14,5 +14,5 @@ var ClientCmd = &cobra.Command{
 func init() {
 	RootCmd.AddCommand(ClientCmd)
 	ClientCmd.PersistentFlags().
-		StringVar(&flags.Dial, "dial", "rtmp://127.0.0.1:1935/app/channel", "dial to server")
+		StringVar(&flags.Dial, "dial", "rtmp://127.0.0.1:1935/app/channel", "rtmp url to dial, or http-flv or hls url to play")
 }
@@ -0,0 +1,197 @@
+package cmd
+
+import (
+	"log"
+	"maps"
+	"os"
+	"os/signal"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"syscall"
+
+	"github.com/spf13/cobra"
+	"github.com/zijiren233/livelib/cache"
+	"github.com/zijiren233/livelib/cmd/flags"
+	"github.com/zijiren233/livelib/config"
+	"github.com/zijiren233/livelib/protocol/hls"
+	"github.com/zijiren233/livelib/server"
+)
+
+// loadConfig reads the config file and environment, then applies the
+// flags given on the command line over them.
+func loadConfig(cmd *cobra.Command) (*config.Config, error) {
+	c, err := config.Load(flags.ConfigFile)
+	if err != nil {
+		return nil, err
+	}
+	changed := func(name string) bool {
+		f := cmd.Flag(name)
+		return f != nil && f.Changed
+	}
+	if changed("listen") {
+		c.Listen = flags.Listen
+	}
+	if changed("port") {
+		c.Port = flags.Port
+	}
+	if changed("dev") {
+		c.Dev = flags.Dev
+	}
+	if changed("admin-token") {
+		c.AdminToken = flags.AdminToken
+	}
+	if changed("record-dir") {
+		c.RecordDir = flags.RecordDir
+	}
+	if len(flags.Hooks) > 0 {
+		c.Hooks = maps.Clone(c.Hooks)
+		if c.Hooks == nil {
+			c.Hooks = make(map[string]string)
+		}
+		for _, h := range flags.Hooks {
+			event, url, _ := strings.Cut(h, "=")
+			c.Hooks[event] = url
+		}
+	}
+	return c, nil
+}
+
+// appConf returns what the manager applies to the new streams of app.
+func appConf(app *config.App) server.AppConf {
+	ac := server.AppConf{
+		MaxStreams: app.Limits.MaxStreams,
+		Record:     app.Record.Enabled,
+		Push:       app.Relays.Push,
+	}
+	if n := app.Limits.MaxPlayers; n > 0 {
+		ac.Channel = append(ac.Channel, server.WithMaxPlayers(n))
+	}
+	if n := app.Limits.RingSize; n > 0 {
+		ac.Channel = append(ac.Channel, server.WithRingSize(n))
+	}
+	var cc []cache.CacheConf
+	if n := app.Limits.GOPCache; n > 0 {
+		cc = append(cc, cache.WithGOPs(n))
+	}
+	if n := app.Limits.GOPCacheBytes; n > 0 {
+		cc = append(cc, cache.WithMaxBytes(n))
+	}
+	if n := app.Limits.GOPCacheFrames; n > 0 {
+		cc = append(cc, cache.WithMaxGOPFrames(n))
+	}
+	if len(cc) > 0 {
+		ac.Channel = append(ac.Channel, server.WithCache(cc...))
+	}
+	if d := app.Timeouts.Stall; d > 0 {
+		ac.Channel = append(ac.Channel, server.WithStallTimeout(d))
+	}
+	if d := app.Timeouts.ReconnectGrace; d > 0 {
+		ac.Channel = append(ac.Channel, server.WithReconnectGrace(d))
+	}
+	return ac
+}
+
+func hlsConf(h config.HLS, conf ...hls.SourceConf) []hls.SourceConf {
+	if h.SegmentDuration > 0 {
+		conf = append(conf, hls.WithSegmentDuration(h.SegmentDuration))
+	}
+	if h.PlaylistLength > 0 {
+		conf = append(conf, hls.WithPlaylistLength(h.PlaylistLength))
+	}
+	return conf
+}
+
+// checkAccess rejects the clients the publish and play sections of their
+// app do not allow, before next.
+func checkAccess(current *atomic.Pointer[config.Config], next server.AuthFunc) server.AuthFunc {
+	return func(req *server.AuthRequest) (*server.Channel, error) {
+		app := current.Load().App(req.App)
+		addr, token := req.RemoteAddr.String(), req.Query.Get("token")
+		if req.IsPublisher {
+			if err := app.Publish.Check(addr, token); err != nil {
+				return nil, server.RejectBadName(err.Error())
+			}
+		} else if err := app.Play.Check(addr, token); err != nil {
+			return nil, server.RejectStreamNotFound(err.Error())
+		}
+		return next(req)
+	}
+}
+
+// pullRelays keeps a pull task running for every relays.pull entry of the
+// config.
+type pullRelays struct {
+	mu      sync.Mutex
+	manager *server.Manager
+	tasks   map[pullRelay]string
+}
+
+type pullRelay struct {
+	app, stream, url string
+}
+
+func newPullRelays(m *server.Manager) *pullRelays {
+	return &pullRelays{
+		manager: m,
+		tasks:   make(map[pullRelay]string),
+	}
+}
+
+// sync starts the relays c has and the manager does not run, and stops the
+// ones c no longer has.
+func (r *pullRelays) sync(c *config.Config) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	want := make(map[pullRelay]bool)
+	for app, a := range c.Apps {
+		for stream, url := range a.Relays.Pull {
+			want[pullRelay{app, stream, url}] = true
+		}
+	}
+	running := make(map[string]bool)
+	for _, t := range r.manager.Tasks() {
+		running[t.ID] = true
+	}
+	for relay, id := range r.tasks {
+		if !want[relay] || !running[id] {
+			r.manager.StopTask(id)
+			delete(r.tasks, relay)
+		}
+	}
+	for relay := range want {
+		if _, ok := r.tasks[relay]; ok {
+			continue
+		}
+		info, err := r.manager.StartPull(relay.app, relay.stream, relay.url)
+		if err != nil {
+			log.Printf("pull %s into %s/%s: %v", relay.url, relay.app, relay.stream, err)
+			continue
+		}
+		r.tasks[relay] = info.ID
+	}
+}
+
+// reloadOnSIGHUP reloads the config whenever the process gets SIGHUP. The
+// new config applies to the sessions that start after, the settings of the
+// listeners need a restart.
+func reloadOnSIGHUP(cmd *cobra.Command, current *atomic.Pointer[config.Config], relays *pullRelays) {
+	hup := make(chan os.Signal, 1)
+	signal.Notify(hup, syscall.SIGHUP)
+	for range hup {
+		c, err := loadConfig(cmd)
+		if err != nil {
+			log.Printf("reload config: %v", err)
+			continue
+		}
+		old := current.Load()
+		if c.Listen != old.Listen || c.Port != old.Port || c.AdminToken != old.AdminToken ||
+			c.RecordDir != old.RecordDir || c.IdleTimeout != old.IdleTimeout ||
+			c.RTMP != old.RTMP || !maps.Equal(c.Hooks, old.Hooks) {
+			log.Printf("reload config: listen, port, admin_token, record_dir, idle_timeout, rtmp and hooks change after a restart")
+		}
+		current.Store(c)
+		relays.sync(c)
+		log.Printf("reloaded config")
+	}
+}
@@ -3,8 +3,15 @@ package flags
 var Dev bool
 
 var (
-	Listen string
-	Port   uint16
+	// ConfigFile is the yaml config, which the other flags override.
+	ConfigFile string
+	Listen     string
+	Port       uint16
+	// Hooks are webhooks given as event=url.
+	Hooks []string
+	// AdminToken enables the admin api when set.
+	AdminToken string
+	RecordDir  string
 )
 
 var (
@@ -8,10 +8,14 @@ import (
 	"github.com/zijiren233/livelib/cmd/flags"
 )
 
+// Version is set at build time with -ldflags "-X".
+var Version = "dev"
+
 var RootCmd = &cobra.Command{
-	Use:   "livelib",
-	Short: "livelib",
-	Long:  `livelib https://github.com/zijiren233/livelib`,
+	Use:     "livelib",
+	Short:   "livelib",
+	Long:    `livelib https://github.com/zijiren233/livelib`,
+	Version: Version,
 }
 
 func Execute() {
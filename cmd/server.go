@@ -10,18 +10,23 @@ import (
 	"math/rand"
 	"net"
 	"net/http"
+	"net/url"
 	"path"
 	"strings"
+	"sync/atomic"
+	"time"
 
 	"github.com/gin-gonic/gin"
 	"github.com/soheilhy/cmux"
 	"github.com/spf13/cobra"
-	"github.com/zijiren233/gencontainer/rwmap"
 	"github.com/zijiren233/livelib/cmd/flags"
+	"github.com/zijiren233/livelib/config"
 	"github.com/zijiren233/livelib/protocol/hls"
 	"github.com/zijiren233/livelib/protocol/httpflv"
+	"github.com/zijiren233/livelib/protocol/wsflv"
 	"github.com/zijiren233/livelib/server"
 	"github.com/zijiren233/livelib/utils"
+	"golang.org/x/net/websocket"
 )
 
 var ServerCmd = &cobra.Command{
@@ -32,9 +37,17 @@ var ServerCmd = &cobra.Command{
 }
 
 func Server(cmd *cobra.Command, args []string) {
-	host := fmt.Sprintf("%s:%d", flags.Listen, flags.Port)
+	conf, err := loadConfig(cmd)
+	if err != nil {
+		log.Fatal(err)
+	}
+	var current atomic.Pointer[config.Config]
+	current.Store(conf)
+	host := fmt.Sprintf("%s:%d", conf.Listen, conf.Port)
 	fmt.Printf(
-		"Run on tcp://%s\nRtmp: rtmp://%s/{app}\nRtmp Secret: {channel}\nHls: http://%s/{app}/{channel}.m3u8\nFlv: http://%s/{app}/{channel}.flv\n",
+		"Run on tcp://%s\nRtmp: rtmp://%s/{app}\nRtmp Secret: {channel}\nHls: http://%s/{app}/{channel}.m3u8\nFlv: http://%s/{app}/{channel}.flv (GET to play, POST or PUT to publish)\nWebSocket Flv: ws://%s/{app}/{channel}.flv (?publish to publish)\nMetrics: http://%s/metrics\n",
+		host,
+		host,
 		host,
 		host,
 		host,
@@ -47,21 +60,64 @@ func Server(cmd *cobra.Command, args []string) {
 	muxer := cmux.New(listener)
 	httpl := muxer.Match(cmux.HTTP1Fast())
 	tcp := muxer.Match(cmux.Any())
-	channels := rwmap.RWMap[string, *server.Channel]{}
-	s := server.NewRtmpServer(
-		func(ReqAppName, ReqChannelName string, IsPublisher bool) (*server.Channel, error) {
-			c, _ := channels.LoadOrStore(ReqAppName, server.NewChannel())
-			return c, c.InitHlsPlayer()
-		},
+	hooks, err := newWebhooks(conf.Hooks)
+	if err != nil {
+		log.Fatal(err)
+	}
+	hlsSessions := server.NewHLSSessions(hooks)
+	metrics := server.NewMetrics()
+	manager := server.NewManager(
+		server.WithMetrics(metrics),
+		server.WithIdleTimeout(conf.IdleTimeout),
+		server.WithRecordDir(conf.RecordDir),
+		server.WithRecordDone(func(key server.StreamKey, path string) {
+			hooks.Notify(server.HookRecordDone, &server.HookRequest{
+				Protocol: "record",
+				App:      key.App,
+				Name:     key.Stream,
+				Path:     path,
+			})
+		}),
+		server.WithAppConf(func(app string) server.AppConf {
+			return appConf(current.Load().App(app))
+		}),
+		server.WithChannelCreated(func(app, stream string, c *server.Channel) {
+			if h := current.Load().App(app).HLS; h.Enabled {
+				c.InitHlsPlayer(hlsConf(h, hooks.HLSSegmentFunc(app, stream))...)
+			}
+		}),
 	)
+	relays := newPullRelays(manager)
+	relays.sync(conf)
+	go reloadOnSIGHUP(cmd, &current, relays)
+	rtmpConf := []server.ServerConf{
+		server.WithServerMetrics(metrics),
+		server.WithWebhooks(hooks),
+	}
+	if conf.RTMP.ChunkSize > 0 {
+		rtmpConf = append(rtmpConf, server.WithChunkSize(conf.RTMP.ChunkSize))
+	}
+	if conf.RTMP.BufferSize > 0 {
+		rtmpConf = append(rtmpConf, server.WithConnBufferSize(conf.RTMP.BufferSize))
+	}
+	s := server.NewRtmpServer(checkAccess(&current, manager.AuthFunc()), rtmpConf...)
 	go s.Serve(tcp)
-	if flags.Dev {
+	if conf.Dev {
 		gin.SetMode(gin.DebugMode)
 	} else {
 		gin.SetMode(gin.ReleaseMode)
 	}
 	e := gin.Default()
 	utils.Cors(e)
+	e.GET("/metrics", gin.WrapH(metrics))
+	if conf.AdminToken != "" {
+		e.Any("/api/*path", gin.WrapH(server.NewAdmin(
+			manager,
+			conf.AdminToken,
+			server.WithAdminMetrics(metrics),
+			server.WithVersion(Version),
+		)))
+	}
 	e.GET("/:app/*channel", func(ctx *gin.Context) {
 		appName := ctx.Param("app")
 		channelStr := strings.Trim(ctx.Param("channel"), "/")
@@ -70,18 +126,73 @@ func Server(cmd *cobra.Command, args []string) {
 		fileExt := path.Ext(channelStr)
 		channelName := strings.TrimSuffix(fileName, fileExt)
 
-		channel, ok := channels.Load(appName)
+		websocketReq := isWebSocket(ctx.Request)
+		if fileExt == ".flv" && websocketReq && ctx.Request.URL.Query().Has("publish") {
+			channelName, ok := flvStreamName(ctx.Param("channel"))
+			if !ok {
+				ctx.AbortWithStatusJSON(http.StatusNotFound, gin.H{
+					"error": server.ErrStreamNotFound.Error(),
+				})
+				return
+			}
+			s.ServeWSFLVPublish(ctx.Writer, ctx.Request, appName, channelName)
+			return
+		}
+		// segments are checked too, the playlist passes the token on
+		err := current.Load().App(appName).Play.Check(ctx.Request.RemoteAddr, ctx.Query("token"))
+		if err != nil {
+			ctx.AbortWithStatusJSON(http.StatusForbidden, gin.H{
+				"error": err.Error(),
+			})
+			return
+		}
+		channel, ok := manager.Get(appName, channelName)
 		if !ok {
 			ctx.AbortWithStatusJSON(http.StatusNotFound, gin.H{
-				"error": "app not found",
+				"error": server.ErrStreamNotFound.Error(),
 			})
 			return
 		}
 		switch fileExt {
+		case ".m3u8", ".ts":
+			start := time.Now()
+			defer func() {
+				channel.Metrics().ObserveHLSRequest(time.Since(start))
+			}()
+		}
+		switch fileExt {
 		case ".flv":
+			protocol := "http-flv"
+			if websocketReq {
+				protocol = "ws-flv"
+			}
+			hookReq := server.NewHookRequest(protocol, appName, channelName, ctx.Request)
+			if err := hooks.Call(ctx.Request.Context(), server.HookPlay, hookReq); err != nil {
+				metrics.AuthFailed(protocol, "player")
+				ctx.AbortWithStatusJSON(http.StatusForbidden, gin.H{
+					"error": err.Error(),
+				})
+				return
+			}
+			defer metrics.ConnOpened(protocol, "player")()
+			start := time.Now()
+			if websocketReq {
+				websocket.Server{Handler: func(ws *websocket.Conn) {
+					w := wsflv.NewWriter(ws)
+					defer w.Close()
+					err := channel.AddPlayer(w, server.WithPlayerInfo(protocol, ctx.Request.RemoteAddr))
+					if err != nil {
+						ws.Close()
+						return
+					}
+					w.SendPacket(ctx.Request.Context())
+					hooks.PlayDone(hookReq, start, w)
+				}}.ServeHTTP(ctx.Writer, ctx.Request)
+				return
+			}
 			w := httpflv.NewHttpFLVWriter(ctx.Writer)
 			defer w.Close()
-			err := channel.AddPlayer(w)
+			err := channel.AddPlayer(w, server.WithPlayerInfo(protocol, ctx.Request.RemoteAddr))
 			if err != nil {
 				ctx.AbortWithStatusJSON(http.StatusNotFound, gin.H{
 					"error": err.Error(),
@@ -89,14 +200,28 @@ func Server(cmd *cobra.Command, args []string) {
 				return
 			}
 			w.SendPacket(ctx.Request.Context())
+			hooks.PlayDone(hookReq, start, w)
 		case ".m3u8":
+			hookReq := server.NewHookRequest("hls", appName, channelName, ctx.Request)
+			if err := hlsSessions.Play(hookReq, ctx.Request); err != nil {
+				metrics.AuthFailed("hls", "player")
+				ctx.AbortWithStatusJSON(http.StatusForbidden, gin.H{
+					"error": err.Error(),
+				})
+				return
+			}
+			var query string
+			if token := ctx.Query("token"); token != "" {
+				query = "?" + url.Values{"token": {token}}.Encode()
+			}
 			b, err := channel.GenM3U8File(func(tsName string) (tsPath string) {
 				return fmt.Sprintf(
-					"/%s/%s/%s.%s",
+					"/%s/%s/%s.%s%s",
 					appName,
 					channelName,
 					tsName,
 					ctx.DefaultQuery("t", "ts"),
+					query,
 				)
 			})
 			if err != nil {
@@ -134,6 +259,19 @@ func Server(cmd *cobra.Command, args []string) {
 			ctx.Writer.Write(b)
 		}
 	})
+	publishFLV := func(ctx *gin.Context) {
+		appName := ctx.Param("app")
+		channelName, ok := flvStreamName(ctx.Param("channel"))
+		if !ok {
+			ctx.AbortWithStatusJSON(http.StatusNotFound, gin.H{
+				"error": server.ErrStreamNotFound.Error(),
+			})
+			return
+		}
+		s.ServeFLVPublish(ctx.Writer, ctx.Request, appName, channelName)
+	}
+	e.POST("/:app/*channel", publishFLV)
+	e.PUT("/:app/*channel", publishFLV)
 	go http.Serve(httpl, e.Handler())
 
 	muxer.Serve()
@@ -141,6 +279,42 @@ func Server(cmd *cobra.Command, args []string) {
 
 func init() {
 	RootCmd.AddCommand(ServerCmd)
+	ServerCmd.Flags().StringVarP(&flags.ConfigFile, "config", "c", "", "yaml config file, reloaded on SIGHUP")
 	ServerCmd.Flags().StringVarP(&flags.Listen, "listen", "l", "127.0.0.1", "address to listen on")
 	ServerCmd.Flags().Uint16VarP(&flags.Port, "port", "p", 1935, "port to listen on")
+	ServerCmd.Flags().StringVar(&flags.AdminToken, "admin-token", "", "bearer token of the admin api at /api, disabled when empty")
+	ServerCmd.Flags().StringVar(&flags.RecordDir, "record-dir", server.DefaultRecordDir, "directory of the recordings")
+	ServerCmd.Flags().StringArrayVar(&flags.Hooks, "hook", nil, "webhook as event=url, for example on_publish=http://127.0.0.1/auth")
+}
+
+func isWebSocket(r *http.Request) bool {
+	return strings.EqualFold(r.Header.Get("Upgrade"), "websocket")
+}
+
+// newWebhooks creates the webhooks of the events in hooks.
+func newWebhooks(hooks map[string]string) (*server.Webhooks, error) {
+	conf := make([]server.WebhookConf, 0, len(hooks))
+	for event, url := range hooks {
+		switch server.HookEvent(event) {
+		case server.HookConnect, server.HookPublish, server.HookPublishDone,
+			server.HookPlay, server.HookPlayDone, server.HookRecordDone, server.HookHLSSegment:
+		default:
+			return nil, fmt.Errorf("invalid hook event %q", event)
+		}
+		if url == "" {
+			return nil, fmt.Errorf("hook %s has no url", event)
+		}
+		conf = append(conf, server.WithHook(server.HookEvent(event), url))
+	}
+	return server.NewWebhooks(conf...), nil
+}
+
+// flvStreamName returns the stream name of the path of an flv publisher,
+// which is a single name with the .flv extension.
+func flvStreamName(channel string) (string, bool) {
+	name, ok := strings.CutSuffix(strings.Trim(channel, "/"), ".flv")
+	if !ok || name == "" || strings.Contains(name, "/") {
+		return "", false
+	}
+	return name, true
 }
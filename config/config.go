@@ -0,0 +1,290 @@
+// Package config reads the configuration file of livelib server.
+//
+// The file is YAML. The default section applies to every app, and the
+// sections under apps override it field by field for a single app:
+//
+//	listen: 0.0.0.0
+//	port: 1935
+//	hooks:
+//	  on_publish: http://127.0.0.1:8080/auth
+//	default:
+//	  hls:
+//	    enabled: true
+//	apps:
+//	  live:
+//	    publish:
+//	      allow: [10.0.0.0/8]
+//	    limits:
+//	      max_players: 100
+//
+// Every field can be overridden with an environment variable named after
+// its path, for example LIVELIB_PORT, LIVELIB_DEFAULT_HLS_ENABLED or
+// LIVELIB_APPS_LIVE_LIMITS_MAX_PLAYERS. Lists are comma separated, the keys
+// of maps follow the prefix in lower case, like LIVELIB_HOOKS_ON_PUBLISH.
+// Apps can only be overridden if the file has a section for them.
+package config
+
+import (
+	"errors"
+	"fmt"
+	"maps"
+	"net/netip"
+	"os"
+	"time"
+
+	"gopkg.in/yaml.v3"
+)
+
+// EnvPrefix is the prefix of the environment variables that override the
+// file.
+const EnvPrefix = "LIVELIB_"
+
+var (
+	ErrForbidden = errors.New("address not allowed")
+	ErrBadToken  = errors.New("invalid token")
+)
+
+type Config struct {
+	Listen string `yaml:"listen"`
+	Port   uint16 `yaml:"port"`
+	Dev    bool   `yaml:"dev"`
+	// AdminToken enables the admin api when set.
+	AdminToken  string        `yaml:"admin_token"`
+	RecordDir   string        `yaml:"record_dir"`
+	IdleTimeout time.Duration `yaml:"idle_timeout"`
+	RTMP        RTMP          `yaml:"rtmp"`
+	// Hooks maps webhook events, like on_publish, to their url.
+	Hooks   map[string]string `yaml:"hooks"`
+	Default App               `yaml:"default"`
+	// Apps holds the app sections merged with Default.
+	Apps map[string]*App `yaml:"-"`
+}
+
+type RTMP struct {
+	ChunkSize  uint32 `yaml:"chunk_size"`
+	BufferSize int32  `yaml:"buffer_size"`
+}
+
+// App configures the streams of an app.
+type App struct {
+	Publish  Access   `yaml:"publish"`
+	Play     Access   `yaml:"play"`
+	HLS      HLS      `yaml:"hls"`
+	Record   Record   `yaml:"record"`
+	Relays   Relays   `yaml:"relays"`
+	Limits   Limits   `yaml:"limits"`
+	Timeouts Timeouts `yaml:"timeouts"`
+}
+
+// Access decides who may publish or play. An empty Access allows everyone.
+type Access struct {
+	// Allow and Deny are addresses, CIDR ranges or all. Deny wins, and an
+	// address must be in Allow unless it is empty.
+	Allow []string `yaml:"allow"`
+	Deny  []string `yaml:"deny"`
+	// Tokens, when set, are the accepted values of the token query
+	// parameter.
+	Tokens []string `yaml:"tokens"`
+
+	allow, deny []netip.Prefix
+}
+
+type HLS struct {
+	Enabled         bool          `yaml:"enabled"`
+	SegmentDuration time.Duration `yaml:"segment_duration"`
+	PlaylistLength  int           `yaml:"playlist_length"`
+}
+
+type Record struct {
+	// Enabled records every stream of the app to the record directory.
+	Enabled bool `yaml:"enabled"`
+}
+
+type Relays struct {
+	// Push lists rtmp urls every stream is pushed to, followed by the
+	// stream name.
+	Push []string `yaml:"push"`
+	// Pull maps stream names to the rtmp, http-flv or hls urls they are
+	// pulled from. It is only valid in the sections of apps.
+	Pull map[string]string `yaml:"pull"`
+}
+
+// Limits are zero for no limit, or the built in default for the buffers.
+type Limits struct {
+	MaxStreams int `yaml:"max_streams"`
+	MaxPlayers int `yaml:"max_players"`
+	// RingSize is the number of packets buffered for the players.
+	RingSize int `yaml:"ring_size"`
+	// GOPCache is the number of GOPs new players start with,
+	// GOPCacheBytes bounds their size and GOPCacheFrames the video frames
+	// of one GOP.
+	GOPCache       int `yaml:"gop_cache"`
+	GOPCacheBytes  int `yaml:"gop_cache_bytes"`
+	GOPCacheFrames int `yaml:"gop_cache_frames"`
+}
+
+// Timeouts are zero for the built in default.
+type Timeouts struct {
+	// Stall is how long the active input may be silent before a standby
+	// input replaces it.
+	Stall time.Duration `yaml:"stall"`
+	// ReconnectGrace keeps the players attached after the publisher left.
+	ReconnectGrace time.Duration `yaml:"reconnect_grace"`
+}
+
+// Default returns the configuration used without a file.
+func Default() *Config {
+	return &Config{
+		Listen:      "127.0.0.1",
+		Port:        1935,
+		RecordDir:   "records",
+		IdleTimeout: 30 * time.Second,
+		Default: App{
+			HLS: HLS{Enabled: true},
+		},
+		Apps: make(map[string]*App),
+	}
+}
+
+// file is the layout of the file, with the app sections kept until the
+// default section is known.
+type file struct {
+	*Config `yaml:",inline"`
+	Apps    map[string]yaml.Node `yaml:"apps"`
+}
+
+// Load reads the file at path over Default and applies the environment. An
+// empty path only applies the environment.
+func Load(path string) (*Config, error) {
+	var b []byte
+	if path != "" {
+		var err error
+		if b, err = os.ReadFile(path); err != nil {
+			return nil, err
+		}
+	}
+	return Parse(b, os.Environ())
+}
+
+// Parse parses the file b over Default and applies environ, a list of
+// key=value variables.
+func Parse(b []byte, environ []string) (*Config, error) {
+	c := Default()
+	f := file{Config: c}
+	if err := yaml.Unmarshal(b, &f); err != nil {
+		return nil, err
+	}
+	env := newEnv(environ)
+	if err := env.apply(EnvPrefix, c); err != nil {
+		return nil, err
+	}
+	if err := c.Default.compile(); err != nil {
+		return nil, fmt.Errorf("default: %w", err)
+	}
+	if len(c.Default.Relays.Pull) > 0 {
+		return nil, errors.New("default: relays.pull needs an app section")
+	}
+	for name, node := range f.Apps {
+		app := c.Default.clone()
+		if err := node.Decode(app); err != nil {
+			return nil, fmt.Errorf("apps.%s: %w", name, err)
+		}
+		if err := env.apply(EnvPrefix+"APPS_"+envName(name)+"_", app); err != nil {
+			return nil, err
+		}
+		if err := app.compile(); err != nil {
+			return nil, fmt.Errorf("apps.%s: %w", name, err)
+		}
+		c.Apps[name] = app
+	}
+	return c, nil
+}
+
+// App returns the configuration of the app.
+func (c *Config) App(name string) *App {
+	if app, ok := c.Apps[name]; ok {
+		return app
+	}
+	return &c.Default
+}
+
+func (a *App) clone() *App {
+	c := *a
+	c.Relays.Pull = maps.Clone(a.Relays.Pull)
+	return &c
+}
+
+func (a *App) compile() error {
+	if err := a.Publish.compile(); err != nil {
+		return fmt.Errorf("publish: %w", err)
+	}
+	if err := a.Play.compile(); err != nil {
+		return fmt.Errorf("play: %w", err)
+	}
+	return nil
+}
+
+func (a *Access) compile() (err error) {
+	if a.allow, err = parsePrefixes(a.Allow); err != nil {
+		return err
+	}
+	a.deny, err = parsePrefixes(a.Deny)
+	return err
+}
+
+func parsePrefixes(list []string) ([]netip.Prefix, error) {
+	prefixes := make([]netip.Prefix, 0, len(list))
+	for _, s := range list {
+		if s == "all" {
+			prefixes = append(prefixes, netip.MustParsePrefix("0.0.0.0/0"), netip.MustParsePrefix("::/0"))
+			continue
+		}
+		if p, err := netip.ParsePrefix(s); err == nil {
+			prefixes = append(prefixes, p.Masked())
+			continue
+		}
+		addr, err := netip.ParseAddr(s)
+		if err != nil {
+			return nil, fmt.Errorf("invalid address %q", s)
+		}
+		prefixes = append(prefixes, netip.PrefixFrom(addr, addr.BitLen()))
+	}
+	return prefixes, nil
+}
+
+// Check returns ErrForbidden or ErrBadToken if the client at addr, an
+// address with or without port, may not use the stream with token.
+func (a *Access) Check(addr, token string) error {
+	if len(a.allow) > 0 || len(a.deny) > 0 {
+		ip, err := parseAddr(addr)
+		if err != nil || contains(a.deny, ip) || len(a.allow) > 0 && !contains(a.allow, ip) {
+			return ErrForbidden
+		}
+	}
+	if len(a.Tokens) > 0 {
+		for _, t := range a.Tokens {
+			if t == token {
+				return nil
+			}
+		}
+		return ErrBadToken
+	}
+	return nil
+}
+
+func parseAddr(addr string) (netip.Addr, error) {
+	if ap, err := netip.ParseAddrPort(addr); err == nil {
+		return ap.Addr().Unmap(), nil
+	}
+	ip, err := netip.ParseAddr(addr)
+	return ip.Unmap(), err
+}
+
+func contains(prefixes []netip.Prefix, ip netip.Addr) bool {
+	for _, p := range prefixes {
+		if p.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
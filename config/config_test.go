@@ -0,0 +1,98 @@
+package config
+
+import (
+	"errors"
+	"testing"
+	"time"
+)
+
+const testFile = `
+port: 1936
+hooks:
+  on_publish: http://127.0.0.1/auth
+default:
+  hls:
+    segment_duration: 2s
+  limits:
+    max_players: 10
+apps:
+  live:
+    publish:
+      allow: [10.0.0.0/8]
+      deny: [10.0.0.1]
+    hls:
+      enabled: false
+    relays:
+      pull:
+        b: rtmp://origin/live/b
+  vod:
+    play:
+      tokens: [secret]
+`
+
+func TestParse(t *testing.T) {
+	c, err := Parse([]byte(testFile), []string{
+		"LIVELIB_LISTEN=0.0.0.0",
+		"LIVELIB_HOOKS_ON_PLAY=http://127.0.0.1/play",
+		"LIVELIB_APPS_VOD_LIMITS_MAX_PLAYERS=5",
+		"LIVELIB_APPS_VOD_PLAY_TOKENS=a, b",
+		"OTHER_PORT=1",
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if c.Listen != "0.0.0.0" || c.Port != 1936 || c.IdleTimeout != 30*time.Second {
+		t.Errorf("listen = %s:%d, idle timeout %v", c.Listen, c.Port, c.IdleTimeout)
+	}
+	if len(c.Hooks) != 2 || c.Hooks["on_play"] != "http://127.0.0.1/play" {
+		t.Errorf("hooks = %v", c.Hooks)
+	}
+
+	live := c.App("live")
+	if live.HLS.Enabled || live.HLS.SegmentDuration != 2*time.Second || live.Limits.MaxPlayers != 10 {
+		t.Errorf("live = %+v", live)
+	}
+	if live.Relays.Pull["b"] != "rtmp://origin/live/b" {
+		t.Errorf("pull = %v", live.Relays.Pull)
+	}
+	for addr, want := range map[string]error{
+		"10.1.2.3:5000": nil,
+		"10.0.0.1:5000": ErrForbidden,
+		"192.0.2.1":     ErrForbidden,
+		"bad":           ErrForbidden,
+	} {
+		if err := live.Publish.Check(addr, ""); !errors.Is(err, want) {
+			t.Errorf("publish from %s: %v, want %v", addr, err, want)
+		}
+	}
+
+	vod := c.App("vod")
+	if vod.Limits.MaxPlayers != 5 || !vod.HLS.Enabled {
+		t.Errorf("vod = %+v", vod)
+	}
+	if err := vod.Play.Check("192.0.2.1:1", "b"); err != nil {
+		t.Error(err)
+	}
+	if err := vod.Play.Check("192.0.2.1:1", "secret"); !errors.Is(err, ErrBadToken) {
+		t.Errorf("overridden token: %v", err)
+	}
+	if c.App("other") != &c.Default {
+		t.Error("unknown app does not use the default section")
+	}
+}
+
+func TestParseErrors(t *testing.T) {
+	for _, tt := range []struct {
+		file    string
+		environ []string
+	}{
+		{file: "apps: {live: {play: {allow: [nope]}}}"},
+		{file: "port: http"},
+		{file: "default: {relays: {pull: {a: rtmp://origin/live/a}}}"},
+		{environ: []string{"LIVELIB_IDLE_TIMEOUT=soon"}},
+	} {
+		if _, err := Parse([]byte(tt.file), tt.environ); err == nil {
+			t.Errorf("Parse(%q, %v) succeeded", tt.file, tt.environ)
+		}
+	}
+}
@@ -0,0 +1,126 @@
+package config
+
+import (
+	"fmt"
+	"reflect"
+	"strconv"
+	"strings"
+	"time"
+)
+
+var durationType = reflect.TypeOf(time.Duration(0))
+
+// env overrides fields with the environment variables that start with
+// EnvPrefix.
+type env map[string]string
+
+func newEnv(environ []string) env {
+	e := make(env)
+	for _, kv := range environ {
+		if key, value, ok := strings.Cut(kv, "="); ok && strings.HasPrefix(key, EnvPrefix) {
+			e[key] = value
+		}
+	}
+	return e
+}
+
+func envName(s string) string {
+	return strings.ToUpper(strings.NewReplacer("-", "_", ".", "_").Replace(s))
+}
+
+// apply sets the fields of the struct v points to from the variables
+// named prefix followed by their yaml key.
+func (e env) apply(prefix string, v any) error {
+	return e.applyStruct(prefix, reflect.ValueOf(v).Elem())
+}
+
+func (e env) applyStruct(prefix string, v reflect.Value) error {
+	t := v.Type()
+	for i := range t.NumField() {
+		f := t.Field(i)
+		tag, _, _ := strings.Cut(f.Tag.Get("yaml"), ",")
+		if !f.IsExported() || tag == "-" || tag == "" {
+			continue
+		}
+		if err := e.applyValue(prefix+envName(tag), v.Field(i)); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (e env) applyValue(key string, v reflect.Value) error {
+	switch v.Kind() {
+	case reflect.Struct:
+		return e.applyStruct(key+"_", v)
+	case reflect.Map:
+		if v.Type().Elem().Kind() != reflect.String {
+			return nil
+		}
+		for k, s := range e {
+			name, ok := strings.CutPrefix(k, key+"_")
+			if !ok {
+				continue
+			}
+			if v.IsNil() {
+				v.Set(reflect.MakeMap(v.Type()))
+			}
+			v.SetMapIndex(reflect.ValueOf(strings.ToLower(name)), reflect.ValueOf(s))
+		}
+		return nil
+	}
+	s, ok := e[key]
+	if !ok {
+		return nil
+	}
+	if err := setString(v, s); err != nil {
+		return fmt.Errorf("%s: %w", key, err)
+	}
+	return nil
+}
+
+func setString(v reflect.Value, s string) error {
+	switch {
+	case v.Type() == durationType:
+		d, err := time.ParseDuration(s)
+		if err != nil {
+			return err
+		}
+		v.SetInt(int64(d))
+		return nil
+	case v.Kind() == reflect.Slice && v.Type().Elem().Kind() == reflect.String:
+		var list []string
+		for _, item := range strings.Split(s, ",") {
+			if item = strings.TrimSpace(item); item != "" {
+				list = append(list, item)
+			}
+		}
+		v.Set(reflect.ValueOf(list))
+		return nil
+	}
+	switch v.Kind() {
+	case reflect.String:
+		v.SetString(s)
+	case reflect.Bool:
+		b, err := strconv.ParseBool(s)
+		if err != nil {
+			return err
+		}
+		v.SetBool(b)
+	case reflect.Int, reflect.Int32, reflect.Int64:
+		n, err := strconv.ParseInt(s, 10, v.Type().Bits())
+		if err != nil {
+			return err
+		}
+		v.SetInt(n)
+	case reflect.Uint16, reflect.Uint32:
+		n, err := strconv.ParseUint(s, 10, v.Type().Bits())
+		if err != nil {
+			return err
+		}
+		v.SetUint(n)
+	default:
+		return fmt.Errorf("unsupported type %s", v.Type())
+	}
+	return nil
+}
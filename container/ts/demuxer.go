@@ -0,0 +1,329 @@
+package ts
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"io"
+
+	"github.com/zijiren233/livelib/av"
+	"github.com/zijiren233/livelib/container/flv"
+)
+
+const (
+	streamTypeAAC  = 0x0f
+	streamTypeH264 = 0x1b
+
+	naluTypeIDR = 5
+	naluTypeSPS = 7
+	naluTypePPS = 8
+	naluTypeAUD = 9
+)
+
+var (
+	ErrSyncByte = errors.New("ts packet without sync byte")
+	ErrPacket   = errors.New("malformed ts packet")
+)
+
+var aacSampleRates = [16]int64{96000, 88200, 64000, 48000, 44100, 32000, 24000, 22050, 16000, 12000, 11025, 8000, 7350}
+
+// Demuxer reads the h264 and aac streams of mpeg-ts into flv tags, like
+// the packets of an rtmp publisher: sequence headers are sent before the
+// first frames and whenever the codec configuration changes. Other streams
+// are skipped. The timestamps are the dts of the frames in milliseconds.
+type Demuxer struct {
+	pmtPID  int
+	streams map[uint16]*pesStream
+	// order is the streams in the order of the pmt, which they are flushed
+	// in at the end of a segment.
+	order      []*pesStream
+	tagDemuxer *flv.Demuxer
+
+	sps, pps []byte
+	asc      []byte
+
+	packets []*av.Packet
+}
+
+type pesStream struct {
+	streamType byte
+	buf        []byte
+	started    bool
+}
+
+func NewDemuxer() *Demuxer {
+	return &Demuxer{
+		pmtPID:     -1,
+		streams:    make(map[uint16]*pesStream),
+		tagDemuxer: flv.NewDemuxer(),
+	}
+}
+
+// Demux reads the ts packets of r, one segment, until io.EOF and returns
+// the frames they carry. The codec configuration is kept for the next
+// segments, which may leave out the sequence headers.
+func (d *Demuxer) Demux(r io.Reader) ([]*av.Packet, error) {
+	var pkt [tsPacketLen]byte
+	var err error
+	for {
+		if _, err = io.ReadFull(r, pkt[:]); err != nil {
+			if err == io.EOF {
+				err = nil
+			}
+			break
+		}
+		if err = d.packet(pkt[:]); err != nil {
+			break
+		}
+	}
+	for _, s := range d.order {
+		d.flush(s)
+	}
+	packets := d.packets
+	d.packets = nil
+	return packets, err
+}
+
+func (d *Demuxer) packet(b []byte) error {
+	if b[0] != 0x47 {
+		return ErrSyncByte
+	}
+	start := b[1]&0x40 != 0
+	pid := uint16(b[1]&0x1f)<<8 | uint16(b[2])
+	adaptation := b[3] >> 4 & 0x03
+	payload := b[4:]
+	if adaptation&0x02 != 0 {
+		n := int(payload[0]) + 1
+		if n > len(payload) {
+			return ErrPacket
+		}
+		payload = payload[n:]
+	}
+	if adaptation&0x01 == 0 {
+		return nil
+	}
+
+	switch {
+	case pid == 0:
+		if start {
+			return d.pat(payload)
+		}
+	case int(pid) == d.pmtPID:
+		if start {
+			return d.pmt(payload)
+		}
+	default:
+		s, ok := d.streams[pid]
+		if !ok {
+			return nil
+		}
+		if start {
+			d.flush(s)
+			s.started = true
+		}
+		if s.started {
+			s.buf = append(s.buf, payload...)
+		}
+	}
+	return nil
+}
+
+// section returns the body of the psi section in payload, between the
+// section length and the crc.
+func section(payload []byte) ([]byte, error) {
+	if len(payload) < 1 || int(payload[0])+1 > len(payload) {
+		return nil, ErrPacket
+	}
+	payload = payload[int(payload[0])+1:]
+	if len(payload) < 3 {
+		return nil, ErrPacket
+	}
+	end := 3 + (int(payload[1]&0x0f)<<8 | int(payload[2]))
+	if end > len(payload) || end < 3+5+4 {
+		return nil, ErrPacket
+	}
+	return payload[3+5 : end-4], nil
+}
+
+func (d *Demuxer) pat(payload []byte) error {
+	body, err := section(payload)
+	if err != nil {
+		return err
+	}
+	for ; len(body) >= 4; body = body[4:] {
+		// program 0 is the network pid.
+		if binary.BigEndian.Uint16(body) != 0 {
+			d.pmtPID = int(binary.BigEndian.Uint16(body[2:]) & 0x1fff)
+			return nil
+		}
+	}
+	return nil
+}
+
+func (d *Demuxer) pmt(payload []byte) error {
+	body, err := section(payload)
+	if err != nil {
+		return err
+	}
+	if len(body) < 4 {
+		return ErrPacket
+	}
+	infoLen := int(binary.BigEndian.Uint16(body[2:]) & 0x0fff)
+	if 4+infoLen > len(body) {
+		return ErrPacket
+	}
+	for body = body[4+infoLen:]; len(body) >= 5; {
+		streamType := body[0]
+		pid := binary.BigEndian.Uint16(body[1:]) & 0x1fff
+		esLen := int(binary.BigEndian.Uint16(body[3:]) & 0x0fff)
+		if (streamType == streamTypeH264 || streamType == streamTypeAAC) && d.streams[pid] == nil {
+			d.streams[pid] = &pesStream{streamType: streamType}
+			d.order = append(d.order, d.streams[pid])
+		}
+		if 5+esLen > len(body) {
+			return ErrPacket
+		}
+		body = body[5+esLen:]
+	}
+	return nil
+}
+
+// flush demuxes the pes packet buffered for s. Broken pes packets are
+// dropped.
+func (d *Demuxer) flush(s *pesStream) {
+	if !s.started {
+		return
+	}
+	b := s.buf
+	s.buf = s.buf[:0]
+	s.started = false
+	if len(b) < 9 || b[0] != 0 || b[1] != 0 || b[2] != 1 {
+		return
+	}
+	flags, headerLen := b[7]>>6, int(b[8])
+	if 9+headerLen > len(b) || flags&0x02 == 0 || headerLen < 5 {
+		return
+	}
+	pts := readTimestamp(b[9:])
+	dts := pts
+	if flags == 0x03 && headerLen >= 10 {
+		dts = readTimestamp(b[14:])
+	}
+	data := b[9+headerLen:]
+	switch s.streamType {
+	case streamTypeH264:
+		d.video(data, pts, dts)
+	case streamTypeAAC:
+		d.audio(data, pts)
+	}
+}
+
+func readTimestamp(b []byte) int64 {
+	return int64(b[0]>>1&0x07)<<30 | int64(b[1])<<22 | int64(b[2]>>1)<<15 | int64(b[3])<<7 | int64(b[4]>>1)
+}
+
+func (d *Demuxer) video(data []byte, pts, dts int64) {
+	cts := (pts - dts) / h264DefaultHZ
+	frame := []byte{0x27, av.AVC_NALU, byte(cts >> 16), byte(cts >> 8), byte(cts)}
+	var sps, pps []byte
+	for _, nalu := range splitAnnexB(data) {
+		switch nalu[0] & 0x1f {
+		case naluTypeSPS:
+			sps = nalu
+			continue
+		case naluTypePPS:
+			pps = nalu
+			continue
+		case naluTypeAUD:
+			continue
+		case naluTypeIDR:
+			frame[0] = 0x17
+		}
+		frame = binary.BigEndian.AppendUint32(frame, uint32(len(nalu)))
+		frame = append(frame, nalu...)
+	}
+	if sps != nil && pps != nil && (!bytes.Equal(sps, d.sps) || !bytes.Equal(pps, d.pps)) && len(sps) >= 4 {
+		d.sps, d.pps = bytes.Clone(sps), bytes.Clone(pps)
+		seq := []byte{0x17, av.AVC_SEQHDR, 0, 0, 0, 1, sps[1], sps[2], sps[3], 0xff, 0xe1}
+		seq = binary.BigEndian.AppendUint16(seq, uint16(len(sps)))
+		seq = append(seq, sps...)
+		seq = append(seq, 1)
+		seq = binary.BigEndian.AppendUint16(seq, uint16(len(pps)))
+		seq = append(seq, pps...)
+		d.emit(&av.Packet{IsVideo: true, TimeStamp: uint32(dts / h264DefaultHZ), Data: seq})
+	}
+	// frames before the first sequence header cannot be decoded.
+	if d.sps == nil || len(frame) == 5 {
+		return
+	}
+	d.emit(&av.Packet{IsVideo: true, TimeStamp: uint32(dts / h264DefaultHZ), Data: frame})
+}
+
+// splitAnnexB returns the nal units of an annex b byte stream.
+func splitAnnexB(b []byte) [][]byte {
+	var nalus [][]byte
+	start := -1
+	for i := 0; i+2 < len(b); {
+		if b[i] != 0 || b[i+1] != 0 || b[i+2] != 1 {
+			i++
+			continue
+		}
+		if start >= 0 {
+			nalus = appendNALU(nalus, b[start:i])
+		}
+		i += 3
+		start = i
+	}
+	if start >= 0 {
+		nalus = appendNALU(nalus, b[start:])
+	}
+	return nalus
+}
+
+// appendNALU appends nalu without the zero of a four byte start code that
+// follows it, nal units never end with a zero byte.
+func appendNALU(nalus [][]byte, nalu []byte) [][]byte {
+	nalu = bytes.TrimRight(nalu, "\x00")
+	if len(nalu) == 0 {
+		return nalus
+	}
+	return append(nalus, nalu)
+}
+
+// audio demuxes the adts frames of data, the first of which starts at pts.
+func (d *Demuxer) audio(data []byte, pts int64) {
+	for i := int64(0); len(data) >= 7; i++ {
+		if data[0] != 0xff || data[1]&0xf0 != 0xf0 {
+			return
+		}
+		headerLen := 7
+		if data[1]&0x01 == 0 {
+			headerLen = 9
+		}
+		size := int(data[3]&0x03)<<11 | int(data[4])<<3 | int(data[5])>>5
+		if size <= headerLen || size > len(data) {
+			return
+		}
+		objectType := data[2]>>6 + 1
+		rateIndex := data[2] >> 2 & 0x0f
+		channels := data[2]&0x01<<2 | data[3]>>6
+		rate := aacSampleRates[rateIndex]
+		if rate == 0 {
+			return
+		}
+		ts := uint32((pts + i*1024*90000/rate) / h264DefaultHZ)
+		asc := []byte{objectType<<3 | rateIndex>>1, rateIndex<<7 | channels<<3}
+		if !bytes.Equal(asc, d.asc) {
+			d.asc = asc
+			d.emit(&av.Packet{IsAudio: true, TimeStamp: ts, Data: append([]byte{0xaf, av.AAC_SEQHDR}, asc...)})
+		}
+		d.emit(&av.Packet{IsAudio: true, TimeStamp: ts, Data: append([]byte{0xaf, av.AAC_RAW}, data[headerLen:size]...)})
+		data = data[size:]
+	}
+}
+
+func (d *Demuxer) emit(p *av.Packet) {
+	if d.tagDemuxer.DemuxH(p) == nil {
+		d.packets = append(d.packets, p)
+	}
+}
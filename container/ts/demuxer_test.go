@@ -0,0 +1,83 @@
+package ts
+
+import (
+	"bytes"
+	"testing"
+
+	"github.com/zijiren233/livelib/av"
+	"github.com/zijiren233/livelib/container/flv"
+)
+
+var (
+	testSPS = []byte{0x67, 0x42, 0xc0, 0x1e, 0xda, 0x02, 0x80}
+	testPPS = []byte{0x68, 0xce, 0x3c, 0x80}
+)
+
+// annexB returns the annex b frame the hls segmenter muxes for an flv
+// video tag with the composition time cts.
+func annexB(t *testing.T, cts int32, nalus ...[]byte) *av.Packet {
+	t.Helper()
+	p := &av.Packet{IsVideo: true, Data: []byte{0x27, 1, byte(cts >> 16), byte(cts >> 8), byte(cts)}}
+	if err := flv.NewDemuxer().DemuxH(p); err != nil {
+		t.Fatal(err)
+	}
+	p.Data = nil
+	for _, nalu := range nalus {
+		p.Data = append(append(p.Data, 0, 0, 0, 1), nalu...)
+	}
+	return p
+}
+
+// adts returns an aac lc, 44.1 kHz stereo frame.
+func adts(payload ...byte) []byte {
+	size := 7 + len(payload)
+	return append([]byte{0xff, 0xf1, 0x50, 0x80, byte(size >> 3), byte(size<<5) | 0x1f, 0xfc}, payload...)
+}
+
+func TestDemuxer(t *testing.T) {
+	muxer := NewMuxer()
+	var seg bytes.Buffer
+	seg.Write(muxer.PAT())
+	seg.Write(muxer.PMT(av.SOUND_AAC, true))
+
+	key := annexB(t, 40, []byte{0x09, 0xf0}, testSPS, testPPS, bytes.Repeat([]byte{0x65, 0x88}, 200))
+	key.TimeStamp = 1000
+	muxer.Mux(key, &seg)
+	inter := annexB(t, 0, []byte{0x41, 0x9a})
+	inter.TimeStamp = 1040
+	muxer.Mux(inter, &seg)
+	// two adts frames in one pes packet.
+	muxer.Mux(&av.Packet{TimeStamp: 1000, Data: append(adts(1, 2), adts(3, 4)...)}, &seg)
+
+	packets, err := NewDemuxer().Demux(&seg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	type tag struct {
+		video bool
+		ts    uint32
+		data  []byte
+	}
+	wantSeq := append([]byte{0x17, 0, 0, 0, 0, 1, 0x42, 0xc0, 0x1e, 0xff, 0xe1, 0, byte(len(testSPS))}, testSPS...)
+	wantSeq = append(append(wantSeq, 1, 0, byte(len(testPPS))), testPPS...)
+	want := []tag{
+		{true, 1000, wantSeq},
+		{true, 1000, append([]byte{0x17, 1, 0, 0, 40, 0, 0, 1, 144}, bytes.Repeat([]byte{0x65, 0x88}, 200)...)},
+		{true, 1040, []byte{0x27, 1, 0, 0, 0, 0, 0, 0, 2, 0x41, 0x9a}},
+		{false, 1000, []byte{0xaf, 0, 0x12, 0x10}},
+		{false, 1000, []byte{0xaf, 1, 1, 2}},
+		{false, 1023, []byte{0xaf, 1, 3, 4}},
+	}
+	if len(packets) != len(want) {
+		t.Fatalf("got %d packets, want %d", len(packets), len(want))
+	}
+	for i, w := range want {
+		p := packets[i]
+		if p.IsVideo != w.video || p.TimeStamp != w.ts || !bytes.Equal(p.Data, w.data) || p.Header == nil {
+			t.Errorf("packet %d = video %v ts %d %x, want video %v ts %d %x", i, p.IsVideo, p.TimeStamp, p.Data, w.video, w.ts, w.data)
+		}
+	}
+	if vh := packets[1].Header.(av.VideoPacketHeader); !vh.IsKeyFrame() || vh.CompositionTime() != 40 {
+		t.Errorf("keyframe header = %+v", vh)
+	}
+}
@@ -25,6 +25,7 @@ type Muxer struct {
 	pat      [tsPacketLen]byte
 	pmt      [tsPacketLen]byte
 	tsPacket [tsPacketLen]byte
+	timeline av.Timeline
 }
 
 func NewMuxer() *Muxer {
@@ -39,7 +40,7 @@ func (muxer *Muxer) Mux(p *av.Packet, w io.Writer) error {
 	dataLen := byte(0)
 
 	var pes pesHeader
-	dts := int64(p.TimeStamp) * int64(h264DefaultHZ)
+	dts := muxer.timeline.Extend(p.TimeStamp) * int64(h264DefaultHZ)
 	pts := dts
 	pid := audioPID
 	var videoH av.VideoPacketHeader
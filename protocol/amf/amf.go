@@ -6,6 +6,11 @@ import (
 )
 
 func (d *Decoder) DecodeBatch(r io.Reader, ver Version) (ret []any, err error) {
+	// references never point outside of the message they appear in
+	d.refCache = d.refCache[:0]
+	d.stringRefs = d.stringRefs[:0]
+	d.objectRefs = d.objectRefs[:0]
+	d.traitRefs = d.traitRefs[:0]
 	var v any
 	for {
 		v, err = d.Decode(r, ver)
@@ -55,12 +55,21 @@ const (
 
 type ExternalHandler func(*Decoder, io.Reader) (any, error)
 
+const (
+	DefaultMaxDepth        = 32
+	DefaultMaxStringLength = 1 << 20
+)
+
 type Decoder struct {
 	refCache         []any
 	stringRefs       []string
 	objectRefs       []any
 	traitRefs        []Trait
 	externalHandlers map[string]ExternalHandler
+
+	depth           int
+	maxDepth        int
+	maxStringLength int
 }
 
 func NewDecoder() *Decoder {
@@ -69,6 +78,18 @@ func NewDecoder() *Decoder {
 	}
 }
 
+// SetMaxDepth bounds how deeply objects and arrays may be nested.
+func (d *Decoder) SetMaxDepth(n int) {
+	d.maxDepth = n
+}
+
+// SetMaxStringLength bounds the length of strings and byte arrays, so that
+// a length prefix cannot make the decoder allocate arbitrary amounts of
+// memory.
+func (d *Decoder) SetMaxStringLength(n int) {
+	d.maxStringLength = n
+}
+
 func (d *Decoder) RegisterExternalHandler(name string, f ExternalHandler) {
 	d.externalHandlers[name] = f
 }
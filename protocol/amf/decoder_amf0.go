@@ -9,6 +9,11 @@ import (
 
 // amf0 polymorphic router
 func (d *Decoder) DecodeAmf0(r io.Reader) (any, error) {
+	if err := d.enter(); err != nil {
+		return nil, err
+	}
+	defer d.leave()
+
 	marker, err := ReadMarker(r)
 	if err != nil {
 		return nil, err
@@ -105,8 +110,11 @@ func (d *Decoder) DecodeAmf0String(r io.Reader, decodeMarker bool) (result strin
 	if err != nil {
 		return "", fmt.Errorf("decode amf0: unable to decode string length: %w", err)
 	}
+	if err = d.checkStringLength(uint32(length)); err != nil {
+		return "", err
+	}
 
-	bytes := make([]byte, length)
+	var bytes []byte
 	if bytes, err = ReadBytes(r, int(length)); err != nil {
 		return "", fmt.Errorf("decode amf0: unable to decode string value: %w", err)
 	}
@@ -280,8 +288,11 @@ func (d *Decoder) DecodeAmf0LongString(r io.Reader, decodeMarker bool) (result s
 	if err != nil {
 		return "", fmt.Errorf("decode amf0: unable to decode long string length: %w", err)
 	}
+	if err = d.checkStringLength(length); err != nil {
+		return "", err
+	}
 
-	bytes := make([]byte, length)
+	var bytes []byte
 	if bytes, err = ReadBytes(r, int(length)); err != nil {
 		return "", fmt.Errorf("decode amf0: unable to decode long string value: %w", err)
 	}
@@ -10,6 +10,11 @@ import (
 
 // amf3 polymorphic router
 func (d *Decoder) DecodeAmf3(r io.Reader) (any, error) {
+	if err := d.enter(); err != nil {
+		return nil, err
+	}
+	defer d.leave()
+
 	marker, err := ReadMarker(r)
 	if err != nil {
 		return nil, err
@@ -128,12 +133,13 @@ func (d *Decoder) DecodeAmf3String(r io.Reader, decodeMarker bool) (result strin
 	}
 
 	if isRef {
-		result = d.stringRefs[refVal]
-		return
+		return refAt(d.stringRefs, refVal)
 	}
 
-	buf := make([]byte, refVal)
-	_, err = r.Read(buf)
+	if err = d.checkStringLength(refVal); err != nil {
+		return "", err
+	}
+	buf, err := ReadBytes(r, int(refVal))
 	if err != nil {
 		return "", fmt.Errorf("amf3 decode: unable to read string: %w", err)
 	}
@@ -166,7 +172,11 @@ func (d *Decoder) DecodeAmf3Date(r io.Reader, decodeMarker bool) (result time.Ti
 	}
 
 	if isRef {
-		res, ok := d.objectRefs[refVal].(time.Time)
+		ref, err := refAt(d.objectRefs, refVal)
+		if err != nil {
+			return result, err
+		}
+		res, ok := ref.(time.Time)
 		if !ok {
 			return result, errors.New(
 				"amf3 decode: unable to extract time from date object references",
@@ -210,9 +220,11 @@ func (d *Decoder) DecodeAmf3Array(r io.Reader, decodeMarker bool) (result Array,
 	}
 
 	if isRef {
-		objRefId := refVal >> 1
-
-		res, ok := d.objectRefs[objRefId].(Array)
+		ref, err := refAt(d.objectRefs, refVal>>1)
+		if err != nil {
+			return result, err
+		}
+		res, ok := ref.(Array)
 		if !ok {
 			return result, errors.New("amf3 decode: unable to extract array from object references")
 		}
@@ -260,9 +272,7 @@ func (d *Decoder) DecodeAmf3Object(r io.Reader, decodeMarker bool) (result any,
 
 	// if this is a object reference only, grab it and return it
 	if isRef {
-		objRefId := refVal >> 1
-
-		return d.objectRefs[objRefId], nil
+		return refAt(d.objectRefs, refVal>>1)
 	}
 
 	// each type has traits that are cached, if the peer sent a reference
@@ -272,8 +282,10 @@ func (d *Decoder) DecodeAmf3Object(r io.Reader, decodeMarker bool) (result any,
 	traitIsRef := (refVal & 0x01) == 0
 
 	if traitIsRef {
-		traitRef := refVal >> 1
-		trait = d.traitRefs[traitRef]
+		trait, err = refAt(d.traitRefs, refVal>>1)
+		if err != nil {
+			return nil, err
+		}
 	} else {
 		// build a new trait from what's left of the given u29
 		trait = *NewTrait()
@@ -416,7 +428,10 @@ func (d *Decoder) DecodeAmf3Xml(r io.Reader, decodeMarker bool) (result string,
 
 	if isRef {
 		var ok bool
-		buf := d.objectRefs[refVal]
+		buf, err := refAt(d.objectRefs, refVal)
+		if err != nil {
+			return "", err
+		}
 		result, ok = buf.(string)
 		if !ok {
 			return "", errors.New("amf3 decode: cannot coerce object reference into xml string")
@@ -425,8 +440,10 @@ func (d *Decoder) DecodeAmf3Xml(r io.Reader, decodeMarker bool) (result string,
 		return result, err
 	}
 
-	buf := make([]byte, refVal)
-	_, err = r.Read(buf)
+	if err = d.checkStringLength(refVal); err != nil {
+		return "", err
+	}
+	buf, err := ReadBytes(r, int(refVal))
 	if err != nil {
 		return "", fmt.Errorf("amf3 decode: unable to read xml string: %w", err)
 	}
@@ -461,7 +478,11 @@ func (d *Decoder) DecodeAmf3ByteArray(r io.Reader, decodeMarker bool) (result []
 
 	if isRef {
 		var ok bool
-		result, ok = d.objectRefs[refVal].([]byte)
+		ref, err := refAt(d.objectRefs, refVal)
+		if err != nil {
+			return result, err
+		}
+		result, ok = ref.([]byte)
 		if !ok {
 			return result, errors.New("amf3 decode: unable to convert object ref to bytes")
 		}
@@ -469,8 +490,10 @@ func (d *Decoder) DecodeAmf3ByteArray(r io.Reader, decodeMarker bool) (result []
 		return result, err
 	}
 
-	result = make([]byte, refVal)
-	_, err = r.Read(result)
+	if err = d.checkStringLength(refVal); err != nil {
+		return result, err
+	}
+	result, err = ReadBytes(r, int(refVal))
 	if err != nil {
 		return result, fmt.Errorf("amf3 decode: unable to read bytearray: %w", err)
 	}
@@ -0,0 +1,67 @@
+package amf
+
+import (
+	"bytes"
+	"testing"
+)
+
+func fuzzSeeds(f *testing.F, ver Version) {
+	enc := new(Encoder)
+	for _, v := range []any{
+		"connect",
+		float64(1),
+		nil,
+		Object{"app": "live", "tcUrl": "rtmp://127.0.0.1/live", "fpad": false},
+		Array{float64(1), "two", Object{"three": true}},
+	} {
+		buf := new(bytes.Buffer)
+		if _, err := enc.Encode(buf, v, ver); err != nil {
+			f.Fatal(err)
+		}
+		f.Add(buf.Bytes())
+	}
+}
+
+func FuzzDecodeAmf0(f *testing.F) {
+	fuzzSeeds(f, AMF0)
+	f.Fuzz(func(t *testing.T, data []byte) {
+		d := NewDecoder()
+		d.SetMaxStringLength(1 << 16)
+		_, _ = d.DecodeBatch(bytes.NewReader(data), AMF0)
+	})
+}
+
+func FuzzDecodeAmf3(f *testing.F) {
+	fuzzSeeds(f, AMF3)
+	f.Fuzz(func(t *testing.T, data []byte) {
+		d := NewDecoder()
+		d.SetMaxStringLength(1 << 16)
+		_, _ = d.DecodeBatch(bytes.NewReader(data), AMF3)
+	})
+}
+
+func TestDecodeLimits(t *testing.T) {
+	nested := Object{}
+	for range DefaultMaxDepth + 1 {
+		nested = Object{"o": nested}
+	}
+	buf := new(bytes.Buffer)
+	if _, err := new(Encoder).Encode(buf, nested, AMF0); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := NewDecoder().Decode(buf, AMF0); err == nil {
+		t.Error("decoded object nested deeper than the limit")
+	}
+
+	// long string marker with a 4 GiB length prefix
+	long := []byte{AMF0_LONG_STRING_MARKER, 0xff, 0xff, 0xff, 0xff}
+	if _, err := NewDecoder().Decode(bytes.NewReader(long), AMF0); err == nil {
+		t.Error("decoded string longer than the limit")
+	}
+
+	// string reference into an empty reference table
+	ref := []byte{AMF3_STRING_MARKER, 0x02}
+	if _, err := NewDecoder().Decode(bytes.NewReader(ref), AMF3); err == nil {
+		t.Error("decoded dangling string reference")
+	}
+}
@@ -1,10 +1,52 @@
 package amf
 
 import (
+	"errors"
 	"fmt"
 	"io"
 )
 
+var (
+	ErrMaxDepth        = errors.New("amf: maximum nesting depth exceeded")
+	ErrStringTooLong   = errors.New("amf: string too long")
+	ErrInvalidRefIndex = errors.New("amf: invalid reference index")
+)
+
+func (d *Decoder) enter() error {
+	maxDepth := d.maxDepth
+	if maxDepth <= 0 {
+		maxDepth = DefaultMaxDepth
+	}
+	if d.depth >= maxDepth {
+		return ErrMaxDepth
+	}
+	d.depth++
+	return nil
+}
+
+func (d *Decoder) leave() {
+	d.depth--
+}
+
+func (d *Decoder) checkStringLength(n uint32) error {
+	maxLen := d.maxStringLength
+	if maxLen <= 0 {
+		maxLen = DefaultMaxStringLength
+	}
+	if uint64(n) > uint64(maxLen) {
+		return fmt.Errorf("%w: %d > %d", ErrStringTooLong, n, maxLen)
+	}
+	return nil
+}
+
+func refAt[T any](refs []T, i uint32) (T, error) {
+	if uint64(i) >= uint64(len(refs)) {
+		var zero T
+		return zero, fmt.Errorf("%w: %d of %d", ErrInvalidRefIndex, i, len(refs))
+	}
+	return refs[i], nil
+}
+
 func WriteByte(w io.Writer, b byte) (err error) {
 	bytes := make([]byte, 1)
 	bytes[0] = b
@@ -30,13 +72,9 @@ func ReadByte(r io.Reader) (byte, error) {
 func ReadBytes(r io.Reader, n int) ([]byte, error) {
 	bytes := make([]byte, n)
 
-	m, err := r.Read(bytes)
+	m, err := io.ReadFull(r, bytes)
 	if err != nil {
-		return bytes, err
-	}
-
-	if m != n {
-		return bytes, fmt.Errorf("decode read bytes failed: expected %d got %d", m, n)
+		return bytes, fmt.Errorf("decode read bytes failed: expected %d got %d: %w", n, m, err)
 	}
 
 	return bytes, nil
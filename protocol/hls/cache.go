@@ -11,42 +11,55 @@ import (
 	"github.com/zijiren233/gencontainer/dllist"
 )
 
-const (
-	maxTSCacheNum = 5
-)
+// tsCacheExtra is how many segments are kept after they left the playlist,
+// for the players that are still fetching them.
+const tsCacheExtra = 2
 
 type TSCache struct {
-	max  int
-	l    *dllist.Dllist[*TSItem]
-	lock sync.RWMutex
+	// window is the number of segments in the playlist, max the number kept.
+	window int
+	max    int
+	l      *dllist.Dllist[*TSItem]
+	lock   sync.RWMutex
+	// discontinuitySeq counts the discontinuities of the evicted items.
+	discontinuitySeq int64
 }
 
 func NewTSCacheItem() *TSCache {
 	return &TSCache{
-		l:   dllist.New[*TSItem](),
-		max: maxTSCacheNum,
+		l:      dllist.New[*TSItem](),
+		window: DefaultPlaylistLength,
+		max:    DefaultPlaylistLength + tsCacheExtra,
 	}
 }
 
-func (tc *TSCache) all() []*TSItem {
+func (tc *TSCache) all() ([]*TSItem, int64) {
 	tc.lock.RLock()
 	defer tc.lock.RUnlock()
 	items := make([]*TSItem, 0, tc.l.Len())
 	for e := tc.l.Front(); e != nil; e = e.Next() {
 		items = append(items, e.Value)
 	}
-	return items
+	return items, tc.discontinuitySeq
 }
 
 func (tc *TSCache) GenM3U8File(tsPath func(tsName string) (tsPath string)) ([]byte, error) {
 	var seq int64
 	var maxDuration int64
 	m3u8body := bytes.NewBuffer(nil)
-	all := tc.all()
-	if l := len(all); l > 3 {
-		all = all[l-3:]
+	all, discontinuitySeq := tc.all()
+	if l := len(all); l > tc.window {
+		for _, item := range all[:l-tc.window] {
+			if item.Discontinuity {
+				discontinuitySeq++
+			}
+		}
+		all = all[l-tc.window:]
 	}
 	for _, item := range all {
+		if item.Discontinuity {
+			m3u8body.WriteString("#EXT-X-DISCONTINUITY\n")
+		}
 		if item.Duration > maxDuration {
 			maxDuration = item.Duration
 		}
@@ -70,6 +83,9 @@ func (tc *TSCache) GenM3U8File(tsPath func(tsName string) (tsPath string)) ([]by
 		maxDuration/1000+1,
 		seq,
 	)
+	if discontinuitySeq != 0 {
+		fmt.Fprintf(w, "#EXT-X-DISCONTINUITY-SEQUENCE:%d\n", discontinuitySeq)
+	}
 	_, err := m3u8body.WriteTo(w)
 	if err != nil {
 		return nil, err
@@ -80,8 +96,11 @@ func (tc *TSCache) GenM3U8File(tsPath func(tsName string) (tsPath string)) ([]by
 func (tc *TSCache) PushItem(item *TSItem) {
 	tc.lock.Lock()
 	defer tc.lock.Unlock()
-	if tc.l.Len() == tc.max {
+	if tc.l.Len() >= tc.max {
 		e := tc.l.Front()
+		if e.Value.Discontinuity {
+			tc.discontinuitySeq++
+		}
 		tc.l.Remove(e)
 	}
 	item.TsName = strings.TrimSuffix(item.TsName, ".ts")
@@ -0,0 +1,27 @@
+package hls
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestGenM3U8Discontinuity(t *testing.T) {
+	tc := NewTSCacheItem()
+	for i := range int64(8) {
+		item := NewTSItem(string(rune('a'+i)), 2000, i+1, nil)
+		item.Discontinuity = i == 1 || i == 6
+		tc.PushItem(item)
+	}
+	b, err := tc.GenM3U8File(func(name string) string { return name + ".ts" })
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := "#EXTM3U\n#EXT-X-VERSION:3\n#EXT-X-ALLOW-CACHE:NO\n#EXT-X-TARGETDURATION:3\n#EXT-X-MEDIA-SEQUENCE:6\n" +
+		"#EXT-X-DISCONTINUITY-SEQUENCE:1\n" +
+		"#EXTINF:2.000,\nf.ts\n" +
+		"#EXT-X-DISCONTINUITY\n#EXTINF:2.000,\ng.ts\n" +
+		"#EXTINF:2.000,\nh.ts\n"
+	if got := string(b); got != want {
+		t.Fatalf("got\n%s\nwant\n%s", got, strings.TrimSpace(want))
+	}
+}
@@ -1,9 +1,16 @@
 package hls
 
-import "errors"
+import (
+	"errors"
+	"time"
+)
 
 const (
-	duration = 3000
+	// DefaultSegmentDuration is the duration a segment reaches before it is
+	// cut at the next keyframe.
+	DefaultSegmentDuration = 3 * time.Second
+	// DefaultPlaylistLength is the number of segments in a playlist.
+	DefaultPlaylistLength = 3
 )
 
 var (
@@ -5,6 +5,9 @@ type TSItem struct {
 	SeqNum   int64
 	Duration int64
 	Data     []byte
+	// Discontinuity is set on the first segment after a change of encoder,
+	// such as a publisher reconnect.
+	Discontinuity bool
 }
 
 func NewTSItem(tsName string, duration, seqNum int64, b []byte) *TSItem {
@@ -109,6 +109,29 @@ func (parser *Parser) adts(src []byte, w io.Writer) error {
 	return nil
 }
 
+// AudioConfig is what an AudioSpecificConfig says about the stream.
+type AudioConfig struct {
+	ObjectType int
+	SampleRate int
+	Channels   int
+}
+
+// ParseAudioSpecificConfig parses the payload of an aac sequence header.
+func ParseAudioSpecificConfig(src []byte) (AudioConfig, error) {
+	if len(src) < 2 {
+		return AudioConfig{}, specificBufInvalid
+	}
+	index := (src[0]&0x07)<<1 | src[1]>>7
+	if int(index) >= len(aacRates) {
+		return AudioConfig{}, specificBufInvalid
+	}
+	return AudioConfig{
+		ObjectType: int(src[0] >> 3),
+		SampleRate: aacRates[index],
+		Channels:   int(src[1] >> 3 & 0x0f),
+	}, nil
+}
+
 func (parser *Parser) SampleRate() int {
 	rate := 44100
 	if parser.cfgInfo.sampleRate <= byte(len(aacRates)-1) {
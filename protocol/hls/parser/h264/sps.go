@@ -0,0 +1,177 @@
+package h264
+
+import "errors"
+
+var errSPSTruncated = errors.New("sps truncated")
+
+// SPSInfo is what a sequence parameter set says about the picture.
+type SPSInfo struct {
+	Profile uint8
+	Level   uint8
+	Width   int
+	Height  int
+}
+
+// ParseConfigurationRecord parses the first sequence parameter set of an
+// AVCDecoderConfigurationRecord, the payload of an avc sequence header.
+func ParseConfigurationRecord(src []byte) (SPSInfo, error) {
+	if len(src) < 8 || src[5]&0x1f == 0 {
+		return SPSInfo{}, spsDataError
+	}
+	spsLen := int(src[6])<<8 | int(src[7])
+	if len(src[8:]) < spsLen || spsLen <= 0 {
+		return SPSInfo{}, spsDataError
+	}
+	return ParseSPS(src[8 : 8+spsLen])
+}
+
+// ParseSPS parses a sequence parameter set nal unit, header included.
+func ParseSPS(nalu []byte) (info SPSInfo, err error) {
+	if len(nalu) < 4 || nalu[0]&0x1f != nalu_type_sps {
+		return info, spsDataError
+	}
+	r := &bitReader{b: unescapeRBSP(nalu[1:])}
+	info.Profile = uint8(r.bits(8))
+	r.bits(8) // constraint flags
+	info.Level = uint8(r.bits(8))
+	r.ue() // seq_parameter_set_id
+
+	chromaFormat := uint32(1)
+	switch info.Profile {
+	case 100, 110, 122, 244, 44, 83, 86, 118, 128, 138, 139, 134, 135:
+		chromaFormat = r.ue()
+		if chromaFormat == 3 {
+			r.bits(1) // separate_colour_plane_flag
+		}
+		r.ue()    // bit_depth_luma_minus8
+		r.ue()    // bit_depth_chroma_minus8
+		r.bits(1) // qpprime_y_zero_transform_bypass_flag
+		if r.bits(1) == 1 {
+			lists := 8
+			if chromaFormat == 3 {
+				lists = 12
+			}
+			for i := range lists {
+				if r.bits(1) == 0 {
+					continue
+				}
+				size := 16
+				if i >= 6 {
+					size = 64
+				}
+				r.skipScalingList(size)
+			}
+		}
+	}
+
+	r.ue() // log2_max_frame_num_minus4
+	switch r.ue() {
+	case 0:
+		r.ue() // log2_max_pic_order_cnt_lsb_minus4
+	case 1:
+		r.bits(1) // delta_pic_order_always_zero_flag
+		r.se()    // offset_for_non_ref_pic
+		r.se()    // offset_for_top_to_bottom_field
+		// num_ref_frames_in_pic_order_cnt_cycle is at most 255.
+		n := r.ue()
+		if n > 255 {
+			return SPSInfo{}, spsDataError
+		}
+		for range n {
+			if r.se(); r.err != nil { // offset_for_ref_frame
+				return SPSInfo{}, r.err
+			}
+		}
+	}
+	r.ue()    // max_num_ref_frames
+	r.bits(1) // gaps_in_frame_num_value_allowed_flag
+	widthMbs := int(r.ue()) + 1
+	heightMapUnits := int(r.ue()) + 1
+	frameMbsOnly := int(r.bits(1))
+	if frameMbsOnly == 0 {
+		r.bits(1) // mb_adaptive_frame_field_flag
+	}
+	r.bits(1) // direct_8x8_inference_flag
+
+	info.Width = widthMbs * 16
+	info.Height = (2 - frameMbsOnly) * heightMapUnits * 16
+	if r.bits(1) == 1 {
+		left, right, top, bottom := int(r.ue()), int(r.ue()), int(r.ue()), int(r.ue())
+		cropX, cropY := 1, 2-frameMbsOnly
+		switch chromaFormat {
+		case 1:
+			cropX, cropY = 2, 2*(2-frameMbsOnly)
+		case 2:
+			cropX = 2
+		}
+		info.Width -= cropX * (left + right)
+		info.Height -= cropY * (top + bottom)
+	}
+	if r.err != nil {
+		return SPSInfo{}, r.err
+	}
+	return info, nil
+}
+
+// unescapeRBSP removes the emulation prevention bytes.
+func unescapeRBSP(b []byte) []byte {
+	out := make([]byte, 0, len(b))
+	for i := 0; i < len(b); i++ {
+		if i >= 2 && b[i] == 3 && b[i-1] == 0 && b[i-2] == 0 {
+			continue
+		}
+		out = append(out, b[i])
+	}
+	return out
+}
+
+type bitReader struct {
+	b   []byte
+	pos int
+	err error
+}
+
+func (r *bitReader) bits(n int) uint32 {
+	var v uint32
+	for range n {
+		if r.pos >= len(r.b)*8 {
+			r.err = errSPSTruncated
+			return 0
+		}
+		v = v<<1 | uint32(r.b[r.pos/8]>>(7-r.pos%8)&1)
+		r.pos++
+	}
+	return v
+}
+
+func (r *bitReader) ue() uint32 {
+	zeros := 0
+	for r.bits(1) == 0 {
+		if r.err != nil || zeros > 31 {
+			r.err = errSPSTruncated
+			return 0
+		}
+		zeros++
+	}
+	return 1<<zeros - 1 + r.bits(zeros)
+}
+
+func (r *bitReader) se() int32 {
+	v := r.ue()
+	if v&1 == 1 {
+		return int32(v+1) / 2
+	}
+	return -int32(v / 2)
+}
+
+func (r *bitReader) skipScalingList(size int) {
+	last, next := int32(8), int32(8)
+	for range size {
+		if next != 0 {
+			next = (last + r.se() + 256) % 256
+		}
+		if next != 0 {
+			last = next
+		}
+	}
+}
@@ -0,0 +1,42 @@
+package h264
+
+import "testing"
+
+func TestParseSPS(t *testing.T) {
+	tests := []struct {
+		sps  []byte
+		want SPSInfo
+	}{
+		{
+			[]byte{0x67, 0x64, 0x00, 0x1f, 0xac, 0xd9, 0x40, 0x50, 0x05, 0xbb, 0x01, 0x10, 0x00, 0x00, 0x03, 0x00, 0x10, 0x00, 0x00, 0x03, 0x03, 0xc0, 0xf1, 0x83, 0x19, 0x60},
+			SPSInfo{Profile: 100, Level: 31, Width: 1280, Height: 720},
+		},
+		{
+			[]byte{0x67, 0x42, 0xc0, 0x1e, 0xda, 0x02, 0x80, 0xbf, 0xe5, 0xc0, 0x44, 0x00, 0x00, 0x03, 0x00, 0x04, 0x00, 0x00, 0x03, 0x00, 0xf2, 0x3c, 0x58, 0xba, 0x80},
+			SPSInfo{Profile: 66, Level: 30, Width: 640, Height: 360},
+		},
+		{
+			// cropped from 1088 lines
+			[]byte{0x67, 0x64, 0x00, 0x28, 0xac, 0xd9, 0x40, 0x78, 0x02, 0x27, 0xe5, 0xc0, 0x44, 0x00, 0x00, 0x03, 0x00, 0x04, 0x00, 0x00, 0x03, 0x00, 0xf0, 0x3c, 0x60, 0xc6, 0x58},
+			SPSInfo{Profile: 100, Level: 40, Width: 1920, Height: 1080},
+		},
+	}
+	for _, tt := range tests {
+		got, err := ParseSPS(tt.sps)
+		if err != nil || got != tt.want {
+			t.Errorf("ParseSPS(% x) = %+v, %v, want %+v", tt.sps, got, err, tt.want)
+		}
+		record := append([]byte{1, tt.sps[1], tt.sps[2], tt.sps[3], 0xff, 0xe1, 0, byte(len(tt.sps))}, tt.sps...)
+		record = append(record, 1, 0, 4, 0x68, 0xeb, 0xe3, 0xcb)
+		if got, err := ParseConfigurationRecord(record); err != nil || got != tt.want {
+			t.Errorf("ParseConfigurationRecord() = %+v, %v, want %+v", got, err, tt.want)
+		}
+	}
+	if _, err := ParseSPS([]byte{0x67, 0x64, 0x00, 0x1f, 0xac}); err == nil {
+		t.Error("truncated sps parsed")
+	}
+	// pic_order_cnt_type 1 with a cycle of 2^25-1 reference frames.
+	if _, err := ParseSPS([]byte{0x67, 0x42, 0xc0, 0x1e, 0xd3, 0x00, 0x00, 0x00, 0xff, 0xff, 0xff, 0xc0}); err == nil {
+		t.Error("sps with an oversized pic order count cycle parsed")
+	}
+}
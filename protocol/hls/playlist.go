@@ -0,0 +1,152 @@
+package hls
+
+import (
+	"bufio"
+	"errors"
+	"io"
+	"strconv"
+	"strings"
+	"time"
+)
+
+var (
+	ErrNotPlaylist = errors.New("not an m3u8 playlist")
+	ErrEncrypted   = errors.New("encrypted hls segments are not supported")
+	// ErrNoTargetDuration is returned for a media playlist without
+	// EXT-X-TARGETDURATION, which clients poll at.
+	ErrNoTargetDuration = errors.New("media playlist without target duration")
+)
+
+// Playlist is a master playlist, which has Variants, or a media playlist.
+type Playlist struct {
+	Variants []Variant
+
+	TargetDuration time.Duration
+	MediaSequence  int64
+	Segments       []Segment
+	// End is set by EXT-X-ENDLIST, no segments will be added.
+	End bool
+}
+
+// Variant is a stream of a master playlist. URI is as written, relative to
+// the playlist.
+type Variant struct {
+	URI       string
+	Bandwidth int
+}
+
+// Segment is a segment of a media playlist. URI is as written, relative to
+// the playlist.
+type Segment struct {
+	URI      string
+	Duration time.Duration
+	Sequence int64
+	// Discontinuity is set on the first segment after a change of encoding
+	// parameters or timestamps.
+	Discontinuity bool
+}
+
+// ParsePlaylist reads a master or media playlist.
+func ParsePlaylist(r io.Reader) (*Playlist, error) {
+	s := bufio.NewScanner(r)
+	var (
+		pl            Playlist
+		header        bool
+		target        bool
+		variant       *Variant
+		duration      time.Duration
+		discontinuity bool
+	)
+	for s.Scan() {
+		line := strings.TrimSpace(s.Text())
+		if line == "" {
+			continue
+		}
+		if !header {
+			if line != "#EXTM3U" {
+				return nil, ErrNotPlaylist
+			}
+			header = true
+			continue
+		}
+		tag, value, _ := strings.Cut(line, ":")
+		switch tag {
+		case "#EXT-X-STREAM-INF":
+			bandwidth, _ := strconv.Atoi(attributes(value)["BANDWIDTH"])
+			variant = &Variant{Bandwidth: bandwidth}
+		case "#EXT-X-TARGETDURATION":
+			seconds, err := strconv.Atoi(value)
+			if err != nil {
+				return nil, err
+			}
+			pl.TargetDuration = time.Duration(seconds) * time.Second
+			target = true
+		case "#EXT-X-MEDIA-SEQUENCE":
+			seq, err := strconv.ParseInt(value, 10, 64)
+			if err != nil {
+				return nil, err
+			}
+			pl.MediaSequence = seq
+		case "#EXTINF":
+			seconds, _, _ := strings.Cut(value, ",")
+			d, err := strconv.ParseFloat(seconds, 64)
+			if err != nil {
+				return nil, err
+			}
+			duration = time.Duration(d * float64(time.Second))
+		case "#EXT-X-DISCONTINUITY":
+			discontinuity = true
+		case "#EXT-X-KEY":
+			if method := attributes(value)["METHOD"]; method != "" && method != "NONE" {
+				return nil, ErrEncrypted
+			}
+		case "#EXT-X-ENDLIST":
+			pl.End = true
+		default:
+			if strings.HasPrefix(line, "#") {
+				continue
+			}
+			if variant != nil {
+				variant.URI = line
+				pl.Variants = append(pl.Variants, *variant)
+				variant = nil
+				continue
+			}
+			pl.Segments = append(pl.Segments, Segment{
+				URI:           line,
+				Duration:      duration,
+				Sequence:      pl.MediaSequence + int64(len(pl.Segments)),
+				Discontinuity: discontinuity,
+			})
+			duration, discontinuity = 0, false
+		}
+	}
+	if err := s.Err(); err != nil {
+		return nil, err
+	}
+	if !header {
+		return nil, ErrNotPlaylist
+	}
+	if len(pl.Variants) == 0 && !target {
+		return nil, ErrNoTargetDuration
+	}
+	return &pl, nil
+}
+
+// attributes parses an attribute list, NAME=value pairs separated by commas
+// outside of quoted strings.
+func attributes(s string) map[string]string {
+	attrs := make(map[string]string)
+	for s != "" {
+		var name, value string
+		name, s, _ = strings.Cut(s, "=")
+		if strings.HasPrefix(s, `"`) {
+			value, s, _ = strings.Cut(s[1:], `"`)
+			s = strings.TrimPrefix(s, ",")
+		} else {
+			value, s, _ = strings.Cut(s, ",")
+		}
+		attrs[strings.TrimSpace(name)] = value
+	}
+	return attrs
+}
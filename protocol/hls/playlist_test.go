@@ -0,0 +1,48 @@
+package hls
+
+import (
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestParsePlaylist(t *testing.T) {
+	master, err := ParsePlaylist(strings.NewReader("#EXTM3U\n" +
+		"#EXT-X-STREAM-INF:BANDWIDTH=1280000,CODECS=\"avc1.42e00a,mp4a.40.2\",RESOLUTION=640x360\nlow/index.m3u8\n" +
+		"#EXT-X-STREAM-INF:AVERAGE-BANDWIDTH=2000000,BANDWIDTH=2560000\nhigh/index.m3u8\n"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(master.Variants) != 2 || master.Variants[0] != (Variant{"low/index.m3u8", 1280000}) ||
+		master.Variants[1] != (Variant{"high/index.m3u8", 2560000}) {
+		t.Errorf("variants = %+v", master.Variants)
+	}
+
+	tc := NewTSCacheItem()
+	for i := range int64(3) {
+		item := NewTSItem(string(rune('a'+i)), 2500, i+7, nil)
+		item.Discontinuity = i == 2
+		tc.PushItem(item)
+	}
+	b, _ := tc.GenM3U8File(func(name string) string { return name + ".ts" })
+	media, err := ParsePlaylist(strings.NewReader(string(b)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if media.TargetDuration != 3*time.Second || media.MediaSequence != 7 || media.End || len(media.Segments) != 3 {
+		t.Fatalf("media playlist = %+v", media)
+	}
+	if s := media.Segments[2]; s != (Segment{"c.ts", 2500 * time.Millisecond, 9, true}) {
+		t.Errorf("last segment = %+v", s)
+	}
+
+	if _, err := ParsePlaylist(strings.NewReader("#EXTM3U\n#EXT-X-KEY:METHOD=AES-128,URI=\"k\"\n")); err != ErrEncrypted {
+		t.Errorf("encrypted playlist: %v", err)
+	}
+	if _, err := ParsePlaylist(strings.NewReader("#EXTM3U\n#EXTINF:2,\na.ts\n")); err != ErrNoTargetDuration {
+		t.Errorf("media playlist without target duration: %v", err)
+	}
+	if _, err := ParsePlaylist(strings.NewReader("<html>")); err != ErrNotPlaylist {
+		t.Errorf("html: %v", err)
+	}
+}
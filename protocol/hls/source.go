@@ -6,6 +6,7 @@ import (
 	"errors"
 	"strconv"
 	"sync"
+	"sync/atomic"
 	"time"
 
 	"github.com/zijiren233/livelib/av"
@@ -17,29 +18,45 @@ import (
 const (
 	videoHZ      = 90000
 	aacSampleLen = 1024
-	maxQueueNum  = 512
 
 	h264_default_hz uint64 = 90
 )
 
+// Source segments the packets written to it. Write segments the packet
+// before it returns.
 type Source struct {
-	seq         int64
-	bwriter     *bytes.Buffer
-	btswriter   *bytes.Buffer
-	demuxer     *flv.Demuxer
-	muxer       *ts.Muxer
-	pts, dts    uint64
-	stat        *status
-	align       align
-	cache       *audioCache
-	tsCache     *TSCache
-	tsparser    *parser.CodecParser
-	packetQueue chan *av.Packet
+	seq       int64
+	bwriter   *bytes.Buffer
+	btswriter *bytes.Buffer
+	demuxer   *flv.Demuxer
+	muxer     *ts.Muxer
+	pts, dts  uint64
+	timeline  av.Timeline
+	stat      *status
+	align     align
+	cache     *audioCache
+	tsCache   *TSCache
+	tsparser  *parser.CodecParser
+	bytesIn   atomic.Uint64
+	// discontinuity is set when the sequence headers change after the first
+	// segment was started, segDiscontinuity when the current segment is the
+	// first one after such a change.
+	discontinuity    bool
+	segDiscontinuity bool
+	// videoSeq and audioSeq are the last sequence headers of each track.
+	videoSeq, audioSeq []byte
 
 	genTsNameFunc func() string
+	onSegment     []func(item *TSItem)
+	segmentMs     int64
 
-	mu     sync.RWMutex
-	closed bool
+	// mu serializes the writes.
+	mu sync.Mutex
+
+	// done is closed by Close or a failed write, err is what failed.
+	done      chan struct{}
+	closeOnce sync.Once
+	err       error
 }
 
 type SourceConf func(*Source)
@@ -50,22 +67,48 @@ func WithGenTsNameFunc(f func() string) SourceConf {
 	}
 }
 
+// WithSegmentFunc calls f for every segment once it is complete, Duration
+// is in milliseconds. f must not block.
+func WithSegmentFunc(f func(item *TSItem)) SourceConf {
+	return func(s *Source) {
+		s.onSegment = append(s.onSegment, f)
+	}
+}
+
+// WithSegmentDuration sets the duration a segment reaches before it is cut
+// at the next keyframe, DefaultSegmentDuration by default.
+func WithSegmentDuration(d time.Duration) SourceConf {
+	return func(s *Source) {
+		s.segmentMs = d.Milliseconds()
+	}
+}
+
+// WithPlaylistLength sets the number of segments in the playlist,
+// DefaultPlaylistLength by default.
+func WithPlaylistLength(n int) SourceConf {
+	return func(s *Source) {
+		n = max(n, 1)
+		s.tsCache.window, s.tsCache.max = n, n+tsCacheExtra
+	}
+}
+
 func DefaultGenTsNameFunc() string {
 	return strconv.FormatInt(time.Now().UnixMicro(), 10)
 }
 
 func NewSource(conf ...SourceConf) *Source {
 	s := &Source{
-		stat:        newStatus(),
-		cache:       newAudioCache(),
-		demuxer:     flv.NewDemuxer(),
-		muxer:       ts.NewMuxer(),
-		tsCache:     NewTSCacheItem(),
-		tsparser:    parser.NewCodecParser(),
-		bwriter:     bytes.NewBuffer(make([]byte, 100*1024)),
-		packetQueue: make(chan *av.Packet, maxQueueNum),
+		stat:     newStatus(),
+		cache:    newAudioCache(),
+		demuxer:  flv.NewDemuxer(),
+		muxer:    ts.NewMuxer(),
+		tsCache:  NewTSCacheItem(),
+		tsparser: parser.NewCodecParser(),
+		bwriter:  bytes.NewBuffer(make([]byte, 100*1024)),
+		done:     make(chan struct{}),
 
 		genTsNameFunc: DefaultGenTsNameFunc,
+		segmentMs:     DefaultSegmentDuration.Milliseconds(),
 	}
 	for _, c := range conf {
 		c(s)
@@ -80,52 +123,62 @@ func (source *Source) GetCacheInc() *TSCache {
 func (source *Source) Write(p *av.Packet) (err error) {
 	source.mu.Lock()
 	defer source.mu.Unlock()
-	if source.closed {
+	select {
+	case <-source.done:
 		return av.ErrClosed
+	default:
+	}
+	source.bytesIn.Add(uint64(len(p.Data)))
+	if err = source.handlePacket(p); err != nil {
+		source.finish(err)
 	}
+	return err
+}
 
-	for {
-		select {
-		case source.packetQueue <- p:
-			return
-		default:
-			av.DropPacket(source.packetQueue)
-		}
+// Stats counts the bytes segmented as sent.
+func (source *Source) Stats() av.WriterStats {
+	return av.WriterStats{
+		Protocol:  "hls",
+		BytesSent: source.bytesIn.Load(),
 	}
 }
 
+// SendPacket waits until the source is closed, segmenting fails or ctx is
+// done, and returns the error of segmenting.
 func (source *Source) SendPacket(ctx context.Context) error {
-	for {
-		select {
-		case <-ctx.Done():
-			return ctx.Err()
-		case p, ok := <-source.packetQueue:
-			if !ok {
-				return nil
-			}
-			if p.IsMetadata {
-				continue
-			}
-			p = p.DeepClone()
-			err := source.demuxer.Demux(p)
-			if err != nil {
-				if errors.Is(err, flv.ErrAvcEndSEQ) {
-					continue
-				}
-				return err
-			}
-
-			compositionTime, isSeq, err := source.parse(p)
-			if err != nil || isSeq {
-				continue
-			}
-			if source.btswriter != nil {
-				source.stat.update(p.IsVideo, p.TimeStamp)
-				source.calcPtsDts(p.IsVideo, p.TimeStamp, uint32(compositionTime))
-				source.tsMux(p)
-			}
+	select {
+	case <-ctx.Done():
+		return ctx.Err()
+	case <-source.done:
+		return source.err
+	}
+}
+
+func (source *Source) handlePacket(p *av.Packet) error {
+	if p.IsMetadata {
+		return nil
+	}
+	// the parsers copy what they keep, so a shallow copy is enough to
+	// demux without touching the shared packet
+	p = p.Clone()
+	err := source.demuxer.Demux(p)
+	if err != nil {
+		if errors.Is(err, flv.ErrAvcEndSEQ) {
+			return nil
 		}
+		return err
 	}
+
+	compositionTime, isSeq, err := source.parse(p)
+	if err != nil || isSeq {
+		return nil
+	}
+	if source.btswriter != nil {
+		source.stat.update(p.IsVideo, p.TimeStamp)
+		source.calcPtsDts(p.IsVideo, p.TimeStamp, uint32(compositionTime))
+		source.tsMux(p)
+	}
+	return nil
 }
 
 // func (source *Source) cleanup() {
@@ -135,14 +188,21 @@ func (source *Source) SendPacket(ctx context.Context) error {
 // 	source.tsCache = nil
 // }
 
+// finish closes the source, keeping err for SendPacket. It reports whether
+// the source was open.
+func (source *Source) finish(err error) (closed bool) {
+	source.closeOnce.Do(func() {
+		source.err = err
+		close(source.done)
+		closed = true
+	})
+	return closed
+}
+
 func (source *Source) Close() error {
-	source.mu.Lock()
-	defer source.mu.Unlock()
-	if source.closed {
+	if !source.finish(nil) {
 		return av.ErrClosed
 	}
-	source.closed = true
-	close(source.packetQueue)
 	return nil
 }
 
@@ -150,11 +210,18 @@ func (source *Source) cut() {
 	newf := true
 	if source.btswriter == nil {
 		source.btswriter = bytes.NewBuffer(nil)
-	} else if source.stat.durationMs() >= duration {
+	} else if source.discontinuity || source.stat.durationMs() >= source.segmentMs {
 		source.flushAudio()
 
 		source.seq++
-		source.tsCache.PushItem(NewTSItem(source.genTsNameFunc(), source.stat.durationMs(), source.seq, source.btswriter.Bytes()))
+		item := NewTSItem(source.genTsNameFunc(), source.stat.durationMs(), source.seq, source.btswriter.Bytes())
+		item.Discontinuity = source.segDiscontinuity
+		source.tsCache.PushItem(item)
+		for _, f := range source.onSegment {
+			f(item)
+		}
+		source.segDiscontinuity = source.discontinuity
+		source.discontinuity = false
 
 		source.btswriter.Reset()
 		source.stat.resetAndNew()
@@ -178,6 +245,7 @@ func (source *Source) parse(p *av.Packet) (int32, bool, error) {
 		}
 		compositionTime = vh.CompositionTime()
 		if vh.IsKeyFrame() && vh.IsSeq() {
+			source.markDiscontinuity(&source.videoSeq, p.Data)
 			return compositionTime, true, source.tsparser.Parse(p, source.bwriter)
 		}
 	} else {
@@ -186,6 +254,7 @@ func (source *Source) parse(p *av.Packet) (int32, bool, error) {
 			return compositionTime, false, ErrNoSupportAudioCodec
 		}
 		if ah.AACPacketType() == av.AAC_SEQHDR {
+			source.markDiscontinuity(&source.audioSeq, p.Data)
 			return compositionTime, true, source.tsparser.Parse(p, source.bwriter)
 		}
 	}
@@ -201,8 +270,21 @@ func (source *Source) parse(p *av.Packet) (int32, bool, error) {
 	return compositionTime, false, nil
 }
 
+// markDiscontinuity starts a new segment with a discontinuity at the next
+// keyframe if the sequence header seq of a track changes in the middle of
+// the stream. Encoders that repeat the same header do not cause one.
+func (source *Source) markDiscontinuity(last *[]byte, seq []byte) {
+	if bytes.Equal(*last, seq) {
+		return
+	}
+	if source.btswriter != nil {
+		source.discontinuity = true
+	}
+	*last = append((*last)[:0], seq...)
+}
+
 func (source *Source) calcPtsDts(isVideo bool, ts, compositionTs uint32) {
-	source.dts = uint64(ts) * h264_default_hz
+	source.dts = uint64(source.timeline.Extend(ts)) * h264_default_hz
 	if isVideo {
 		source.pts = source.dts + uint64(compositionTs)*h264_default_hz
 	} else {
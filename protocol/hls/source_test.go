@@ -0,0 +1,81 @@
+package hls
+
+import (
+	"bytes"
+	"encoding/binary"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/zijiren233/livelib/av"
+)
+
+func avcSeqHeader(level byte) []byte {
+	sps := []byte{0x67, 0x42, 0xc0, level, 0xda}
+	pps := []byte{0x68, 0xce, 0x3c, 0x80}
+	seq := append([]byte{0x17, 0, 0, 0, 0, 1, 0x42, 0xc0, level, 0xff, 0xe1, 0, byte(len(sps))}, sps...)
+	return append(append(seq, 1, 0, byte(len(pps))), pps...)
+}
+
+// writeGOPs writes n GOPs of 200ms from the timestamp start, with a
+// keyframe and four frames of video and aac audio each.
+func writeGOPs(t *testing.T, source *Source, start uint32, n int) {
+	t.Helper()
+	for i := range n * 5 {
+		ts := start + uint32(i*40)
+		nalu := []byte{0x41, 0x9a, byte(i)}
+		frame := byte(0x27)
+		if i%5 == 0 {
+			frame = 0x17
+			nalu = append([]byte{0x65}, bytes.Repeat([]byte{0x88}, 400)...)
+		}
+		video := append(binary.BigEndian.AppendUint32([]byte{frame, 1, 0, 0, 0}, uint32(len(nalu))), nalu...)
+		for _, p := range []*av.Packet{
+			{IsVideo: true, TimeStamp: ts, Data: video},
+			{IsAudio: true, TimeStamp: ts, Data: []byte{0xaf, 1, byte(i), 0x21}},
+		} {
+			if err := source.Write(p); err != nil {
+				t.Fatal(err)
+			}
+		}
+	}
+}
+
+func TestSourceDiscontinuity(t *testing.T) {
+	tests := []struct {
+		name  string
+		level byte
+		want  int
+	}{
+		{"repeated headers", 0x1e, 0},
+		{"new headers", 0x1f, 1},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			source := NewSource(WithSegmentDuration(160 * time.Millisecond))
+			defer source.Close()
+			headers := func(level byte) {
+				for _, p := range []*av.Packet{
+					{IsVideo: true, Data: avcSeqHeader(level)},
+					{IsAudio: true, Data: []byte{0xaf, 0, 0x12, 0x10}},
+				} {
+					if err := source.Write(p); err != nil {
+						t.Fatal(err)
+					}
+				}
+			}
+			headers(0x1e)
+			writeGOPs(t, source, 0, 2)
+			headers(tt.level)
+			writeGOPs(t, source, 400, 3)
+
+			b, err := source.GetCacheInc().GenM3U8File(func(name string) string { return name })
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got := strings.Count(string(b), "#EXT-X-DISCONTINUITY\n"); got != tt.want {
+				t.Fatalf("%d discontinuities, want %d:\n%s", got, tt.want, b)
+			}
+		})
+	}
+}
@@ -5,6 +5,7 @@ import (
 	"errors"
 	"io"
 	"sync"
+	"sync/atomic"
 
 	"github.com/zijiren233/livelib/av"
 	"github.com/zijiren233/livelib/container/flv"
@@ -12,21 +13,25 @@ import (
 	"github.com/zijiren233/stream"
 )
 
-const (
-	headerLen   = 11
-	maxQueueNum = 1024
-)
+const headerLen = 11
 
+// HttpFlvWriter sends packets as an flv stream. Write blocks until the tag
+// is written, a player that cannot keep up falls behind in what feeds it
+// rather than in a queue of the writer.
 type HttpFlvWriter struct {
 	headerBuf []byte
 	w         *stream.Writer
 	inited    bool
 	bufSize   int
+	bytesSent atomic.Uint64
 
-	packetQueue chan *av.Packet
+	// mu serializes the writes to w.
+	mu sync.Mutex
 
-	closed bool
-	mu     sync.RWMutex
+	// done is closed by Close or a failed write, err is what failed.
+	done      chan struct{}
+	closeOnce sync.Once
+	err       error
 }
 
 type HttpFlvWriterConf func(*HttpFlvWriter)
@@ -39,9 +44,9 @@ func WithWriterBuffer(size int) HttpFlvWriterConf {
 
 func NewHttpFLVWriter(w io.Writer, conf ...HttpFlvWriterConf) *HttpFlvWriter {
 	writer := &HttpFlvWriter{
-		headerBuf:   make([]byte, headerLen),
-		bufSize:     1024,
-		packetQueue: make(chan *av.Packet, maxQueueNum),
+		headerBuf: make([]byte, headerLen),
+		bufSize:   1024,
+		done:      make(chan struct{}),
 	}
 
 	for _, hfwc := range conf {
@@ -56,77 +61,92 @@ func NewHttpFLVWriter(w io.Writer, conf ...HttpFlvWriterConf) *HttpFlvWriter {
 func (w *HttpFlvWriter) Write(p *av.Packet) (err error) {
 	w.mu.Lock()
 	defer w.mu.Unlock()
-	if w.closed {
+	select {
+	case <-w.done:
 		return av.ErrClosed
+	default:
+	}
+	if err = w.writePacket(p); err != nil {
+		w.finish(err)
 	}
+	return err
+}
 
-	for {
-		select {
-		case w.packetQueue <- p:
-			return
-		default:
-			av.DropPacket(w.packetQueue)
-		}
+func (w *HttpFlvWriter) Stats() av.WriterStats {
+	return av.WriterStats{
+		Protocol:  "http-flv",
+		BytesSent: w.bytesSent.Load(),
 	}
 }
 
+// SendPacket waits until the writer is closed, a write fails or ctx is
+// done, and returns the error of the failed write. Once it returns nothing
+// is written anymore, so that the handler of the request can return.
 func (w *HttpFlvWriter) SendPacket(ctx context.Context) error {
+	select {
+	case <-ctx.Done():
+		w.finish(ctx.Err())
+	case <-w.done:
+	}
+	// wait for a write in progress
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	return w.err
+}
+
+func (w *HttpFlvWriter) writePacket(p *av.Packet) error {
+	if !w.inited {
+		if err := w.w.Bytes(flv.FlvFirstHeader).Error(); err != nil {
+			return err
+		}
+		w.inited = true
+	}
+
 	var typeID uint8
-	for {
-		select {
-		case <-ctx.Done():
-			return ctx.Err()
-		case p, ok := <-w.packetQueue:
-			if !ok {
-				return nil
-			}
-			if !w.inited {
-				if err := w.w.Bytes(flv.FlvFirstHeader).Error(); err != nil {
-					return err
-				}
-				w.inited = true
-			}
-
-			if p.IsVideo {
-				typeID = av.TAG_VIDEO
-			} else if p.IsMetadata {
-				var err error
-				typeID = av.TAG_SCRIPTDATAAMF0
-				p = p.DeepClone()
-				p.Data, err = amf.MetaDataReform(p.Data, amf.DEL)
-				if err != nil {
-					return err
-				}
-			} else if p.IsAudio {
-				typeID = av.TAG_AUDIO
-			} else {
-				return errors.New("not allowed packet type")
-			}
-			dataLen := len(p.Data)
-			preDataLen := dataLen + headerLen
-			timestampExt := p.TimeStamp >> 24
-
-			if err := w.w.
-				U8(typeID).
-				U24(uint32(dataLen)).
-				U24(p.TimeStamp).
-				U8(uint8(timestampExt)).
-				U24(0).
-				Bytes(p.Data).
-				U32(uint32(preDataLen)).Error(); err != nil {
-				return err
-			}
+	if p.IsVideo {
+		typeID = av.TAG_VIDEO
+	} else if p.IsMetadata {
+		var err error
+		typeID = av.TAG_SCRIPTDATAAMF0
+		p = p.DeepClone()
+		p.Data, err = amf.MetaDataReform(p.Data, amf.DEL)
+		if err != nil {
+			return err
 		}
+	} else if p.IsAudio {
+		typeID = av.TAG_AUDIO
+	} else {
+		return errors.New("not allowed packet type")
 	}
+	dataLen := len(p.Data)
+	preDataLen := dataLen + headerLen
+	timestampExt := p.TimeStamp >> 24
+	w.bytesSent.Add(uint64(preDataLen + 4))
+
+	return w.w.
+		U8(typeID).
+		U24(uint32(dataLen)).
+		U24(p.TimeStamp).
+		U8(uint8(timestampExt)).
+		U24(0).
+		Bytes(p.Data).
+		U32(uint32(preDataLen)).Error()
+}
+
+// finish closes the writer, keeping err for SendPacket. It reports whether
+// the writer was open.
+func (w *HttpFlvWriter) finish(err error) (closed bool) {
+	w.closeOnce.Do(func() {
+		w.err = err
+		close(w.done)
+		closed = true
+	})
+	return closed
 }
 
 func (w *HttpFlvWriter) Close() error {
-	w.mu.Lock()
-	defer w.mu.Unlock()
-	if w.closed {
+	if !w.finish(nil) {
 		return av.ErrClosed
 	}
-	w.closed = true
-	close(w.packetQueue)
 	return nil
 }
@@ -0,0 +1,341 @@
+package core
+
+import (
+	"crypto/hmac"
+	"crypto/md5"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"strings"
+	"sync"
+	"time"
+)
+
+// The connect authentication schemes understood by Wowza, FMS and encoders
+// built on librtmp or FFmpeg. The client first connects without
+// credentials and is rejected with the scheme to use, then reconnects with
+// its user name to receive a challenge, and finally reconnects with the
+// response in the query string of the app name.
+const (
+	AuthModAdobe = "adobe"
+	AuthModLLNW  = "llnw"
+)
+
+// Status codes used to reject a connection or a stream.
+const (
+	CodeConnectRejected    = "NetConnection.Connect.Rejected"
+	CodePublishBadName     = "NetStream.Publish.BadName"
+	CodePlayStreamNotFound = "NetStream.Play.StreamNotFound"
+)
+
+const (
+	authRejectPrefix = "[ AccessManager.Reject ] : "
+
+	reasonNeedAuth   = "needauth"
+	reasonAuthFailed = "authfailed"
+	reasonNoSuchUser = "nosuchuser"
+
+	llnwRealm  = "live"
+	llnwMethod = "publish"
+	llnwQop    = "auth"
+	llnwNc     = "00000001"
+
+	defaultChallengeTTL = 5 * time.Minute
+)
+
+var ErrAuthFailed = errors.New("rtmp authentication failed")
+
+// StatusError is an error status sent by the peer in reply to a command,
+// such as a rejected connect.
+type StatusError struct {
+	Code        string
+	Description string
+}
+
+func (e *StatusError) Error() string {
+	if e.Description == "" {
+		return e.Code
+	}
+	return e.Code + ": " + e.Description
+}
+
+// CredentialLookup returns the password of user for app.
+type CredentialLookup func(app, user string) (password string, ok bool)
+
+// ConnectAuth verifies the challenge-response authentication of connect
+// requests. A challenge is accepted once, by the ConnectAuth that issued
+// it, so a single ConnectAuth must be shared by all connections of a server.
+type ConnectAuth struct {
+	lookup CredentialLookup
+	mods   []string
+	secret []byte
+	ttl    time.Duration
+	now    func() time.Time
+
+	mu sync.Mutex
+	// issued holds the creation time of the challenges not answered yet.
+	issued map[string]time.Time
+}
+
+// NewConnectAuth returns a ConnectAuth accepting the given schemes, the
+// first of which is offered to clients that connect without credentials.
+// It accepts AuthModAdobe when no scheme is given.
+func NewConnectAuth(lookup CredentialLookup, mods ...string) *ConnectAuth {
+	if len(mods) == 0 {
+		mods = []string{AuthModAdobe}
+	}
+	secret := make([]byte, 32)
+	if _, err := rand.Read(secret); err != nil {
+		panic(err)
+	}
+	return &ConnectAuth{
+		lookup: lookup,
+		mods:   mods,
+		secret: secret,
+		ttl:    defaultChallengeTTL,
+		now:    time.Now,
+		issued: make(map[string]time.Time),
+	}
+}
+
+// SetChallengeTTL sets how long a challenge stays valid.
+func (a *ConnectAuth) SetChallengeTTL(ttl time.Duration) {
+	a.ttl = ttl
+}
+
+func (a *ConnectAuth) supports(mod string) bool {
+	for _, m := range a.mods {
+		if m == mod {
+			return true
+		}
+	}
+	return false
+}
+
+func (a *ConnectAuth) mac(parts ...string) []byte {
+	h := hmac.New(sha256.New, a.secret)
+	for _, p := range parts {
+		h.Write([]byte(p))
+		h.Write([]byte{0})
+	}
+	return h.Sum(nil)
+}
+
+// salt is derived from the user name, so that it does not change between
+// the reconnects of a client.
+func (a *ConnectAuth) salt(user string) string {
+	return hex.EncodeToString(a.mac("salt", user)[:8])
+}
+
+// token returns a challenge that carries its creation time and is signed
+// for mod and user, and records it until it is answered or expires.
+func (a *ConnectAuth) token(mod, user string) string {
+	now := a.now()
+	ts := make([]byte, 8)
+	binary.BigEndian.PutUint64(ts, uint64(now.Unix()))
+	// the random part makes the challenges of the same second differ
+	t := hex.EncodeToString(ts) + randomHex4()
+	token := t + hex.EncodeToString(a.mac("token", mod, user, t)[:12])
+
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	for k, created := range a.issued {
+		if now.Sub(created) > a.ttl {
+			delete(a.issued, k)
+		}
+	}
+	a.issued[token] = now
+	return token
+}
+
+// checkToken reports whether token is a challenge issued for mod and user
+// that did not expire, and consumes it, so that a response cannot be
+// replayed.
+func (a *ConnectAuth) checkToken(mod, user, token string) bool {
+	if len(token) != 16+8+24 {
+		return false
+	}
+	ts, err := hex.DecodeString(token[:16])
+	if err != nil {
+		return false
+	}
+	created := time.Unix(int64(binary.BigEndian.Uint64(ts)), 0)
+	if age := a.now().Sub(created); age < 0 || age > a.ttl {
+		return false
+	}
+	want := hex.EncodeToString(a.mac("token", mod, user, token[:24])[:12])
+	if !hmac.Equal([]byte(want), []byte(token[24:])) {
+		return false
+	}
+
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	if _, ok := a.issued[token]; !ok {
+		return false
+	}
+	delete(a.issued, token)
+	return true
+}
+
+// verify checks the authentication parameters sent with connect for app.
+// On success it returns the authenticated user, otherwise the description
+// to reject the connection with.
+func (a *ConnectAuth) verify(app string, params map[string]string) (user, reject string) {
+	mod := params["authmod"]
+	if mod == "" || !a.supports(mod) {
+		return "", authRejectPrefix + fmt.Sprintf("[ code=403 need auth; authmod=%s ] : ", a.mods[0])
+	}
+	reject = authRejectPrefix + fmt.Sprintf("[ authmod=%s ] : ?reason=", mod)
+
+	user = params["user"]
+	password, ok := a.lookup(app, user)
+	if user == "" || !ok {
+		return "", reject + reasonNoSuchUser
+	}
+
+	switch mod {
+	case AuthModAdobe:
+		opaque, challenge, response := params["opaque"], params["challenge"], params["response"]
+		if response == "" {
+			token := a.token(mod, user)
+			return "", reject + fmt.Sprintf(
+				"%s&user=%s&salt=%s&challenge=%s&opaque=%s",
+				reasonNeedAuth, user, a.salt(user), token, token,
+			)
+		}
+		if !a.checkToken(mod, user, opaque) ||
+			!hmac.Equal([]byte(response), []byte(adobeResponse(user, a.salt(user), password, opaque, challenge))) {
+			return "", reject + reasonAuthFailed
+		}
+	case AuthModLLNW:
+		nonce, cnonce, nc, response := params["nonce"], params["cnonce"], params["nc"], params["response"]
+		if response == "" {
+			return "", reject + fmt.Sprintf(
+				"%s&user=%s&nonce=%s",
+				reasonNeedAuth, user, a.token(mod, user),
+			)
+		}
+		if !a.checkToken(mod, user, nonce) ||
+			!hmac.Equal([]byte(response), []byte(llnwResponse(user, password, app, nonce, cnonce, nc))) {
+			return "", reject + reasonAuthFailed
+		}
+	}
+	return user, ""
+}
+
+func md5Base64(parts ...string) string {
+	h := md5.New()
+	for _, p := range parts {
+		h.Write([]byte(p))
+	}
+	return base64.StdEncoding.EncodeToString(h.Sum(nil))
+}
+
+func md5Hex(parts ...string) string {
+	h := md5.New()
+	for _, p := range parts {
+		h.Write([]byte(p))
+	}
+	return hex.EncodeToString(h.Sum(nil))
+}
+
+// adobeResponse computes base64(md5(base64(md5(user+salt+password)) +
+// opaque + challenge)), where challenge is the one chosen by the client.
+func adobeResponse(user, salt, password, opaque, challenge string) string {
+	return md5Base64(md5Base64(user, salt, password), opaque, challenge)
+}
+
+// llnwResponse computes the digest response of the Limelight scheme.
+func llnwResponse(user, password, app, nonce, cnonce, nc string) string {
+	ha1 := md5Hex(user, ":", llnwRealm, ":", password)
+	uri := app
+	if i := strings.IndexAny(uri, "/?"); i >= 0 {
+		uri = uri[:i]
+	}
+	if !strings.Contains(app, "/") {
+		uri += "/_definst_"
+	}
+	ha2 := md5Hex(llnwMethod, ":/", uri)
+	return md5Hex(ha1, ":", nonce, ":", nc, ":", cnonce, ":", llnwQop, ":", ha2)
+}
+
+// splitAuthQuery splits the query string off app. The values are kept as
+// they are, since base64 responses are sent without escaping.
+func splitAuthQuery(app string) (string, map[string]string) {
+	app, query, ok := strings.Cut(app, "?")
+	if !ok {
+		return app, nil
+	}
+	return app, parseAuthParams(query)
+}
+
+func parseAuthParams(query string) map[string]string {
+	params := make(map[string]string)
+	for _, kv := range strings.Split(query, "&") {
+		k, v, _ := strings.Cut(kv, "=")
+		if k != "" {
+			params[k] = v
+		}
+	}
+	return params
+}
+
+func randomHex4() string {
+	b := make([]byte, 4)
+	if _, err := rand.Read(b); err != nil {
+		panic(err)
+	}
+	return hex.EncodeToString(b)
+}
+
+// newAuthQuery returns the query to reconnect with after the server rejected
+// connect with description, or an error if the rejection is final.
+func newAuthQuery(app, user, password, description string) (string, error) {
+	var mod string
+	switch {
+	case strings.Contains(description, "authmod="+AuthModAdobe):
+		mod = AuthModAdobe
+	case strings.Contains(description, "authmod="+AuthModLLNW):
+		mod = AuthModLLNW
+	default:
+		return "", fmt.Errorf("%w: %s", ErrAuthFailed, description)
+	}
+
+	if strings.Contains(description, "code=403 need auth") {
+		return fmt.Sprintf("?authmod=%s&user=%s", mod, user), nil
+	}
+	_, query, ok := strings.Cut(description, "?reason="+reasonNeedAuth)
+	if !ok {
+		return "", fmt.Errorf("%w: %s", ErrAuthFailed, description)
+	}
+	params := parseAuthParams(query)
+
+	switch mod {
+	case AuthModAdobe:
+		opaque, challenge := params["opaque"], params["challenge"]
+		if opaque == "" {
+			opaque = challenge
+		}
+		challenge2 := randomHex4()
+		q := fmt.Sprintf(
+			"?authmod=%s&user=%s&challenge=%s&response=%s",
+			mod, user, challenge2,
+			adobeResponse(user, params["salt"], password, opaque, challenge2),
+		)
+		if params["opaque"] != "" {
+			q += "&opaque=" + params["opaque"]
+		}
+		return q, nil
+	default:
+		nonce, cnonce := params["nonce"], randomHex4()
+		return fmt.Sprintf(
+			"?authmod=%s&user=%s&nonce=%s&cnonce=%s&nc=%s&response=%s",
+			mod, user, nonce, cnonce, llnwNc,
+			llnwResponse(user, password, app, nonce, cnonce, llnwNc),
+		), nil
+	}
+}
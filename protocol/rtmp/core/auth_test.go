@@ -0,0 +1,213 @@
+package core
+
+import (
+	"bytes"
+	"errors"
+	"net"
+	"testing"
+
+	"github.com/zijiren233/livelib/av"
+	"github.com/zijiren233/livelib/protocol/amf"
+)
+
+// serve accepts connections on a local listener and reads the initial
+// messages of each, reporting the connections that got to publish or play.
+func serve(t *testing.T, conf ...ConnServerConf) (string, <-chan *ConnServer) {
+	t.Helper()
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { l.Close() })
+	done := make(chan *ConnServer, 8)
+	go func() {
+		for {
+			c, err := l.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				conn := NewConn(c, 4096)
+				defer conn.Close()
+				if err := conn.HandshakeServer(); err != nil {
+					return
+				}
+				cs := NewConnServer(conn, conf...)
+				if cs.ReadInitMsg() == nil {
+					done <- cs
+				}
+			}()
+		}
+	}()
+	return l.Addr().String(), done
+}
+
+func TestConnectAuth(t *testing.T) {
+	lookup := func(app, user string) (string, bool) {
+		return "secret", app == "live" && user == "alice"
+	}
+
+	for _, mod := range []string{AuthModAdobe, AuthModLLNW} {
+		t.Run(mod, func(t *testing.T) {
+			addr, done := serve(t, WithConnectAuth(NewConnectAuth(lookup, mod)))
+
+			cc := NewConnClient()
+			if err := cc.Start("rtmp://alice:secret@"+addr+"/live/stream", av.PUBLISH); err != nil {
+				t.Fatal(err)
+			}
+			defer cc.Close()
+			cs := <-done
+			if cs.User != "alice" || cs.ConnInfo.App != "live" || cs.PublishInfo.Name != "stream" {
+				t.Fatalf("user=%q app=%q name=%q", cs.User, cs.ConnInfo.App, cs.PublishInfo.Name)
+			}
+
+			for _, url := range []string{
+				"rtmp://alice:wrong@" + addr + "/live/stream",
+				"rtmp://bob:secret@" + addr + "/live/stream",
+				"rtmp://" + addr + "/live/stream",
+			} {
+				cc := NewConnClient()
+				err := cc.Start(url, av.PUBLISH)
+				var status *StatusError
+				if !errors.Is(err, ErrAuthFailed) && !(errors.As(err, &status) && status.Code == CodeConnectRejected) {
+					t.Errorf("%s: err=%v, want rejection", url, err)
+				}
+				if cc.conn != nil {
+					cc.Close()
+				}
+			}
+		})
+	}
+}
+
+func TestConnectAuthExpiredChallenge(t *testing.T) {
+	auth := NewConnectAuth(func(app, user string) (string, bool) { return "secret", true })
+	token := auth.token(AuthModAdobe, "alice")
+	if auth.checkToken(AuthModAdobe, "bob", token) || auth.checkToken(AuthModLLNW, "alice", token) {
+		t.Fatal("token accepted for another user or scheme")
+	}
+	if !auth.checkToken(AuthModAdobe, "alice", token) {
+		t.Fatal("fresh token rejected")
+	}
+	token = auth.token(AuthModAdobe, "alice")
+	auth.SetChallengeTTL(-1)
+	if auth.checkToken(AuthModAdobe, "alice", token) {
+		t.Fatal("expired token accepted")
+	}
+}
+
+func TestConnectAuthReplay(t *testing.T) {
+	auth := NewConnectAuth(func(app, user string) (string, bool) { return "secret", true }, AuthModAdobe, AuthModLLNW)
+	for _, mod := range []string{AuthModAdobe, AuthModLLNW} {
+		t.Run(mod, func(t *testing.T) {
+			_, reject := auth.verify("live", map[string]string{"authmod": mod, "user": "alice"})
+			query, err := newAuthQuery("live", "alice", "secret", reject)
+			if err != nil {
+				t.Fatal(err)
+			}
+			params := parseAuthParams(query[1:])
+			if user, reject := auth.verify("live", params); user != "alice" {
+				t.Fatalf("response rejected: %s", reject)
+			}
+			if user, _ := auth.verify("live", params); user != "" {
+				t.Fatal("replayed response accepted")
+			}
+		})
+	}
+}
+
+func TestAuthorizeReject(t *testing.T) {
+	addr, done := serve(t, WithAuthorize(func(cs *ConnServer) error {
+		switch {
+		case cs.PublishInfo.Name == "taken":
+			return &StatusError{Code: CodePublishBadName, Description: "already publishing"}
+		case cs.PublishInfo.Name == "banned":
+			return &StatusError{Code: CodeConnectRejected, Description: "banned"}
+		case cs.PublishInfo.Name != "ok?token=1":
+			return errors.New("no such stream")
+		}
+		return nil
+	}))
+
+	tests := []struct {
+		url, method, code string
+	}{
+		{"rtmp://" + addr + "/live/taken", av.PUBLISH, CodePublishBadName},
+		{"rtmp://" + addr + "/live/other", av.PUBLISH, CodePublishBadName},
+		{"rtmp://" + addr + "/live/other", av.PLAY, CodePlayStreamNotFound},
+		// the connection is accepted by then, so the stream is rejected
+		{"rtmp://" + addr + "/live/banned", av.PUBLISH, CodePublishBadName},
+		{"rtmp://" + addr + "/live/banned", av.PLAY, CodePlayStreamNotFound},
+		{"rtmp://" + addr + "/live/ok?token=1", av.PLAY, ""},
+	}
+	for _, tt := range tests {
+		cc := NewConnClient()
+		err := cc.Start(tt.url, tt.method)
+		var status *StatusError
+		switch {
+		case tt.code == "" && err != nil:
+			t.Errorf("%s %s: %v", tt.method, tt.url, err)
+		case tt.code != "" && (!errors.As(err, &status) || status.Code != tt.code):
+			t.Errorf("%s %s: err=%v, want %s", tt.method, tt.url, err, tt.code)
+		}
+		cc.Close()
+	}
+	<-done
+}
+
+func TestConnectCheck(t *testing.T) {
+	addr, done := serve(t, WithConnectCheck(func(cs *ConnServer) error {
+		if cs.ConnInfo.App != "live" {
+			return errors.New("unknown app")
+		}
+		return nil
+	}))
+
+	cc := NewConnClient()
+	err := cc.Start("rtmp://"+addr+"/other/stream", av.PUBLISH)
+	var status *StatusError
+	if !errors.As(err, &status) || status.Code != CodeConnectRejected || status.Description != "unknown app" {
+		t.Errorf("err=%v, want connect rejected", err)
+	}
+	if cc.conn != nil {
+		cc.Close()
+	}
+
+	cc = NewConnClient()
+	if err := cc.Start("rtmp://"+addr+"/live/stream", av.PUBLISH); err != nil {
+		t.Fatal(err)
+	}
+	defer cc.Close()
+	<-done
+}
+
+func TestWriteStatus(t *testing.T) {
+	a, b := net.Pipe()
+	defer a.Close()
+	defer b.Close()
+	cs := NewConnServer(NewConn(a, 4096))
+	peer := NewConn(b, 4096)
+	read := func() []any {
+		t.Helper()
+		c, err := peer.Read()
+		if err != nil {
+			t.Fatal(err)
+		}
+		vs, _ := cs.decoder.DecodeBatch(bytes.NewReader(c.Data), amf.AMF0)
+		return vs
+	}
+
+	// connect is pending, the error answers its transaction
+	cs.transactionID = 1
+	go cs.writeStatus(3, 0, &StatusError{Code: CodeConnectRejected, Description: "denied"})
+	if vs := read(); vs[0] != respError || vs[1] != float64(1) {
+		t.Fatalf("rejected connect: %v", vs)
+	}
+
+	cs.connected = true
+	cs.transactionID = 4
+	go cs.writeStatus(3, 1, &StatusError{Code: CodePublishBadName, Description: "denied"})
+	if vs := read(); vs[0] != onStatus || vs[1] != float64(0) {
+		t.Fatalf("rejected publish: %v", vs)
+	}
+}
@@ -20,6 +20,8 @@ type ChunkStream struct {
 	got       bool
 	tmpFromat uint32
 	Data      []byte
+
+	buf *av.Buffer
 }
 
 func (chunkStream *ChunkStream) full() bool {
@@ -30,48 +32,132 @@ func (chunkStream *ChunkStream) init() {
 	chunkStream.got = false
 	chunkStream.index = 0
 	chunkStream.remain = chunkStream.Length
-	chunkStream.Data = make([]byte, chunkStream.Length)
+	if chunkStream.buf != nil {
+		chunkStream.buf.Release()
+	}
+	chunkStream.buf = av.NewBuffer(int(chunkStream.Length))
+	chunkStream.Data = chunkStream.buf.Bytes()
 }
 
-func (chunkStream *ChunkStream) writeHeader(w *ReadWriter) error {
-	// Chunk Basic Header
-	h := chunkStream.Format << 6
+// TakeBuffer hands the pooled buffer behind Data over to the caller, who
+// becomes responsible for releasing it. Without it, Data is reused for the
+// next message on the same chunk stream.
+func (chunkStream *ChunkStream) TakeBuffer() *av.Buffer {
+	b := chunkStream.buf
+	chunkStream.buf = nil
+	if b == nil {
+		b = av.NewBuffer(len(chunkStream.Data))
+		copy(b.Bytes(), chunkStream.Data)
+	}
+	return b
+}
+
+// Chunk stream IDs used for outgoing messages. Audio, video and metadata
+// get their own chunk streams so that their headers can be compressed
+// independently and their chunks can be interleaved.
+const (
+	csidControl  = 2
+	csidCommand  = 3
+	csidAudio    = 4
+	csidMetadata = 5
+	csidVideo    = 6
+)
+
+func csidForType(typeID, csid uint32) uint32 {
+	switch typeID {
+	case av.TAG_AUDIO:
+		return csidAudio
+	case av.TAG_VIDEO:
+		return csidVideo
+	case av.TAG_SCRIPTDATAAMF0, av.TAG_SCRIPTDATAAMF3:
+		return csidMetadata
+	}
+	return csid
+}
+
+// chunkHeader is the last message header sent on an outgoing chunk stream,
+// which later messages on the same chunk stream are compressed against.
+type chunkHeader struct {
+	valid     bool
+	format    uint32
+	timestamp uint32
+	timeDelta uint32
+	length    uint32
+	typeID    uint32
+	streamID  uint32
+}
+
+// compress picks the smallest message header format for chunkStream given
+// the previous header on the same chunk stream, and returns the value of
+// the timestamp field (absolute for type 0, delta for type 1 and 2).
+func (h *chunkHeader) compress(chunkStream *ChunkStream) (format, ts uint32) {
+	delta := chunkStream.Timestamp - h.timestamp
+	switch {
+	case !h.valid,
+		chunkStream.StreamID != h.streamID,
+		chunkStream.Timestamp < h.timestamp,
+		delta >= 0xffffff:
+		format, ts = 0, chunkStream.Timestamp
+	case chunkStream.Length != h.length, chunkStream.TypeID != h.typeID:
+		format, ts = 1, delta
+	// type 3 repeats the previous delta, which only exists after a
+	// type 1 or 2 header
+	case h.format != 0 && delta == h.timeDelta:
+		format, ts = 3, delta
+	default:
+		format, ts = 2, delta
+	}
+
+	h.valid = true
+	h.timestamp = chunkStream.Timestamp
+	h.length = chunkStream.Length
+	h.typeID = chunkStream.TypeID
+	h.streamID = chunkStream.StreamID
+	if format != 3 {
+		h.format = format
+		if format != 0 {
+			h.timeDelta = delta
+		}
+	}
+	return format, ts
+}
+
+func (chunkStream *ChunkStream) writeBasicHeader(w *ReadWriter, format uint32) error {
+	h := format << 6
 	switch {
+	case chunkStream.CSID < 2:
+		// 0 and 1 select the two and three byte forms
 	case chunkStream.CSID < 64:
 		h |= chunkStream.CSID
-		if err := w.WriteUintBE(h, 1); err != nil {
-			return err
-		}
+		return w.WriteUintBE(h, 1)
 	case chunkStream.CSID-64 < 256:
-		h |= 0
 		if err := w.WriteUintBE(h, 1); err != nil {
 			return err
 		}
-		if err := w.WriteUintLE(chunkStream.CSID-64, 1); err != nil {
-			return err
-		}
+		return w.WriteUintLE(chunkStream.CSID-64, 1)
 	case chunkStream.CSID-64 < 65536:
 		h |= 1
-		w.WriteUintBE(h, 1)
 		if err := w.WriteUintBE(h, 1); err != nil {
 			return err
 		}
-		if err := w.WriteUintLE(chunkStream.CSID-64, 2); err != nil {
-			return err
-		}
+		return w.WriteUintLE(chunkStream.CSID-64, 2)
+	}
+	return fmt.Errorf("invalid csid=%d", chunkStream.CSID)
+}
+
+func (chunkStream *ChunkStream) writeHeader(w *ReadWriter, format, ts uint32) error {
+	// Chunk Basic Header
+	if err := chunkStream.writeBasicHeader(w, format); err != nil {
+		return err
 	}
 	// Chunk Message Header
-	ts := chunkStream.Timestamp
-	if chunkStream.Format == 3 {
+	if format == 3 {
 		goto END
 	}
-	if chunkStream.Timestamp > 0xffffff {
-		ts = 0xffffff
-	}
-	if err := w.WriteUintBE(ts, 3); err != nil {
+	if err := w.WriteUintBE(min(ts, 0xffffff), 3); err != nil {
 		return err
 	}
-	if chunkStream.Format == 2 {
+	if format == 2 {
 		goto END
 	}
 	if chunkStream.Length > 0xffffff {
@@ -83,7 +169,7 @@ func (chunkStream *ChunkStream) writeHeader(w *ReadWriter) error {
 	if err := w.WriteUintBE(chunkStream.TypeID, 1); err != nil {
 		return err
 	}
-	if chunkStream.Format == 1 {
+	if format == 1 {
 		goto END
 	}
 	if err := w.WriteUintLE(chunkStream.StreamID, 4); err != nil {
@@ -92,50 +178,118 @@ func (chunkStream *ChunkStream) writeHeader(w *ReadWriter) error {
 END:
 	// Extended Timestamp
 	if ts >= 0xffffff {
-		if err := w.WriteUintBE(chunkStream.Timestamp, 4); err != nil {
+		if err := w.WriteUintBE(ts, 4); err != nil {
 			return err
 		}
 	}
 	return nil
 }
 
-func (chunkStream *ChunkStream) writeChunk(w *ReadWriter, chunkSize uint32) error {
-	switch chunkStream.TypeID {
-	case av.TAG_AUDIO:
-		chunkStream.CSID = 4
-	case av.TAG_VIDEO, av.TAG_SCRIPTDATAAMF0, av.TAG_SCRIPTDATAAMF3:
-		chunkStream.CSID = 6
-	}
+// chunkWriter tracks the progress of one message being split into chunks.
+type chunkWriter struct {
+	cs     *ChunkStream
+	offset uint32
+	ts     uint32
+}
 
-	totalLen := uint32(0)
-	numChunks := (chunkStream.Length / chunkSize)
-	for i := uint32(0); i <= numChunks; i++ {
-		if totalLen == chunkStream.Length {
-			break
-		}
-		if i == 0 {
-			chunkStream.Format = uint32(0)
-		} else {
-			chunkStream.Format = uint32(3)
+// writeNext writes the next chunk of the message and reports whether the
+// whole message has been written. The first chunk carries a header
+// compressed against prev, the following ones a type 3 header.
+func (c *chunkWriter) writeNext(w *ReadWriter, chunkSize uint32, prev *chunkHeader) (bool, error) {
+	if c.offset == 0 {
+		var format uint32
+		format, c.ts = prev.compress(c.cs)
+		if err := c.cs.writeHeader(w, format, c.ts); err != nil {
+			return false, err
 		}
-		if err := chunkStream.writeHeader(w); err != nil {
-			return err
-		}
-		inc := chunkSize
-		start := i * chunkSize
-		if uint32(len(chunkStream.Data))-start <= inc {
-			inc = uint32(len(chunkStream.Data)) - start
+	} else if err := c.cs.writeHeader(w, 3, c.ts); err != nil {
+		return false, err
+	}
+	end := min(c.offset+chunkSize, c.cs.Length)
+	if _, err := w.Write(c.cs.Data[c.offset:end]); err != nil {
+		return false, err
+	}
+	c.offset = end
+	return c.offset >= c.cs.Length, nil
+}
+
+// chunkLane holds the messages of one chunk stream in a batch.
+type chunkLane struct {
+	msgs []*ChunkStream
+	next int
+	cw   chunkWriter
+}
+
+// chunkScheduler splits messages into chunks. Its buffers are reused
+// between calls so that writing a batch does not allocate.
+type chunkScheduler struct {
+	lanes []chunkLane
+}
+
+// writeChunks writes messages split into chunks of chunkSize. Messages on
+// different chunk streams are interleaved chunk by chunk, so that a small
+// audio message is not held back behind a large video frame. Messages on
+// the same chunk stream keep their order.
+func (s *chunkScheduler) writeChunks(w *ReadWriter, chunkSize uint32, headers map[uint32]*chunkHeader, css ...*ChunkStream) error {
+	defer s.reset()
+	for _, cs := range css {
+		cs.CSID = csidForType(cs.TypeID, cs.CSID)
+		cs.Length = uint32(len(cs.Data))
+		i := 0
+		for i < len(s.lanes) && s.lanes[i].msgs[0].CSID != cs.CSID {
+			i++
 		}
-		totalLen += inc
-		end := start + inc
-		if _, err := w.Write(chunkStream.Data[start:end]); err != nil {
-			return err
+		if i == len(s.lanes) {
+			if i < cap(s.lanes) {
+				s.lanes = s.lanes[:i+1]
+			} else {
+				s.lanes = append(s.lanes, chunkLane{})
+			}
 		}
+		s.lanes[i].msgs = append(s.lanes[i].msgs, cs)
 	}
 
+	for remain := len(s.lanes); remain > 0; {
+		for i := range s.lanes {
+			lane := &s.lanes[i]
+			if lane.next == len(lane.msgs) {
+				continue
+			}
+			if lane.cw.cs == nil {
+				lane.cw.cs = lane.msgs[lane.next]
+			}
+			prev, ok := headers[lane.cw.cs.CSID]
+			if !ok {
+				prev = new(chunkHeader)
+				headers[lane.cw.cs.CSID] = prev
+			}
+			done, err := lane.cw.writeNext(w, chunkSize, prev)
+			if err != nil {
+				return err
+			}
+			if !done {
+				continue
+			}
+			lane.cw = chunkWriter{}
+			lane.next++
+			if lane.next == len(lane.msgs) {
+				remain--
+			}
+		}
+	}
 	return nil
 }
 
+// reset drops the references to written messages so that their data can
+// be collected.
+func (s *chunkScheduler) reset() {
+	for i := range s.lanes {
+		clear(s.lanes[i].msgs)
+		s.lanes[i] = chunkLane{msgs: s.lanes[i].msgs[:0]}
+	}
+	s.lanes = s.lanes[:0]
+}
+
 // func (chunkStream *ChunkStream) readChunk(r *ReadWriter, chunkSize uint32, pool *pool.Pool) (err error) {
 // 	if chunkStream.remain != 0 && chunkStream.tmpFromat != 3 {
 // 		return fmt.Errorf("invalid remain = %d", chunkStream.remain)
@@ -0,0 +1,174 @@
+package core
+
+import (
+	"bytes"
+	"net"
+	"testing"
+
+	"github.com/zijiren233/livelib/av"
+)
+
+type bufConn struct {
+	net.Conn
+	buf bytes.Buffer
+}
+
+func (c *bufConn) Read(p []byte) (int, error) {
+	return c.buf.Read(p)
+}
+
+func (c *bufConn) Write(p []byte) (int, error) {
+	return c.buf.Write(p)
+}
+
+func newMsg(typeID, ts uint32, size int) *ChunkStream {
+	data := make([]byte, size)
+	for i := range data {
+		data[i] = byte(i + int(ts))
+	}
+	return &ChunkStream{
+		TypeID:    typeID,
+		StreamID:  1,
+		Timestamp: ts,
+		Length:    uint32(size),
+		Data:      data,
+	}
+}
+
+func TestWriteInterleavedRoundTrip(t *testing.T) {
+	bc := new(bufConn)
+	conn := NewConn(bc, 4096)
+
+	batches := [][]*ChunkStream{
+		{newMsg(av.TAG_VIDEO, 0, 5000), newMsg(av.TAG_AUDIO, 0, 100), newMsg(av.TAG_AUDIO, 23, 100)},
+		{newMsg(av.TAG_AUDIO, 46, 100), newMsg(av.TAG_AUDIO, 69, 100), newMsg(av.TAG_VIDEO, 40, 300)},
+		{newMsg(av.TAG_VIDEO, 80, 300), newMsg(av.TAG_AUDIO, 92, 120)},
+		{newMsg(av.TAG_VIDEO, 0xfffff0, 400), newMsg(av.TAG_VIDEO, 0x1000010, 400)},
+	}
+	var want []*ChunkStream
+	for _, batch := range batches {
+		for _, cs := range batch {
+			want = append(want, &ChunkStream{
+				TypeID:    cs.TypeID,
+				Timestamp: cs.Timestamp,
+				Data:      bytes.Clone(cs.Data),
+			})
+		}
+		if err := conn.WriteInterleaved(batch...); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := conn.Flush(); err != nil {
+		t.Fatal(err)
+	}
+
+	reader := NewConn(bc, 4096)
+	var got []*ChunkStream
+	for range want {
+		cs, err := reader.Read()
+		if err != nil {
+			t.Fatal(err)
+		}
+		got = append(got, &ChunkStream{
+			TypeID:    cs.TypeID,
+			Timestamp: cs.Timestamp,
+			Data:      bytes.Clone(cs.Data),
+		})
+	}
+
+	// the small audio messages of the first batch finish before the video
+	// frame they were queued behind
+	if got[0].TypeID != av.TAG_AUDIO || got[1].TypeID != av.TAG_AUDIO {
+		t.Fatalf("audio not interleaved with video: got types %d, %d", got[0].TypeID, got[1].TypeID)
+	}
+
+	for _, w := range want {
+		found := false
+		for _, g := range got {
+			if g.TypeID == w.TypeID && g.Timestamp == w.Timestamp && bytes.Equal(g.Data, w.Data) {
+				found = true
+				break
+			}
+		}
+		if !found {
+			t.Errorf("message type=%d ts=%d not read back", w.TypeID, w.Timestamp)
+		}
+	}
+}
+
+func TestChunkHeaderCompress(t *testing.T) {
+	var h chunkHeader
+	steps := []struct {
+		cs     *ChunkStream
+		format uint32
+	}{
+		{newMsg(av.TAG_AUDIO, 0, 10), 0},
+		{newMsg(av.TAG_AUDIO, 23, 10), 2},
+		{newMsg(av.TAG_AUDIO, 46, 10), 3},
+		{newMsg(av.TAG_AUDIO, 69, 12), 1},
+		{newMsg(av.TAG_AUDIO, 92, 12), 3},
+		{newMsg(av.TAG_AUDIO, 10, 12), 0},
+	}
+	for i, s := range steps {
+		if format, _ := h.compress(s.cs); format != s.format {
+			t.Errorf("step %d: format=%d, want %d", i, format, s.format)
+		}
+	}
+}
+
+// loopConn replays the same bytes forever and discards what is written.
+type loopConn struct {
+	net.Conn
+	data []byte
+	off  int
+}
+
+func (c *loopConn) Read(p []byte) (int, error) {
+	if c.off == len(c.data) {
+		c.off = 0
+	}
+	n := copy(p, c.data[c.off:])
+	c.off += n
+	return n, nil
+}
+
+func (c *loopConn) Write(p []byte) (int, error) {
+	return len(p), nil
+}
+
+// newLoopConn returns a Conn that reads a stream of typical media messages
+// over and over.
+func newLoopConn(tb testing.TB) *Conn {
+	bc := new(bufConn)
+	w := NewConn(bc, 4096)
+	for i := range 30 {
+		size := 4 * 1024
+		if i == 0 {
+			size = 64 * 1024
+		}
+		msgs := []*ChunkStream{
+			newMsg(av.TAG_VIDEO, uint32(i*33), size),
+			newMsg(av.TAG_AUDIO, uint32(i*33), 300),
+		}
+		if err := w.WriteInterleaved(msgs...); err != nil {
+			tb.Fatal(err)
+		}
+	}
+	if err := w.Flush(); err != nil {
+		tb.Fatal(err)
+	}
+	return NewConn(&loopConn{data: bc.buf.Bytes()}, 4096)
+}
+
+func BenchmarkConnRead(b *testing.B) {
+	conn := newLoopConn(b)
+	b.ReportAllocs()
+	b.ResetTimer()
+	for range b.N {
+		cs, err := conn.Read()
+		if err != nil {
+			b.Fatal(err)
+		}
+		cs.TakeBuffer().Release()
+	}
+}
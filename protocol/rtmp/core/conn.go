@@ -4,6 +4,7 @@ import (
 	"encoding/binary"
 	"fmt"
 	"net"
+	"sync"
 	"sync/atomic"
 	"time"
 
@@ -30,10 +31,16 @@ type Conn struct {
 	ackReceived         uint32
 	rw                  *ReadWriter
 	chunks              map[uint32]*ChunkStream
+	limits              Limits
+	buffered            uint32
+
+	wmu        sync.Mutex
+	outHeaders map[uint32]*chunkHeader
+	scheduler  chunkScheduler
 }
 
-func NewConn(c net.Conn, bufferSize int) *Conn {
-	return &Conn{
+func NewConn(c net.Conn, bufferSize int, conf ...ConnConf) *Conn {
+	conn := &Conn{
 		Conn:                c,
 		chunkSize:           128,
 		remoteChunkSize:     128,
@@ -41,9 +48,18 @@ func NewConn(c net.Conn, bufferSize int) *Conn {
 		remoteWindowAckSize: 2500000,
 		rw:                  NewReadWriter(c, bufferSize),
 		chunks:              make(map[uint32]*ChunkStream),
+		outHeaders:          make(map[uint32]*chunkHeader),
+		limits:              Limits{}.withDefaults(),
+	}
+	for _, c := range conf {
+		c(conn)
 	}
+	return conn
 }
 
+// Read returns the next complete message. Its Data stays valid until the
+// next message arrives on the same chunk stream, unless the buffer is taken
+// over with TakeBuffer.
 func (conn *Conn) Read() (c *ChunkStream, err error) {
 	for {
 		c, err = conn.readNextChunk()
@@ -55,7 +71,9 @@ func (conn *Conn) Read() (c *ChunkStream, err error) {
 		}
 	}
 
-	conn.handleControlMsg(c)
+	if err := conn.handleControlMsg(c); err != nil {
+		return nil, err
+	}
 
 	conn.ack(c.Length)
 
@@ -69,28 +87,31 @@ func (conn *Conn) readNextChunk() (chunkStream *ChunkStream, err error) {
 	}
 	format := h >> 6
 	csid := h & 0x3f
-	chunkStream, ok := conn.chunks[csid]
-	if !ok {
-		chunkStream = &ChunkStream{CSID: csid}
-		conn.chunks[csid] = chunkStream
-	}
-	chunkStream.tmpFromat = format
-	if chunkStream.remain != 0 && chunkStream.tmpFromat != 3 {
-		return nil, fmt.Errorf("invalid remain = %d", chunkStream.remain)
-	}
-	switch chunkStream.CSID {
+	switch csid {
 	case 0:
 		id, err := conn.rw.ReadUintLE(1)
 		if err != nil {
-			return chunkStream, err
+			return nil, err
 		}
-		chunkStream.CSID = id + 64
+		csid = id + 64
 	case 1:
 		id, err := conn.rw.ReadUintLE(2)
 		if err != nil {
-			return chunkStream, err
+			return nil, err
+		}
+		csid = id + 64
+	}
+	chunkStream, ok := conn.chunks[csid]
+	if !ok {
+		if len(conn.chunks) >= conn.limits.MaxChunkStreams {
+			return nil, ErrTooManyChunkStreams
 		}
-		chunkStream.CSID = id + 64
+		chunkStream = &ChunkStream{CSID: csid}
+		conn.chunks[csid] = chunkStream
+	}
+	chunkStream.tmpFromat = format
+	if chunkStream.remain != 0 && chunkStream.tmpFromat != 3 {
+		return nil, fmt.Errorf("invalid remain = %d", chunkStream.remain)
 	}
 
 	switch chunkStream.tmpFromat {
@@ -121,7 +142,9 @@ func (conn *Conn) readNextChunk() (chunkStream *ChunkStream, err error) {
 		} else {
 			chunkStream.exted = false
 		}
-		chunkStream.init()
+		if err := conn.startMessage(chunkStream); err != nil {
+			return chunkStream, err
+		}
 	case 1:
 		chunkStream.Format = chunkStream.tmpFromat
 		timeStamp, err := conn.rw.ReadUintBE(3)
@@ -147,7 +170,9 @@ func (conn *Conn) readNextChunk() (chunkStream *ChunkStream, err error) {
 		}
 		chunkStream.timeDelta = timeStamp
 		chunkStream.Timestamp += timeStamp
-		chunkStream.init()
+		if err := conn.startMessage(chunkStream); err != nil {
+			return chunkStream, err
+		}
 	case 2:
 		chunkStream.Format = chunkStream.tmpFromat
 		timeStamp, err := conn.rw.ReadUintBE(3)
@@ -165,7 +190,9 @@ func (conn *Conn) readNextChunk() (chunkStream *ChunkStream, err error) {
 		}
 		chunkStream.timeDelta = timeStamp
 		chunkStream.Timestamp += timeStamp
-		chunkStream.init()
+		if err := conn.startMessage(chunkStream); err != nil {
+			return chunkStream, err
+		}
 	case 3:
 		if chunkStream.remain == 0 {
 			switch chunkStream.Format {
@@ -189,7 +216,9 @@ func (conn *Conn) readNextChunk() (chunkStream *ChunkStream, err error) {
 				}
 				chunkStream.Timestamp += timedet
 			}
-			chunkStream.init()
+			if err := conn.startMessage(chunkStream); err != nil {
+				return chunkStream, err
+			}
 		} else {
 			if chunkStream.exted {
 				b, err := conn.rw.Peek(4)
@@ -219,20 +248,40 @@ func (conn *Conn) readNextChunk() (chunkStream *ChunkStream, err error) {
 	}
 	if chunkStream.remain == 0 {
 		chunkStream.got = true
+		conn.buffered -= chunkStream.Length
 	}
 
 	return chunkStream, err
 }
 
 func (conn *Conn) Write(c *ChunkStream) error {
-	if c.TypeID == idSetChunkSize {
-		atomic.StoreUint32(&conn.chunkSize, binary.BigEndian.Uint32(c.Data))
-	}
+	return conn.WriteInterleaved(c)
+}
+
+// WriteInterleaved writes several messages at once, interleaving the chunks
+// of messages that belong to different chunk streams.
+func (conn *Conn) WriteInterleaved(cs ...*ChunkStream) error {
+	conn.wmu.Lock()
+	defer conn.wmu.Unlock()
+	return conn.writeInterleaved(cs...)
+}
 
-	return c.writeChunk(conn.rw, atomic.LoadUint32(&conn.chunkSize))
+func (conn *Conn) writeInterleaved(cs ...*ChunkStream) error {
+	if err := conn.scheduler.writeChunks(conn.rw, atomic.LoadUint32(&conn.chunkSize), conn.outHeaders, cs...); err != nil {
+		return err
+	}
+	// the new chunk size applies to the chunks that follow the message
+	for _, c := range cs {
+		if c.TypeID == idSetChunkSize && len(c.Data) >= 4 {
+			atomic.StoreUint32(&conn.chunkSize, binary.BigEndian.Uint32(c.Data))
+		}
+	}
+	return nil
 }
 
 func (conn *Conn) Flush() error {
+	conn.wmu.Lock()
+	defer conn.wmu.Unlock()
 	return conn.rw.Flush()
 }
 
@@ -270,13 +319,28 @@ func (conn *Conn) NewSetPeerBandwidth(size uint32) *ChunkStream {
 	return ret
 }
 
-func (conn *Conn) handleControlMsg(c *ChunkStream) {
+func (conn *Conn) handleControlMsg(c *ChunkStream) error {
+	switch c.TypeID {
+	case idSetChunkSize, idWindowAckSize:
+		if len(c.Data) < 4 {
+			return ErrShortControlMessage
+		}
+	default:
+		return nil
+	}
+	v := binary.BigEndian.Uint32(c.Data)
 	switch c.TypeID {
 	case idSetChunkSize:
-		atomic.StoreUint32(&conn.remoteChunkSize, binary.BigEndian.Uint32(c.Data))
+		// the most significant bit must be zero
+		v &= 0x7fffffff
+		if v == 0 || v > conn.limits.MaxChunkSize {
+			return fmt.Errorf("%w: %d", ErrInvalidChunkSize, v)
+		}
+		atomic.StoreUint32(&conn.remoteChunkSize, v)
 	case idWindowAckSize:
-		atomic.StoreUint32(&conn.remoteWindowAckSize, binary.BigEndian.Uint32(c.Data))
+		atomic.StoreUint32(&conn.remoteWindowAckSize, v)
 	}
+	return nil
 }
 
 func (conn *Conn) ack(size uint32) {
@@ -288,8 +352,9 @@ func (conn *Conn) ack(size uint32) {
 	if ackReceived := atomic.LoadUint32(&conn.ackReceived); ackReceived >= atomic.LoadUint32(
 		&conn.remoteWindowAckSize,
 	) {
-		cs := conn.NewAck(ackReceived)
-		cs.writeChunk(conn.rw, atomic.LoadUint32(&conn.chunkSize))
+		conn.wmu.Lock()
+		conn.writeInterleaved(conn.NewAck(ackReceived))
+		conn.wmu.Unlock()
 		atomic.CompareAndSwapUint32(&conn.ackReceived, ackReceived, 0)
 	}
 }
@@ -297,7 +362,7 @@ func (conn *Conn) ack(size uint32) {
 func initControlMsg(id, size, value uint32) *ChunkStream {
 	ret := &ChunkStream{
 		Format:   0,
-		CSID:     2,
+		CSID:     csidControl,
 		TypeID:   id,
 		StreamID: 0,
 		Length:   size,
@@ -328,7 +393,7 @@ func (conn *Conn) userControlMsg(eventType, buflen uint32) ChunkStream {
 	buflen += 2
 	ret = ChunkStream{
 		Format:   0,
-		CSID:     2,
+		CSID:     csidControl,
 		TypeID:   4,
 		StreamID: 1,
 		Length:   buflen,
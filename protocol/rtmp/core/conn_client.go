@@ -20,6 +20,11 @@ const (
 	onStatus       = "onStatus"
 	publishStart   = "NetStream.Publish.Start"
 	connectSuccess = "NetConnection.Connect.Success"
+	respError      = "_error"
+
+	// maxConnectAttempts covers the unauthenticated connect, the one asking
+	// for a challenge and the one answering it.
+	maxConnectAttempts = 3
 )
 
 var ErrFail = errors.New("response err")
@@ -27,6 +32,7 @@ var ErrFail = errors.New("response err")
 type ConnClient struct {
 	transID    int
 	url        string
+	tcURL      string
 	app        string
 	title      string
 	curcmdName string
@@ -36,15 +42,38 @@ type ConnClient struct {
 	encoder    *amf.Encoder
 	decoder    *amf.Decoder
 	bytesw     *bytes.Buffer
+	chunkSize  uint32
+	limits     Limits
+}
+
+type ConnClientConf func(*ConnClient)
+
+// WithClientLimits bounds the resources the server can make the client use.
+func WithClientLimits(l Limits) ConnClientConf {
+	return func(cc *ConnClient) {
+		cc.limits = l
+	}
 }
 
-func NewConnClient() *ConnClient {
-	return &ConnClient{
+// WithClientChunkSize makes the client announce and use a chunk size other
+// than the protocol default of 128 bytes once connected.
+func WithClientChunkSize(size uint32) ConnClientConf {
+	return func(cc *ConnClient) {
+		cc.chunkSize = size
+	}
+}
+
+func NewConnClient(conf ...ConnClientConf) *ConnClient {
+	cc := &ConnClient{
 		transID: 1,
 		bytesw:  bytes.NewBuffer(nil),
 		encoder: new(amf.Encoder),
 		decoder: new(amf.Decoder),
 	}
+	for _, c := range conf {
+		c(cc)
+	}
+	return cc
 }
 
 func (connClient *ConnClient) DecodeBatch(r io.Reader, ver amf.Version) (ret []any, err error) {
@@ -55,7 +84,7 @@ func (connClient *ConnClient) DecodeBatch(r io.Reader, ver amf.Version) (ret []a
 func (connClient *ConnClient) readRespMsg() error {
 	for {
 		rc, err := connClient.conn.Read()
-		if err != nil && !errors.Is(err, io.EOF) {
+		if err != nil {
 			return err
 		}
 		switch rc.TypeID {
@@ -68,6 +97,9 @@ func (connClient *ConnClient) readRespMsg() error {
 				case string:
 					switch connClient.curcmdName {
 					case cmdConnect, cmdCreateStream:
+						if v == respError {
+							return statusError(vs)
+						}
 						if v != respResult {
 							return errors.New(v)
 						}
@@ -98,14 +130,16 @@ func (connClient *ConnClient) readRespMsg() error {
 				case amf.Object:
 					switch connClient.curcmdName {
 					case cmdConnect:
-						code, ok := v["code"]
-						if ok && code.(string) != connectSuccess {
+						if code, ok := v["code"]; ok && code != connectSuccess {
 							return ErrFail
 						}
 					case cmdPublish:
-						code, ok := v["code"]
-						if ok && code.(string) != publishStart {
-							return ErrFail
+						if code, ok := v["code"]; ok && code != publishStart {
+							return statusError(vs)
+						}
+					case cmdPlay:
+						if v["level"] == "error" {
+							return statusError(vs)
 						}
 					}
 				}
@@ -116,6 +150,19 @@ func (connClient *ConnClient) readRespMsg() error {
 	}
 }
 
+// statusError returns the status carried by the info object of an error
+// response.
+func statusError(vs []any) error {
+	for _, v := range vs {
+		if obj, ok := v.(amf.Object); ok {
+			code, _ := obj["code"].(string)
+			description, _ := obj["description"].(string)
+			return &StatusError{Code: code, Description: description}
+		}
+	}
+	return errors.New(respError)
+}
+
 func (connClient *ConnClient) writeMsg(args ...any) error {
 	connClient.bytesw.Reset()
 	for _, v := range args {
@@ -126,7 +173,7 @@ func (connClient *ConnClient) writeMsg(args ...any) error {
 	msg := connClient.bytesw.Bytes()
 	c := &ChunkStream{
 		Format:    0,
-		CSID:      3,
+		CSID:      csidCommand,
 		Timestamp: 0,
 		TypeID:    20,
 		StreamID:  connClient.streamid,
@@ -140,12 +187,12 @@ func (connClient *ConnClient) writeMsg(args ...any) error {
 	return connClient.conn.Flush()
 }
 
-func (connClient *ConnClient) writeConnectMsg() error {
+func (connClient *ConnClient) writeConnectMsg(authQuery string) error {
 	event := make(amf.Object)
-	event["app"] = connClient.app
+	event["app"] = connClient.app + authQuery
 	event["type"] = "nonprivate"
 	event["flashVer"] = "FMS.3.1"
-	event["tcUrl"] = connClient.url
+	event["tcUrl"] = connClient.tcURL + authQuery
 	connClient.curcmdName = cmdConnect
 
 	if err := connClient.writeMsg(cmdConnect, connClient.transID, event); err != nil {
@@ -192,12 +239,14 @@ func (connClient *ConnClient) writePlayMsg() error {
 	return connClient.readRespMsg()
 }
 
+// Start connects to rtmpURL and publishes or plays the stream in it. If
+// the URL carries user info, it is used to answer the adobe or llnw
+// authentication challenge of the server.
 func (connClient *ConnClient) Start(rtmpURL, method string) error {
 	u, err := neturl.Parse(rtmpURL)
 	if err != nil {
 		return err
 	}
-	connClient.url = rtmpURL
 	path := strings.TrimLeft(u.Path, "/")
 	ps := strings.SplitN(path, "/", 2)
 	if len(ps) != 2 {
@@ -213,7 +262,55 @@ func (connClient *ConnClient) Start(rtmpURL, method string) error {
 	}
 	connClient.isRTMPS = strings.EqualFold(u.Scheme, "rtmps")
 
-	var conn net.Conn
+	var user, password string
+	if u.User != nil {
+		user = u.User.Username()
+		password, _ = u.User.Password()
+		u.User = nil
+	}
+	connClient.url = u.String()
+	connClient.tcURL = u.Scheme + "://" + u.Host + "/" + connClient.app
+
+	var authQuery string
+	for attempt := 1; ; attempt++ {
+		err := connClient.connect(u.Host, authQuery)
+		if err == nil {
+			break
+		}
+		var status *StatusError
+		if user == "" || attempt == maxConnectAttempts ||
+			!errors.As(err, &status) || status.Code != CodeConnectRejected {
+			return err
+		}
+		connClient.conn.Close()
+		if authQuery, err = newAuthQuery(connClient.app, user, password, status.Description); err != nil {
+			return err
+		}
+	}
+
+	if err := connClient.writeCreateStreamMsg(); err != nil {
+		return err
+	}
+
+	switch method {
+	case av.PUBLISH:
+		if err := connClient.writePublishMsg(); err != nil {
+			return err
+		}
+	case av.PLAY:
+		if err := connClient.writePlayMsg(); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+func (connClient *ConnClient) connect(host, authQuery string) error {
+	var (
+		conn net.Conn
+		err  error
+	)
 	if connClient.isRTMPS {
 		var config tls.Config
 		enable_tls_verify := false
@@ -227,45 +324,36 @@ func (connClient *ConnClient) Start(rtmpURL, method string) error {
 			config.InsecureSkipVerify = true
 		}
 
-		conn, err = tls.Dial("tcp", u.Host, &config)
+		conn, err = tls.Dial("tcp", host, &config)
 		if err != nil {
 			return err
 		}
 	} else {
-		conn, err = net.Dial("tcp", u.Host)
+		conn, err = net.Dial("tcp", host)
 		if err != nil {
 			return err
 		}
 	}
 
-	connClient.conn = NewConn(conn, 4*1024)
+	connClient.conn = NewConn(conn, 4*1024, WithLimits(connClient.limits))
+	connClient.decoder = connClient.conn.limits.newDecoder()
 
 	if err := connClient.conn.HandshakeClient(); err != nil {
+		conn.Close()
 		return err
 	}
 
-	if err := connClient.writeConnectMsg(); err != nil {
-		return err
-	}
-	if err := connClient.writeCreateStreamMsg(); err != nil {
-		return err
-	}
-
-	switch method {
-	case av.PUBLISH:
-		if err := connClient.writePublishMsg(); err != nil {
-			return err
-		}
-	case av.PLAY:
-		if err := connClient.writePlayMsg(); err != nil {
+	if connClient.chunkSize != 0 {
+		if err := connClient.conn.Write(connClient.conn.NewSetChunkSize(connClient.chunkSize)); err != nil {
+			conn.Close()
 			return err
 		}
 	}
 
-	return nil
+	return connClient.writeConnectMsg(authQuery)
 }
 
-func (connClient *ConnClient) Write(c *ChunkStream) error {
+func (connClient *ConnClient) reform(c *ChunkStream) error {
 	if c.TypeID == av.TAG_SCRIPTDATAAMF0 ||
 		c.TypeID == av.TAG_SCRIPTDATAAMF3 {
 		var err error
@@ -274,9 +362,25 @@ func (connClient *ConnClient) Write(c *ChunkStream) error {
 		}
 		c.Length = uint32(len(c.Data))
 	}
+	return nil
+}
+
+func (connClient *ConnClient) Write(c *ChunkStream) error {
+	if err := connClient.reform(c); err != nil {
+		return err
+	}
 	return connClient.conn.Write(c)
 }
 
+func (connClient *ConnClient) WriteInterleaved(cs ...*ChunkStream) error {
+	for _, c := range cs {
+		if err := connClient.reform(c); err != nil {
+			return err
+		}
+	}
+	return connClient.conn.WriteInterleaved(cs...)
+}
+
 func (connClient *ConnClient) Flush() error {
 	return connClient.conn.Flush()
 }
@@ -3,7 +3,9 @@ package core
 import (
 	"bytes"
 	"errors"
+	"fmt"
 	"io"
+	"net"
 
 	"github.com/zijiren233/livelib/av"
 	"github.com/zijiren233/livelib/protocol/amf"
@@ -11,6 +13,8 @@ import (
 
 const (
 	publishLive = "live"
+
+	defaultServerChunkSize uint32 = 1024
 )
 
 var ErrReq = errors.New("req error")
@@ -57,26 +61,84 @@ type PublishInfo struct {
 }
 
 type ConnServer struct {
-	done          bool
+	done bool
+	// connected is set once connect was answered, after which errors are
+	// reported as stream status.
+	connected     bool
 	streamID      int
 	isPublisher   bool
 	conn          *Conn
 	transactionID int
 	ConnInfo      ConnectInfo
-	PublishInfo   PublishInfo
-	decoder       *amf.Decoder
-	encoder       *amf.Encoder
-	bytesw        *bytes.Buffer
+	// ConnArgs holds the optional arguments sent after the command object
+	// of connect.
+	ConnArgs    []any
+	PublishInfo PublishInfo
+	decoder     *amf.Decoder
+	encoder     *amf.Encoder
+	bytesw      *bytes.Buffer
+	chunkSize   uint32
+	auth        *ConnectAuth
+	authorize   func(*ConnServer) error
+	connCheck   func(*ConnServer) error
+	// User is the name the peer authenticated as, if connect authentication
+	// is enabled.
+	User string
+}
+
+type ConnServerConf func(*ConnServer)
+
+// WithServerChunkSize sets the chunk size announced to the peer and used
+// for every message sent after connect.
+func WithServerChunkSize(size uint32) ConnServerConf {
+	return func(cs *ConnServer) {
+		cs.chunkSize = size
+	}
+}
+
+// WithConnectAuth requires the peer to authenticate with one of the schemes
+// accepted by auth before connect succeeds.
+func WithConnectAuth(auth *ConnectAuth) ConnServerConf {
+	return func(cs *ConnServer) {
+		cs.auth = auth
+	}
+}
+
+// WithAuthorize sets a check that runs when the peer asks to publish or
+// play, before the server answers. If it returns an error, the request is
+// rejected with the code and description of a *StatusError, or with
+// CodePublishBadName or CodePlayStreamNotFound otherwise.
+func WithAuthorize(f func(*ConnServer) error) ConnServerConf {
+	return func(cs *ConnServer) {
+		cs.authorize = f
+	}
 }
 
-func NewConnServer(conn *Conn) *ConnServer {
-	return &ConnServer{
-		conn:     conn,
-		streamID: 1,
-		bytesw:   bytes.NewBuffer(nil),
-		decoder:  &amf.Decoder{},
-		encoder:  &amf.Encoder{},
+// WithConnectCheck sets a check that runs when the peer connects, after
+// connect authentication. If it returns an error, the connection is
+// rejected with its description, or the description of a *StatusError.
+func WithConnectCheck(f func(*ConnServer) error) ConnServerConf {
+	return func(cs *ConnServer) {
+		cs.connCheck = f
+	}
+}
+
+func NewConnServer(conn *Conn, conf ...ConnServerConf) *ConnServer {
+	cs := &ConnServer{
+		conn:      conn,
+		streamID:  1,
+		bytesw:    bytes.NewBuffer(nil),
+		decoder:   conn.limits.newDecoder(),
+		encoder:   &amf.Encoder{},
+		chunkSize: defaultServerChunkSize,
+	}
+	for _, c := range conf {
+		c(cs)
 	}
+	if cs.chunkSize == 0 {
+		cs.chunkSize = defaultServerChunkSize
+	}
+	return cs
 }
 
 func (connServer *ConnServer) writeMsg(csid, streamID uint32, args ...any) error {
@@ -101,7 +163,7 @@ func (connServer *ConnServer) writeMsg(csid, streamID uint32, args ...any) error
 }
 
 func (connServer *ConnServer) connect(vs []any) error {
-	for _, v := range vs {
+	for k, v := range vs {
 		switch v := v.(type) {
 		case string:
 		case float64:
@@ -111,29 +173,56 @@ func (connServer *ConnServer) connect(vs []any) error {
 			}
 			connServer.transactionID = id
 		case amf.Object:
-			if app, ok := v["app"]; ok {
-				connServer.ConnInfo.App = app.(string)
+			var err error
+			if connServer.ConnInfo.App, err = stringField(v, "app"); err != nil {
+				return err
+			}
+			if connServer.ConnInfo.Flashver, err = stringField(v, "flashVer"); err != nil {
+				return err
 			}
-			if flashVer, ok := v["flashVer"]; ok {
-				connServer.ConnInfo.Flashver = flashVer.(string)
+			if connServer.ConnInfo.SwfUrl, err = stringField(v, "swfUrl"); err != nil {
+				return err
 			}
-			if tcurl, ok := v["tcUrl"]; ok {
-				connServer.ConnInfo.TcUrl = tcurl.(string)
+			if connServer.ConnInfo.TcUrl, err = stringField(v, "tcUrl"); err != nil {
+				return err
+			}
+			if connServer.ConnInfo.PageUrl, err = stringField(v, "pageUrl"); err != nil {
+				return err
 			}
 			if encoding, ok := v["objectEncoding"]; ok {
-				connServer.ConnInfo.ObjectEncoding = int(encoding.(float64))
+				f, ok := encoding.(float64)
+				if !ok {
+					return fmt.Errorf("%w: objectEncoding is %T", ErrReq, encoding)
+				}
+				connServer.ConnInfo.ObjectEncoding = int(f)
 			}
+			connServer.ConnArgs = vs[k+1:]
+			return nil
 		}
 	}
 	return nil
 }
 
+// stringField returns the string value of key in obj, or an empty string
+// if the key is missing.
+func stringField(obj amf.Object, key string) (string, error) {
+	v, ok := obj[key]
+	if !ok || v == nil {
+		return "", nil
+	}
+	s, ok := v.(string)
+	if !ok {
+		return "", fmt.Errorf("%w: %s is %T", ErrReq, key, v)
+	}
+	return s, nil
+}
+
 func (connServer *ConnServer) connectResp(CSID, StreamID uint32) error {
 	c := connServer.conn.NewWindowAckSize(2500000)
 	connServer.conn.Write(c)
 	c = connServer.conn.NewSetPeerBandwidth(2500000)
 	connServer.conn.Write(c)
-	c = connServer.conn.NewSetChunkSize(uint32(1024))
+	c = connServer.conn.NewSetChunkSize(connServer.chunkSize)
 	connServer.conn.Write(c)
 
 	resp := make(amf.Object)
@@ -145,7 +234,69 @@ func (connServer *ConnServer) connectResp(CSID, StreamID uint32) error {
 	event["code"] = "NetConnection.Connect.Success"
 	event["description"] = "Connection succeeded."
 	event["objectEncoding"] = connServer.ConnInfo.ObjectEncoding
-	return connServer.writeMsg(CSID, StreamID, "_result", connServer.transactionID, resp, event)
+	if err := connServer.writeMsg(CSID, StreamID, "_result", connServer.transactionID, resp, event); err != nil {
+		return err
+	}
+	connServer.connected = true
+	return nil
+}
+
+// authenticate checks the credentials sent in the query string of the app
+// name and rejects the connection if they are missing or wrong.
+func (connServer *ConnServer) authenticate(CSID, StreamID uint32) error {
+	app, params := splitAuthQuery(connServer.ConnInfo.App)
+	user, reject := connServer.auth.verify(app, params)
+	if reject != "" {
+		return connServer.rejectConnect(CSID, StreamID, reject)
+	}
+	connServer.ConnInfo.App = app
+	connServer.ConnInfo.TcUrl, _ = splitAuthQuery(connServer.ConnInfo.TcUrl)
+	connServer.User = user
+	return nil
+}
+
+func (connServer *ConnServer) rejectConnect(CSID, StreamID uint32, description string) error {
+	status := &StatusError{Code: CodeConnectRejected, Description: description}
+	if err := connServer.writeStatus(CSID, StreamID, status); err != nil {
+		return err
+	}
+	return status
+}
+
+// check runs the authorize function and sends its rejection, using code if
+// it did not return a *StatusError of the stream.
+func (connServer *ConnServer) check(CSID, StreamID uint32, code string) error {
+	if connServer.authorize == nil {
+		return nil
+	}
+	err := connServer.authorize(connServer)
+	if err == nil {
+		return nil
+	}
+	var status *StatusError
+	if !errors.As(err, &status) {
+		status = &StatusError{Code: code, Description: err.Error()}
+	} else if status.Code == CodeConnectRejected {
+		// the connection was accepted already, reject the stream
+		status = &StatusError{Code: code, Description: status.Description}
+	}
+	if werr := connServer.writeStatus(CSID, StreamID, status); werr != nil {
+		return werr
+	}
+	return err
+}
+
+// writeStatus sends an error status. While connect is pending it is the
+// error response to connect, afterwards a stream status.
+func (connServer *ConnServer) writeStatus(CSID, StreamID uint32, status *StatusError) error {
+	event := make(amf.Object)
+	event["level"] = "error"
+	event["code"] = status.Code
+	event["description"] = status.Description
+	if !connServer.connected {
+		return connServer.writeMsg(CSID, StreamID, respError, connServer.transactionID, nil, event)
+	}
+	return connServer.writeMsg(CSID, StreamID, onStatus, 0, nil, event)
 }
 
 func (connServer *ConnServer) createStream(vs []any) error {
@@ -235,6 +386,9 @@ func (connServer *ConnServer) playResp(CSID, StreamID uint32) error {
 
 func (connServer *ConnServer) handleCmdMsg(c *ChunkStream) error {
 	if c.TypeID == 17 {
+		if len(c.Data) == 0 {
+			return ErrReq
+		}
 		c.Data = c.Data[1:]
 	}
 	r := bytes.NewReader(c.Data)
@@ -242,6 +396,9 @@ func (connServer *ConnServer) handleCmdMsg(c *ChunkStream) error {
 	if err != nil && !errors.Is(err, io.EOF) {
 		return err
 	}
+	if len(vi) == 0 {
+		return ErrReq
+	}
 
 	switch v := vi[0].(type) {
 	case string:
@@ -250,6 +407,21 @@ func (connServer *ConnServer) handleCmdMsg(c *ChunkStream) error {
 			if err = connServer.connect(vi[1:]); err != nil {
 				return err
 			}
+			if connServer.auth != nil {
+				if err = connServer.authenticate(c.CSID, c.StreamID); err != nil {
+					return err
+				}
+			}
+			if connServer.connCheck != nil {
+				if err = connServer.connCheck(connServer); err != nil {
+					description := err.Error()
+					var status *StatusError
+					if errors.As(err, &status) {
+						description = status.Description
+					}
+					return connServer.rejectConnect(c.CSID, c.StreamID, description)
+				}
+			}
 			if err = connServer.connectResp(c.CSID, c.StreamID); err != nil {
 				return err
 			}
@@ -264,20 +436,26 @@ func (connServer *ConnServer) handleCmdMsg(c *ChunkStream) error {
 			if err = connServer.publishOrPlay(vi[1:]); err != nil {
 				return err
 			}
+			connServer.isPublisher = true
+			if err = connServer.check(c.CSID, c.StreamID, CodePublishBadName); err != nil {
+				return err
+			}
 			if err = connServer.publishResp(c.CSID, c.StreamID); err != nil {
 				return err
 			}
 			connServer.done = true
-			connServer.isPublisher = true
 		case cmdPlay:
 			if err = connServer.publishOrPlay(vi[1:]); err != nil {
 				return err
 			}
+			connServer.isPublisher = false
+			if err = connServer.check(c.CSID, c.StreamID, CodePlayStreamNotFound); err != nil {
+				return err
+			}
 			if err = connServer.playResp(c.CSID, c.StreamID); err != nil {
 				return err
 			}
 			connServer.done = true
-			connServer.isPublisher = false
 		case cmdFcpublish:
 			// connServer.fcPublish(vi)
 		case cmdReleaseStream:
@@ -314,7 +492,7 @@ func (connServer *ConnServer) IsPublisher() bool {
 	return connServer.isPublisher
 }
 
-func (connServer *ConnServer) Write(c *ChunkStream) error {
+func (connServer *ConnServer) reform(c *ChunkStream) error {
 	if c.TypeID == av.TAG_SCRIPTDATAAMF0 ||
 		c.TypeID == av.TAG_SCRIPTDATAAMF3 {
 		var err error
@@ -323,9 +501,25 @@ func (connServer *ConnServer) Write(c *ChunkStream) error {
 		}
 		c.Length = uint32(len(c.Data))
 	}
+	return nil
+}
+
+func (connServer *ConnServer) Write(c *ChunkStream) error {
+	if err := connServer.reform(c); err != nil {
+		return err
+	}
 	return connServer.conn.Write(c)
 }
 
+func (connServer *ConnServer) WriteInterleaved(cs ...*ChunkStream) error {
+	for _, c := range cs {
+		if err := connServer.reform(c); err != nil {
+			return err
+		}
+	}
+	return connServer.conn.WriteInterleaved(cs...)
+}
+
 func (connServer *ConnServer) Flush() error {
 	return connServer.conn.Flush()
 }
@@ -340,6 +534,10 @@ func (connServer *ConnServer) GetInfo() (app, name string) {
 	return
 }
 
+func (connServer *ConnServer) RemoteAddr() net.Addr {
+	return connServer.conn.RemoteAddr()
+}
+
 func (connServer *ConnServer) Close() error {
 	return connServer.conn.Close()
 }
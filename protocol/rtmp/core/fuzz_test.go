@@ -0,0 +1,94 @@
+package core
+
+import (
+	"bytes"
+	"net"
+	"testing"
+
+	"github.com/zijiren233/livelib/av"
+	"github.com/zijiren233/livelib/protocol/amf"
+)
+
+// fuzzConn reads from a fixed input and discards what is written.
+type fuzzConn struct {
+	net.Conn
+	r *bytes.Reader
+}
+
+func (c *fuzzConn) Read(p []byte) (int, error) {
+	return c.r.Read(p)
+}
+
+func (c *fuzzConn) Write(p []byte) (int, error) {
+	return len(p), nil
+}
+
+func (c *fuzzConn) Close() error {
+	return nil
+}
+
+var fuzzLimits = Limits{
+	MaxMessageSize:     1 << 16,
+	MaxBufferedSize:    1 << 18,
+	MaxAMFStringLength: 1 << 12,
+}
+
+func encodeCmd(tb testing.TB, csid, streamID uint32, args ...any) *ChunkStream {
+	buf := new(bytes.Buffer)
+	if _, err := new(amf.Encoder).EncodeBatch(buf, amf.AMF0, args...); err != nil {
+		tb.Fatal(err)
+	}
+	return &ChunkStream{CSID: csid, TypeID: 20, StreamID: streamID, Data: buf.Bytes()}
+}
+
+func writeSeed(tb testing.TB, css ...*ChunkStream) []byte {
+	bc := new(bufConn)
+	w := NewConn(bc, 4096)
+	if err := w.WriteInterleaved(css...); err != nil {
+		tb.Fatal(err)
+	}
+	if err := w.Flush(); err != nil {
+		tb.Fatal(err)
+	}
+	return bc.buf.Bytes()
+}
+
+func publishSeed(tb testing.TB) []byte {
+	return writeSeed(tb,
+		initControlMsg(idSetChunkSize, 4, 4096),
+		encodeCmd(tb, csidCommand, 0, cmdConnect, 1, amf.Object{
+			"app":      "live",
+			"flashVer": "FMLE/3.0",
+			"tcUrl":    "rtmp://127.0.0.1/live",
+		}),
+		encodeCmd(tb, csidCommand, 0, cmdCreateStream, 2, nil),
+		encodeCmd(tb, csidCommand, 1, cmdPublish, 3, nil, "stream", publishLive),
+		newMsg(av.TAG_VIDEO, 0, 3000),
+		newMsg(av.TAG_AUDIO, 0, 200),
+	)
+}
+
+func FuzzConnRead(f *testing.F) {
+	f.Add(publishSeed(f))
+	f.Add(writeSeed(f, newMsg(av.TAG_VIDEO, 0xfffff0, 500), newMsg(av.TAG_VIDEO, 0x1000010, 500)))
+	f.Fuzz(func(t *testing.T, data []byte) {
+		conn := NewConn(&fuzzConn{r: bytes.NewReader(data)}, 1024, WithLimits(fuzzLimits))
+		for {
+			cs, err := conn.Read()
+			if err != nil {
+				return
+			}
+			if cs.Length > fuzzLimits.MaxMessageSize {
+				t.Fatalf("message of %d bytes exceeds the limit", cs.Length)
+			}
+		}
+	})
+}
+
+func FuzzConnServerReadInitMsg(f *testing.F) {
+	f.Add(publishSeed(f))
+	f.Fuzz(func(t *testing.T, data []byte) {
+		conn := NewConn(&fuzzConn{r: bytes.NewReader(data)}, 1024, WithLimits(fuzzLimits))
+		_ = NewConnServer(conn).ReadInitMsg()
+	})
+}
@@ -0,0 +1,92 @@
+package core
+
+import (
+	"errors"
+	"fmt"
+
+	"github.com/zijiren233/livelib/protocol/amf"
+)
+
+const (
+	DefaultMaxMessageSize  uint32 = 8 << 20
+	DefaultMaxBufferedSize uint32 = 16 << 20
+	DefaultMaxChunkSize    uint32 = 16 << 20
+	DefaultMaxChunkStreams        = 16
+)
+
+var (
+	ErrMessageTooLarge     = errors.New("message too large")
+	ErrBufferLimit         = errors.New("too much message data buffered")
+	ErrInvalidChunkSize    = errors.New("invalid chunk size")
+	ErrTooManyChunkStreams = errors.New("too many chunk streams")
+	ErrShortControlMessage = errors.New("control message too short")
+)
+
+// Limits bounds the resources a peer can make a Conn use. Zero fields fall
+// back to the defaults.
+type Limits struct {
+	// MaxMessageSize is the largest message accepted from the peer.
+	MaxMessageSize uint32
+	// MaxBufferedSize caps the total size of the messages that are being
+	// received at the same time on different chunk streams.
+	MaxBufferedSize uint32
+	// MaxChunkSize is the largest chunk size the peer may announce.
+	MaxChunkSize uint32
+	// MaxChunkStreams is the number of chunk streams the peer may use.
+	MaxChunkStreams int
+	// MaxAMFDepth and MaxAMFStringLength bound the command messages, see
+	// amf.Decoder.
+	MaxAMFDepth        int
+	MaxAMFStringLength int
+}
+
+func (l Limits) withDefaults() Limits {
+	if l.MaxMessageSize == 0 {
+		l.MaxMessageSize = DefaultMaxMessageSize
+	}
+	if l.MaxBufferedSize == 0 {
+		l.MaxBufferedSize = DefaultMaxBufferedSize
+	}
+	if l.MaxChunkSize == 0 {
+		l.MaxChunkSize = DefaultMaxChunkSize
+	}
+	if l.MaxChunkStreams == 0 {
+		l.MaxChunkStreams = DefaultMaxChunkStreams
+	}
+	if l.MaxAMFDepth == 0 {
+		l.MaxAMFDepth = amf.DefaultMaxDepth
+	}
+	if l.MaxAMFStringLength == 0 {
+		l.MaxAMFStringLength = amf.DefaultMaxStringLength
+	}
+	return l
+}
+
+func (l Limits) newDecoder() *amf.Decoder {
+	d := amf.NewDecoder()
+	d.SetMaxDepth(l.MaxAMFDepth)
+	d.SetMaxStringLength(l.MaxAMFStringLength)
+	return d
+}
+
+type ConnConf func(*Conn)
+
+func WithLimits(l Limits) ConnConf {
+	return func(c *Conn) {
+		c.limits = l.withDefaults()
+	}
+}
+
+// startMessage prepares chunkStream for a new message after checking it
+// against the limits.
+func (conn *Conn) startMessage(chunkStream *ChunkStream) error {
+	if chunkStream.Length > conn.limits.MaxMessageSize {
+		return fmt.Errorf("%w: %d > %d", ErrMessageTooLarge, chunkStream.Length, conn.limits.MaxMessageSize)
+	}
+	if conn.buffered+chunkStream.Length > conn.limits.MaxBufferedSize {
+		return ErrBufferLimit
+	}
+	conn.buffered += chunkStream.Length
+	chunkStream.init()
+	return nil
+}
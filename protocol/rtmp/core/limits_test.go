@@ -0,0 +1,43 @@
+package core
+
+import (
+	"bytes"
+	"errors"
+	"testing"
+
+	"github.com/zijiren233/livelib/av"
+)
+
+func TestConnLimits(t *testing.T) {
+	tests := []struct {
+		name string
+		data []byte
+		want error
+	}{
+		{"message size", writeSeed(t, newMsg(av.TAG_VIDEO, 0, 1<<17)), ErrMessageTooLarge},
+		{"chunk size", writeSeed(t, initControlMsg(idSetChunkSize, 4, 0)), ErrInvalidChunkSize},
+		{"short control", writeSeed(t, &ChunkStream{CSID: csidControl, TypeID: idSetChunkSize, Data: []byte{1}}), ErrShortControlMessage},
+		{"chunk streams", func() []byte {
+			var css []*ChunkStream
+			for i := range DefaultMaxChunkStreams + 1 {
+				cs := newMsg(av.TAG_VIDEO, 0, 10)
+				cs.TypeID = 20
+				cs.CSID = uint32(10 + i)
+				css = append(css, cs)
+			}
+			return writeSeed(t, css...)
+		}(), ErrTooManyChunkStreams},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			conn := NewConn(&fuzzConn{r: bytes.NewReader(tt.data)}, 1024, WithLimits(fuzzLimits))
+			var err error
+			for err == nil {
+				_, err = conn.Read()
+			}
+			if !errors.Is(err, tt.want) {
+				t.Errorf("got %v, want %v", err, tt.want)
+			}
+		})
+	}
+}
@@ -1,6 +1,7 @@
 package rtmp
 
 import (
+	"io"
 	"sync/atomic"
 	"time"
 
@@ -72,7 +73,7 @@ func (v *Reader) Read() (p *av.Packet, err error) {
 	p.IsVideo = cs.TypeID == av.TAG_VIDEO
 	p.IsMetadata = cs.TypeID == av.TAG_SCRIPTDATAAMF0 || cs.TypeID == av.TAG_SCRIPTDATAAMF3
 	p.StreamID = cs.StreamID
-	p.Data = cs.Data
+	p.SetBuffer(cs.TakeBuffer())
 	p.TimeStamp = cs.Timestamp
 
 	v.SaveStatics(p.StreamID, uint64(len(p.Data)), p.IsVideo)
@@ -83,8 +84,12 @@ func (v *Reader) Closed() bool {
 	return atomic.LoadUint32(&v.closed) == 1
 }
 
+// Close also closes the connection, so that a blocked Read returns.
 func (v *Reader) Close() error {
 	if atomic.CompareAndSwapUint32(&v.closed, 0, 1) {
+		if c, ok := v.conn.(io.Closer); ok {
+			return c.Close()
+		}
 		return nil
 	}
 	return av.ErrClosed
@@ -7,7 +7,7 @@ import (
 )
 
 const (
-	maxQueueNum           = 1024
+	maxInterleaveNum      = 64
 	SAVE_STATICS_INTERVAL = 5000
 )
 
@@ -24,6 +24,17 @@ type ChunkWriter interface {
 	Write(*core.ChunkStream) error
 }
 
+// ChunkInterleavedWriter writes several messages at once, interleaving the
+// chunks of messages that belong to different chunk streams.
+type ChunkInterleavedWriter interface {
+	WriteInterleaved(...*core.ChunkStream) error
+}
+
+// ChunkFlusher is implemented by chunk writers that buffer their output.
+type ChunkFlusher interface {
+	Flush() error
+}
+
 type ChunkWriteCloser interface {
 	io.Closer
 	ChunkWriter
@@ -2,31 +2,39 @@ package rtmp
 
 import (
 	"context"
-	"reflect"
 	"sync"
+	"sync/atomic"
 	"time"
 
 	"github.com/zijiren233/livelib/av"
 	"github.com/zijiren233/livelib/protocol/rtmp/core"
 )
 
+// Writer sends packets to an rtmp connection. Write blocks until the
+// packet is written, a player that cannot keep up falls behind in what
+// feeds it rather than in a queue of the writer.
 type Writer struct {
 	conn        ChunkWriter
-	packetQueue chan *av.Packet
 	WriteBWInfo StaticsBW
+	bytesSent   atomic.Uint64
 
-	closed bool
-	mu     sync.RWMutex
+	// mu serializes the writes to the connection.
+	mu    sync.Mutex
+	batch *chunkBatch
+
+	// done is closed by Close or a failed write, err is what failed.
+	done      chan struct{}
+	closeOnce sync.Once
+	err       error
 }
 
 func NewWriter(conn ChunkWriter) *Writer {
-	w := &Writer{
+	return &Writer{
 		conn:        conn,
-		packetQueue: make(chan *av.Packet, maxQueueNum),
 		WriteBWInfo: StaticsBW{0, 0, 0, 0, 0, 0, 0, 0},
+		batch:       newChunkBatch(),
+		done:        make(chan struct{}),
 	}
-
-	return w
 }
 
 func (w *Writer) SaveStatics(streamid uint32, length uint64, isVideoFlag bool) {
@@ -53,60 +61,136 @@ func (w *Writer) SaveStatics(streamid uint32, length uint64, isVideoFlag bool) {
 	}
 }
 
-func (w *Writer) Write(p *av.Packet) (err error) {
+// Write sends p and flushes the connection.
+func (w *Writer) Write(p *av.Packet) error {
+	return w.WriteBatch([]*av.Packet{p})
+}
+
+// WriteBatch sends pkts together, interleaving the chunks of the audio and
+// video messages, and flushes the connection once.
+func (w *Writer) WriteBatch(pkts []*av.Packet) error {
 	w.mu.Lock()
 	defer w.mu.Unlock()
-	if w.closed {
+	select {
+	case <-w.done:
 		return av.ErrClosed
+	default:
 	}
+	for len(pkts) > 0 {
+		n := min(len(pkts), len(w.batch.chunks))
+		if err := w.writeBatch(pkts[:n]); err != nil {
+			w.finish(err)
+			return err
+		}
+		pkts = pkts[n:]
+	}
+	if flusher, ok := w.conn.(ChunkFlusher); ok {
+		if err := flusher.Flush(); err != nil {
+			w.finish(err)
+			return err
+		}
+	}
+	return nil
+}
 
-	for {
-		select {
-		case w.packetQueue <- p:
-			return
-		default:
-			av.DropPacket(w.packetQueue)
+func (w *Writer) writeBatch(pkts []*av.Packet) error {
+	for _, p := range pkts {
+		w.addChunk(w.batch, p)
+	}
+	err := w.writeChunks(w.batch.chunks[:len(w.batch.pkts)])
+	if err == nil {
+		for _, p := range pkts {
+			w.bytesSent.Add(uint64(len(p.Data)))
 		}
 	}
+	w.batch.reset()
+	return err
+}
+
+func (w *Writer) Stats() av.WriterStats {
+	return av.WriterStats{
+		Protocol:  "rtmp",
+		BytesSent: w.bytesSent.Load(),
+	}
+}
+
+// chunkBatch holds the packets written to the connection in one go,
+// together with the chunk streams they are sent as.
+type chunkBatch struct {
+	chunks []*core.ChunkStream
+	pkts   []*av.Packet
+}
+
+// reset forgets the packets of b, which it does not own.
+func (b *chunkBatch) reset() {
+	for i := range b.pkts {
+		b.chunks[i].Data = nil
+	}
+	clear(b.pkts)
+	b.pkts = b.pkts[:0]
 }
 
+func newChunkBatch() *chunkBatch {
+	b := &chunkBatch{
+		chunks: make([]*core.ChunkStream, maxInterleaveNum),
+		pkts:   make([]*av.Packet, 0, maxInterleaveNum),
+	}
+	for i := range b.chunks {
+		b.chunks[i] = new(core.ChunkStream)
+	}
+	return b
+}
+
+// SendPacket waits until the writer is closed, a write fails or ctx is
+// done, and returns the error of the failed write.
 func (w *Writer) SendPacket(ctx context.Context) error {
-	Flush := reflect.ValueOf(w.conn).MethodByName("Flush")
-	cs := new(core.ChunkStream)
-	for {
-		select {
-		case <-ctx.Done():
-			return ctx.Err()
-		case p, ok := <-w.packetQueue:
-			if !ok {
-				return nil
-			}
-			cs.Data = p.Data
-			cs.Length = uint32(len(p.Data))
-			cs.StreamID = p.StreamID
-
-			cs.TypeID = uint32(p.Type())
-
-			w.SaveStatics(p.StreamID, uint64(cs.Length), p.IsVideo)
-			cs.Timestamp = p.TimeStamp
-			if err := w.conn.Write(cs); err != nil {
-				return err
-			}
-			v := Flush.Call(nil)
-			if v[0].Interface() != nil {
-				return v[0].Interface().(error)
-			}
+	select {
+	case <-ctx.Done():
+		return ctx.Err()
+	case <-w.done:
+		return w.err
+	}
+}
+
+func (w *Writer) addChunk(b *chunkBatch, p *av.Packet) {
+	cs := b.chunks[len(b.pkts)]
+	b.pkts = append(b.pkts, p)
+	cs.Data = p.Data
+	cs.Length = uint32(len(p.Data))
+	cs.StreamID = p.StreamID
+	cs.TypeID = uint32(p.Type())
+	cs.Timestamp = p.TimeStamp
+	w.SaveStatics(p.StreamID, uint64(cs.Length), p.IsVideo)
+}
+
+func (w *Writer) writeChunks(css []*core.ChunkStream) error {
+	if iw, ok := w.conn.(ChunkInterleavedWriter); ok {
+		return iw.WriteInterleaved(css...)
+	}
+	for _, cs := range css {
+		if err := w.conn.Write(cs); err != nil {
+			return err
 		}
 	}
+	return nil
 }
 
+// finish closes the writer, keeping err for SendPacket. It reports whether
+// the writer was open.
+func (w *Writer) finish(err error) (closed bool) {
+	w.closeOnce.Do(func() {
+		w.err = err
+		close(w.done)
+		closed = true
+	})
+	return closed
+}
+
+// Close ends SendPacket. It does not wait for a write in progress, which
+// fails once the connection is closed.
 func (w *Writer) Close() error {
-	w.mu.Lock()
-	defer w.mu.Unlock()
-	if w.closed {
+	if !w.finish(nil) {
 		return av.ErrClosed
 	}
-	w.closed = true
-	close(w.packetQueue)
 	return nil
 }
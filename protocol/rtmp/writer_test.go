@@ -0,0 +1,75 @@
+package rtmp
+
+import (
+	"net"
+	"sync/atomic"
+	"testing"
+
+	"github.com/zijiren233/livelib/av"
+	"github.com/zijiren233/livelib/protocol/rtmp/core"
+)
+
+// discardConn counts the writes that would have been syscalls on a real
+// socket.
+type discardConn struct {
+	net.Conn
+	writes atomic.Int64
+}
+
+func (c *discardConn) Write(p []byte) (int, error) {
+	c.writes.Add(1)
+	return len(p), nil
+}
+
+func (c *discardConn) Close() error {
+	return nil
+}
+
+// benchPackets is one second of a typical stream: 30 video frames with a
+// keyframe, and 43 AAC frames.
+func benchPackets() []*av.Packet {
+	var pkts []*av.Packet
+	for i := range 30 {
+		size := 4 * 1024
+		if i == 0 {
+			size = 64 * 1024
+		}
+		pkts = append(pkts, &av.Packet{IsVideo: true, TimeStamp: uint32(i * 33), StreamID: 1, Data: make([]byte, size)})
+		pkts = append(pkts, &av.Packet{IsAudio: true, TimeStamp: uint32(i * 33), StreamID: 1, Data: make([]byte, 300)})
+		if i%2 == 0 {
+			pkts = append(pkts, &av.Packet{IsAudio: true, TimeStamp: uint32(i*33 + 16), StreamID: 1, Data: make([]byte, 300)})
+		}
+	}
+	return pkts
+}
+
+func benchmarkWriter(b *testing.B, batch int) {
+	conn := &discardConn{}
+	w := NewWriter(core.NewConn(conn, 4*1024))
+	pkts := benchPackets()
+
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i += batch {
+		start := i % len(pkts)
+		end := min(start+batch, len(pkts))
+		if err := w.WriteBatch(pkts[start:end]); err != nil {
+			b.Fatal(err)
+		}
+	}
+	b.StopTimer()
+	w.Close()
+	b.ReportMetric(float64(conn.writes.Load())/float64(b.N), "syscalls/pkt")
+}
+
+// BenchmarkWriterPerPacket measures a player that receives packets one at a
+// time, as on an idle connection.
+func BenchmarkWriterPerPacket(b *testing.B) {
+	benchmarkWriter(b, 1)
+}
+
+// BenchmarkWriterBurst measures a player that has fallen slightly behind
+// and finds several packets ready on each wakeup.
+func BenchmarkWriterBurst(b *testing.B) {
+	benchmarkWriter(b, 16)
+}
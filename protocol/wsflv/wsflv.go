@@ -0,0 +1,281 @@
+// Package wsflv carries flv over WebSocket, the way flv.js and mpegts.js
+// play it: the flv header and tags are sent in binary frames.
+package wsflv
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"io"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/zijiren233/livelib/av"
+	"github.com/zijiren233/livelib/container/flv"
+	"golang.org/x/net/websocket"
+)
+
+// DefaultPingInterval is how often the peer is pinged. A peer that sends
+// nothing, not even the pong, for two intervals is disconnected.
+const DefaultPingInterval = 10 * time.Second
+
+var ErrTimeout = errors.New("websocket peer timed out")
+
+// Writer sends the packets written to it to a player, the flv header and
+// first tag in the first binary frame and one tag per frame after. Write
+// blocks until the frame is sent. It pings the player and closes the
+// websocket when it is closed.
+type Writer struct {
+	ws           *websocket.Conn
+	buf          bytes.Buffer
+	fw           *flv.Writer
+	pingInterval time.Duration
+	bytesSent    atomic.Uint64
+
+	// mu serializes the frames sent on ws.
+	mu sync.Mutex
+
+	// done is closed by Close or a failed write, err is what failed.
+	done      chan struct{}
+	closeOnce sync.Once
+	err       error
+}
+
+type WriterConf func(*Writer)
+
+// WithPingInterval sets how often the player is pinged,
+// DefaultPingInterval by default.
+func WithPingInterval(d time.Duration) WriterConf {
+	return func(w *Writer) {
+		w.pingInterval = d
+	}
+}
+
+func NewWriter(ws *websocket.Conn, conf ...WriterConf) *Writer {
+	w := &Writer{
+		ws:           ws,
+		pingInterval: DefaultPingInterval,
+		done:         make(chan struct{}),
+	}
+	for _, c := range conf {
+		c(w)
+	}
+	w.fw = flv.NewWriter(&w.buf)
+	ws.PayloadType = websocket.BinaryFrame
+	return w
+}
+
+func (w *Writer) Write(p *av.Packet) error {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	select {
+	case <-w.done:
+		return av.ErrClosed
+	default:
+	}
+	err := w.writePacket(p)
+	if err != nil {
+		w.finish(err)
+	}
+	return err
+}
+
+func (w *Writer) Stats() av.WriterStats {
+	return av.WriterStats{
+		Protocol:  "ws-flv",
+		BytesSent: w.bytesSent.Load(),
+	}
+}
+
+// SendPacket pings the player until the writer is closed, a write fails,
+// the player leaves or times out, or ctx is done. The websocket is closed
+// after.
+func (w *Writer) SendPacket(ctx context.Context) error {
+	defer w.closeWS()
+	gone := make(chan error, 1)
+	go func() {
+		gone <- keepalive(w.ws, 2*w.pingInterval)
+	}()
+	ping := time.NewTicker(w.pingInterval)
+	defer ping.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			w.finish(ctx.Err())
+		case err := <-gone:
+			w.finish(err)
+		case <-w.done:
+			return w.err
+		case <-ping.C:
+			if err := w.ping(); err != nil {
+				w.finish(err)
+			}
+		}
+	}
+}
+
+// closeWS closes the websocket once no frame is being written, failing a
+// write that is stuck on the player.
+func (w *Writer) closeWS() {
+	if !w.mu.TryLock() {
+		w.ws.SetWriteDeadline(time.Now())
+		w.mu.Lock()
+	}
+	defer w.mu.Unlock()
+	w.ws.Close()
+}
+
+// ping sends a ping frame, unless a frame is being written, which keeps
+// the player busy enough.
+func (w *Writer) ping() error {
+	if !w.mu.TryLock() {
+		return nil
+	}
+	defer w.mu.Unlock()
+	w.ws.PayloadType = websocket.PingFrame
+	_, err := w.ws.Write(nil)
+	w.ws.PayloadType = websocket.BinaryFrame
+	return err
+}
+
+func (w *Writer) writePacket(p *av.Packet) error {
+	w.buf.Reset()
+	if err := w.fw.Write(p); err != nil {
+		return err
+	}
+	if w.buf.Len() == 0 {
+		return nil
+	}
+	w.bytesSent.Add(uint64(w.buf.Len()))
+	_, err := w.ws.Write(w.buf.Bytes())
+	return err
+}
+
+// finish closes the writer, keeping err for SendPacket. It reports whether
+// the writer was open.
+func (w *Writer) finish(err error) (closed bool) {
+	w.closeOnce.Do(func() {
+		w.err = err
+		close(w.done)
+		closed = true
+	})
+	return closed
+}
+
+func (w *Writer) Close() error {
+	if !w.finish(nil) {
+		return av.ErrClosed
+	}
+	return nil
+}
+
+// keepalive reads and discards what a player sends, answering its pings,
+// until it closes the websocket or sends nothing for timeout.
+func keepalive(ws *websocket.Conn, timeout time.Duration) error {
+	for {
+		ws.SetReadDeadline(time.Now().Add(timeout))
+		frame, err := ws.NewFrameReader()
+		if err != nil {
+			return timeoutErr(err)
+		}
+		if frame, err = ws.HandleFrame(frame); err != nil {
+			return timeoutErr(err)
+		}
+		if frame != nil {
+			if _, err := io.Copy(io.Discard, frame); err != nil {
+				return timeoutErr(err)
+			}
+		}
+	}
+}
+
+func timeoutErr(err error) error {
+	var te interface{ Timeout() bool }
+	if errors.As(err, &te) && te.Timeout() {
+		return ErrTimeout
+	}
+	return err
+}
+
+// Reader reads the flv stream a publisher sends in the binary frames of a
+// websocket, split in any way. Close interrupts a blocked Read without
+// waiting, the websocket is closed by its owner.
+type Reader struct {
+	*flv.Reader
+	ws           *websocket.Conn
+	pingInterval time.Duration
+	stopPing     chan struct{}
+	once         sync.Once
+}
+
+type ReaderConf func(*Reader)
+
+// WithReaderPingInterval sets how often the publisher is pinged,
+// DefaultPingInterval by default. A publisher that sends nothing for two
+// intervals is disconnected.
+func WithReaderPingInterval(d time.Duration) ReaderConf {
+	return func(r *Reader) {
+		r.pingInterval = d
+	}
+}
+
+func NewReader(ws *websocket.Conn, conf ...ReaderConf) *Reader {
+	r := &Reader{
+		ws:           ws,
+		pingInterval: DefaultPingInterval,
+		stopPing:     make(chan struct{}),
+	}
+	for _, c := range conf {
+		c(r)
+	}
+	r.Reader = flv.NewReader(&deadlineReader{ws: ws, timeout: 2 * r.pingInterval})
+	go r.ping()
+	return r
+}
+
+// ping pings the publisher, it is the only writer to the websocket.
+func (r *Reader) ping() {
+	t := time.NewTicker(r.pingInterval)
+	defer t.Stop()
+	r.ws.PayloadType = websocket.PingFrame
+	for {
+		select {
+		case <-r.stopPing:
+			return
+		case <-t.C:
+			if _, err := r.ws.Write(nil); err != nil {
+				return
+			}
+		}
+	}
+}
+
+func (r *Reader) Read() (*av.Packet, error) {
+	p, err := r.Reader.Read()
+	if err != nil {
+		err = timeoutErr(err)
+	}
+	return p, err
+}
+
+func (r *Reader) Close() error {
+	var err error
+	r.once.Do(func() {
+		close(r.stopPing)
+		err = r.ws.SetReadDeadline(time.Now())
+	})
+	return err
+}
+
+// deadlineReader extends the read deadline of the websocket before every
+// read.
+type deadlineReader struct {
+	ws      *websocket.Conn
+	timeout time.Duration
+}
+
+func (r *deadlineReader) Read(b []byte) (int, error) {
+	r.ws.SetReadDeadline(time.Now().Add(r.timeout))
+	return r.ws.Read(b)
+}
@@ -0,0 +1,126 @@
+package wsflv
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"io"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/zijiren233/livelib/av"
+	"github.com/zijiren233/livelib/container/flv"
+	"golang.org/x/net/websocket"
+)
+
+func serve(t *testing.T, h func(ws *websocket.Conn)) *websocket.Conn {
+	t.Helper()
+	srv := httptest.NewServer(websocket.Server{Handler: h})
+	t.Cleanup(srv.Close)
+	ws, err := websocket.Dial("ws"+strings.TrimPrefix(srv.URL, "http"), "", srv.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { ws.Close() })
+	return ws
+}
+
+func keyframe(ts uint32) *av.Packet {
+	return &av.Packet{IsVideo: true, TimeStamp: ts, Data: []byte{0x17, 1, 0, 0, 0, 2}}
+}
+
+func TestWriter(t *testing.T) {
+	errc := make(chan error, 1)
+	ws := serve(t, func(ws *websocket.Conn) {
+		w := NewWriter(ws)
+		for i := range 3 {
+			w.Write(keyframe(uint32(i * 40)))
+		}
+		w.Close()
+		errc <- w.SendPacket(context.Background())
+	})
+
+	var frames [][]byte
+	for {
+		var b []byte
+		if err := websocket.Message.Receive(ws, &b); err != nil {
+			if !errors.Is(err, io.EOF) {
+				t.Fatal(err)
+			}
+			break
+		}
+		frames = append(frames, b)
+	}
+	if len(frames) != 3 || !bytes.HasPrefix(frames[0], flv.FlvFirstHeader) {
+		t.Fatalf("got %d frames, first %x", len(frames), frames[0])
+	}
+	r := flv.NewReader(bytes.NewReader(bytes.Join(frames, nil)))
+	for i := range 3 {
+		p, err := r.Read()
+		if err != nil || !p.IsVideo || p.TimeStamp != uint32(i*40) {
+			t.Fatalf("tag %d = %+v, %v", i, p, err)
+		}
+	}
+	if err := <-errc; err != nil {
+		t.Errorf("SendPacket = %v", err)
+	}
+}
+
+func TestWriterTimeout(t *testing.T) {
+	errc := make(chan error, 1)
+	// the client never reads, so it does not answer the pings.
+	serve(t, func(ws *websocket.Conn) {
+		errc <- NewWriter(ws, WithPingInterval(20*time.Millisecond)).SendPacket(context.Background())
+	})
+	select {
+	case err := <-errc:
+		if !errors.Is(err, ErrTimeout) {
+			t.Errorf("SendPacket = %v, want ErrTimeout", err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("silent player not disconnected")
+	}
+}
+
+func TestReader(t *testing.T) {
+	type result struct {
+		ts  []uint32
+		err error
+	}
+	done := make(chan result, 1)
+	ws := serve(t, func(ws *websocket.Conn) {
+		r := NewReader(ws)
+		defer r.Close()
+		var res result
+		for {
+			p, err := r.Read()
+			if err != nil {
+				res.err = err
+				break
+			}
+			res.ts = append(res.ts, p.TimeStamp)
+		}
+		done <- res
+	})
+
+	var buf bytes.Buffer
+	w := flv.NewWriter(&buf)
+	for i := range 3 {
+		w.Write(keyframe(uint32(i * 40)))
+	}
+	// frames do not have to follow the tags.
+	b := buf.Bytes()
+	for len(b) > 0 {
+		n := min(len(b), 7)
+		websocket.Message.Send(ws, b[:n])
+		b = b[n:]
+	}
+	ws.Close()
+
+	res := <-done
+	if len(res.ts) != 3 || res.ts[2] != 80 || !errors.Is(res.err, io.EOF) {
+		t.Errorf("read %v, %v", res.ts, res.err)
+	}
+}
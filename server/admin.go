@@ -0,0 +1,269 @@
+package server
+
+import (
+	"crypto/subtle"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/zijiren233/livelib/client"
+)
+
+// Admin serves a JSON API under /api to inspect and moderate the streams
+// of a Manager. Requests authenticate with the token as a bearer token.
+type Admin struct {
+	manager *Manager
+	token   string
+	metrics *Metrics
+	version string
+	started time.Time
+	mux     *http.ServeMux
+}
+
+type AdminConf func(*Admin)
+
+// WithAdminMetrics reports the connection counts of m in the server info.
+func WithAdminMetrics(m *Metrics) AdminConf {
+	return func(a *Admin) {
+		a.metrics = m
+	}
+}
+
+// WithVersion sets the version reported in the server info.
+func WithVersion(version string) AdminConf {
+	return func(a *Admin) {
+		a.version = version
+	}
+}
+
+// NewAdmin returns the admin API of m. An empty token rejects every
+// request.
+func NewAdmin(m *Manager, token string, conf ...AdminConf) *Admin {
+	a := &Admin{
+		manager: m,
+		token:   token,
+		version: "dev",
+		started: time.Now(),
+		mux:     http.NewServeMux(),
+	}
+	for _, c := range conf {
+		c(a)
+	}
+	a.mux.HandleFunc("GET /api/server", a.serverInfo)
+	a.mux.HandleFunc("GET /api/apps", a.apps)
+	a.mux.HandleFunc("GET /api/streams", a.streams)
+	a.mux.HandleFunc("GET /api/streams/{app}/{stream}", a.stream)
+	a.mux.HandleFunc("DELETE /api/streams/{app}/{stream}", a.closeStream)
+	a.mux.HandleFunc("GET /api/streams/{app}/{stream}/players", a.players)
+	a.mux.HandleFunc("DELETE /api/streams/{app}/{stream}/players/{id}", a.kickPlayer)
+	a.mux.HandleFunc("DELETE /api/streams/{app}/{stream}/publisher", a.kickPublisher)
+	a.mux.HandleFunc("POST /api/streams/{app}/{stream}/recordings", a.startRecording)
+	a.mux.HandleFunc("POST /api/streams/{app}/{stream}/relays", a.startRelay)
+	a.mux.HandleFunc("GET /api/tasks", a.tasks)
+	a.mux.HandleFunc("DELETE /api/tasks/{id}", a.stopTask)
+	return a
+}
+
+func (a *Admin) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	token, ok := strings.CutPrefix(r.Header.Get("Authorization"), "Bearer ")
+	if !ok || a.token == "" || subtle.ConstantTimeCompare([]byte(token), []byte(a.token)) != 1 {
+		w.Header().Set("WWW-Authenticate", "Bearer")
+		writeError(w, http.StatusUnauthorized, errors.New("unauthorized"))
+		return
+	}
+	a.mux.ServeHTTP(w, r)
+}
+
+func writeJSON(w http.ResponseWriter, status int, v any) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(v)
+}
+
+func writeError(w http.ResponseWriter, status int, err error) {
+	writeJSON(w, status, map[string]string{"error": err.Error()})
+}
+
+// writeResult writes v, or err with the status it calls for.
+func writeResult(w http.ResponseWriter, v any, err error) {
+	switch {
+	case err == nil:
+		writeJSON(w, http.StatusOK, v)
+	case errors.Is(err, ErrStreamNotFound), errors.Is(err, ErrPlayerNotFound),
+		errors.Is(err, ErrInputNotFound), errors.Is(err, ErrTaskNotFound):
+		writeError(w, http.StatusNotFound, err)
+	case errors.Is(err, ErrInvalidName):
+		writeError(w, http.StatusBadRequest, err)
+	case errors.Is(err, ErrManagerClosed), errors.Is(err, ErrClosed):
+		writeError(w, http.StatusServiceUnavailable, err)
+	default:
+		writeError(w, http.StatusInternalServerError, err)
+	}
+}
+
+type serverInfo struct {
+	Version     string            `json:"version"`
+	StartedAt   time.Time         `json:"startedAt"`
+	Uptime      float64           `json:"uptime"`
+	Streams     int               `json:"streams"`
+	Connections []ConnectionCount `json:"connections"`
+}
+
+func (a *Admin) serverInfo(w http.ResponseWriter, r *http.Request) {
+	writeJSON(w, http.StatusOK, serverInfo{
+		Version:     a.version,
+		StartedAt:   a.started,
+		Uptime:      time.Since(a.started).Seconds(),
+		Streams:     len(a.manager.List()),
+		Connections: a.metrics.Connections(),
+	})
+}
+
+type appInfo struct {
+	App     string `json:"app"`
+	Streams int    `json:"streams"`
+}
+
+func (a *Admin) apps(w http.ResponseWriter, r *http.Request) {
+	apps := []appInfo{}
+	for _, s := range a.manager.List() {
+		if n := len(apps); n > 0 && apps[n-1].App == s.App {
+			apps[n-1].Streams++
+			continue
+		}
+		apps = append(apps, appInfo{App: s.App, Streams: 1})
+	}
+	writeJSON(w, http.StatusOK, apps)
+}
+
+type streamInfo struct {
+	StreamKey
+	CreatedAt time.Time `json:"createdAt"`
+	Stats
+}
+
+func newStreamInfo(s StreamInfo) streamInfo {
+	return streamInfo{StreamKey: s.StreamKey, CreatedAt: s.CreatedAt, Stats: s.Channel.Stats()}
+}
+
+func (a *Admin) streams(w http.ResponseWriter, r *http.Request) {
+	app := r.URL.Query().Get("app")
+	streams := []streamInfo{}
+	for _, s := range a.manager.List() {
+		if app == "" || s.App == app {
+			streams = append(streams, newStreamInfo(s))
+		}
+	}
+	writeJSON(w, http.StatusOK, streams)
+}
+
+func (a *Admin) find(r *http.Request) (StreamInfo, error) {
+	key := StreamKey{r.PathValue("app"), r.PathValue("stream")}
+	for _, s := range a.manager.List() {
+		if s.StreamKey == key && s.State != StateClosed {
+			return s, nil
+		}
+	}
+	return StreamInfo{}, ErrStreamNotFound
+}
+
+func (a *Admin) stream(w http.ResponseWriter, r *http.Request) {
+	s, err := a.find(r)
+	if err != nil {
+		writeResult(w, nil, err)
+		return
+	}
+	writeJSON(w, http.StatusOK, newStreamInfo(s))
+}
+
+func (a *Admin) closeStream(w http.ResponseWriter, r *http.Request) {
+	err := a.manager.CloseStream(r.PathValue("app"), r.PathValue("stream"))
+	writeResult(w, struct{}{}, err)
+}
+
+func (a *Admin) players(w http.ResponseWriter, r *http.Request) {
+	s, err := a.find(r)
+	if err != nil {
+		writeResult(w, nil, err)
+		return
+	}
+	players := s.Channel.Stats().Players
+	if players == nil {
+		players = []PlayerStats{}
+	}
+	writeJSON(w, http.StatusOK, players)
+}
+
+func (a *Admin) kickPlayer(w http.ResponseWriter, r *http.Request) {
+	s, err := a.find(r)
+	if err != nil {
+		writeResult(w, nil, err)
+		return
+	}
+	id, err := strconv.ParseUint(r.PathValue("id"), 10, 64)
+	if err != nil {
+		writeError(w, http.StatusBadRequest, err)
+		return
+	}
+	writeResult(w, struct{}{}, s.Channel.KickPlayer(id))
+}
+
+// kickPublisher kicks the active input, or the one named by the input
+// query parameter.
+func (a *Admin) kickPublisher(w http.ResponseWriter, r *http.Request) {
+	s, err := a.find(r)
+	if err != nil {
+		writeResult(w, nil, err)
+		return
+	}
+	writeResult(w, struct{}{}, s.Channel.KickInput(r.URL.Query().Get("input")))
+}
+
+func (a *Admin) startRecording(w http.ResponseWriter, r *http.Request) {
+	info, err := a.manager.StartRecording(r.PathValue("app"), r.PathValue("stream"))
+	writeResult(w, info, err)
+}
+
+type relayRequest struct {
+	// Direction is push or pull.
+	Direction TaskKind `json:"direction"`
+	URL       string   `json:"url"`
+}
+
+func (a *Admin) startRelay(w http.ResponseWriter, r *http.Request) {
+	var req relayRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		writeError(w, http.StatusBadRequest, err)
+		return
+	}
+	if !strings.HasPrefix(req.URL, "rtmp://") && (req.Direction != TaskPull || !client.IsFLVURL(req.URL) && !client.IsHLSURL(req.URL)) {
+		writeError(w, http.StatusBadRequest, errors.New("url must be an rtmp url, or an http-flv or hls url to pull"))
+		return
+	}
+	var (
+		info TaskInfo
+		err  error
+	)
+	app, stream := r.PathValue("app"), r.PathValue("stream")
+	switch req.Direction {
+	case TaskPush:
+		info, err = a.manager.StartPush(app, stream, req.URL)
+	case TaskPull:
+		info, err = a.manager.StartPull(app, stream, req.URL)
+	default:
+		writeError(w, http.StatusBadRequest, errors.New("direction must be push or pull"))
+		return
+	}
+	writeResult(w, info, err)
+}
+
+func (a *Admin) tasks(w http.ResponseWriter, r *http.Request) {
+	writeJSON(w, http.StatusOK, a.manager.Tasks())
+}
+
+func (a *Admin) stopTask(w http.ResponseWriter, r *http.Request) {
+	writeResult(w, struct{}{}, a.manager.StopTask(r.PathValue("id")))
+}
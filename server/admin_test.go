@@ -0,0 +1,124 @@
+package server
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func adminDo(t *testing.T, h http.Handler, method, path string, v any) int {
+	t.Helper()
+	r := httptest.NewRequest(method, path, nil)
+	r.Header.Set("Authorization", "Bearer secret")
+	w := httptest.NewRecorder()
+	h.ServeHTTP(w, r)
+	if v != nil && w.Code == http.StatusOK {
+		if err := json.Unmarshal(w.Body.Bytes(), v); err != nil {
+			t.Fatalf("%s %s: %v", method, path, err)
+		}
+	}
+	return w.Code
+}
+
+func TestAdmin(t *testing.T) {
+	dir := t.TempDir()
+	m := NewManager(WithRecordDir(dir))
+	defer m.Close()
+	admin := NewAdmin(m, "secret")
+
+	for _, auth := range []string{"", "Bearer wrong"} {
+		r := httptest.NewRequest(http.MethodGet, "/api/server", nil)
+		r.Header.Set("Authorization", auth)
+		w := httptest.NewRecorder()
+		admin.ServeHTTP(w, r)
+		if w.Code != http.StatusUnauthorized || w.Header().Get("WWW-Authenticate") == "" {
+			t.Errorf("auth %q: status %d", auth, w.Code)
+		}
+	}
+
+	ch, err := m.Publish("live", "a")
+	if err != nil {
+		t.Fatal(err)
+	}
+	pub, _ := startPublisher(ch)
+	pub.send(newPacket(pktKey, 0))
+	rec := new(recorder)
+	for ch.AddPlayer(rec, WithPlayerInfo("test", "10.0.0.2:5000")) != nil {
+		time.Sleep(time.Millisecond)
+	}
+	rec.wait(t, 1)
+
+	var streams []streamInfo
+	if code := adminDo(t, admin, http.MethodGet, "/api/streams?app=live", &streams); code != http.StatusOK {
+		t.Fatalf("list streams: status %d", code)
+	}
+	if len(streams) != 1 || streams[0].Stream != "a" || streams[0].State != StatePublishing {
+		t.Fatalf("streams = %+v", streams)
+	}
+	if code := adminDo(t, admin, http.MethodGet, "/api/streams/live/missing", nil); code != http.StatusNotFound {
+		t.Errorf("missing stream: status %d", code)
+	}
+
+	var players []PlayerStats
+	adminDo(t, admin, http.MethodGet, "/api/streams/live/a/players", &players)
+	if len(players) != 1 || players[0].Protocol != "test" {
+		t.Fatalf("players = %+v", players)
+	}
+	path := "/api/streams/live/a/players/" + jsonString(players[0].ID)
+	if code := adminDo(t, admin, http.MethodDelete, path, nil); code != http.StatusOK {
+		t.Errorf("kick player: status %d", code)
+	}
+	if code := adminDo(t, admin, http.MethodDelete, path, nil); code != http.StatusNotFound {
+		t.Errorf("kick kicked player: status %d", code)
+	}
+	for !rec.isClosed() {
+		time.Sleep(time.Millisecond)
+	}
+
+	var task TaskInfo
+	if code := adminDo(t, admin, http.MethodPost, "/api/streams/live/a/recordings", &task); code != http.StatusOK {
+		t.Fatalf("start recording: status %d", code)
+	}
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		var tasks []TaskInfo
+		adminDo(t, admin, http.MethodGet, "/api/tasks", &tasks)
+		if len(tasks) == 1 && tasks[0].Target != "" {
+			if filepath.Dir(tasks[0].Target) != filepath.Join(dir, "live") {
+				t.Errorf("target = %s", tasks[0].Target)
+			}
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("tasks = %+v", tasks)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	pub.send(newPacket(pktInter, 40))
+	if code := adminDo(t, admin, http.MethodDelete, "/api/tasks/"+task.ID, nil); code != http.StatusOK {
+		t.Errorf("stop recording: status %d", code)
+	}
+	files, _ := filepath.Glob(filepath.Join(dir, "live", "a-*.flv"))
+	if len(files) != 1 {
+		t.Fatalf("recordings = %v", files)
+	}
+	if fi, err := os.Stat(files[0]); err != nil || fi.Size() == 0 {
+		t.Errorf("recording %s: %v", files[0], err)
+	}
+
+	if code := adminDo(t, admin, http.MethodDelete, "/api/streams/live/a", nil); code != http.StatusOK {
+		t.Errorf("close stream: status %d", code)
+	}
+	if _, ok := m.Get("live", "a"); ok {
+		t.Error("stream still open after close")
+	}
+}
+
+func jsonString(v any) string {
+	b, _ := json.Marshal(v)
+	return string(b)
+}
@@ -3,7 +3,7 @@ package server
 import (
 	"context"
 	"errors"
-	"runtime"
+	"io"
 	"sync"
 	"sync/atomic"
 	"time"
@@ -15,11 +15,41 @@ import (
 )
 
 type Channel struct {
-	inPublication bool
-	players       rwmap.RWMap[av.WriteCloser, *packWriter]
-
-	mu     sync.RWMutex
-	closed bool
+	players rwmap.RWMap[any, *packWriter]
+	ring    *ring
+
+	conflict   PublishConflict
+	ringSize   int
+	maxPlayers int
+	cacheConf  []cache.CacheConf
+	metrics    *StreamMetrics
+
+	stallTimeout    time.Duration
+	reconnectGrace  time.Duration
+	maxTimestampGap time.Duration
+
+	mu    sync.RWMutex
+	state ChannelState
+	// stateChanged is closed and replaced on every change of state.
+	stateChanged chan struct{}
+	watchers     map[*stateWatcher]struct{}
+	done         chan struct{}
+	// publisher is the input the players are fed from, inputs holds all
+	// connected ones in the order they arrived.
+	publisher *publisher
+	inputs    []*publisher
+	pinned    *publisher
+	inputSeq  int
+	playerSeq uint64
+	// lastTimestamp is the extended timestamp of the last frame sent to the
+	// players, the next publisher continues from it one frameDuration later
+	// if hasOutput is set.
+	lastTimestamp int64
+	frameDuration int64
+	hasOutput     bool
+	// graceTimer runs while the players wait for a publisher to come back.
+	graceTimer *time.Timer
+	graceSeq   int
 
 	hlsOnce sync.Once
 
@@ -28,27 +58,172 @@ type Channel struct {
 
 type ChannelConf func(*Channel)
 
+// PublishConflict decides what happens when a second publisher arrives
+// while the channel is live.
+type PublishConflict int
+
+const (
+	// ConflictReject refuses the new publisher.
+	ConflictReject PublishConflict = iota
+	// ConflictTakeover disconnects the current publisher and continues the
+	// stream from the new one without disconnecting the players.
+	ConflictTakeover
+	// ConflictStandby keeps the new publisher connected as a backup. The
+	// players are fed from the best ranked input that is not stalled, see
+	// WithInputRank.
+	ConflictStandby
+)
+
+const DefaultStallTimeout = 3 * time.Second
+
+func WithPublishConflict(policy PublishConflict) ChannelConf {
+	return func(c *Channel) {
+		c.conflict = policy
+	}
+}
+
+// WithStallTimeout sets how long the active input may go without sending a
+// packet before a standby input replaces it. Zero disables stall detection.
+func WithStallTimeout(d time.Duration) ChannelConf {
+	return func(c *Channel) {
+		c.stallTimeout = d
+	}
+}
+
+// WithReconnectGrace keeps the players attached for d after the last
+// publisher left. A publisher arriving in time continues the stream, with
+// rebased timestamps and a discontinuity in HLS.
+func WithReconnectGrace(d time.Duration) ChannelConf {
+	return func(c *Channel) {
+		c.reconnectGrace = d
+	}
+}
+
+// WithMaxTimestampGap sets the largest forward jump of the timestamps of an
+// input that is passed on. Larger jumps, like backward ones, are treated as
+// discontinuities and bridged with the duration of one frame. Zero lets any
+// forward jump through.
+func WithMaxTimestampGap(d time.Duration) ChannelConf {
+	return func(c *Channel) {
+		c.maxTimestampGap = d
+	}
+}
+
+// WithCache configures the fast-start cache of the inputs, which new
+// players start with.
+func WithCache(conf ...cache.CacheConf) ChannelConf {
+	return func(c *Channel) {
+		c.cacheConf = append(c.cacheConf, conf...)
+	}
+}
+
+// WithRingSize sets how many packets are buffered for the players. A
+// player that falls further behind loses packets according to its
+// LagPolicy.
+func WithRingSize(n int) ChannelConf {
+	return func(c *Channel) {
+		c.ringSize = n
+	}
+}
+
+// WithMaxPlayers limits the number of players AddPlayer accepts. Zero, the
+// default, does not limit them.
+func WithMaxPlayers(n int) ChannelConf {
+	return func(c *Channel) {
+		c.maxPlayers = n
+	}
+}
+
 func NewChannel(conf ...ChannelConf) *Channel {
-	ch := &Channel{}
+	ch := &Channel{
+		ringSize:        DefaultRingSize,
+		stallTimeout:    DefaultStallTimeout,
+		maxTimestampGap: DefaultMaxTimestampGap,
+		stateChanged:    make(chan struct{}),
+		watchers:        make(map[*stateWatcher]struct{}),
+		done:            make(chan struct{}),
+	}
 	for _, c := range conf {
 		c(ch)
 	}
+	ch.ring = newRing(max(ch.ringSize, 1))
+	ch.metrics.addChannel(ch)
 	return ch
 }
 
 var (
 	ErrPusherAlreadyInPublication = errors.New("pusher already in publication")
 	ErrPusherNotInPublication     = errors.New("pusher not in publication")
+	ErrPusherKicked               = errors.New("pusher replaced by a new publisher")
+	ErrPlayerLagged               = errors.New("player fell too far behind")
+	ErrPlayerNotFound             = errors.New("player not found")
+	ErrTooManyPlayers             = errors.New("too many players")
+)
+
+// LagPolicy decides what happens to a player that falls so far behind
+// that its packets were overwritten in the ring.
+type LagPolicy int
+
+const (
+	// LagSkip skips ahead to the last buffered keyframe, or to the next one
+	// if none is left. Sequence headers and metadata are not skipped.
+	LagSkip LagPolicy = iota
+	// LagDisconnect closes the player.
+	LagDisconnect
 )
 
+// Tracks selects the tracks a player gets.
+type Tracks uint8
+
+const (
+	TrackVideo Tracks = 1 << iota
+	TrackAudio
+	TrackMetadata
+
+	TrackAll = TrackVideo | TrackAudio | TrackMetadata
+)
+
+func (t Tracks) has(p *av.Packet) bool {
+	switch {
+	case p.IsVideo:
+		return t&TrackVideo != 0
+	case p.IsAudio:
+		return t&TrackAudio != 0
+	}
+	return t&TrackMetadata != 0
+}
+
+// packWriter is a player reading from the ring, either on its own goroutine
+// for AddPlayer or on the goroutine of the caller for Subscribe.
 type packWriter struct {
-	init bool
-	w    av.WriteCloser
+	w         av.WriteCloser
+	lag       LagPolicy
+	liveEdge  bool
+	tracks    Tracks
+	zeroStart *zeroStart
+	cursor    *cursor
+	dropped   atomic.Uint64
+	// id, protocol, remoteAddr and joinedAt describe the player for Stats.
+	id         uint64
+	protocol   string
+	remoteAddr string
+	joinedAt   time.Time
+	metrics    *StreamMetrics
+	// buf holds the packets taken from the ring that are not sent yet,
+	// starting with the cached headers and GOP.
+	buf []*av.Packet
+	off int
+
+	done      chan struct{}
+	closeOnce sync.Once
 }
 
 func newPackWriterCloser(w av.WriteCloser) *packWriter {
 	return &packWriter{
-		w: w,
+		w:      w,
+		tracks: TrackAll,
+		buf:    make([]*av.Packet, 0, ringBatch),
+		done:   make(chan struct{}),
 	}
 }
 
@@ -56,12 +231,94 @@ func (p *packWriter) GetWriter() av.WriteCloser {
 	return p.w
 }
 
-func (p *packWriter) Init() {
-	p.init = true
+// Write adds the cached packet p to the start of buf.
+func (p *packWriter) Write(pkt *av.Packet) error {
+	p.buf = append(p.buf, pkt.Retain())
+	return nil
 }
 
-func (p *packWriter) Inited() bool {
-	return p.init
+func (p *packWriter) Close() error {
+	return nil
+}
+
+func (p *packWriter) close() {
+	p.closeOnce.Do(func() {
+		close(p.done)
+		if p.w != nil {
+			p.w.Close()
+		}
+		p.metrics.retire(p)
+	})
+}
+
+// next returns the next packet for the player, which the caller releases.
+// It returns io.EOF once the player was closed.
+func (p *packWriter) next(ctx context.Context) (*av.Packet, error) {
+	return p.take(ctx, true)
+}
+
+// take is next, and returns nil rather than waiting for the ring unless
+// wait is set.
+func (p *packWriter) take(ctx context.Context, wait bool) (*av.Packet, error) {
+	for {
+		if p.off < len(p.buf) {
+			pkt := p.buf[p.off]
+			p.buf[p.off] = nil
+			p.off++
+			if !p.tracks.has(pkt) {
+				pkt.Release()
+				continue
+			}
+			if !p.cursor.filter(pkt) {
+				p.dropped.Add(1)
+				pkt.Release()
+				continue
+			}
+			if p.zeroStart != nil {
+				pkt = p.zeroStart.shift(pkt)
+			}
+			return pkt, nil
+		}
+		select {
+		case <-p.done:
+			return nil, io.EOF
+		default:
+		}
+
+		var (
+			ready  <-chan struct{}
+			lagged bool
+		)
+		p.buf, ready, lagged = p.cursor.fetch(p.buf[:0])
+		p.off = 0
+		switch {
+		case lagged && p.lag == LagDisconnect:
+			return nil, ErrPlayerLagged
+		case lagged:
+			var lost uint64
+			p.buf, lost = p.cursor.skip(p.buf)
+			p.dropped.Add(lost)
+		case ready != nil && !wait:
+			return nil, nil
+		case ready != nil:
+			select {
+			case <-ready:
+			case <-p.done:
+				return nil, io.EOF
+			case <-ctx.Done():
+				return nil, ctx.Err()
+			}
+		}
+	}
+}
+
+// release drops the packets the player did not get to.
+func (p *packWriter) release() {
+	for _, pkt := range p.buf[p.off:] {
+		pkt.Release()
+	}
+	clear(p.buf)
+	p.buf, p.off = p.buf[:0], 0
 }
 
 var (
@@ -69,32 +326,32 @@ var (
 	ErrClosed      = errors.New("channel closed")
 )
 
-func (c *Channel) PushStart(pusher av.Reader) error {
+// PushStart feeds the channel from pusher until it fails, ctx is done or
+// the channel is closed. With ConflictStandby several pushers can be added
+// as ranked inputs.
+func (c *Channel) PushStart(ctx context.Context, pusher av.Reader, conf ...InputConf) error {
 	if pusher == nil {
 		return ErrPusherIsNil
 	}
 
-	c.mu.Lock()
-	if c.closed {
-		c.mu.Unlock()
-		return ErrClosed
+	pub := &publisher{
+		reader: pusher,
+		cache:  cache.NewCache(c.cacheConf...),
+		clock:  newNormalizer(c.maxTimestampGap),
 	}
-
-	if c.inPublication {
-		c.mu.Unlock()
-		return ErrPusherAlreadyInPublication
+	for _, cf := range conf {
+		cf(pub)
 	}
-	c.inPublication = true
-	c.mu.Unlock()
-
-	defer func() {
+	if err := c.addPublisher(pub); err != nil {
+		return err
+	}
+	defer c.removePublisher(pub)
+	stop := context.AfterFunc(ctx, func() {
 		c.mu.Lock()
 		defer c.mu.Unlock()
-		c.kickAllPlayers()
-		c.inPublication = false
-	}()
-
-	cache := cache.NewCache()
+		pub.kick()
+	})
+	defer stop()
 
 	for {
 		if c.Closed() {
@@ -102,104 +359,284 @@ func (c *Channel) PushStart(pusher av.Reader) error {
 		}
 		p, err := pusher.Read()
 		if err != nil {
+			switch {
+			case c.Closed():
+				return nil
+			case ctx.Err() != nil:
+				return ctx.Err()
+			case c.kicked(pub):
+				return ErrPusherKicked
+			}
 			return err
 		}
-		if c.Closed() {
-			return nil
+		seq := isSeqHeader(p)
+		var info seqInfo
+		if seq {
+			info = parseSeqHeader(p)
 		}
 
-		cache.Write(p)
-
-		c.players.Range(func(w av.WriteCloser, player *packWriter) bool {
-			if !player.Inited() {
-				if err = cache.Send(player.GetWriter()); err != nil {
-					c.players.Delete(w)
-					player.GetWriter().Close()
-				}
-				player.Init()
-			} else {
-				if err = player.GetWriter().Write(p); err != nil {
-					c.players.Delete(w)
-					player.GetWriter().Close()
-				}
+		c.mu.Lock()
+		switch {
+		case c.state == StateClosed:
+			err = ErrClosed
+		case ctx.Err() != nil:
+			err = ctx.Err()
+		case pub.kicked:
+			err = ErrPusherKicked
+		default:
+			if seq {
+				pub.stats.setSeqHeader(p, info)
 			}
-			return true
-		})
+			c.handleInput(pub, p, time.Now())
+		}
+		c.mu.Unlock()
+		p.Release()
+
+		if errors.Is(err, ErrClosed) {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
 	}
 }
 
+// Close disconnects the publishers and players. The channel does not
+// accept any again.
 func (c *Channel) Close() error {
 	c.mu.Lock()
 	defer c.mu.Unlock()
-	if c.closed {
+	if c.state == StateClosed {
 		return ErrClosed
 	}
-
+	for _, in := range c.inputs {
+		in.kick()
+	}
+	if c.graceTimer != nil {
+		c.graceTimer.Stop()
+		c.graceTimer = nil
+	}
 	c.kickAllPlayers()
+	c.setState(StateClosed)
 	return nil
 }
 
 func (c *Channel) kickAllPlayers() {
-	c.players.Range(func(w av.WriteCloser, player *packWriter) bool {
+	c.players.Range(func(w any, player *packWriter) bool {
 		c.players.Delete(w)
-		player.GetWriter().Close()
+		player.close()
 		return true
 	})
+	c.ring.reset()
 }
 
 func (c *Channel) Closed() bool {
 	c.mu.RLock()
 	defer c.mu.RUnlock()
-	return c.closed
+	return c.state == StateClosed
 }
 
-func (c *Channel) AddPlayer(w av.WriteCloser) error {
-	c.mu.Lock()
-	defer c.mu.Unlock()
-	if c.closed {
+type PlayerConf func(*packWriter)
+
+// WithLagPolicy sets what happens when the player falls behind by more than
+// the ring holds, LagSkip by default.
+func WithLagPolicy(policy LagPolicy) PlayerConf {
+	return func(p *packWriter) {
+		p.lag = policy
+	}
+}
+
+// WithLiveEdge starts the player at the newest cached keyframe, however
+// many GOPs the cache keeps.
+func WithLiveEdge() PlayerConf {
+	return func(p *packWriter) {
+		p.liveEdge = true
+	}
+}
+
+// WithTracks only sends the given tracks to the player.
+func WithTracks(tracks Tracks) PlayerConf {
+	return func(p *packWriter) {
+		p.tracks = tracks
+	}
+}
+
+// WithPlayerInfo describes the player for Stats. The protocol defaults to
+// the one the writer reports.
+func WithPlayerInfo(protocol, remoteAddr string) PlayerConf {
+	return func(p *packWriter) {
+		p.protocol = protocol
+		p.remoteAddr = remoteAddr
+	}
+}
+
+// WithZeroStart makes the timestamps of the player start near zero instead
+// of continuing the timeline of the channel.
+func WithZeroStart() PlayerConf {
+	return func(p *packWriter) {
+		p.zeroStart = new(zeroStart)
+	}
+}
+
+// CanPlay reports whether a new player would be accepted.
+func (c *Channel) CanPlay() error {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+	return c.canPlay()
+}
+
+// canPlay is CanPlay with c.mu held.
+func (c *Channel) canPlay() error {
+	if c.state == StateClosed {
 		return ErrClosed
 	}
-	if !c.inPublication {
+	if c.publisher == nil && c.graceTimer == nil {
 		return ErrPusherNotInPublication
 	}
-	_, loaded := c.players.LoadOrStore(w, newPackWriterCloser(w))
-	if loaded {
+	if c.maxPlayers > 0 && c.playerCount() >= c.maxPlayers {
+		return ErrTooManyPlayers
+	}
+	return nil
+}
+
+func (c *Channel) AddPlayer(w av.WriteCloser, conf ...PlayerConf) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if err := c.canPlay(); err != nil {
+		return err
+	}
+	pw := newPackWriterCloser(w)
+	for _, cf := range conf {
+		cf(pw)
+	}
+	// c.mu serializes the adds, pw is attached before others can see it
+	if _, ok := c.players.Load(w); ok {
 		return errors.New("player already exists")
 	}
+	c.attach(pw)
+	c.players.Store(w, pw)
+	go c.pump(w, pw)
 	return nil
 }
 
+// playerCount counts the players, not the subscriptions or the hls
+// segmenter.
+func (c *Channel) playerCount() (n int) {
+	c.players.Range(func(key any, _ *packWriter) bool {
+		switch key.(type) {
+		case *Subscription, *hls.Source:
+		default:
+			n++
+		}
+		return true
+	})
+	return n
+}
+
+// attach starts pw with the cache, followed by what the ring gets from now
+// on. c.mu must be held.
+func (c *Channel) attach(pw *packWriter) {
+	c.playerSeq++
+	pw.id = c.playerSeq
+	pw.joinedAt = time.Now()
+	pw.metrics = c.metrics
+	pw.cursor = c.ring.cursor()
+	if pub := c.publisher; pub != nil {
+		if pw.liveEdge {
+			pub.cache.SendMode(pw, cache.JoinLiveEdge)
+		} else {
+			pub.cache.Send(pw)
+		}
+		// without a cached keyframe the player waits for the next one
+		pw.cursor.waitKey = pub.cache.HasVideo() && !pub.cache.HasKeyFrame()
+	}
+}
+
 func (c *Channel) DelPlayer(w av.WriteCloser) bool {
-	pw, loaded := c.players.LoadAndDelete(w)
+	return c.delPlayer(w)
+}
+
+// KickPlayer disconnects the player with the id reported by Stats.
+func (c *Channel) KickPlayer(id uint64) error {
+	var key any
+	c.players.Range(func(k any, pw *packWriter) bool {
+		if pw.id == id {
+			key = k
+			return false
+		}
+		return true
+	})
+	if key == nil || !c.delPlayer(key) {
+		return ErrPlayerNotFound
+	}
+	return nil
+}
+
+func (c *Channel) delPlayer(key any) bool {
+	pw, loaded := c.players.LoadAndDelete(key)
 	if loaded {
-		pw.GetWriter().Close()
+		pw.close()
 	}
 	return loaded
 }
 
+// pump writes the packets of the ring to a player until it is closed or
+// fails. The writes block, so a slow player falls behind in the ring. A
+// BatchWriter gets the packets that are ready together.
+func (c *Channel) pump(w av.WriteCloser, pw *packWriter) {
+	defer pw.release()
+	bw, _ := w.(av.BatchWriter)
+	batch := make([]*av.Packet, 0, ringBatch)
+	for {
+		p, err := pw.next(context.Background())
+		for err == nil && p != nil {
+			batch = append(batch, p)
+			if bw == nil || len(batch) == cap(batch) {
+				break
+			}
+			p, err = pw.take(context.Background(), false)
+		}
+		if err == nil {
+			if bw != nil {
+				err = bw.WriteBatch(batch)
+			} else {
+				err = w.Write(batch[0])
+			}
+		}
+		for _, p := range batch {
+			p.Release()
+		}
+		clear(batch)
+		batch = batch[:0]
+		if err != nil {
+			c.DelPlayer(w)
+			return
+		}
+	}
+}
+
+// InitHlsPlayer segments the stream to HLS whenever the channel is
+// published, until it is closed.
 func (c *Channel) InitHlsPlayer(conf ...hls.SourceConf) error {
+	if c.metrics != nil {
+		conf = append([]hls.SourceConf{hls.WithSegmentFunc(c.metrics.observeSegment)}, conf...)
+	}
 	c.hlsOnce.Do(func() {
-		p := hls.NewSource(conf...)
-		c.hlsWriter.Store(p)
+		c.hlsWriter.Store(hls.NewSource(conf...))
 		go func() {
-			for {
+			for c.WaitPublishing(context.Background()) == nil {
+				p := c.hlsWriter.Load()
 				if err := c.AddPlayer(p); err != nil {
-					if errors.Is(err, ErrClosed) {
-						p.Close()
-						return
-					}
-					if errors.Is(err, ErrPusherNotInPublication) {
-						time.Sleep(time.Second)
-					} else {
-						runtime.Gosched()
-					}
+					// the next session may accept it, retrying now would
+					// fail again.
+					c.waitLeave(StatePublishing)
 					continue
 				}
 				_ = p.SendPacket(context.Background())
 				p.Close()
-				p = hls.NewSource(conf...)
-				c.hlsWriter.Store(p)
+				c.hlsWriter.Store(hls.NewSource(conf...))
 			}
+			c.hlsWriter.Load().Close()
 		}()
 	})
 	return nil
@@ -0,0 +1,340 @@
+package server
+
+import (
+	"context"
+	"errors"
+	"io"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/zijiren233/livelib/av"
+	"github.com/zijiren233/livelib/container/flv"
+)
+
+// chanReader is a publisher fed through a channel.
+type chanReader struct {
+	in        chan *av.Packet
+	done      chan struct{}
+	closeOnce sync.Once
+}
+
+func newChanReader() *chanReader {
+	return &chanReader{in: make(chan *av.Packet), done: make(chan struct{})}
+}
+
+func (r *chanReader) Read() (*av.Packet, error) {
+	select {
+	case p, ok := <-r.in:
+		if !ok {
+			return nil, io.EOF
+		}
+		return p, nil
+	case <-r.done:
+		return nil, av.ErrClosed
+	}
+}
+
+func (r *chanReader) Close() error {
+	r.closeOnce.Do(func() { close(r.done) })
+	return nil
+}
+
+// send pushes packets and reports false if the reader was closed.
+func (r *chanReader) send(pkts ...*av.Packet) bool {
+	for _, p := range pkts {
+		select {
+		case r.in <- p:
+		case <-r.done:
+			return false
+		}
+	}
+	return true
+}
+
+const (
+	pktSeq = iota
+	pktKey
+	pktInter
+	pktAudio
+)
+
+func newPacket(kind int, ts uint32) *av.Packet {
+	p := &av.Packet{TimeStamp: ts}
+	switch kind {
+	case pktSeq:
+		p.IsVideo, p.Data = true, []byte{0x17, 0, 0, 0, 0, 1}
+	case pktKey:
+		p.IsVideo, p.Data = true, []byte{0x17, 1, 0, 0, 0, 2}
+	case pktInter:
+		p.IsVideo, p.Data = true, []byte{0x27, 1, 0, 0, 0, 3}
+	case pktAudio:
+		p.IsAudio, p.Data = true, []byte{0xaf, 1, 4}
+	}
+	if err := flv.NewDemuxer().DemuxH(p); err != nil {
+		panic(err)
+	}
+	return p
+}
+
+type received struct {
+	kind int
+	ts   uint32
+}
+
+func kindOf(p *av.Packet) int {
+	switch {
+	case p.IsAudio:
+		return pktAudio
+	case isSeqHeader(p):
+		return pktSeq
+	case p.Header.(av.VideoPacketHeader).IsKeyFrame():
+		return pktKey
+	}
+	return pktInter
+}
+
+// recorder is a player that remembers what it was sent.
+type recorder struct {
+	mu     sync.Mutex
+	pkts   []received
+	closed bool
+}
+
+func (r *recorder) Write(p *av.Packet) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.pkts = append(r.pkts, received{kindOf(p), p.TimeStamp})
+	return nil
+}
+
+func (r *recorder) Close() error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.closed = true
+	return nil
+}
+
+func (r *recorder) wait(t *testing.T, n int) []received {
+	t.Helper()
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		r.mu.Lock()
+		pkts := append([]received(nil), r.pkts...)
+		r.mu.Unlock()
+		if len(pkts) >= n {
+			return pkts
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("got %d packets, want %d: %v", len(pkts), n, pkts)
+		}
+		time.Sleep(time.Millisecond)
+	}
+}
+
+func (r *recorder) isClosed() bool {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return r.closed
+}
+
+func startPublisher(ch *Channel, conf ...InputConf) (*chanReader, <-chan error) {
+	r := newChanReader()
+	errc := make(chan error, 1)
+	go func() { errc <- ch.PushStart(context.Background(), r, conf...) }()
+	return r, errc
+}
+
+func addPlayer(t *testing.T, ch *Channel) *recorder {
+	t.Helper()
+	rec := new(recorder)
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		err := ch.AddPlayer(rec)
+		if err == nil {
+			return rec
+		}
+		if !errors.Is(err, ErrPusherNotInPublication) || time.Now().After(deadline) {
+			t.Fatal(err)
+		}
+		time.Sleep(time.Millisecond)
+	}
+}
+
+func checkReceived(t *testing.T, got []received, want []received) {
+	t.Helper()
+	if len(got) != len(want) {
+		t.Fatalf("got %v, want %v", got, want)
+	}
+	for i := range want {
+		if got[i] != want[i] {
+			t.Fatalf("got %v, want %v", got, want)
+		}
+	}
+}
+
+func TestPublishConflictReject(t *testing.T) {
+	ch := NewChannel()
+	r1, _ := startPublisher(ch)
+	addPlayer(t, ch)
+	if err := ch.CanPublish(); !errors.Is(err, ErrPusherAlreadyInPublication) {
+		t.Fatalf("CanPublish() = %v", err)
+	}
+	if err := ch.PushStart(context.Background(), newChanReader()); !errors.Is(err, ErrPusherAlreadyInPublication) {
+		t.Fatalf("PushStart() = %v", err)
+	}
+	r1.Close()
+}
+
+func TestMaxPlayersHLS(t *testing.T) {
+	ch := NewChannel(WithMaxPlayers(1))
+	defer ch.Close()
+	ch.InitHlsPlayer()
+	startPublisher(ch)
+	// the segmenter joins once the channel is published, and does not take
+	// the slot of the player.
+	for {
+		if _, ok := ch.players.Load(ch.HlsPlayer()); ok {
+			break
+		}
+		time.Sleep(time.Millisecond)
+	}
+	addPlayer(t, ch)
+	if err := ch.AddPlayer(new(recorder)); !errors.Is(err, ErrTooManyPlayers) {
+		t.Errorf("second player: %v", err)
+	}
+}
+
+func TestPublishConflictTakeover(t *testing.T) {
+	ch := NewChannel(WithPublishConflict(ConflictTakeover))
+	r1, errc1 := startPublisher(ch)
+	rec := addPlayer(t, ch)
+	r1.send(newPacket(pktSeq, 0), newPacket(pktKey, 0), newPacket(pktInter, 40), newPacket(pktInter, 80))
+	rec.wait(t, 4)
+
+	if err := ch.CanPublish(); err != nil {
+		t.Fatalf("CanPublish() = %v", err)
+	}
+	r2, _ := startPublisher(ch)
+	if err := <-errc1; !errors.Is(err, ErrPusherKicked) {
+		t.Fatalf("first publisher: %v", err)
+	}
+	r2.send(newPacket(pktSeq, 0), newPacket(pktInter, 0), newPacket(pktKey, 1000), newPacket(pktInter, 1040))
+
+	checkReceived(t, rec.wait(t, 7), []received{
+		{pktSeq, 0}, {pktKey, 0}, {pktInter, 40}, {pktInter, 80},
+		{pktSeq, 120}, {pktKey, 120}, {pktInter, 160},
+	})
+	if rec.isClosed() {
+		t.Fatal("player closed on takeover")
+	}
+	r2.Close()
+}
+
+func TestPublishConflictStandby(t *testing.T) {
+	ch := NewChannel(WithPublishConflict(ConflictStandby))
+	r1, errc1 := startPublisher(ch)
+	rec := addPlayer(t, ch)
+	r1.send(newPacket(pktSeq, 0), newPacket(pktKey, 0), newPacket(pktInter, 40))
+
+	r2, _ := startPublisher(ch)
+	r2.send(newPacket(pktSeq, 0), newPacket(pktKey, 500), newPacket(pktInter, 540))
+	rec.wait(t, 3)
+
+	close(r1.in)
+	if err := <-errc1; !errors.Is(err, io.EOF) {
+		t.Fatalf("first publisher: %v", err)
+	}
+	r2.send(newPacket(pktInter, 580), newPacket(pktKey, 600), newPacket(pktInter, 640))
+
+	checkReceived(t, rec.wait(t, 6), []received{
+		{pktSeq, 0}, {pktKey, 0}, {pktInter, 40},
+		{pktSeq, 80}, {pktKey, 80}, {pktInter, 120},
+	})
+	if rec.isClosed() {
+		t.Fatal("player closed on failover")
+	}
+
+	r2.Close()
+	deadline := time.Now().Add(5 * time.Second)
+	for !rec.isClosed() {
+		if time.Now().After(deadline) {
+			t.Fatal("player not closed after the last publisher left")
+		}
+		time.Sleep(time.Millisecond)
+	}
+}
+
+func TestReconnectGrace(t *testing.T) {
+	ch := NewChannel(WithReconnectGrace(100 * time.Millisecond))
+	r1, errc1 := startPublisher(ch)
+	rec := addPlayer(t, ch)
+	r1.send(newPacket(pktSeq, 0), newPacket(pktKey, 0), newPacket(pktInter, 40))
+	rec.wait(t, 3)
+	close(r1.in)
+	<-errc1
+
+	// players can still join while the publisher is away
+	late := addPlayer(t, ch)
+	r2, _ := startPublisher(ch)
+	r2.send(newPacket(pktSeq, 0), newPacket(pktKey, 5000), newPacket(pktInter, 5040))
+	checkReceived(t, rec.wait(t, 6), []received{
+		{pktSeq, 0}, {pktKey, 0}, {pktInter, 40},
+		{pktSeq, 80}, {pktKey, 80}, {pktInter, 120},
+	})
+	checkReceived(t, late.wait(t, 3), []received{{pktSeq, 80}, {pktKey, 80}, {pktInter, 120}})
+	if rec.isClosed() {
+		t.Fatal("player closed during the grace period")
+	}
+
+	r2.Close()
+	time.Sleep(50 * time.Millisecond)
+	if rec.isClosed() {
+		t.Fatal("player closed before the grace period ended")
+	}
+	deadline := time.Now().Add(5 * time.Second)
+	for !rec.isClosed() || !late.isClosed() {
+		if time.Now().After(deadline) {
+			t.Fatal("players not closed after the grace period")
+		}
+		time.Sleep(time.Millisecond)
+	}
+	if err := ch.AddPlayer(new(recorder)); !errors.Is(err, ErrPusherNotInPublication) {
+		t.Fatalf("AddPlayer() = %v", err)
+	}
+}
+
+func TestKickPlayer(t *testing.T) {
+	ch := NewChannel()
+	r, _ := startPublisher(ch)
+	defer r.Close()
+	rec := addPlayer(t, ch)
+
+	// players joining while others are kicked
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		for range 100 {
+			ch.AddPlayer(new(recorder))
+		}
+	}()
+kick:
+	for id := uint64(2); ; id++ {
+		select {
+		case <-done:
+			break kick
+		default:
+		}
+		ch.KickPlayer(id)
+	}
+
+	if err := ch.KickPlayer(1); err != nil {
+		t.Fatal(err)
+	}
+	if !rec.isClosed() {
+		t.Fatal("kicked player not closed")
+	}
+	if err := ch.KickPlayer(1); !errors.Is(err, ErrPlayerNotFound) {
+		t.Fatalf("KickPlayer(1) again = %v", err)
+	}
+}
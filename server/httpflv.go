@@ -0,0 +1,147 @@
+package server
+
+import (
+	"context"
+	"errors"
+	"io"
+	"net"
+	"net/http"
+	"net/netip"
+	"time"
+
+	"github.com/zijiren233/livelib/av"
+	"github.com/zijiren233/livelib/container/flv"
+	"github.com/zijiren233/livelib/protocol/wsflv"
+	"golang.org/x/net/websocket"
+)
+
+// httpAddr is the address of an http client that is not ip:port.
+type httpAddr string
+
+func (a httpAddr) Network() string { return "tcp" }
+func (a httpAddr) String() string  { return string(a) }
+
+func remoteAddr(r *http.Request) net.Addr {
+	if ap, err := netip.ParseAddrPort(r.RemoteAddr); err == nil {
+		return net.TCPAddrFromAddrPort(ap)
+	}
+	return httpAddr(r.RemoteAddr)
+}
+
+// flvBody reads the flv stream of a request. Close interrupts a blocked
+// Read, so that the input can be kicked.
+type flvBody struct {
+	*flv.Reader
+	rc *http.ResponseController
+}
+
+func (b *flvBody) Close() error {
+	return b.rc.SetReadDeadline(time.Now())
+}
+
+// httpPublisher is an http publisher that passed the AuthFunc and webhooks
+// of the server.
+type httpPublisher struct {
+	s        *Server
+	protocol string
+	channel  *Channel
+	req      *AuthRequest
+	hookReq  *HookRequest
+}
+
+// authorizeHTTP runs an http publisher through the AuthFunc, publish
+// conflict check and on_publish of the server like an rtmp one. On failure
+// it returns the status to answer with.
+func (s *Server) authorizeHTTP(protocol string, r *http.Request, app, name string) (*httpPublisher, int, error) {
+	hookReq := NewHookRequest(protocol, app, name, r)
+	req := &AuthRequest{
+		RemoteAddr:  remoteAddr(r),
+		App:         app,
+		Name:        name,
+		RawQuery:    r.URL.RawQuery,
+		Query:       r.URL.Query(),
+		IsPublisher: true,
+		PublishType: "live",
+		TcUrl:       hookReq.TcUrl,
+	}
+	channel, err := s.authFunc(req)
+	if err != nil {
+		s.metrics.AuthFailed(protocol, "publisher")
+		return nil, http.StatusForbidden, err
+	}
+	if err = channel.CanPublish(); err != nil {
+		req.reject()
+		s.metrics.AuthFailed(protocol, "publisher")
+		return nil, http.StatusConflict, err
+	}
+	if err = s.hooks.Call(r.Context(), HookPublish, hookReq); err != nil {
+		req.reject()
+		s.metrics.AuthFailed(protocol, "publisher")
+		return nil, http.StatusForbidden, err
+	}
+	return &httpPublisher{s: s, protocol: protocol, channel: channel, req: req, hookReq: hookReq}, 0, nil
+}
+
+// push feeds the channel from r until it ends, and returns the status to
+// answer with.
+func (p *httpPublisher) push(r av.ReadCloser) (int, error) {
+	defer p.s.metrics.ConnOpened(p.protocol, "publisher")()
+	start := time.Now()
+	reader := &countingReader{ReadCloser: r}
+	// not the context of the request, which the server cancels when a kick
+	// interrupts the body.
+	err := p.channel.PushStart(
+		context.Background(),
+		reader,
+		WithInputName(p.req.RemoteAddr.String()),
+		WithInputAddr(p.req.RemoteAddr.String()),
+		WithInputRank(p.req.InputRank),
+	)
+	p.hookReq.Stats = &HookStats{Duration: time.Since(start).Seconds(), BytesIn: reader.bytes}
+	p.s.hooks.Notify(HookPublishDone, p.hookReq)
+
+	switch {
+	case err == nil, errors.Is(err, io.EOF), errors.Is(err, io.ErrUnexpectedEOF):
+		return http.StatusNoContent, nil
+	case errors.Is(err, ErrPusherAlreadyInPublication), errors.Is(err, ErrPusherKicked):
+		return http.StatusConflict, err
+	case errors.Is(err, ErrClosed):
+		return http.StatusServiceUnavailable, err
+	}
+	return http.StatusBadRequest, err
+}
+
+// ServeFLVPublish publishes the flv stream in the body of r, a POST or PUT
+// of any length, to the stream name of app. The publisher goes through
+// the AuthFunc, webhooks and metrics of the server like an rtmp one, and
+// the response is written once the stream ends.
+func (s *Server) ServeFLVPublish(w http.ResponseWriter, r *http.Request, app, name string) {
+	p, status, err := s.authorizeHTTP("http-flv", r, app, name)
+	if err == nil {
+		status, err = p.push(&flvBody{
+			Reader: flv.NewReader(r.Body),
+			rc:     http.NewResponseController(w),
+		})
+	}
+	if err != nil {
+		writeError(w, status, err)
+		return
+	}
+	w.WriteHeader(status)
+}
+
+// ServeWSFLVPublish upgrades r to a websocket and publishes the flv stream
+// sent in its binary frames to the stream name of app, like
+// ServeFLVPublish. Rejected publishers get an http error before the
+// upgrade.
+func (s *Server) ServeWSFLVPublish(w http.ResponseWriter, r *http.Request, app, name string, conf ...wsflv.ReaderConf) {
+	p, status, err := s.authorizeHTTP("ws-flv", r, app, name)
+	if err != nil {
+		writeError(w, status, err)
+		return
+	}
+	websocket.Server{Handler: func(ws *websocket.Conn) {
+		defer ws.Close()
+		p.push(wsflv.NewReader(ws, conf...))
+	}}.ServeHTTP(w, r)
+}
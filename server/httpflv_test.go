@@ -0,0 +1,192 @@
+package server
+
+import (
+	"bytes"
+	"context"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/zijiren233/livelib/container/flv"
+	"golang.org/x/net/websocket"
+)
+
+func TestServeFLVPublish(t *testing.T) {
+	url, calls := hookServer(t, "denied")
+	mgr := NewManager()
+	defer mgr.Close()
+	s := NewRtmpServer(mgr.AuthFunc(), WithWebhooks(NewWebhooks(
+		WithHook(HookPublish, url),
+		WithHook(HookPublishDone, url),
+	)))
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		app, name, _ := strings.Cut(strings.TrimPrefix(r.URL.Path, "/"), "/")
+		s.ServeFLVPublish(w, r, app, strings.TrimSuffix(name, ".flv"))
+	}))
+	defer srv.Close()
+
+	post := func(path string, body io.Reader) <-chan *http.Response {
+		respc := make(chan *http.Response, 1)
+		go func() {
+			resp, err := http.Post(srv.URL+path, "video/x-flv", body)
+			if err != nil {
+				t.Error(err)
+				close(respc)
+				return
+			}
+			resp.Body.Close()
+			respc <- resp
+		}()
+		return respc
+	}
+	status := func(respc <-chan *http.Response) int {
+		t.Helper()
+		select {
+		case resp := <-respc:
+			if resp == nil {
+				t.FailNow()
+			}
+			return resp.StatusCode
+		case <-time.After(5 * time.Second):
+			t.Fatal("no response")
+		}
+		return 0
+	}
+
+	if code := status(post("/live/denied.flv", strings.NewReader(""))); code != http.StatusForbidden {
+		t.Errorf("denied publish: status %d", code)
+	}
+	nextCall(t, calls)
+
+	pr, pw := io.Pipe()
+	respc := post("/live/a.flv?token=1", pr)
+	w := flv.NewWriter(pw)
+	if err := w.Write(newPacket(pktKey, 0)); err != nil {
+		t.Fatal(err)
+	}
+	if got := nextCall(t, calls); got.Call != HookPublish || got.Protocol != "http-flv" || got.Args.Get("token") != "1" {
+		t.Errorf("on_publish = %+v", got)
+	}
+	ch, ok := mgr.Get("live", "a")
+	if !ok {
+		t.Fatal("stream not created")
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	if err := ch.WaitPublishing(ctx); err != nil {
+		t.Fatal(err)
+	}
+	rec := new(recorder)
+	if err := ch.AddPlayer(rec); err != nil {
+		t.Fatal(err)
+	}
+	w.Write(newPacket(pktInter, 40))
+	rec.wait(t, 2)
+
+	if code := status(post("/live/a.flv", strings.NewReader(""))); code != http.StatusConflict {
+		t.Errorf("second publisher: status %d", code)
+	}
+
+	pw.Close()
+	if code := status(respc); code != http.StatusNoContent {
+		t.Errorf("end of stream: status %d", code)
+	}
+	if got := nextCall(t, calls); got.Call != HookPublishDone || got.Stats == nil || got.Stats.BytesIn == 0 {
+		t.Errorf("on_publish_done = %+v", got)
+	}
+}
+
+func TestServeFLVPublishKick(t *testing.T) {
+	mgr := NewManager()
+	defer mgr.Close()
+	s := NewRtmpServer(mgr.AuthFunc())
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		s.ServeFLVPublish(w, r, "live", "a")
+	}))
+	defer srv.Close()
+
+	pr, pw := io.Pipe()
+	defer pw.Close()
+	respc := make(chan int, 1)
+	go func() {
+		resp, err := http.Post(srv.URL, "video/x-flv", pr)
+		if err != nil {
+			respc <- 0
+			return
+		}
+		resp.Body.Close()
+		respc <- resp.StatusCode
+	}()
+	flv.NewWriter(pw).Write(newPacket(pktKey, 0))
+	var ch *Channel
+	for ch == nil {
+		ch, _ = mgr.Get("live", "a")
+		time.Sleep(time.Millisecond)
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	if err := ch.WaitPublishing(ctx); err != nil {
+		t.Fatal(err)
+	}
+	if err := ch.KickInput(""); err != nil {
+		t.Fatal(err)
+	}
+	select {
+	case code := <-respc:
+		if code != http.StatusConflict {
+			t.Errorf("kicked publisher: status %d", code)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("kicked publisher still connected")
+	}
+}
+
+func TestServeWSFLVPublish(t *testing.T) {
+	mgr := NewManager()
+	defer mgr.Close()
+	s := NewRtmpServer(mgr.AuthFunc())
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		s.ServeWSFLVPublish(w, r, "live", "a")
+	}))
+	defer srv.Close()
+	dial := func() (*websocket.Conn, error) {
+		return websocket.Dial("ws"+strings.TrimPrefix(srv.URL, "http"), "", srv.URL)
+	}
+
+	ws, err := dial()
+	if err != nil {
+		t.Fatal(err)
+	}
+	var buf bytes.Buffer
+	w := flv.NewWriter(&buf)
+	w.Write(newPacket(pktKey, 0))
+	websocket.Message.Send(ws, buf.Bytes())
+	ch, _ := mgr.Get("live", "a")
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	if err := ch.WaitPublishing(ctx); err != nil {
+		t.Fatal(err)
+	}
+	rec := new(recorder)
+	if err := ch.AddPlayer(rec); err != nil {
+		t.Fatal(err)
+	}
+	buf.Reset()
+	w.Write(newPacket(pktInter, 40))
+	websocket.Message.Send(ws, buf.Bytes())
+	rec.wait(t, 2)
+
+	if _, err := dial(); err == nil {
+		t.Error("second publisher upgraded")
+	}
+	ws.Close()
+	for ch.State() == StatePublishing {
+		if ctx.Err() != nil {
+			t.Fatal("publisher still active after closing the websocket")
+		}
+		time.Sleep(time.Millisecond)
+	}
+}
@@ -0,0 +1,388 @@
+package server
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"slices"
+	"time"
+
+	"github.com/zijiren233/livelib/av"
+	"github.com/zijiren233/livelib/cache"
+	"github.com/zijiren233/livelib/client"
+	"github.com/zijiren233/livelib/protocol/rtmp"
+	"github.com/zijiren233/livelib/protocol/rtmp/core"
+)
+
+var ErrInputNotFound = errors.New("input not found")
+
+// publisher is an input of a channel.
+type publisher struct {
+	name      string
+	addr      string
+	startedAt time.Time
+	rank      int
+	reader    av.Reader
+	cache     *cache.Cache
+	kicked    bool
+	lastRead  time.Time
+	// resync is set when the publisher takes over players that were fed by
+	// another one. Its frames are held back until a keyframe, which is sent
+	// after its sequence headers and continues the timeline of the channel.
+	resync bool
+	clock  *normalizer
+	stats  ingestStats
+}
+
+func (p *publisher) kick() {
+	p.kicked = true
+	if c, ok := p.reader.(io.Closer); ok {
+		c.Close()
+	}
+}
+
+type InputConf func(*publisher)
+
+// WithInputName names the input for SelectInput and Inputs.
+func WithInputName(name string) InputConf {
+	return func(p *publisher) {
+		p.name = name
+	}
+}
+
+// WithInputAddr sets the remote address of the input reported by Stats.
+func WithInputAddr(addr string) InputConf {
+	return func(p *publisher) {
+		p.addr = addr
+	}
+}
+
+// WithInputRank sets the preference of the input, lower ranks are
+// preferred. Inputs of equal rank are used in the order they arrived.
+func WithInputRank(rank int) InputConf {
+	return func(p *publisher) {
+		p.rank = rank
+	}
+}
+
+// InputInfo describes an input of a channel.
+type InputInfo struct {
+	Name       string
+	Rank       int
+	Active     bool
+	Selected   bool
+	LastPacket time.Time
+}
+
+func (c *Channel) Inputs() []InputInfo {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+	infos := make([]InputInfo, 0, len(c.inputs))
+	for _, in := range c.inputs {
+		infos = append(infos, InputInfo{
+			Name:       in.name,
+			Rank:       in.rank,
+			Active:     in == c.publisher,
+			Selected:   in == c.pinned,
+			LastPacket: in.lastRead,
+		})
+	}
+	return infos
+}
+
+// SelectInput switches the players to the named input at its next
+// keyframe, and keeps them on it for as long as it does not stall or leave.
+func (c *Channel) SelectInput(name string) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	for _, in := range c.inputs {
+		if in.name == name && !in.kicked {
+			c.pinned = in
+			return nil
+		}
+	}
+	return ErrInputNotFound
+}
+
+// KickInput disconnects the named input, the active one if name is empty.
+func (c *Channel) KickInput(name string) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	for _, in := range c.inputs {
+		if !in.kicked && (in.name == name || name == "" && in == c.publisher) {
+			in.kick()
+			return nil
+		}
+	}
+	return ErrInputNotFound
+}
+
+// AutoSelectInput undoes SelectInput, so that the best ranked input is
+// used again.
+func (c *Channel) AutoSelectInput() {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.pinned = nil
+}
+
+// CanPublish reports whether a new publisher would be accepted.
+func (c *Channel) CanPublish() error {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+	if c.state == StateClosed {
+		return ErrClosed
+	}
+	if c.publisher != nil && c.conflict == ConflictReject {
+		return ErrPusherAlreadyInPublication
+	}
+	return nil
+}
+
+func (c *Channel) kicked(pub *publisher) bool {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+	return pub.kicked
+}
+
+func (c *Channel) addPublisher(pub *publisher) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.state == StateClosed {
+		return ErrClosed
+	}
+	if c.publisher != nil {
+		switch c.conflict {
+		case ConflictTakeover:
+			c.publisher.kick()
+		case ConflictStandby:
+		default:
+			return ErrPusherAlreadyInPublication
+		}
+	}
+	if c.graceTimer != nil {
+		c.graceTimer.Stop()
+		c.graceTimer = nil
+	}
+	c.inputSeq++
+	if pub.name == "" {
+		pub.name = fmt.Sprintf("input-%d", c.inputSeq)
+	}
+	pub.startedAt = time.Now()
+	c.inputs = append(c.inputs, pub)
+	if c.publisher == nil || c.publisher.kicked {
+		c.activate(pub)
+	}
+	c.setState(StatePublishing)
+	return nil
+}
+
+// activate makes pub the input the players are fed from.
+func (c *Channel) activate(pub *publisher) {
+	c.publisher = pub
+	pub.resync = c.hasOutput
+}
+
+func (c *Channel) removePublisher(pub *publisher) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.inputs = slices.DeleteFunc(c.inputs, func(p *publisher) bool { return p == pub })
+	if c.pinned == pub {
+		c.pinned = nil
+	}
+	if pub != c.publisher {
+		return
+	}
+	if next := c.bestInput(time.Now()); next != nil {
+		c.activate(next)
+		return
+	}
+	c.publisher = nil
+	if c.state == StateClosed {
+		return
+	}
+	if c.reconnectGrace > 0 && c.hasOutput {
+		c.graceSeq++
+		seq := c.graceSeq
+		c.graceTimer = time.AfterFunc(c.reconnectGrace, func() { c.endGrace(seq) })
+		c.setState(StateDraining)
+		return
+	}
+	c.hasOutput = false
+	c.kickAllPlayers()
+	c.setState(StateIdle)
+}
+
+// endGrace disconnects the players if no publisher came back in time.
+func (c *Channel) endGrace(seq int) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.graceTimer == nil || c.graceSeq != seq {
+		return
+	}
+	c.graceTimer = nil
+	c.hasOutput = false
+	c.kickAllPlayers()
+	c.setState(StateIdle)
+}
+
+func (c *Channel) stalled(in *publisher, now time.Time) bool {
+	return c.stallTimeout > 0 && now.Sub(in.lastRead) > c.stallTimeout
+}
+
+// bestInput returns the best ranked input that is not stalled, or the best
+// ranked one if all are.
+func (c *Channel) bestInput(now time.Time) *publisher {
+	var (
+		best        *publisher
+		bestHealthy bool
+	)
+	for _, in := range c.inputs {
+		if in.kicked {
+			continue
+		}
+		healthy := !c.stalled(in, now)
+		if best == nil ||
+			healthy && !bestHealthy ||
+			healthy == bestHealthy && in.rank < best.rank {
+			best, bestHealthy = in, healthy
+		}
+	}
+	return best
+}
+
+// preferred reports whether the players should switch to the standby input
+// pub, which just delivered a keyframe.
+func (c *Channel) preferred(pub *publisher, now time.Time) bool {
+	if c.pinned != nil && !c.stalled(c.pinned, now) {
+		return pub == c.pinned
+	}
+	if c.stalled(c.publisher, now) {
+		return c.bestInput(now) == pub
+	}
+	return pub.rank < c.publisher.rank
+}
+
+// handleInput processes a packet of any input. Standby inputs only keep
+// their cache up to date, until one of them is preferred over the active
+// input at one of its keyframes.
+func (c *Channel) handleInput(pub *publisher, p *av.Packet, now time.Time) {
+	pub.lastRead = now
+	pub.stats.add(p, now)
+	c.metrics.addBytesIn(len(p.Data))
+	if pub != c.publisher {
+		if isSeqHeader(p) || !isSyncPoint(pub, p) || !c.preferred(pub, now) {
+			c.cacheWrite(pub, p)
+			return
+		}
+		c.activate(pub)
+	}
+	c.forward(pub, p)
+}
+
+// forward sends a packet of the active input to the players.
+func (c *Channel) forward(pub *publisher, p *av.Packet) {
+	if pub.resync {
+		if isSeqHeader(p) || !isSyncPoint(pub, p) {
+			c.cacheWrite(pub, p)
+			return
+		}
+		pub.resync = false
+		pub.clock = newNormalizer(c.maxTimestampGap)
+		pub.clock.start(p.TimeStamp, c.lastTimestamp+c.frameDuration)
+		// the cached GOPs have the timestamps of the input, not those the
+		// players continue with
+		pub.cache.Reset()
+		for _, h := range pub.cache.Headers() {
+			h = h.Clone()
+			h.TimeStamp = uint32(pub.clock.out)
+			c.cacheWrite(pub, h)
+			c.ring.push(h, false)
+		}
+	}
+	jumps := pub.clock.discontinuities
+	ts := pub.clock.normalize(p)
+	if pub.clock.discontinuities != jumps {
+		pub.stats.discontinuities++
+		c.metrics.addDiscontinuity()
+	}
+	if !p.IsMetadata && !isSeqHeader(p) {
+		c.lastTimestamp = ts
+		c.frameDuration = pub.clock.frameDuration()
+		c.hasOutput = true
+	}
+
+	c.cacheWrite(pub, p)
+	c.ring.push(p, !isSeqHeader(p) && isSyncPoint(pub, p))
+}
+
+// cacheWrite caches p for pub, counting the GOPs the cache drops for not
+// fitting its budget.
+func (c *Channel) cacheWrite(pub *publisher, p *av.Packet) {
+	if errors.Is(pub.cache.Write(p), cache.ErrGopTooBig) {
+		pub.stats.gopsDropped++
+		c.metrics.addGOPDropped()
+	}
+}
+
+func isSeqHeader(p *av.Packet) bool {
+	// flv tag headers are both video and audio headers.
+	if p.IsVideo {
+		h, ok := p.Header.(av.VideoPacketHeader)
+		return ok && h.IsSeq()
+	}
+	if p.IsAudio {
+		h, ok := p.Header.(av.AudioPacketHeader)
+		return ok && h.SoundFormat() == av.SOUND_AAC && h.AACPacketType() == av.AAC_SEQHDR
+	}
+	return false
+}
+
+// isSyncPoint reports whether players can switch to pub at p: a video
+// keyframe, or any audio frame for streams without video.
+func isSyncPoint(pub *publisher, p *av.Packet) bool {
+	if p.IsVideo {
+		vh, ok := p.Header.(av.VideoPacketHeader)
+		return ok && vh.IsKeyFrame()
+	}
+	return p.IsAudio && !pub.cache.HasVideo()
+}
+
+const pullRetryDelay = time.Second
+
+// PullStart adds the rtmp, http-flv or hls stream at url as an input of the
+// channel, reconnecting whenever it fails, until ctx is done.
+func (c *Channel) PullStart(ctx context.Context, url string, conf ...InputConf) error {
+	conf = append([]InputConf{WithInputName(url)}, conf...)
+	for {
+		if reader, err := dialPull(ctx, url); err == nil {
+			err = c.PushStart(ctx, reader, conf...)
+			reader.Close()
+			if errors.Is(err, ErrClosed) || errors.Is(err, ErrPusherAlreadyInPublication) {
+				return err
+			}
+		}
+		if c.Closed() {
+			return ErrClosed
+		}
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-time.After(pullRetryDelay):
+		}
+	}
+}
+
+func dialPull(ctx context.Context, url string) (av.ReadCloser, error) {
+	switch {
+	case client.IsHLSURL(url):
+		return client.DialHLS(ctx, url)
+	case client.IsFLVURL(url):
+		return client.DialFLV(ctx, url)
+	}
+	connClient := core.NewConnClient()
+	if err := connClient.Start(url, av.PLAY); err != nil {
+		return nil, err
+	}
+	return rtmp.NewReader(connClient), nil
+}
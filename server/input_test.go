@@ -0,0 +1,120 @@
+package server
+
+import (
+	"testing"
+	"time"
+
+	"github.com/zijiren233/livelib/cache"
+)
+
+func TestInputFailback(t *testing.T) {
+	ch := NewChannel(WithPublishConflict(ConflictStandby), WithStallTimeout(0))
+	backup, _ := startPublisher(ch, WithInputName("backup"), WithInputRank(1))
+	rec := addPlayer(t, ch)
+	backup.send(newPacket(pktSeq, 0), newPacket(pktKey, 0), newPacket(pktInter, 40))
+	rec.wait(t, 3)
+
+	main, _ := startPublisher(ch, WithInputName("main"))
+	main.send(newPacket(pktSeq, 0), newPacket(pktInter, 860))
+	backup.send(newPacket(pktInter, 80))
+	rec.wait(t, 4)
+	main.send(newPacket(pktKey, 900), newPacket(pktInter, 940))
+	backup.send(newPacket(pktInter, 120))
+
+	checkReceived(t, rec.wait(t, 7), []received{
+		{pktSeq, 0}, {pktKey, 0}, {pktInter, 40}, {pktInter, 80},
+		{pktSeq, 120}, {pktKey, 120}, {pktInter, 160},
+	})
+	for _, in := range ch.Inputs() {
+		if in.Active != (in.Name == "main") {
+			t.Fatalf("inputs: %+v", ch.Inputs())
+		}
+	}
+	main.Close()
+	backup.Close()
+}
+
+func TestInputStallFailover(t *testing.T) {
+	ch := NewChannel(WithPublishConflict(ConflictStandby), WithStallTimeout(50*time.Millisecond))
+	main, _ := startPublisher(ch, WithInputName("main"))
+	rec := addPlayer(t, ch)
+	main.send(newPacket(pktSeq, 0), newPacket(pktKey, 0), newPacket(pktInter, 40))
+
+	backup, _ := startPublisher(ch, WithInputName("backup"), WithInputRank(1))
+	backup.send(newPacket(pktSeq, 0), newPacket(pktKey, 300))
+	rec.wait(t, 3)
+
+	time.Sleep(100 * time.Millisecond)
+	backup.send(newPacket(pktKey, 400), newPacket(pktInter, 440))
+	checkReceived(t, rec.wait(t, 6), []received{
+		{pktSeq, 0}, {pktKey, 0}, {pktInter, 40},
+		{pktSeq, 80}, {pktKey, 80}, {pktInter, 120},
+	})
+
+	// the main encoder recovers and takes over again at its next keyframe
+	main.send(newPacket(pktKey, 1000), newPacket(pktInter, 1040))
+	backup.send(newPacket(pktInter, 480))
+	checkReceived(t, rec.wait(t, 9), []received{
+		{pktSeq, 0}, {pktKey, 0}, {pktInter, 40},
+		{pktSeq, 80}, {pktKey, 80}, {pktInter, 120},
+		{pktSeq, 160}, {pktKey, 160}, {pktInter, 200},
+	})
+	main.Close()
+	backup.Close()
+}
+
+func TestSelectInput(t *testing.T) {
+	ch := NewChannel(WithPublishConflict(ConflictStandby), WithStallTimeout(0))
+	a, _ := startPublisher(ch, WithInputName("a"))
+	rec := addPlayer(t, ch)
+	a.send(newPacket(pktSeq, 0), newPacket(pktKey, 0))
+	b, _ := startPublisher(ch, WithInputName("b"), WithInputRank(1))
+	// a packet is handled before the next one is read, so the last one of
+	// each send only makes sure the others were
+	b.send(newPacket(pktSeq, 0), newPacket(pktKey, 0), newPacket(pktInter, 20))
+	rec.wait(t, 2)
+
+	if err := ch.SelectInput("c"); err != ErrInputNotFound {
+		t.Fatalf("SelectInput(c) = %v", err)
+	}
+	if err := ch.SelectInput("b"); err != nil {
+		t.Fatal(err)
+	}
+	b.send(newPacket(pktInter, 40))
+	a.send(newPacket(pktInter, 40))
+	rec.wait(t, 3)
+	b.send(newPacket(pktKey, 80), newPacket(pktInter, 120))
+	// a keyframe of the better ranked input does not undo the selection
+	a.send(newPacket(pktKey, 80), newPacket(pktInter, 120))
+
+	checkReceived(t, rec.wait(t, 6), []received{
+		{pktSeq, 0}, {pktKey, 0}, {pktInter, 40},
+		{pktSeq, 80}, {pktKey, 80}, {pktInter, 120},
+	})
+
+	ch.AutoSelectInput()
+	a.send(newPacket(pktKey, 160), newPacket(pktInter, 200))
+	checkReceived(t, rec.wait(t, 9)[6:], []received{{pktSeq, 160}, {pktKey, 160}, {pktInter, 200}})
+	a.Close()
+	b.Close()
+}
+
+func TestInputFailoverCache(t *testing.T) {
+	ch := NewChannel(WithPublishConflict(ConflictStandby), WithCache(cache.WithGOPs(2)))
+	main, errc := startPublisher(ch, WithInputName("main"))
+	rec := addPlayer(t, ch)
+	main.send(newPacket(pktSeq, 0), newPacket(pktKey, 0), newPacket(pktInter, 40))
+
+	backup, _ := startPublisher(ch, WithInputName("backup"), WithInputRank(1))
+	backup.send(newPacket(pktSeq, 0), newPacket(pktKey, 500), newPacket(pktInter, 540))
+	rec.wait(t, 3)
+	close(main.in)
+	<-errc
+	backup.send(newPacket(pktKey, 600), newPacket(pktInter, 640))
+	rec.wait(t, 6)
+
+	// the GOPs cached before the switch are not in the players' timebase
+	late := addPlayer(t, ch)
+	checkReceived(t, late.wait(t, 3), []received{{pktSeq, 80}, {pktKey, 80}, {pktInter, 120}})
+	backup.Close()
+}
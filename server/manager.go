@@ -0,0 +1,366 @@
+package server
+
+import (
+	"context"
+	"errors"
+	"slices"
+	"sort"
+	"sync"
+	"time"
+)
+
+const DefaultIdleTimeout = 30 * time.Second
+
+// DefaultRecordDir is where recordings are written by default.
+const DefaultRecordDir = "records"
+
+var (
+	ErrStreamNotFound = errors.New("stream not found")
+	ErrTooManyStreams = errors.New("too many streams")
+	ErrManagerClosed  = errors.New("manager closed")
+)
+
+// StreamKey identifies a channel of a Manager.
+type StreamKey struct {
+	App    string `json:"app"`
+	Stream string `json:"stream"`
+}
+
+// StreamInfo describes a channel of a Manager.
+type StreamInfo struct {
+	StreamKey
+	Channel   *Channel
+	State     ChannelState
+	CreatedAt time.Time
+}
+
+type managedChannel struct {
+	ch        *Channel
+	createdAt time.Time
+}
+
+// Manager owns the channels of a server by app and stream name. Channels
+// are created when they are published and closed once they were idle for
+// a while.
+type Manager struct {
+	mu       sync.RWMutex
+	closed   bool
+	channels map[StreamKey]*managedChannel
+
+	idleTimeout time.Duration
+	maxStreams  int
+	appStreams  map[string]int
+	channelConf []ChannelConf
+	metrics     *Metrics
+	onCreate    func(app, stream string, c *Channel)
+	appConf     func(app string) AppConf
+
+	tasks        map[string]*task
+	taskSeq      int
+	recordDir    string
+	onRecordDone func(key StreamKey, path string)
+}
+
+type ManagerConf func(*Manager)
+
+// AppConf configures the streams of an app, see WithAppConf.
+type AppConf struct {
+	// MaxStreams limits the number of streams of the app when positive,
+	// overriding WithMaxStreams.
+	MaxStreams int
+	// Channel configures the channels of the app, after WithChannelConf.
+	Channel []ChannelConf
+	// Record records every stream of the app for as long as it exists.
+	Record bool
+	// Push pushes every stream of the app to each of the rtmp urls,
+	// followed by the stream name, for as long as it exists.
+	Push []string
+}
+
+// WithIdleTimeout closes channels that had no publisher for d, 30 seconds
+// by default. Zero keeps them until they are closed.
+func WithIdleTimeout(d time.Duration) ManagerConf {
+	return func(m *Manager) {
+		m.idleTimeout = d
+	}
+}
+
+// WithMaxStreams limits the number of streams of each app. Zero, the
+// default, does not limit them.
+func WithMaxStreams(n int) ManagerConf {
+	return func(m *Manager) {
+		m.maxStreams = n
+	}
+}
+
+// WithAppMaxStreams limits the number of streams of app, overriding
+// WithMaxStreams.
+func WithAppMaxStreams(app string, n int) ManagerConf {
+	return func(m *Manager) {
+		m.appStreams[app] = n
+	}
+}
+
+// WithChannelConf configures the channels the manager creates.
+func WithChannelConf(conf ...ChannelConf) ManagerConf {
+	return func(m *Manager) {
+		m.channelConf = append(m.channelConf, conf...)
+	}
+}
+
+// WithMetrics reports the streams of the manager to m.
+func WithMetrics(m *Metrics) ManagerConf {
+	return func(mgr *Manager) {
+		mgr.metrics = m
+	}
+}
+
+// WithChannelCreated calls f for every channel the manager creates, for
+// example to start HLS. f must not call the manager.
+func WithChannelCreated(f func(app, stream string, c *Channel)) ManagerConf {
+	return func(m *Manager) {
+		m.onCreate = f
+	}
+}
+
+// WithRecordDir writes recordings to dir/app/stream-time.flv,
+// DefaultRecordDir by default.
+func WithRecordDir(dir string) ManagerConf {
+	return func(m *Manager) {
+		m.recordDir = dir
+	}
+}
+
+// WithRecordDone calls f for every recorded file once it is complete.
+func WithRecordDone(f func(key StreamKey, path string)) ManagerConf {
+	return func(m *Manager) {
+		m.onRecordDone = f
+	}
+}
+
+// WithAppConf configures the streams of each app with f. f is called for
+// every stream the manager creates, so what it returns may change over time
+// without affecting the existing streams. f must not call the manager.
+func WithAppConf(f func(app string) AppConf) ManagerConf {
+	return func(m *Manager) {
+		m.appConf = f
+	}
+}
+
+func NewManager(conf ...ManagerConf) *Manager {
+	m := &Manager{
+		channels:    make(map[StreamKey]*managedChannel),
+		idleTimeout: DefaultIdleTimeout,
+		appStreams:  make(map[string]int),
+		tasks:       make(map[string]*task),
+		recordDir:   DefaultRecordDir,
+	}
+	for _, c := range conf {
+		c(m)
+	}
+	return m
+}
+
+func (m *Manager) limit(app string, ac AppConf) int {
+	if n, ok := m.appStreams[app]; ok {
+		return n
+	}
+	if ac.MaxStreams > 0 {
+		return ac.MaxStreams
+	}
+	return m.maxStreams
+}
+
+// Publish returns the channel of the stream, creating it if needed.
+func (m *Manager) Publish(app, stream string) (*Channel, error) {
+	ch, _, err := m.publish(app, stream)
+	return ch, err
+}
+
+// publish is Publish, and reports whether the channel was created.
+func (m *Manager) publish(app, stream string) (*Channel, bool, error) {
+	key := StreamKey{app, stream}
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if m.closed {
+		return nil, false, ErrManagerClosed
+	}
+	if mc, ok := m.channels[key]; ok && !mc.ch.Closed() {
+		return mc.ch, false, nil
+	}
+	var ac AppConf
+	if m.appConf != nil {
+		ac = m.appConf(app)
+	}
+	if limit := m.limit(app, ac); limit > 0 && m.count(app) >= limit {
+		return nil, false, ErrTooManyStreams
+	}
+	conf := m.channelConf
+	if len(ac.Channel) > 0 {
+		conf = append(slices.Clip(conf), ac.Channel...)
+	}
+	if m.metrics != nil {
+		conf = append(slices.Clip(conf), WithStreamMetrics(m.metrics.Stream(app, stream)))
+	}
+	ch := NewChannel(conf...)
+	m.channels[key] = &managedChannel{ch: ch, createdAt: time.Now()}
+	go m.watch(key, ch)
+	if m.onCreate != nil {
+		m.onCreate(app, stream, ch)
+	}
+	m.startChannelTasks(key, ch, ac)
+	return ch, true, nil
+}
+
+// abandon closes ch, which a rejected publisher created, unless it was
+// published since.
+func (m *Manager) abandon(ch *Channel) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if ch.State() == StateIdle {
+		ch.Close()
+	}
+}
+
+func (m *Manager) count(app string) (n int) {
+	for key, mc := range m.channels {
+		if key.App == app && !mc.ch.Closed() {
+			n++
+		}
+	}
+	return
+}
+
+// watch forgets ch and its metrics once it is closed, and closes it once
+// it was idle for the idle timeout.
+func (m *Manager) watch(key StreamKey, ch *Channel) {
+	defer func() {
+		m.mu.Lock()
+		if mc, ok := m.channels[key]; ok && mc.ch == ch {
+			delete(m.channels, key)
+		}
+		m.mu.Unlock()
+		m.metrics.Release(ch.metrics)
+	}()
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	var idle <-chan time.Time
+	states := ch.StateChanges(ctx)
+	for {
+		select {
+		case s, ok := <-states:
+			if !ok || s == StateClosed {
+				return
+			}
+			idle = nil
+			if s == StateIdle && m.idleTimeout > 0 {
+				idle = time.After(m.idleTimeout)
+			}
+		case <-idle:
+			m.mu.Lock()
+			if ch.State() == StateIdle {
+				ch.Close()
+			}
+			m.mu.Unlock()
+		}
+	}
+}
+
+// Get returns the channel of the stream.
+func (m *Manager) Get(app, stream string) (*Channel, bool) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	mc, ok := m.channels[StreamKey{app, stream}]
+	if !ok || mc.ch.Closed() {
+		return nil, false
+	}
+	return mc.ch, true
+}
+
+// List returns the streams sorted by app and stream name.
+func (m *Manager) List() []StreamInfo {
+	m.mu.RLock()
+	infos := make([]StreamInfo, 0, len(m.channels))
+	for key, mc := range m.channels {
+		infos = append(infos, StreamInfo{
+			StreamKey: key,
+			Channel:   mc.ch,
+			CreatedAt: mc.createdAt,
+		})
+	}
+	m.mu.RUnlock()
+	for i := range infos {
+		infos[i].State = infos[i].Channel.State()
+	}
+	sort.Slice(infos, func(i, j int) bool {
+		if infos[i].App != infos[j].App {
+			return infos[i].App < infos[j].App
+		}
+		return infos[i].Stream < infos[j].Stream
+	})
+	return infos
+}
+
+// CloseStream closes the channel of the stream, disconnecting its
+// publishers and players.
+func (m *Manager) CloseStream(app, stream string) error {
+	ch, ok := m.Get(app, stream)
+	if !ok {
+		return ErrStreamNotFound
+	}
+	return ch.Close()
+}
+
+// Close stops the tasks and closes all channels, the manager does not
+// create any after.
+func (m *Manager) Close() error {
+	m.mu.Lock()
+	if m.closed {
+		m.mu.Unlock()
+		return ErrManagerClosed
+	}
+	m.closed = true
+	channels := make([]*Channel, 0, len(m.channels))
+	for _, mc := range m.channels {
+		channels = append(channels, mc.ch)
+	}
+	tasks := m.tasks
+	m.tasks = make(map[string]*task)
+	m.mu.Unlock()
+	for _, t := range tasks {
+		t.cancel()
+	}
+	for _, ch := range channels {
+		ch.Close()
+	}
+	for _, t := range tasks {
+		<-t.done
+	}
+	return nil
+}
+
+// AuthFunc returns an AuthFunc that lets publishers create streams and
+// players play the ones being published. A stream created for a publisher
+// that is rejected after the AuthFunc is closed again.
+func (m *Manager) AuthFunc() AuthFunc {
+	return func(req *AuthRequest) (*Channel, error) {
+		if req.IsPublisher {
+			ch, created, err := m.publish(req.App, req.Name)
+			if err != nil {
+				return nil, RejectBadName(err.Error())
+			}
+			if created {
+				req.Rejected = func() { m.abandon(ch) }
+			}
+			return ch, nil
+		}
+		ch, ok := m.Get(req.App, req.Name)
+		if !ok {
+			return nil, RejectStreamNotFound(ErrStreamNotFound.Error())
+		}
+		if err := ch.CanPlay(); err != nil {
+			return nil, RejectStreamNotFound(err.Error())
+		}
+		return ch, nil
+	}
+}
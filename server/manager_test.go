@@ -0,0 +1,197 @@
+package server
+
+import (
+	"context"
+	"errors"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/zijiren233/livelib/protocol/rtmp/core"
+)
+
+func TestManager(t *testing.T) {
+	var created []StreamKey
+	m := NewManager(
+		WithMaxStreams(2),
+		WithAppMaxStreams("solo", 1),
+		WithChannelCreated(func(app, stream string, c *Channel) {
+			created = append(created, StreamKey{app, stream})
+		}),
+	)
+	defer m.Close()
+
+	a, err := m.Publish("live", "a")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if again, _ := m.Publish("live", "a"); again != a {
+		t.Fatal("second publish of a stream got another channel")
+	}
+	b, err := m.Publish("live", "b")
+	if err != nil || b == a {
+		t.Fatalf("Publish(live, b) = %p, %v", b, err)
+	}
+	if _, err := m.Publish("live", "c"); !errors.Is(err, ErrTooManyStreams) {
+		t.Fatalf("Publish(live, c) = %v", err)
+	}
+	if _, err := m.Publish("solo", "a"); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := m.Publish("solo", "b"); !errors.Is(err, ErrTooManyStreams) {
+		t.Fatalf("Publish(solo, b) = %v", err)
+	}
+	if len(created) != 3 {
+		t.Fatalf("created %v", created)
+	}
+
+	if ch, ok := m.Get("live", "b"); !ok || ch != b {
+		t.Fatal("Get(live, b) failed")
+	}
+	if _, ok := m.Get("live", "c"); ok {
+		t.Fatal("Get(live, c) found a stream")
+	}
+	list := m.List()
+	if len(list) != 3 || list[0].StreamKey != (StreamKey{"live", "a"}) || list[2].App != "solo" {
+		t.Fatalf("List() = %+v", list)
+	}
+
+	if err := m.CloseStream("live", "b"); err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := m.Get("live", "b"); ok {
+		t.Fatal("closed stream still found")
+	}
+	if _, err := m.Publish("live", "c"); err != nil {
+		t.Fatalf("Publish(live, c) after closing b = %v", err)
+	}
+}
+
+func TestManagerReap(t *testing.T) {
+	m := NewManager(WithIdleTimeout(50 * time.Millisecond))
+	defer m.Close()
+	ch, err := m.Publish("live", "a")
+	if err != nil {
+		t.Fatal(err)
+	}
+	r, errc := startPublisher(ch)
+	if err := ch.WaitPublishing(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	time.Sleep(100 * time.Millisecond)
+	if _, ok := m.Get("live", "a"); !ok {
+		t.Fatal("published stream reaped")
+	}
+	r.Close()
+	<-errc
+	select {
+	case <-ch.Done():
+	case <-time.After(5 * time.Second):
+		t.Fatal("idle stream not closed")
+	}
+	deadline := time.Now().Add(5 * time.Second)
+	for len(m.List()) != 0 {
+		if time.Now().After(deadline) {
+			t.Fatalf("List() = %+v", m.List())
+		}
+		time.Sleep(time.Millisecond)
+	}
+}
+
+func TestManagerAppConf(t *testing.T) {
+	maxPlayers := 1
+	m := NewManager(
+		WithRecordDir(t.TempDir()),
+		WithAppConf(func(app string) AppConf {
+			if app != "rec" {
+				return AppConf{}
+			}
+			return AppConf{
+				MaxStreams: 1,
+				Channel:    []ChannelConf{WithMaxPlayers(maxPlayers)},
+				Record:     true,
+			}
+		}),
+	)
+	defer m.Close()
+	ch, err := m.Publish("rec", "a")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := m.Publish("rec", "b"); !errors.Is(err, ErrTooManyStreams) {
+		t.Fatalf("Publish(rec, b) = %v", err)
+	}
+	if tasks := m.Tasks(); len(tasks) != 1 || tasks[0].Kind != TaskRecord {
+		t.Fatalf("tasks = %+v", tasks)
+	}
+	startPublisher(ch)
+	if err := ch.WaitPublishing(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	if err := ch.AddPlayer(new(recorder)); err != nil {
+		t.Fatal(err)
+	}
+	if err := ch.AddPlayer(new(recorder)); !errors.Is(err, ErrTooManyPlayers) {
+		t.Errorf("second player: %v", err)
+	}
+
+	maxPlayers = 2
+	if err := m.CloseStream("rec", "a"); err != nil {
+		t.Fatal(err)
+	}
+	deadline := time.Now().Add(5 * time.Second)
+	for len(m.Tasks()) != 0 {
+		if time.Now().After(deadline) {
+			t.Fatalf("recording of closed stream still running: %+v", m.Tasks())
+		}
+		time.Sleep(time.Millisecond)
+	}
+	ch, err = m.Publish("rec", "b")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if ch.maxPlayers != 2 {
+		t.Errorf("new stream has %d max players, want 2", ch.maxPlayers)
+	}
+}
+
+func TestManagerAuthFunc(t *testing.T) {
+	m := NewManager()
+	defer m.Close()
+	auth := m.AuthFunc()
+	var status *core.StatusError
+	if _, err := auth(&AuthRequest{App: "live", Name: "a"}); !errors.As(err, &status) || status.Code != core.CodePlayStreamNotFound {
+		t.Fatalf("play before publish: %v", err)
+	}
+	ch, err := auth(&AuthRequest{App: "live", Name: "a", IsPublisher: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := auth(&AuthRequest{App: "live", Name: "a"}); !errors.As(err, &status) || status.Code != core.CodePlayStreamNotFound {
+		t.Fatalf("play before the publisher sends: %v", err)
+	}
+	pub, _ := startPublisher(ch)
+	pub.send(newPacket(pktKey, 0))
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	if err := ch.WaitPublishing(ctx); err != nil {
+		t.Fatal(err)
+	}
+	if got, err := auth(&AuthRequest{App: "live", Name: "a"}); err != nil || got != ch {
+		t.Fatalf("play: %p, %v", got, err)
+	}
+
+	full, _ := m.Publish("live", "full")
+	full.maxPlayers = 1
+	pub, _ = startPublisher(full)
+	pub.send(newPacket(pktKey, 0))
+	if err := full.WaitPublishing(ctx); err != nil {
+		t.Fatal(err)
+	}
+	if err := full.AddPlayer(new(recorder)); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := auth(&AuthRequest{App: "live", Name: "full"}); !errors.As(err, &status) || !strings.Contains(status.Description, ErrTooManyPlayers.Error()) {
+		t.Fatalf("play a full stream: %v", err)
+	}
+}
@@ -0,0 +1,532 @@
+package server
+
+import (
+	"bytes"
+	"io"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/zijiren233/livelib/av"
+	"github.com/zijiren233/livelib/protocol/hls"
+)
+
+// MetricsContentType is the content type of the prometheus text format.
+const MetricsContentType = "text/plain; version=0.0.4; charset=utf-8"
+
+// DefaultMaxStreamSeries is how many streams get their own series by
+// default.
+const DefaultMaxStreamSeries = 1000
+
+// OtherLabel is the app and stream label of the streams beyond the series
+// limit, which share one series.
+const OtherLabel = "_other"
+
+var (
+	segmentBuckets = []float64{1, 2, 4, 6, 8, 10, 15, 20, 30}
+	latencyBuckets = []float64{.005, .01, .025, .05, .1, .25, .5, 1, 2.5, 5}
+)
+
+type connLabels struct {
+	protocol string
+	role     string
+}
+
+type connCount struct {
+	open  int64
+	total uint64
+}
+
+// Metrics collects the metrics of a server and writes them in the
+// prometheus text format. A nil *Metrics collects nothing.
+type Metrics struct {
+	mu                sync.Mutex
+	maxStreams        int
+	conns             map[connLabels]*connCount
+	handshakeFailures map[string]uint64
+	authFailures      map[connLabels]uint64
+	streams           map[StreamKey]*StreamMetrics
+}
+
+type MetricsConf func(*Metrics)
+
+// WithMaxStreamSeries limits the number of streams with their own series,
+// DefaultMaxStreamSeries by default. The streams beyond it are reported
+// together with OtherLabel as app and stream.
+func WithMaxStreamSeries(n int) MetricsConf {
+	return func(m *Metrics) {
+		m.maxStreams = n
+	}
+}
+
+func NewMetrics(conf ...MetricsConf) *Metrics {
+	m := &Metrics{
+		maxStreams:        DefaultMaxStreamSeries,
+		conns:             make(map[connLabels]*connCount),
+		handshakeFailures: make(map[string]uint64),
+		authFailures:      make(map[connLabels]uint64),
+		streams:           make(map[StreamKey]*StreamMetrics),
+	}
+	for _, c := range conf {
+		c(m)
+	}
+	return m
+}
+
+// ConnOpened counts a connection, role is publisher or player. The returned
+// func counts it as closed.
+func (m *Metrics) ConnOpened(protocol, role string) (closed func()) {
+	if m == nil {
+		return func() {}
+	}
+	key := connLabels{protocol, role}
+	m.mu.Lock()
+	cc, ok := m.conns[key]
+	if !ok {
+		cc = new(connCount)
+		m.conns[key] = cc
+	}
+	cc.open++
+	cc.total++
+	m.mu.Unlock()
+	var once sync.Once
+	return func() {
+		once.Do(func() {
+			m.mu.Lock()
+			cc.open--
+			m.mu.Unlock()
+		})
+	}
+}
+
+// ConnectionCount is the number of connections of a protocol and role.
+type ConnectionCount struct {
+	Protocol string `json:"protocol"`
+	Role     string `json:"role"`
+	Open     int64  `json:"open"`
+	Total    uint64 `json:"total"`
+}
+
+// Connections returns the connection counts by protocol and role.
+func (m *Metrics) Connections() []ConnectionCount {
+	if m == nil {
+		return nil
+	}
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	keys := sortedKeys(m.conns, connLess)
+	counts := make([]ConnectionCount, len(keys))
+	for i, k := range keys {
+		counts[i] = ConnectionCount{k.protocol, k.role, m.conns[k].open, m.conns[k].total}
+	}
+	return counts
+}
+
+func (m *Metrics) HandshakeFailed(protocol string) {
+	if m == nil {
+		return
+	}
+	m.mu.Lock()
+	m.handshakeFailures[protocol]++
+	m.mu.Unlock()
+}
+
+// AuthFailed counts a rejected client, role is publisher, player or
+// unknown for connections rejected before they asked for either.
+func (m *Metrics) AuthFailed(protocol, role string) {
+	if m == nil {
+		return
+	}
+	m.mu.Lock()
+	m.authFailures[connLabels{protocol, role}]++
+	m.mu.Unlock()
+}
+
+// Stream returns the metrics of a stream, see WithStreamMetrics. Every
+// call is paired with a Release of the result, once the last one is
+// released the series of the stream are dropped.
+func (m *Metrics) Stream(app, stream string) *StreamMetrics {
+	if m == nil {
+		return nil
+	}
+	key := StreamKey{app, stream}
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	sm, ok := m.streams[key]
+	if !ok && len(m.streams) >= m.maxStreams {
+		key = StreamKey{OtherLabel, OtherLabel}
+		sm, ok = m.streams[key]
+	}
+	if !ok {
+		sm = newStreamMetrics(key)
+		m.streams[key] = sm
+	}
+	sm.refs++
+	return sm
+}
+
+// Release drops the series of the stream of sm when it was the last user.
+func (m *Metrics) Release(sm *StreamMetrics) {
+	if m == nil || sm == nil {
+		return
+	}
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if sm.refs--; sm.refs == 0 && m.streams[sm.key] == sm {
+		delete(m.streams, sm.key)
+	}
+}
+
+// StreamMetrics collects the metrics of the channels of a stream. A nil
+// *StreamMetrics collects nothing.
+type StreamMetrics struct {
+	bytesIn         atomic.Uint64
+	gopsDropped     atomic.Uint64
+	discontinuities atomic.Uint64
+
+	// key and refs are guarded by the mutex of the Metrics.
+	key  StreamKey
+	refs int
+
+	mu       sync.Mutex
+	channels map[*Channel]struct{}
+	// bytesOut and dropped count the players that left, out and lost what
+	// was last reported so that the counters do not go backwards while a
+	// player is leaving.
+	bytesOut, dropped uint64
+	out, lost         uint64
+	segments          *histogram
+	requests          *histogram
+}
+
+func newStreamMetrics(key StreamKey) *StreamMetrics {
+	return &StreamMetrics{
+		key:      key,
+		channels: make(map[*Channel]struct{}),
+		segments: newHistogram(segmentBuckets),
+		requests: newHistogram(latencyBuckets),
+	}
+}
+
+// ObserveHLSRequest records how long a playlist or segment request of the
+// stream took.
+func (sm *StreamMetrics) ObserveHLSRequest(d time.Duration) {
+	if sm == nil {
+		return
+	}
+	sm.mu.Lock()
+	sm.requests.observe(d.Seconds())
+	sm.mu.Unlock()
+}
+
+func (sm *StreamMetrics) observeSegment(item *hls.TSItem) {
+	sm.mu.Lock()
+	sm.segments.observe(float64(item.Duration) / 1000)
+	sm.mu.Unlock()
+}
+
+func (sm *StreamMetrics) addChannel(c *Channel) {
+	if sm == nil {
+		return
+	}
+	sm.mu.Lock()
+	sm.channels[c] = struct{}{}
+	sm.mu.Unlock()
+}
+
+func (sm *StreamMetrics) removeChannel(c *Channel) {
+	if sm == nil {
+		return
+	}
+	sm.mu.Lock()
+	delete(sm.channels, c)
+	sm.mu.Unlock()
+}
+
+func (sm *StreamMetrics) addBytesIn(n int) {
+	if sm == nil {
+		return
+	}
+	sm.bytesIn.Add(uint64(n))
+}
+
+func (sm *StreamMetrics) addGOPDropped() {
+	if sm == nil {
+		return
+	}
+	sm.gopsDropped.Add(1)
+}
+
+func (sm *StreamMetrics) addDiscontinuity() {
+	if sm == nil {
+		return
+	}
+	sm.discontinuities.Add(1)
+}
+
+// retire counts what a leaving player sent and lost.
+func (sm *StreamMetrics) retire(pw *packWriter) {
+	if sm == nil {
+		return
+	}
+	out, dropped := pw.traffic()
+	sm.mu.Lock()
+	sm.bytesOut += out
+	sm.dropped += dropped
+	sm.mu.Unlock()
+}
+
+type streamSample struct {
+	bytesIn, bytesOut, dropped uint64
+	gopsDropped                uint64
+	discontinuities            uint64
+	players                    int
+	cachePackets, cacheBytes   int
+	segments, requests         histogram
+}
+
+func (sm *StreamMetrics) collect() (s streamSample) {
+	sm.mu.Lock()
+	channels := make([]*Channel, 0, len(sm.channels))
+	for c := range sm.channels {
+		channels = append(channels, c)
+	}
+	sm.mu.Unlock()
+
+	// channels are not read under sm.mu, they take it while holding their
+	// own lock.
+	var out, dropped uint64
+	for _, c := range channels {
+		t := c.traffic()
+		out += t.bytesOut
+		dropped += t.dropped
+		s.players += t.players
+		s.cachePackets += t.cachePackets
+		s.cacheBytes += t.cacheBytes
+	}
+
+	sm.mu.Lock()
+	defer sm.mu.Unlock()
+	sm.out = max(sm.out, sm.bytesOut+out)
+	sm.lost = max(sm.lost, sm.dropped+dropped)
+	s.bytesIn = sm.bytesIn.Load()
+	s.gopsDropped = sm.gopsDropped.Load()
+	s.discontinuities = sm.discontinuities.Load()
+	s.bytesOut, s.dropped = sm.out, sm.lost
+	s.segments, s.requests = sm.segments.clone(), sm.requests.clone()
+	return s
+}
+
+// WithStreamMetrics reports the traffic of the channel to sm, and the
+// segments of its HLS player.
+func WithStreamMetrics(sm *StreamMetrics) ChannelConf {
+	return func(c *Channel) {
+		c.metrics = sm
+	}
+}
+
+// Metrics returns what the channel reports to, nil without WithStreamMetrics.
+func (c *Channel) Metrics() *StreamMetrics {
+	return c.metrics
+}
+
+type channelTraffic struct {
+	bytesOut, dropped        uint64
+	players                  int
+	cachePackets, cacheBytes int
+}
+
+func (c *Channel) traffic() (t channelTraffic) {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+	c.players.Range(func(_ any, pw *packWriter) bool {
+		out, dropped := pw.traffic()
+		t.bytesOut += out
+		t.dropped += dropped
+		t.players++
+		return true
+	})
+	if c.publisher != nil {
+		t.cachePackets, t.cacheBytes = c.publisher.cache.Size()
+	}
+	return t
+}
+
+// traffic returns what the player sent and lost.
+func (p *packWriter) traffic() (out, dropped uint64) {
+	dropped = p.dropped.Load()
+	if sw, ok := p.w.(av.StatsWriter); ok {
+		ws := sw.Stats()
+		out, dropped = ws.BytesSent, dropped+ws.Dropped
+	}
+	return out, dropped
+}
+
+type histogram struct {
+	bounds []float64
+	// counts holds the observations of each bucket, the last one is +Inf.
+	counts []uint64
+	sum    float64
+	count  uint64
+}
+
+func newHistogram(bounds []float64) *histogram {
+	return &histogram{bounds: bounds, counts: make([]uint64, len(bounds)+1)}
+}
+
+func (h *histogram) observe(v float64) {
+	h.counts[sort.SearchFloat64s(h.bounds, v)]++
+	h.sum += v
+	h.count++
+}
+
+func (h *histogram) clone() histogram {
+	c := *h
+	c.counts = append([]uint64(nil), h.counts...)
+	return c
+}
+
+func (m *Metrics) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", MetricsContentType)
+	m.WriteTo(w)
+}
+
+// WriteTo writes the metrics in the prometheus text format.
+func (m *Metrics) WriteTo(w io.Writer) (int64, error) {
+	var e metricsEncoder
+
+	m.mu.Lock()
+	conns := sortedKeys(m.conns, connLess)
+	e.family("livelib_connections", "gauge", "Open connections by protocol and role.")
+	for _, k := range conns {
+		e.sample("livelib_connections", float64(m.conns[k].open), "protocol", k.protocol, "role", k.role)
+	}
+	e.family("livelib_connections_total", "counter", "Connections accepted by protocol and role.")
+	for _, k := range conns {
+		e.sample("livelib_connections_total", float64(m.conns[k].total), "protocol", k.protocol, "role", k.role)
+	}
+	e.family("livelib_handshake_failures_total", "counter", "Connections that failed the handshake.")
+	for _, p := range sortedKeys(m.handshakeFailures, func(a, b string) bool { return a < b }) {
+		e.sample("livelib_handshake_failures_total", float64(m.handshakeFailures[p]), "protocol", p)
+	}
+	e.family("livelib_auth_failures_total", "counter", "Clients rejected by authentication or authorization.")
+	for _, k := range sortedKeys(m.authFailures, connLess) {
+		e.sample("livelib_auth_failures_total", float64(m.authFailures[k]), "protocol", k.protocol, "role", k.role)
+	}
+	keys := sortedKeys(m.streams, func(a, b StreamKey) bool {
+		if a.App != b.App {
+			return a.App < b.App
+		}
+		return a.Stream < b.Stream
+	})
+	streams := make([]*StreamMetrics, len(keys))
+	for i, k := range keys {
+		streams[i] = m.streams[k]
+	}
+	m.mu.Unlock()
+
+	samples := make([]streamSample, len(streams))
+	for i, sm := range streams {
+		samples[i] = sm.collect()
+	}
+	gauges := []struct {
+		name, typ, help string
+		value           func(s *streamSample) float64
+	}{
+		{"livelib_stream_bytes_in_total", "counter", "Bytes received from the publishers of the stream.",
+			func(s *streamSample) float64 { return float64(s.bytesIn) }},
+		{"livelib_stream_bytes_out_total", "counter", "Bytes sent to the players of the stream.",
+			func(s *streamSample) float64 { return float64(s.bytesOut) }},
+		{"livelib_stream_packets_dropped_total", "counter", "Packets dropped for players that could not keep up.",
+			func(s *streamSample) float64 { return float64(s.dropped) }},
+		{"livelib_stream_players", "gauge", "Players of the stream.",
+			func(s *streamSample) float64 { return float64(s.players) }},
+		{"livelib_stream_gop_cache_packets", "gauge", "Packets in the GOP cache of the stream.",
+			func(s *streamSample) float64 { return float64(s.cachePackets) }},
+		{"livelib_stream_gop_cache_bytes", "gauge", "Bytes in the GOP cache of the stream.",
+			func(s *streamSample) float64 { return float64(s.cacheBytes) }},
+		{"livelib_stream_gops_dropped_total", "counter", "GOPs too big for the GOP cache of the stream.",
+			func(s *streamSample) float64 { return float64(s.gopsDropped) }},
+		{"livelib_stream_timestamp_discontinuities_total", "counter", "Timestamp jumps of the publishers of the stream that were bridged.",
+			func(s *streamSample) float64 { return float64(s.discontinuities) }},
+	}
+	for _, g := range gauges {
+		e.family(g.name, g.typ, g.help)
+		for i, k := range keys {
+			e.sample(g.name, g.value(&samples[i]), "app", k.App, "stream", k.Stream)
+		}
+	}
+	e.family("livelib_hls_segment_duration_seconds", "histogram", "Duration of the HLS segments produced.")
+	for i, k := range keys {
+		e.histogram("livelib_hls_segment_duration_seconds", &samples[i].segments, "app", k.App, "stream", k.Stream)
+	}
+	e.family("livelib_hls_request_duration_seconds", "histogram", "Latency of HLS playlist and segment requests.")
+	for i, k := range keys {
+		e.histogram("livelib_hls_request_duration_seconds", &samples[i].requests, "app", k.App, "stream", k.Stream)
+	}
+	return e.b.WriteTo(w)
+}
+
+func connLess(a, b connLabels) bool {
+	if a.protocol != b.protocol {
+		return a.protocol < b.protocol
+	}
+	return a.role < b.role
+}
+
+func sortedKeys[K comparable, V any](m map[K]V, less func(a, b K) bool) []K {
+	keys := make([]K, 0, len(m))
+	for k := range m {
+		keys = append(keys, k)
+	}
+	sort.Slice(keys, func(i, j int) bool { return less(keys[i], keys[j]) })
+	return keys
+}
+
+// metricsEncoder writes the prometheus text format.
+type metricsEncoder struct {
+	b bytes.Buffer
+}
+
+func (e *metricsEncoder) family(name, typ, help string) {
+	e.b.WriteString("# HELP " + name + " " + help + "\n")
+	e.b.WriteString("# TYPE " + name + " " + typ + "\n")
+}
+
+// sample writes a sample, labels are name and value pairs.
+func (e *metricsEncoder) sample(name string, v float64, labels ...string) {
+	e.b.WriteString(name)
+	if len(labels) > 0 {
+		e.b.WriteByte('{')
+		for i := 0; i < len(labels); i += 2 {
+			if i > 0 {
+				e.b.WriteByte(',')
+			}
+			e.b.WriteString(labels[i] + `="` + labelEscaper.Replace(labels[i+1]) + `"`)
+		}
+		e.b.WriteByte('}')
+	}
+	e.b.WriteByte(' ')
+	e.b.WriteString(strconv.FormatFloat(v, 'g', -1, 64))
+	e.b.WriteByte('\n')
+}
+
+func (e *metricsEncoder) histogram(name string, h *histogram, labels ...string) {
+	var cum uint64
+	for i, n := range h.counts {
+		cum += n
+		le := "+Inf"
+		if i < len(h.bounds) {
+			le = strconv.FormatFloat(h.bounds[i], 'g', -1, 64)
+		}
+		e.sample(name+"_bucket", float64(cum), append(labels, "le", le)...)
+	}
+	e.sample(name+"_sum", h.sum, labels...)
+	e.sample(name+"_count", float64(h.count), labels...)
+}
+
+var labelEscaper = strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`)
@@ -0,0 +1,110 @@
+package server
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/zijiren233/livelib/av"
+)
+
+// sentRecorder is a player that claims to have sent 100 bytes.
+type sentRecorder struct {
+	recorder
+}
+
+func (r *sentRecorder) Stats() av.WriterStats {
+	return av.WriterStats{Protocol: "test", BytesSent: 100, Dropped: 2}
+}
+
+func scrape(t *testing.T, m *Metrics) string {
+	t.Helper()
+	var b bytes.Buffer
+	if _, err := m.WriteTo(&b); err != nil {
+		t.Fatal(err)
+	}
+	return b.String()
+}
+
+func checkMetrics(t *testing.T, out string, want ...string) {
+	t.Helper()
+	for _, line := range want {
+		if !strings.Contains(out, line+"\n") {
+			t.Errorf("missing %q in\n%s", line, out)
+		}
+	}
+}
+
+func TestMetrics(t *testing.T) {
+	m := NewMetrics(WithMaxStreamSeries(1))
+	mgr := NewManager(WithMetrics(m))
+	defer mgr.Close()
+
+	ch, err := mgr.Publish("live", "a")
+	if err != nil {
+		t.Fatal(err)
+	}
+	r, _ := startPublisher(ch)
+	r.send(newPacket(pktSeq, 0), newPacket(pktKey, 0), newPacket(pktInter, 40))
+	player := new(sentRecorder)
+	for ch.AddPlayer(player) != nil {
+		time.Sleep(time.Millisecond)
+	}
+	player.wait(t, 3)
+	if _, err := mgr.Publish("live", "b"); err != nil {
+		t.Fatal(err)
+	}
+
+	closed := m.ConnOpened("rtmp", "publisher")
+	m.ConnOpened("rtmp", "publisher")
+	closed()
+	closed()
+	m.AuthFailed("rtmp", "player")
+	m.HandshakeFailed("rtmp")
+	ch.Metrics().ObserveHLSRequest(30 * time.Millisecond)
+
+	out := scrape(t, m)
+	checkMetrics(t, out,
+		`livelib_connections{protocol="rtmp",role="publisher"} 1`,
+		`livelib_connections_total{protocol="rtmp",role="publisher"} 2`,
+		`livelib_auth_failures_total{protocol="rtmp",role="player"} 1`,
+		`livelib_handshake_failures_total{protocol="rtmp"} 1`,
+		`livelib_stream_bytes_in_total{app="live",stream="a"} 18`,
+		`livelib_stream_bytes_out_total{app="live",stream="a"} 100`,
+		`livelib_stream_packets_dropped_total{app="live",stream="a"} 2`,
+		`livelib_stream_players{app="live",stream="a"} 1`,
+		`livelib_stream_gop_cache_packets{app="live",stream="a"} 2`,
+		`livelib_stream_players{app="_other",stream="_other"} 0`,
+		`livelib_hls_request_duration_seconds_bucket{app="live",stream="a",le="0.025"} 0`,
+		`livelib_hls_request_duration_seconds_bucket{app="live",stream="a",le="0.05"} 1`,
+		`livelib_hls_request_duration_seconds_bucket{app="live",stream="a",le="+Inf"} 1`,
+		`livelib_hls_request_duration_seconds_count{app="live",stream="a"} 1`,
+	)
+	if strings.Contains(out, `stream="b"`) {
+		t.Errorf("stream beyond the limit has its own series:\n%s", out)
+	}
+
+	// what a player sent is still counted after it left
+	ch.DelPlayer(player)
+	checkMetrics(t, scrape(t, m),
+		`livelib_stream_bytes_out_total{app="live",stream="a"} 100`,
+		`livelib_stream_players{app="live",stream="a"} 0`,
+	)
+
+	// the series of a stream go with its channel
+	ch.Close()
+	deadline := time.Now().Add(time.Second)
+	for strings.Contains(scrape(t, m), `stream="a"`) {
+		if time.Now().After(deadline) {
+			t.Fatal("series of a removed stream kept")
+		}
+		time.Sleep(time.Millisecond)
+	}
+}
+
+func TestMetricsLabelEscaping(t *testing.T) {
+	m := NewMetrics()
+	m.Stream("a\"b", "c\\d\ne")
+	checkMetrics(t, scrape(t, m), `livelib_stream_players{app="a\"b",stream="c\\d\ne"} 0`)
+}
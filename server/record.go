@@ -0,0 +1,40 @@
+package server
+
+import (
+	"context"
+	"io"
+
+	"github.com/zijiren233/livelib/container/flv"
+)
+
+// Record writes one session of the channel as flv: it waits for a
+// publisher, then writes to the file returned by open until the publisher
+// leaves or ctx is done.
+func (c *Channel) Record(ctx context.Context, open func() (io.WriteCloser, error)) error {
+	if err := c.WaitPublishing(ctx); err != nil {
+		return err
+	}
+	sub, err := c.Subscribe(ctx, WithZeroStart())
+	if err != nil {
+		return err
+	}
+	defer sub.Close()
+	f, err := open()
+	if err != nil {
+		return err
+	}
+	w := flv.NewWriter(f)
+	for p := range sub.All() {
+		if err = w.Write(p); err != nil {
+			break
+		}
+	}
+	w.Close()
+	if cerr := f.Close(); err == nil {
+		err = cerr
+	}
+	if err != nil {
+		return err
+	}
+	return sub.Err()
+}
@@ -0,0 +1,45 @@
+package server
+
+import (
+	"context"
+
+	"github.com/zijiren233/livelib/av"
+	"github.com/zijiren233/livelib/protocol/rtmp"
+	"github.com/zijiren233/livelib/protocol/rtmp/core"
+)
+
+// PushTo publishes one session of the channel to the rtmp stream at url: it
+// waits for a publisher and returns once that leaves, the push fails or ctx
+// is done.
+func (c *Channel) PushTo(ctx context.Context, url string) error {
+	if err := c.WaitPublishing(ctx); err != nil {
+		return err
+	}
+	sub, err := c.Subscribe(ctx)
+	if err != nil {
+		return err
+	}
+	defer sub.Close()
+	connClient := core.NewConnClient()
+	if err := connClient.Start(url, av.PUBLISH); err != nil {
+		return err
+	}
+	defer connClient.Close()
+
+	w := rtmp.NewWriter(connClient)
+	errc := make(chan error, 1)
+	go func() {
+		errc <- w.SendPacket(ctx)
+		sub.Close()
+	}()
+	for p := range sub.All() {
+		if w.Write(p) != nil {
+			break
+		}
+	}
+	w.Close()
+	if err := <-errc; err != nil {
+		return err
+	}
+	return sub.Err()
+}
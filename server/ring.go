@@ -0,0 +1,230 @@
+package server
+
+import (
+	"sync"
+	"sync/atomic"
+
+	"github.com/zijiren233/livelib/av"
+)
+
+const (
+	DefaultRingSize = 1024
+
+	// ringBatch is how many packets a player takes from the ring at once.
+	ringBatch = 64
+)
+
+const (
+	ringMetadata = iota
+	ringVideoSeq
+	ringAudioSeq
+	ringHeaderNum
+)
+
+type ringHeader struct {
+	seq uint64
+	p   *av.Packet
+}
+
+// ring is the bounded buffer the packets of a channel are fanned out from.
+// The publisher appends to it without ever waiting for the players, each of
+// which reads at its own cursor and may fall behind until its packets are
+// overwritten.
+type ring struct {
+	mu    sync.RWMutex
+	slots []*av.Packet
+	// next is the sequence number of the next packet, the packet with
+	// sequence number s is kept in slots[s%len(slots)].
+	next uint64
+	// base is the sequence number of the first packet after a reset.
+	base uint64
+	// lastSync is the sequence number of the last sync point plus one, zero
+	// if there was none.
+	lastSync uint64
+	// headers are the last sequence headers and metadata, retained apart
+	// from the slots, which a player that skips ahead must not lose.
+	headers [ringHeaderNum]ringHeader
+
+	// wait is closed and replaced once packets were appended.
+	wait       chan struct{}
+	signalling atomic.Bool
+}
+
+func newRing(size int) *ring {
+	return &ring{
+		slots: make([]*av.Packet, size),
+		wait:  make(chan struct{}),
+	}
+}
+
+// push appends p, which the ring retains. syncPoint marks a packet players
+// can skip ahead to.
+func (r *ring) push(p *av.Packet, syncPoint bool) {
+	r.mu.Lock()
+	i := r.next % uint64(len(r.slots))
+	if old := r.slots[i]; old != nil {
+		old.Release()
+	}
+	r.slots[i] = p.Retain()
+	if h := ringHeaderOf(p); h >= 0 {
+		if old := r.headers[h].p; old != nil {
+			old.Release()
+		}
+		r.headers[h] = ringHeader{r.next, p.Retain()}
+	}
+	r.next++
+	if syncPoint {
+		r.lastSync = r.next
+	}
+	r.mu.Unlock()
+	r.signal()
+}
+
+func ringHeaderOf(p *av.Packet) int {
+	switch {
+	case p.IsMetadata:
+		return ringMetadata
+	case isSeqHeader(p) && p.IsVideo:
+		return ringVideoSeq
+	case isSeqHeader(p):
+		return ringAudioSeq
+	}
+	return -1
+}
+
+// signal wakes the waiting players. The wakeup happens on another
+// goroutine, so that the publisher does not pay for the size of the
+// audience.
+func (r *ring) signal() {
+	if r.signalling.CompareAndSwap(false, true) {
+		go r.broadcast()
+	}
+}
+
+func (r *ring) broadcast() {
+	for {
+		r.mu.Lock()
+		wait, announced := r.wait, r.next
+		r.wait = make(chan struct{})
+		r.mu.Unlock()
+		close(wait)
+		r.signalling.Store(false)
+
+		r.mu.RLock()
+		more := r.next != announced
+		r.mu.RUnlock()
+		if !more || !r.signalling.CompareAndSwap(false, true) {
+			return
+		}
+	}
+}
+
+// reset drops the buffered packets, the sequence numbers go on.
+func (r *ring) reset() {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	for i, p := range r.slots {
+		if p != nil {
+			p.Release()
+			r.slots[i] = nil
+		}
+	}
+	for i, h := range r.headers {
+		if h.p != nil {
+			h.p.Release()
+			r.headers[i] = ringHeader{}
+		}
+	}
+	r.lastSync = 0
+	r.base = r.next
+}
+
+// oldest is the sequence number of the oldest buffered packet.
+func (r *ring) oldest() uint64 {
+	return max(r.base, r.next-min(r.next, uint64(len(r.slots))))
+}
+
+// cursor is the read position of a player in the ring.
+type cursor struct {
+	ring *ring
+	// pos is only written by the player, and read by Stats.
+	pos atomic.Uint64
+	// waitKey holds back video until a keyframe after skipping ahead.
+	waitKey bool
+}
+
+func (r *ring) cursor() *cursor {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	c := &cursor{ring: r}
+	c.pos.Store(r.next)
+	return c
+}
+
+// fetch appends the packets from the cursor on to buf, retaining them. If
+// nothing is available it returns a channel that is closed once there is.
+// lagged reports that packets at the cursor were overwritten already.
+func (c *cursor) fetch(buf []*av.Packet) (pkts []*av.Packet, wait <-chan struct{}, lagged bool) {
+	r := c.ring
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	pos := c.pos.Load()
+	if pos < r.oldest() {
+		return buf, nil, true
+	}
+	if pos == r.next {
+		return buf, r.wait, false
+	}
+	for pos < r.next && len(buf) < cap(buf) {
+		buf = append(buf, r.slots[pos%uint64(len(r.slots))].Retain())
+		pos++
+	}
+	c.pos.Store(pos)
+	return buf, nil, false
+}
+
+// skip moves a lagging cursor ahead to the last sync point still buffered,
+// or to the end of the ring and the next keyframe. It appends the headers
+// that were skipped to buf, retaining them, and returns the number of
+// packets lost.
+func (c *cursor) skip(buf []*av.Packet) ([]*av.Packet, uint64) {
+	r := c.ring
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	target := r.next
+	pos := c.pos.Load()
+	if r.lastSync > r.oldest() && r.lastSync-1 >= pos {
+		target = r.lastSync - 1
+	} else {
+		c.waitKey = true
+	}
+	lost := target - pos
+	for _, h := range r.headers {
+		if h.p != nil && h.seq >= pos && h.seq < target {
+			buf = append(buf, h.p.Retain())
+			lost--
+		}
+	}
+	c.pos.Store(target)
+	return buf, lost
+}
+
+// backlog returns how many packets the cursor is behind.
+func (c *cursor) backlog() uint64 {
+	c.ring.mu.RLock()
+	defer c.ring.mu.RUnlock()
+	return c.ring.next - min(c.pos.Load(), c.ring.next)
+}
+
+// filter reports whether p is sent, dropping video until a keyframe after
+// the cursor skipped to the end of the ring.
+func (c *cursor) filter(p *av.Packet) bool {
+	if !c.waitKey || !p.IsVideo || isSeqHeader(p) {
+		return true
+	}
+	if vh, ok := p.Header.(av.VideoPacketHeader); ok && vh.IsKeyFrame() {
+		c.waitKey = false
+		return true
+	}
+	return false
+}
@@ -0,0 +1,163 @@
+package server
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"net"
+	"runtime"
+	"testing"
+	"time"
+
+	"github.com/zijiren233/livelib/av"
+	"github.com/zijiren233/livelib/cache"
+	"github.com/zijiren233/livelib/protocol/httpflv"
+	"github.com/zijiren233/livelib/protocol/rtmp"
+	"github.com/zijiren233/livelib/protocol/rtmp/core"
+)
+
+// blockedRecorder is a player whose first write blocks until it is
+// released.
+type blockedRecorder struct {
+	recorder
+	entered, release chan struct{}
+	blocked          bool
+}
+
+func newBlockedRecorder() *blockedRecorder {
+	return &blockedRecorder{entered: make(chan struct{}), release: make(chan struct{})}
+}
+
+func (r *blockedRecorder) Write(p *av.Packet) error {
+	if !r.blocked {
+		r.blocked = true
+		close(r.entered)
+		<-r.release
+	}
+	return r.recorder.Write(p)
+}
+
+func publishLagging(t *testing.T, policy LagPolicy) (*Channel, *blockedRecorder) {
+	t.Helper()
+	ch := NewChannel(WithRingSize(8))
+	r, _ := startPublisher(ch)
+	t.Cleanup(func() { r.Close() })
+	fast := addPlayer(t, ch)
+	slow := newBlockedRecorder()
+	if err := ch.AddPlayer(slow, WithLagPolicy(policy)); err != nil {
+		t.Fatal(err)
+	}
+	r.send(newPacket(pktSeq, 0))
+	<-slow.entered
+	pkts := []*av.Packet{newPacket(pktKey, 0)}
+	for ts := uint32(40); ts <= 200; ts += 40 {
+		pkts = append(pkts, newPacket(pktInter, ts))
+	}
+	pkts = append(pkts, newPacket(pktKey, 240), newPacket(pktInter, 280), newPacket(pktInter, 320))
+	// the fast player keeps up with each packet before the next is sent
+	for i, p := range pkts {
+		r.send(p)
+		fast.wait(t, i+2)
+	}
+	return ch, slow
+}
+
+func TestLagSkip(t *testing.T) {
+	ch, slow := publishLagging(t, LagSkip)
+	close(slow.release)
+	checkReceived(t, slow.wait(t, 4), []received{
+		{pktSeq, 0}, {pktKey, 240}, {pktInter, 280}, {pktInter, 320},
+	})
+	pw, _ := ch.players.Load(slow)
+	if n := pw.dropped.Load(); n != 6 {
+		t.Fatalf("dropped %d, want 6", n)
+	}
+}
+
+func TestLagDisconnect(t *testing.T) {
+	ch, slow := publishLagging(t, LagDisconnect)
+	close(slow.release)
+	deadline := time.Now().Add(5 * time.Second)
+	for !slow.isClosed() {
+		if time.Now().After(deadline) {
+			t.Fatal("lagging player not closed")
+		}
+		time.Sleep(time.Millisecond)
+	}
+	if _, ok := ch.players.Load(slow); ok {
+		t.Fatal("lagging player not removed")
+	}
+}
+
+// pipeWriter returns a writer of protocol over a pipe whose other end is
+// read and discarded.
+func pipeWriter(b *testing.B, protocol string) av.WriteCloser {
+	conn, peer := net.Pipe()
+	go io.Copy(io.Discard, peer)
+	b.Cleanup(func() {
+		conn.Close()
+		peer.Close()
+	})
+	var w interface {
+		av.WriteCloser
+		SendPacket(context.Context) error
+	}
+	switch protocol {
+	case "rtmp":
+		w = rtmp.NewWriter(core.NewConn(conn, 4*1024))
+	default:
+		w = httpflv.NewHttpFLVWriter(conn)
+	}
+	go w.SendPacket(context.Background())
+	return w
+}
+
+// BenchmarkFanout measures what publishing a packet costs with a growing
+// audience of real writers, and what each player costs in memory.
+func BenchmarkFanout(b *testing.B) {
+	for _, protocol := range []string{"rtmp", "http-flv"} {
+		for _, n := range []int{1, 100, 10000} {
+			b.Run(fmt.Sprintf("%s/players=%d", protocol, n), func(b *testing.B) {
+				benchmarkFanout(b, protocol, n)
+			})
+		}
+	}
+}
+
+func benchmarkFanout(b *testing.B, protocol string, n int) {
+	ch := NewChannel()
+	defer ch.Close()
+	pub := &publisher{cache: cache.NewCache(), clock: newNormalizer(ch.maxTimestampGap)}
+	if err := ch.addPublisher(pub); err != nil {
+		b.Fatal(err)
+	}
+	now := time.Now()
+	for _, p := range []*av.Packet{newPacket(pktSeq, 0), newPacket(pktKey, 0)} {
+		ch.handleInput(pub, p, now)
+	}
+
+	var before, after runtime.MemStats
+	runtime.GC()
+	runtime.ReadMemStats(&before)
+	for range n {
+		if err := ch.AddPlayer(pipeWriter(b, protocol)); err != nil {
+			b.Fatal(err)
+		}
+	}
+	runtime.GC()
+	runtime.ReadMemStats(&after)
+	perPlayer := float64(after.HeapAlloc+after.StackInuse-before.HeapAlloc-before.StackInuse) / float64(n)
+
+	inter := newPacket(pktInter, 0)
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := range b.N {
+		p := inter.Clone()
+		p.TimeStamp = uint32(40 + i*40)
+		ch.mu.Lock()
+		ch.handleInput(pub, p, now)
+		ch.mu.Unlock()
+	}
+	b.StopTimer()
+	b.ReportMetric(perPlayer, "B/player")
+}
@@ -4,7 +4,10 @@ import (
 	"context"
 	"errors"
 	"net"
+	"net/url"
+	"strings"
 	"sync/atomic"
+	"time"
 
 	"github.com/zijiren233/livelib/protocol/rtmp"
 	"github.com/zijiren233/livelib/protocol/rtmp/core"
@@ -12,10 +15,88 @@ import (
 
 type Server struct {
 	connBufferSize int32
+	chunkSize      uint32
+	limits         core.Limits
+	connectAuth    *core.ConnectAuth
 	authFunc       AuthFunc
+	metrics        *Metrics
+	hooks          *Webhooks
 }
 
-type AuthFunc func(ReqAppName, ReqChannelName string, IsPublisher bool) (*Channel, error)
+// AuthFunc decides whether a client may publish or play and returns the
+// channel to use. Returning one of the Reject errors sends that status to
+// the client; any other error is sent as NetStream.Publish.BadName to
+// publishers and NetStream.Play.StreamNotFound to players.
+type AuthFunc func(req *AuthRequest) (*Channel, error)
+
+// AuthRequest describes a publish or play request.
+type AuthRequest struct {
+	RemoteAddr net.Addr
+	App        string
+	Name       string
+	// RawQuery is the query string sent after the stream name, Query its
+	// parsed form.
+	RawQuery    string
+	Query       url.Values
+	IsPublisher bool
+	// PublishType is live, record or append.
+	PublishType string
+	TcUrl       string
+	FlashVer    string
+	// User is the authenticated user, see WithConnectAuth.
+	User        string
+	ConnectInfo core.ConnectInfo
+	// ConnectArgs are the optional arguments of connect.
+	ConnectArgs []any
+	// InputRank is the rank of a publisher among the inputs of the channel.
+	// AuthFunc may set it, see WithInputRank.
+	InputRank int
+	// Rejected is called when the request is rejected after the AuthFunc
+	// accepted it, by a publish conflict or a webhook. AuthFunc may set it.
+	Rejected func()
+}
+
+// reject calls req.Rejected, if set.
+func (req *AuthRequest) reject() {
+	if req.Rejected != nil {
+		req.Rejected()
+	}
+}
+
+func newAuthRequest(cs *core.ConnServer) *AuthRequest {
+	name, rawQuery, _ := strings.Cut(cs.PublishInfo.Name, "?")
+	query, _ := url.ParseQuery(rawQuery)
+	return &AuthRequest{
+		RemoteAddr:  cs.RemoteAddr(),
+		App:         cs.ConnInfo.App,
+		Name:        name,
+		RawQuery:    rawQuery,
+		Query:       query,
+		IsPublisher: cs.IsPublisher(),
+		PublishType: cs.PublishInfo.Type,
+		TcUrl:       cs.ConnInfo.TcUrl,
+		FlashVer:    cs.ConnInfo.Flashver,
+		User:        cs.User,
+		ConnectInfo: cs.ConnInfo,
+		ConnectArgs: cs.ConnArgs,
+	}
+}
+
+// RejectConnect rejects the whole connection.
+func RejectConnect(description string) error {
+	return &core.StatusError{Code: core.CodeConnectRejected, Description: description}
+}
+
+// RejectBadName rejects a publisher because of its stream name, for example
+// because the stream is already being published.
+func RejectBadName(description string) error {
+	return &core.StatusError{Code: core.CodePublishBadName, Description: description}
+}
+
+// RejectStreamNotFound rejects a player of a stream that does not exist.
+func RejectStreamNotFound(description string) error {
+	return &core.StatusError{Code: core.CodePlayStreamNotFound, Description: description}
+}
 
 type ServerConf func(*Server)
 
@@ -25,6 +106,44 @@ func WithConnBufferSize(bufferSize int32) ServerConf {
 	}
 }
 
+// WithChunkSize sets the chunk size used for messages sent to clients.
+func WithChunkSize(size uint32) ServerConf {
+	return func(s *Server) {
+		s.chunkSize = size
+	}
+}
+
+// WithLimits bounds the resources a single client can make the server use.
+func WithLimits(l core.Limits) ServerConf {
+	return func(s *Server) {
+		s.limits = l
+	}
+}
+
+// WithConnectAuth makes clients authenticate with the adobe or llnw
+// challenge-response scheme, checking their credentials with lookup. The
+// first of mods is offered to clients, adobe if none is given.
+func WithConnectAuth(lookup core.CredentialLookup, mods ...string) ServerConf {
+	return func(s *Server) {
+		s.connectAuth = core.NewConnectAuth(lookup, mods...)
+	}
+}
+
+// WithServerMetrics reports the connections of the server to m.
+func WithServerMetrics(m *Metrics) ServerConf {
+	return func(s *Server) {
+		s.metrics = m
+	}
+}
+
+// WithWebhooks calls the callbacks of h for the clients of the server. A
+// failed on_connect, on_publish or on_play rejects the client.
+func WithWebhooks(h *Webhooks) ServerConf {
+	return func(s *Server) {
+		s.hooks = h
+	}
+}
+
 func NewRtmpServer(authFunc AuthFunc, c ...ServerConf) *Server {
 	s := &Server{
 		authFunc: authFunc,
@@ -49,7 +168,11 @@ func (s *Server) Serve(l net.Listener) error {
 		if err != nil {
 			continue
 		}
-		conn := core.NewConn(netconn, int(atomic.LoadInt32(&s.connBufferSize)))
+		conn := core.NewConn(
+			netconn,
+			int(atomic.LoadInt32(&s.connBufferSize)),
+			core.WithLimits(s.limits),
+		)
 		go s.handleConn(conn)
 	}
 }
@@ -57,35 +180,103 @@ func (s *Server) Serve(l net.Listener) error {
 func (s *Server) handleConn(conn *core.Conn) (err error) {
 	if err := conn.HandshakeServer(); err != nil {
 		conn.Close()
+		s.metrics.HandshakeFailed("rtmp")
 		return err
 	}
-	connServer := core.NewConnServer(conn)
-	defer connServer.Close()
-
-	if err = connServer.ReadInitMsg(); err != nil {
-		return err
-	}
-
-	app, name := connServer.ConnInfo.App, connServer.PublishInfo.Name
 	if s.authFunc == nil {
 		panic("rtmp server auth func not implemented")
 	}
 
-	channel, err := s.authFunc(app, name, connServer.IsPublisher())
-	if err != nil {
+	var (
+		channel *Channel
+		req     *AuthRequest
+	)
+	connServer := core.NewConnServer(
+		conn,
+		core.WithServerChunkSize(s.chunkSize),
+		core.WithConnectAuth(s.connectAuth),
+		core.WithConnectCheck(func(cs *core.ConnServer) error {
+			return s.hooks.Call(context.Background(), HookConnect, &HookRequest{
+				Protocol: "rtmp",
+				Addr:     cs.RemoteAddr().String(),
+				App:      cs.ConnInfo.App,
+				TcUrl:    cs.ConnInfo.TcUrl,
+				FlashVer: cs.ConnInfo.Flashver,
+			})
+		}),
+		core.WithAuthorize(func(cs *core.ConnServer) (err error) {
+			req = newAuthRequest(cs)
+			defer func() {
+				if err != nil {
+					s.metrics.AuthFailed("rtmp", rtmpRole(cs))
+				}
+			}()
+			if channel, err = s.authFunc(req); err != nil {
+				return err
+			}
+			if cs.IsPublisher() {
+				if err = channel.CanPublish(); err == nil {
+					err = s.hooks.Call(context.Background(), HookPublish, newRtmpHookRequest(req))
+				}
+				if err != nil {
+					req.reject()
+					return RejectBadName(err.Error())
+				}
+				return nil
+			}
+			if err = channel.CanPlay(); err == nil {
+				err = s.hooks.Call(context.Background(), HookPlay, newRtmpHookRequest(req))
+			}
+			if err != nil {
+				req.reject()
+				return RejectStreamNotFound(err.Error())
+			}
+			return nil
+		}),
+	)
+	defer connServer.Close()
+
+	if err = connServer.ReadInitMsg(); err != nil {
+		var status *core.StatusError
+		if errors.As(err, &status) && status.Code == core.CodeConnectRejected {
+			s.metrics.AuthFailed("rtmp", "unknown")
+		}
 		return err
 	}
+	defer s.metrics.ConnOpened("rtmp", rtmpRole(connServer))()
 
+	start := time.Now()
 	if connServer.IsPublisher() {
-		reader := rtmp.NewReader(connServer)
+		reader := &countingReader{ReadCloser: rtmp.NewReader(connServer)}
 		defer reader.Close()
-		channel.PushStart(reader)
+		channel.PushStart(
+			context.Background(),
+			reader,
+			WithInputName(req.RemoteAddr.String()),
+			WithInputAddr(req.RemoteAddr.String()),
+			WithInputRank(req.InputRank),
+		)
+		hookReq := newRtmpHookRequest(req)
+		hookReq.Stats = &HookStats{Duration: time.Since(start).Seconds(), BytesIn: reader.bytes}
+		s.hooks.Notify(HookPublishDone, hookReq)
 	} else {
 		writer := rtmp.NewWriter(connServer)
 		defer writer.Close()
-		channel.AddPlayer(writer)
-		_ = writer.SendPacket(context.Background())
+		// the channel can fill up or lose its publisher after the check in
+		// authorize, the connection is closed then.
+		if err = channel.AddPlayer(writer, WithPlayerInfo("rtmp", req.RemoteAddr.String())); err == nil {
+			_ = writer.SendPacket(context.Background())
+		}
+		s.hooks.PlayDone(newRtmpHookRequest(req), start, writer)
 	}
 
 	return err
 }
+
+// rtmpRole is the role of a connection for metrics.
+func rtmpRole(cs *core.ConnServer) string {
+	if cs.IsPublisher() {
+		return "publisher"
+	}
+	return "player"
+}
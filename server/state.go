@@ -0,0 +1,178 @@
+package server
+
+import (
+	"context"
+	"fmt"
+	"sync"
+)
+
+// ChannelState is the lifecycle state of a channel.
+type ChannelState int
+
+const (
+	// StateIdle is a channel without publisher or players.
+	StateIdle ChannelState = iota
+	// StatePublishing is a channel with an active publisher.
+	StatePublishing
+	// StateDraining is a channel whose publisher left while the players
+	// wait for it to come back, see WithReconnectGrace.
+	StateDraining
+	// StateClosed is a channel that was closed, it is not used again.
+	StateClosed
+)
+
+func (s ChannelState) String() string {
+	switch s {
+	case StateIdle:
+		return "idle"
+	case StatePublishing:
+		return "publishing"
+	case StateDraining:
+		return "draining"
+	case StateClosed:
+		return "closed"
+	}
+	return "unknown"
+}
+
+func (s ChannelState) MarshalText() ([]byte, error) {
+	return []byte(s.String()), nil
+}
+
+func (s *ChannelState) UnmarshalText(text []byte) error {
+	for _, state := range []ChannelState{StateIdle, StatePublishing, StateDraining, StateClosed} {
+		if state.String() == string(text) {
+			*s = state
+			return nil
+		}
+	}
+	return fmt.Errorf("unknown channel state %q", text)
+}
+
+// stateWatcher queues the states of a channel for StateChanges.
+type stateWatcher struct {
+	mu     sync.Mutex
+	states []ChannelState
+	notify chan struct{}
+}
+
+func (w *stateWatcher) add(s ChannelState) {
+	w.mu.Lock()
+	w.states = append(w.states, s)
+	w.mu.Unlock()
+	select {
+	case w.notify <- struct{}{}:
+	default:
+	}
+}
+
+func (w *stateWatcher) take() []ChannelState {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	states := w.states
+	w.states = nil
+	return states
+}
+
+// setState moves the channel to s. c.mu must be held.
+func (c *Channel) setState(s ChannelState) {
+	if c.state == s {
+		return
+	}
+	c.state = s
+	close(c.stateChanged)
+	c.stateChanged = make(chan struct{})
+	for w := range c.watchers {
+		w.add(s)
+	}
+	if s == StateClosed {
+		c.metrics.removeChannel(c)
+		close(c.done)
+	}
+}
+
+func (c *Channel) State() ChannelState {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+	return c.state
+}
+
+// Done returns a channel that is closed once the channel is.
+func (c *Channel) Done() <-chan struct{} {
+	return c.done
+}
+
+// WaitPublishing waits until the channel has an active publisher. It
+// returns ErrClosed if the channel is closed first.
+func (c *Channel) WaitPublishing(ctx context.Context) error {
+	for {
+		c.mu.RLock()
+		state, changed := c.state, c.stateChanged
+		c.mu.RUnlock()
+		switch state {
+		case StatePublishing:
+			return nil
+		case StateClosed:
+			return ErrClosed
+		}
+		select {
+		case <-changed:
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+	}
+}
+
+// waitLeave waits until the channel is no longer in state s.
+func (c *Channel) waitLeave(s ChannelState) {
+	for {
+		c.mu.RLock()
+		state, changed := c.state, c.stateChanged
+		c.mu.RUnlock()
+		if state != s {
+			return
+		}
+		<-changed
+	}
+}
+
+// StateChanges sends the current state of the channel and every state it
+// moves to after. The returned channel is closed after StateClosed or once
+// ctx is done.
+func (c *Channel) StateChanges(ctx context.Context) <-chan ChannelState {
+	w := &stateWatcher{notify: make(chan struct{}, 1)}
+	c.mu.Lock()
+	w.add(c.state)
+	if c.state != StateClosed {
+		c.watchers[w] = struct{}{}
+	}
+	c.mu.Unlock()
+
+	out := make(chan ChannelState)
+	go func() {
+		defer close(out)
+		defer func() {
+			c.mu.Lock()
+			delete(c.watchers, w)
+			c.mu.Unlock()
+		}()
+		for {
+			select {
+			case <-w.notify:
+			case <-ctx.Done():
+				return
+			}
+			for _, s := range w.take() {
+				select {
+				case out <- s:
+				case <-ctx.Done():
+					return
+				}
+				if s == StateClosed {
+					return
+				}
+			}
+		}
+	}()
+	return out
+}
@@ -0,0 +1,80 @@
+package server
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+)
+
+func TestChannelLifecycle(t *testing.T) {
+	ch := NewChannel(WithReconnectGrace(50 * time.Millisecond))
+	states := ch.StateChanges(context.Background())
+
+	published := make(chan error, 1)
+	go func() { published <- ch.WaitPublishing(context.Background()) }()
+	r1, errc1 := startPublisher(ch)
+	if err := <-published; err != nil {
+		t.Fatalf("WaitPublishing() = %v", err)
+	}
+	rec := addPlayer(t, ch)
+	r1.send(newPacket(pktSeq, 0), newPacket(pktKey, 0))
+	rec.wait(t, 2)
+	close(r1.in)
+	<-errc1
+	for !rec.isClosed() {
+		time.Sleep(time.Millisecond)
+	}
+
+	_, errc2 := startPublisher(ch)
+	if err := ch.WaitPublishing(context.Background()); err != nil {
+		t.Fatalf("WaitPublishing() = %v", err)
+	}
+	if err := ch.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if err := <-errc2; err != nil {
+		t.Fatalf("PushStart() = %v after Close", err)
+	}
+	<-ch.Done()
+	if err := ch.CanPublish(); !errors.Is(err, ErrClosed) {
+		t.Fatalf("CanPublish() = %v", err)
+	}
+	if err := ch.PushStart(context.Background(), newChanReader()); !errors.Is(err, ErrClosed) {
+		t.Fatalf("PushStart() = %v", err)
+	}
+	if err := ch.WaitPublishing(context.Background()); !errors.Is(err, ErrClosed) {
+		t.Fatalf("WaitPublishing() = %v", err)
+	}
+
+	var got []ChannelState
+	for s := range states {
+		got = append(got, s)
+	}
+	want := []ChannelState{StateIdle, StatePublishing, StateDraining, StateIdle, StatePublishing, StateClosed}
+	if len(got) != len(want) {
+		t.Fatalf("states %v, want %v", got, want)
+	}
+	for i := range want {
+		if got[i] != want[i] {
+			t.Fatalf("states %v, want %v", got, want)
+		}
+	}
+}
+
+func TestPushStartContext(t *testing.T) {
+	ch := NewChannel()
+	ctx, cancel := context.WithCancel(context.Background())
+	errc := make(chan error, 1)
+	go func() { errc <- ch.PushStart(ctx, newChanReader()) }()
+	if err := ch.WaitPublishing(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	cancel()
+	if err := <-errc; !errors.Is(err, context.Canceled) {
+		t.Fatalf("PushStart() = %v", err)
+	}
+	if s := ch.State(); s != StateIdle {
+		t.Fatalf("state %v after the publisher left", s)
+	}
+}
@@ -0,0 +1,302 @@
+package server
+
+import (
+	"fmt"
+	"time"
+
+	"github.com/zijiren233/livelib/av"
+	"github.com/zijiren233/livelib/protocol/hls/parser/aac"
+	"github.com/zijiren233/livelib/protocol/hls/parser/h264"
+)
+
+// statsWindow is the interval bitrates and frame rates are averaged over.
+const statsWindow = time.Second
+
+// Stats is a snapshot of a channel.
+type Stats struct {
+	State ChannelState `json:"state"`
+	// Publisher, Video and Audio describe the active input, they are nil
+	// without one.
+	Publisher *PublisherStats `json:"publisher,omitempty"`
+	Video     *VideoStats     `json:"video,omitempty"`
+	Audio     *AudioStats     `json:"audio,omitempty"`
+	Players   []PlayerStats   `json:"players"`
+}
+
+type PublisherStats struct {
+	Name      string    `json:"name"`
+	Addr      string    `json:"addr"`
+	StartedAt time.Time `json:"startedAt"`
+	// GOPsDropped counts the GOPs that were too big for the cache, players
+	// joining during one of them wait for the next keyframe.
+	GOPsDropped uint64 `json:"gopsDropped"`
+	// Discontinuities counts the timestamp jumps of the input, such as
+	// encoder restarts, that were bridged for the players.
+	Discontinuities uint64 `json:"discontinuities"`
+}
+
+type VideoStats struct {
+	Codec   string `json:"codec"`
+	Profile int    `json:"profile"`
+	Level   int    `json:"level"`
+	Width   int    `json:"width"`
+	Height  int    `json:"height"`
+	// Bitrate is in bits per second.
+	Bitrate int64   `json:"bitrate"`
+	FPS     float64 `json:"fps"`
+	// GOPFrames and GOPDuration are the length of the last complete GOP.
+	GOPFrames   int           `json:"gopFrames"`
+	GOPDuration time.Duration `json:"gopDuration"`
+	Bytes       uint64        `json:"bytes"`
+	Frames      uint64        `json:"frames"`
+}
+
+type AudioStats struct {
+	Codec      string `json:"codec"`
+	SampleRate int    `json:"sampleRate"`
+	Channels   int    `json:"channels"`
+	// Bitrate is in bits per second.
+	Bitrate int64  `json:"bitrate"`
+	Bytes   uint64 `json:"bytes"`
+	Frames  uint64 `json:"frames"`
+}
+
+type PlayerStats struct {
+	// ID identifies the player for KickPlayer.
+	ID         uint64    `json:"id"`
+	Protocol   string    `json:"protocol"`
+	RemoteAddr string    `json:"remoteAddr"`
+	JoinedAt   time.Time `json:"joinedAt"`
+	BytesSent  uint64    `json:"bytesSent"`
+	// QueueDepth is how many packets the player is behind.
+	QueueDepth int    `json:"queueDepth"`
+	Dropped    uint64 `json:"dropped"`
+}
+
+// trackMeter measures the packets of a track.
+type trackMeter struct {
+	bytes, frames uint64
+
+	windowStart  time.Time
+	windowBytes  uint64
+	windowFrames uint64
+	bitrate      int64
+	fps          float64
+}
+
+func (m *trackMeter) add(n int, now time.Time) {
+	m.bytes += uint64(n)
+	m.frames++
+	if m.windowStart.IsZero() {
+		m.windowStart = now
+	}
+	m.windowBytes += uint64(n)
+	m.windowFrames++
+	if d := now.Sub(m.windowStart); d >= statsWindow {
+		m.bitrate = int64(float64(m.windowBytes*8) / d.Seconds())
+		m.fps = float64(m.windowFrames) / d.Seconds()
+		m.windowStart, m.windowBytes, m.windowFrames = now, 0, 0
+	}
+}
+
+// rates returns the bitrate and frame rate at now. Once a window passed
+// since the last measurement they cover the packets since, so that a
+// stalled input drops to zero.
+func (m *trackMeter) rates(now time.Time) (bitrate int64, fps float64) {
+	d := now.Sub(m.windowStart)
+	if m.windowStart.IsZero() || d < statsWindow {
+		return m.bitrate, m.fps
+	}
+	return int64(float64(m.windowBytes*8) / d.Seconds()), float64(m.windowFrames) / d.Seconds()
+}
+
+// ingestStats measures the packets of an input.
+type ingestStats struct {
+	video, audio trackMeter
+
+	videoCodec  uint8
+	audioFormat uint8
+	audioFlags  byte
+	// videoInfo and audioInfo are parsed from the last sequence headers.
+	videoInfo *h264.SPSInfo
+	audioInfo *aac.AudioConfig
+
+	sawKey         bool
+	lastKey        uint32
+	framesSinceKey int
+	gopFrames      int
+	gopDuration    time.Duration
+	gopsDropped    uint64
+	// discontinuities outlives the normalizer, which is replaced when
+	// players switch to the input.
+	discontinuities uint64
+}
+
+// seqInfo is what a sequence header says about its track.
+type seqInfo struct {
+	video *h264.SPSInfo
+	audio *aac.AudioConfig
+}
+
+// parseSeqHeader parses the codec configuration of a sequence header. It
+// runs once per header, without the lock of the channel.
+func parseSeqHeader(p *av.Packet) (info seqInfo) {
+	switch {
+	case !isSeqHeader(p):
+	case p.IsVideo && len(p.Data) > 5:
+		if vh, ok := p.Header.(av.VideoPacketHeader); ok && vh.CodecID() == av.CODEC_AVC {
+			if sps, err := h264.ParseConfigurationRecord(p.Data[5:]); err == nil {
+				info.video = &sps
+			}
+		}
+	case p.IsAudio && len(p.Data) > 2:
+		if cfg, err := aac.ParseAudioSpecificConfig(p.Data[2:]); err == nil {
+			info.audio = &cfg
+		}
+	}
+	return info
+}
+
+// setSeqHeader keeps what the sequence header p says about its track.
+func (s *ingestStats) setSeqHeader(p *av.Packet, info seqInfo) {
+	if p.IsVideo {
+		s.videoInfo = info.video
+	} else {
+		s.audioInfo = info.audio
+	}
+}
+
+func (s *ingestStats) add(p *av.Packet, now time.Time) {
+	switch {
+	case p.IsMetadata || isSeqHeader(p):
+	case p.IsVideo:
+		s.video.add(len(p.Data), now)
+		vh, ok := p.Header.(av.VideoPacketHeader)
+		if ok {
+			s.videoCodec = vh.CodecID()
+		}
+		if ok && vh.IsKeyFrame() {
+			if s.sawKey {
+				s.gopFrames = s.framesSinceKey
+				s.gopDuration = time.Duration(int32(p.TimeStamp-s.lastKey)) * time.Millisecond
+			}
+			s.sawKey, s.lastKey, s.framesSinceKey = true, p.TimeStamp, 0
+		}
+		s.framesSinceKey++
+	case p.IsAudio:
+		s.audio.add(len(p.Data), now)
+		if ah, ok := p.Header.(av.AudioPacketHeader); ok {
+			s.audioFormat = ah.SoundFormat()
+		}
+		if len(p.Data) > 0 {
+			s.audioFlags = p.Data[0]
+		}
+	}
+}
+
+func (c *Channel) Stats() Stats {
+	c.mu.RLock()
+	stats := Stats{State: c.state}
+	if pub := c.publisher; pub != nil {
+		stats.Publisher = &PublisherStats{
+			Name:            pub.name,
+			Addr:            pub.addr,
+			StartedAt:       pub.startedAt,
+			GOPsDropped:     pub.stats.gopsDropped,
+			Discontinuities: pub.stats.discontinuities,
+		}
+		stats.Video, stats.Audio = pub.trackStats(time.Now())
+	}
+	defer c.mu.RUnlock()
+
+	c.players.Range(func(_ any, pw *packWriter) bool {
+		ps := PlayerStats{
+			ID:         pw.id,
+			Protocol:   pw.protocol,
+			RemoteAddr: pw.remoteAddr,
+			JoinedAt:   pw.joinedAt,
+			QueueDepth: int(pw.cursor.backlog()),
+			Dropped:    pw.dropped.Load(),
+		}
+		if sw, ok := pw.w.(av.StatsWriter); ok {
+			ws := sw.Stats()
+			if ps.Protocol == "" {
+				ps.Protocol = ws.Protocol
+			}
+			ps.BytesSent = ws.BytesSent
+			ps.QueueDepth += ws.QueueDepth
+			ps.Dropped += ws.Dropped
+		}
+		stats.Players = append(stats.Players, ps)
+		return true
+	})
+	return stats
+}
+
+// trackStats describes the tracks of the input at now from its
+// measurements and sequence headers. c.mu must be held.
+func (pub *publisher) trackStats(now time.Time) (video *VideoStats, audio *AudioStats) {
+	m := &pub.stats
+	if m.video.frames > 0 {
+		video = &VideoStats{
+			Codec:       videoCodec(m.videoCodec),
+			GOPFrames:   m.gopFrames,
+			GOPDuration: m.gopDuration,
+			Bytes:       m.video.bytes,
+			Frames:      m.video.frames,
+		}
+		video.Bitrate, video.FPS = m.video.rates(now)
+	}
+	if m.audio.frames > 0 {
+		audio = &AudioStats{
+			Codec:  audioCodec(m.audioFormat),
+			Bytes:  m.audio.bytes,
+			Frames: m.audio.frames,
+		}
+		audio.Bitrate, _ = m.audio.rates(now)
+		// The flv sound rate and type, the AAC sequence header has the
+		// real ones.
+		audio.SampleRate = []int{5512, 11025, 22050, 44100}[m.audioFlags>>2&3]
+		audio.Channels = int(m.audioFlags&1) + 1
+	}
+	if info := m.videoInfo; video != nil && info != nil && m.videoCodec == av.CODEC_AVC {
+		video.Profile, video.Level = int(info.Profile), int(info.Level)
+		video.Width, video.Height = info.Width, info.Height
+	}
+	if cfg := m.audioInfo; audio != nil && cfg != nil {
+		audio.SampleRate, audio.Channels = cfg.SampleRate, cfg.Channels
+	}
+	return
+}
+
+func videoCodec(id uint8) string {
+	switch id {
+	case av.CODEC_AVC:
+		return "H264"
+	case 12:
+		return "HEVC"
+	case av.CODEC_SORENSON:
+		return "H263"
+	case av.CODEC_ON2VP6, av.CODEC_ON2VP6ALPHA:
+		return "VP6"
+	}
+	return fmt.Sprintf("codec-%d", id)
+}
+
+func audioCodec(format uint8) string {
+	switch format {
+	case av.SOUND_AAC:
+		return "AAC"
+	case av.SOUND_MP3:
+		return "MP3"
+	case av.SOUND_SPEEX:
+		return "Speex"
+	case av.SOUND_ALAW:
+		return "G711A"
+	case av.SOUND_MULAW:
+		return "G711U"
+	case av.SOUND_NELLYMOSER, av.SOUND_NELLYMOSER_8KHZ_MONO, av.SOUND_NELLYMOSER_16KHZ_MONO:
+		return "Nellymoser"
+	}
+	return fmt.Sprintf("format-%d", format)
+}
@@ -0,0 +1,122 @@
+package server
+
+import (
+	"testing"
+	"time"
+
+	"github.com/zijiren233/livelib/av"
+	"github.com/zijiren233/livelib/cache"
+	"github.com/zijiren233/livelib/container/flv"
+)
+
+func TestIngestStats(t *testing.T) {
+	var s ingestStats
+	start := time.Now()
+	// Two seconds of 25 fps video with a GOP of 50 frames.
+	for i := range 101 {
+		kind := pktInter
+		if i%50 == 0 {
+			kind = pktKey
+		}
+		s.add(newPacket(kind, uint32(i*40)), start.Add(time.Duration(i)*40*time.Millisecond))
+	}
+	if s.gopFrames != 50 || s.gopDuration != 2*time.Second {
+		t.Errorf("gop = %d frames, %v, want 50 frames, 2s", s.gopFrames, s.gopDuration)
+	}
+	if s.video.frames != 101 || s.video.bytes != 606 {
+		t.Errorf("video = %d frames, %d bytes", s.video.frames, s.video.bytes)
+	}
+	if s.video.fps < 24 || s.video.fps > 26 {
+		t.Errorf("fps = %v, want 25", s.video.fps)
+	}
+	if s.video.bitrate < 1150 || s.video.bitrate > 1250 {
+		t.Errorf("bitrate = %d, want 1200", s.video.bitrate)
+	}
+}
+
+func TestChannelStats(t *testing.T) {
+	ch := NewChannel()
+	defer ch.Close()
+	if st := ch.Stats(); st.State != StateIdle || st.Publisher != nil || st.Video != nil {
+		t.Fatalf("idle stats = %+v", st)
+	}
+
+	sps := []byte{0x67, 0x64, 0x00, 0x1f, 0xac, 0xd9, 0x40, 0x50, 0x05, 0xbb, 0x01, 0x10, 0x00, 0x00, 0x03, 0x00, 0x10, 0x00, 0x00, 0x03, 0x03, 0xc0, 0xf1, 0x83, 0x19, 0x60}
+	seq := &av.Packet{IsVideo: true, Data: append([]byte{0x17, 0, 0, 0, 0, 1, 0x64, 0, 0x1f, 0xff, 0xe1, 0, byte(len(sps))}, sps...)}
+	seq.Data = append(seq.Data, 1, 0, 4, 0x68, 0xeb, 0xe3, 0xcb)
+	aacSeq := &av.Packet{IsAudio: true, Data: []byte{0xaf, 0, 0x12, 0x10}}
+	for _, p := range []*av.Packet{seq, aacSeq} {
+		if err := flv.NewDemuxer().DemuxH(p); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	r, _ := startPublisher(ch, WithInputAddr("10.0.0.1:1935"))
+	r.send(seq, aacSeq, newPacket(pktKey, 0), newPacket(pktAudio, 10))
+	rec := new(recorder)
+	for ch.AddPlayer(rec, WithPlayerInfo("test", "10.0.0.2:5000")) != nil {
+		time.Sleep(time.Millisecond)
+	}
+	rec.wait(t, 4)
+
+	st := ch.Stats()
+	if st.State != StatePublishing || st.Publisher == nil || st.Publisher.Addr != "10.0.0.1:1935" {
+		t.Fatalf("stats = %+v", st)
+	}
+	if v := st.Video; v == nil || v.Codec != "H264" || v.Width != 1280 || v.Height != 720 || v.Frames != 1 {
+		t.Errorf("video = %+v", v)
+	}
+	if a := st.Audio; a == nil || a.Codec != "AAC" || a.SampleRate != 44100 || a.Channels != 2 || a.Frames != 1 {
+		t.Errorf("audio = %+v", a)
+	}
+	if len(st.Players) != 1 || st.Players[0].Protocol != "test" || st.Players[0].RemoteAddr != "10.0.0.2:5000" {
+		t.Errorf("players = %+v", st.Players)
+	}
+}
+
+func TestStatsGOPsDropped(t *testing.T) {
+	ch := NewChannel(WithCache(cache.WithMaxGOPFrames(2)))
+	defer ch.Close()
+	r, _ := startPublisher(ch)
+	r.send(newPacket(pktSeq, 0), newPacket(pktKey, 0), newPacket(pktInter, 40), newPacket(pktInter, 80))
+	rec := new(recorder)
+	for ch.AddPlayer(rec) != nil {
+		time.Sleep(time.Millisecond)
+	}
+	deadline := time.Now().Add(time.Second)
+	for ch.Stats().Publisher.GOPsDropped != 1 {
+		if time.Now().After(deadline) {
+			t.Fatalf("publisher = %+v", ch.Stats().Publisher)
+		}
+		time.Sleep(time.Millisecond)
+	}
+}
+
+func TestStatsDiscontinuities(t *testing.T) {
+	ch := NewChannel()
+	defer ch.Close()
+	r, _ := startPublisher(ch)
+	rec := addPlayer(t, ch)
+	// the encoder restarts
+	r.send(newPacket(pktSeq, 0), newPacket(pktKey, 5000), newPacket(pktInter, 5040), newPacket(pktKey, 0), newPacket(pktInter, 40))
+	rec.wait(t, 5)
+	if n := ch.Stats().Publisher.Discontinuities; n != 1 {
+		t.Fatalf("discontinuities = %d, want 1", n)
+	}
+}
+
+func TestTrackMeterStall(t *testing.T) {
+	var m trackMeter
+	start := time.Now()
+	last := start
+	for i := range 26 {
+		last = start.Add(time.Duration(i) * 40 * time.Millisecond)
+		m.add(1000, last)
+	}
+	if bitrate, fps := m.rates(last); bitrate < 200000 || fps < 25 {
+		t.Fatalf("bitrate = %d, fps = %v", bitrate, fps)
+	}
+	if bitrate, fps := m.rates(last.Add(2 * time.Second)); bitrate != 0 || fps != 0 {
+		t.Fatalf("stalled: bitrate = %d, fps = %v", bitrate, fps)
+	}
+}
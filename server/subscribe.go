@@ -0,0 +1,105 @@
+package server
+
+import (
+	"context"
+	"errors"
+	"io"
+	"iter"
+
+	"github.com/zijiren233/livelib/av"
+)
+
+// Subscription reads the packets of a channel: the cached start-up sequence
+// followed by the live packets. It is an av.ReadCloser and must not be read
+// from several goroutines.
+type Subscription struct {
+	c   *Channel
+	pw  *packWriter
+	ctx context.Context
+	err error
+
+	stop func() bool
+}
+
+// Subscribe returns a subscription to the channel. It ends with io.EOF when
+// the publisher leaves, with ErrPlayerLagged when it falls behind under
+// LagDisconnect, and with the error of ctx once that is done.
+func (c *Channel) Subscribe(ctx context.Context, conf ...PlayerConf) (*Subscription, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.state == StateClosed {
+		return nil, ErrClosed
+	}
+	if c.publisher == nil && c.graceTimer == nil {
+		return nil, ErrPusherNotInPublication
+	}
+	pw := newPackWriterCloser(nil)
+	pw.protocol = "subscription"
+	for _, cf := range conf {
+		cf(pw)
+	}
+	s := &Subscription{c: c, pw: pw, ctx: ctx}
+	c.attach(pw)
+	c.players.Store(s, pw)
+	s.stop = context.AfterFunc(ctx, func() { c.delPlayer(s) })
+	return s, nil
+}
+
+// Read returns the next packet, which the caller releases.
+func (s *Subscription) Read() (*av.Packet, error) {
+	if s.err != nil {
+		return nil, s.err
+	}
+	p, err := s.pw.next(s.ctx)
+	if err != nil {
+		if ctxErr := s.ctx.Err(); ctxErr != nil {
+			err = ctxErr
+		}
+		s.err = err
+		s.pw.release()
+		s.Close()
+		return nil, err
+	}
+	return p, nil
+}
+
+// All iterates over the packets until the subscription ends, see Err. A
+// packet is released once the loop body is done with it, unless it was
+// retained.
+func (s *Subscription) All() iter.Seq[*av.Packet] {
+	return func(yield func(*av.Packet) bool) {
+		for {
+			p, err := s.Read()
+			if err != nil {
+				return
+			}
+			more := yield(p)
+			p.Release()
+			if !more {
+				return
+			}
+		}
+	}
+}
+
+// Err returns why the subscription ended, nil if it has not or the
+// publisher left.
+func (s *Subscription) Err() error {
+	if errors.Is(s.err, io.EOF) {
+		return nil
+	}
+	return s.err
+}
+
+// Dropped returns the number of packets lost by falling behind.
+func (s *Subscription) Dropped() uint64 {
+	return s.pw.dropped.Load()
+}
+
+func (s *Subscription) Close() error {
+	s.stop()
+	if !s.c.delPlayer(s) {
+		return av.ErrClosed
+	}
+	return nil
+}
@@ -0,0 +1,81 @@
+package server
+
+import (
+	"context"
+	"errors"
+	"io"
+	"testing"
+)
+
+func readAll(t *testing.T, s *Subscription, n int) []received {
+	t.Helper()
+	var got []received
+	for p := range s.All() {
+		got = append(got, received{kindOf(p), p.TimeStamp})
+		if len(got) == n {
+			break
+		}
+	}
+	return got
+}
+
+func TestSubscribe(t *testing.T) {
+	ch := NewChannel()
+	r, errc := startPublisher(ch)
+	rec := addPlayer(t, ch)
+	r.send(newPacket(pktSeq, 0), newPacket(pktKey, 0), newPacket(pktAudio, 20), newPacket(pktInter, 40))
+	rec.wait(t, 4)
+
+	s, err := ch.Subscribe(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	video, err := ch.Subscribe(context.Background(), WithTracks(TrackVideo))
+	if err != nil {
+		t.Fatal(err)
+	}
+	r.send(newPacket(pktAudio, 60), newPacket(pktInter, 80))
+	checkReceived(t, readAll(t, s, 6), []received{
+		{pktSeq, 0}, {pktKey, 0}, {pktAudio, 20}, {pktInter, 40}, {pktAudio, 60}, {pktInter, 80},
+	})
+	checkReceived(t, readAll(t, video, 4), []received{
+		{pktSeq, 0}, {pktKey, 0}, {pktInter, 40}, {pktInter, 80},
+	})
+
+	close(r.in)
+	<-errc
+	if p, err := s.Read(); !errors.Is(err, io.EOF) {
+		t.Fatalf("Read() = %v, %v after the publisher left", p, err)
+	}
+	if s.Err() != nil {
+		t.Fatalf("Err() = %v", s.Err())
+	}
+	if got := readAll(t, video, 1); len(got) != 0 {
+		t.Fatalf("got %v after the publisher left", got)
+	}
+}
+
+func TestSubscribeCancel(t *testing.T) {
+	ch := NewChannel()
+	r, _ := startPublisher(ch)
+	defer r.Close()
+	addPlayer(t, ch)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	s, err := ch.Subscribe(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	done := make(chan error)
+	go func() {
+		_, err := s.Read()
+		done <- err
+	}()
+	cancel()
+	if err := <-done; !errors.Is(err, context.Canceled) {
+		t.Fatalf("Read() = %v", err)
+	}
+	if _, ok := ch.players.Load(s); ok {
+		t.Fatal("subscription not removed")
+	}
+}
@@ -0,0 +1,241 @@
+package server
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const taskRetryDelay = time.Second
+
+var (
+	ErrTaskNotFound = errors.New("task not found")
+	ErrInvalidName  = errors.New("invalid app or stream name")
+
+	errTaskDone = errors.New("task done")
+)
+
+// TaskKind is what a task of a Manager does.
+type TaskKind string
+
+const (
+	// TaskRecord records the stream to flv files, one per session.
+	TaskRecord TaskKind = "record"
+	// TaskPull publishes the rtmp, http-flv or hls stream at the target url
+	// to the stream.
+	TaskPull TaskKind = "pull"
+	// TaskPush publishes the stream to the rtmp url of the target.
+	TaskPush TaskKind = "push"
+)
+
+// TaskInfo describes a recording or relay of a Manager.
+type TaskInfo struct {
+	ID string `json:"id"`
+	StreamKey
+	Kind TaskKind `json:"kind"`
+	// Target is the url of a relay, or the file being recorded.
+	Target    string    `json:"target"`
+	StartedAt time.Time `json:"startedAt"`
+	// Err is the last error of the task, which retries until it is
+	// stopped.
+	Err string `json:"error,omitempty"`
+}
+
+type task struct {
+	seq    int
+	info   TaskInfo
+	cancel context.CancelFunc
+	done   chan struct{}
+}
+
+// StartRecording records the stream to flv files under the record
+// directory, one per publishing session, until StopTask.
+func (m *Manager) StartRecording(app, stream string) (TaskInfo, error) {
+	if !validName(app) || !validName(stream) {
+		return TaskInfo{}, ErrInvalidName
+	}
+	key := StreamKey{app, stream}
+	return m.startTask(TaskRecord, key, "", func(ctx context.Context, t *task) error {
+		ch, ok := m.Get(app, stream)
+		if !ok {
+			return ErrStreamNotFound
+		}
+		return m.record(ctx, t, key, ch)
+	})
+}
+
+func (m *Manager) record(ctx context.Context, t *task, key StreamKey, ch *Channel) error {
+	var path string
+	err := ch.Record(ctx, func() (io.WriteCloser, error) {
+		path = filepath.Join(m.recordDir, key.App, fmt.Sprintf("%s-%s.flv", key.Stream, time.Now().Format("20060102-150405")))
+		m.setTaskTarget(t, path)
+		if err := os.MkdirAll(filepath.Dir(path), 0o755); err != nil {
+			return nil, err
+		}
+		return os.Create(path)
+	})
+	if path != "" && m.onRecordDone != nil {
+		m.onRecordDone(key, path)
+	}
+	return err
+}
+
+// StartPull pulls the rtmp, http-flv or hls stream at url into the stream
+// until StopTask.
+func (m *Manager) StartPull(app, stream, url string) (TaskInfo, error) {
+	return m.startTask(TaskPull, StreamKey{app, stream}, url, func(ctx context.Context, _ *task) error {
+		ch, err := m.Publish(app, stream)
+		if err != nil {
+			return err
+		}
+		return ch.PullStart(ctx, url)
+	})
+}
+
+// StartPush pushes the stream to the rtmp url whenever it is published,
+// until StopTask.
+func (m *Manager) StartPush(app, stream, url string) (TaskInfo, error) {
+	return m.startTask(TaskPush, StreamKey{app, stream}, url, func(ctx context.Context, _ *task) error {
+		ch, ok := m.Get(app, stream)
+		if !ok {
+			return ErrStreamNotFound
+		}
+		return ch.PushTo(ctx, url)
+	})
+}
+
+// startChannelTasks starts the recording and pushes AppConf asks for, which
+// end with ch. m.mu must be held.
+func (m *Manager) startChannelTasks(key StreamKey, ch *Channel, ac AppConf) {
+	// the tasks end once they return errTaskDone, when ch is closed.
+	until := func(run func(ctx context.Context, t *task) error) func(ctx context.Context, t *task) error {
+		return func(ctx context.Context, t *task) error {
+			if ch.Closed() {
+				return errTaskDone
+			}
+			err := run(ctx, t)
+			if ch.Closed() {
+				return errTaskDone
+			}
+			return err
+		}
+	}
+	if ac.Record && validName(key.App) && validName(key.Stream) {
+		m.startTaskLocked(TaskRecord, key, "", until(func(ctx context.Context, t *task) error {
+			return m.record(ctx, t, key, ch)
+		}))
+	}
+	for _, u := range ac.Push {
+		u = strings.TrimSuffix(u, "/") + "/" + key.Stream
+		m.startTaskLocked(TaskPush, key, u, until(func(ctx context.Context, _ *task) error {
+			return ch.PushTo(ctx, u)
+		}))
+	}
+}
+
+// startTask runs run until the task is stopped, again after a while if it
+// fails.
+func (m *Manager) startTask(kind TaskKind, key StreamKey, target string, run func(ctx context.Context, t *task) error) (TaskInfo, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if m.closed {
+		return TaskInfo{}, ErrManagerClosed
+	}
+	return m.startTaskLocked(kind, key, target, run), nil
+}
+
+func (m *Manager) startTaskLocked(kind TaskKind, key StreamKey, target string, run func(ctx context.Context, t *task) error) TaskInfo {
+	m.taskSeq++
+	ctx, cancel := context.WithCancel(context.Background())
+	t := &task{
+		seq: m.taskSeq,
+		info: TaskInfo{
+			ID:        strconv.Itoa(m.taskSeq),
+			StreamKey: key,
+			Kind:      kind,
+			Target:    target,
+			StartedAt: time.Now(),
+		},
+		cancel: cancel,
+		done:   make(chan struct{}),
+	}
+	m.tasks[t.info.ID] = t
+	go func() {
+		defer close(t.done)
+		for {
+			err := run(ctx, t)
+			if ctx.Err() != nil {
+				return
+			}
+			if errors.Is(err, errTaskDone) {
+				m.mu.Lock()
+				if m.tasks[t.info.ID] == t {
+					delete(m.tasks, t.info.ID)
+				}
+				m.mu.Unlock()
+				return
+			}
+			if err == nil {
+				continue
+			}
+			m.mu.Lock()
+			t.info.Err = err.Error()
+			m.mu.Unlock()
+			select {
+			case <-ctx.Done():
+				return
+			case <-time.After(taskRetryDelay):
+			}
+		}
+	}()
+	return t.info
+}
+
+func (m *Manager) setTaskTarget(t *task, target string) {
+	m.mu.Lock()
+	t.info.Target = target
+	t.info.Err = ""
+	m.mu.Unlock()
+}
+
+// Tasks returns the recordings and relays in the order they were started.
+func (m *Manager) Tasks() []TaskInfo {
+	m.mu.RLock()
+	tasks := make([]*task, 0, len(m.tasks))
+	for _, t := range m.tasks {
+		tasks = append(tasks, t)
+	}
+	sort.Slice(tasks, func(i, j int) bool { return tasks[i].seq < tasks[j].seq })
+	infos := make([]TaskInfo, len(tasks))
+	for i, t := range tasks {
+		infos[i] = t.info
+	}
+	m.mu.RUnlock()
+	return infos
+}
+
+// StopTask stops a recording or relay and waits for it to end.
+func (m *Manager) StopTask(id string) error {
+	m.mu.Lock()
+	t, ok := m.tasks[id]
+	delete(m.tasks, id)
+	m.mu.Unlock()
+	if !ok {
+		return ErrTaskNotFound
+	}
+	t.cancel()
+	<-t.done
+	return nil
+}
+
+// validName reports whether name can be used in a file path.
+func validName(name string) bool {
+	return name != "" && name != "." && name != ".." && !strings.ContainsAny(name, `/\`)
+}
@@ -0,0 +1,133 @@
+package server
+
+import (
+	"time"
+
+	"github.com/zijiren233/livelib/av"
+)
+
+const (
+	DefaultMaxTimestampGap = 10 * time.Second
+
+	// maxTimestampBackward is how far audio and video may be interleaved
+	// out of order before a backward jump counts as a discontinuity.
+	maxTimestampBackward = 1000
+	defaultFrameDuration = 40
+)
+
+const (
+	trackVideo = iota
+	trackAudio
+	trackNum
+)
+
+// normalizer maps the timestamps of an input onto the timeline of the
+// channel. The timeline never goes backwards per track, wraps of the 32-bit
+// input timestamps are followed, and jumps such as encoder restarts are
+// bridged with the duration of one frame.
+type normalizer struct {
+	maxGap  int64
+	started bool
+	lastIn  uint32
+	out     int64
+
+	trackIn  [trackNum]uint32
+	trackSet [trackNum]bool
+	// frameDur is the last frame duration seen per track.
+	frameDur [trackNum]int64
+	lastOut  [trackNum]int64
+
+	// discontinuities counts the jumps that were bridged.
+	discontinuities uint64
+}
+
+func newNormalizer(maxGap time.Duration) *normalizer {
+	return &normalizer{
+		maxGap:   maxGap.Milliseconds(),
+		frameDur: [trackNum]int64{defaultFrameDuration, defaultFrameDuration},
+	}
+}
+
+func trackOf(p *av.Packet) int {
+	if p.IsAudio {
+		return trackAudio
+	}
+	return trackVideo
+}
+
+// start anchors the timeline so that input timestamp in is sent at out.
+func (n *normalizer) start(in uint32, out int64) {
+	n.started = true
+	n.lastIn = in
+	n.out = out
+	for i := range n.lastOut {
+		n.lastOut[i] = out
+	}
+}
+
+// frameDuration is the duration of the last frame of the busiest track.
+func (n *normalizer) frameDuration() int64 {
+	if n.trackSet[trackVideo] {
+		return n.frameDur[trackVideo]
+	}
+	return n.frameDur[trackAudio]
+}
+
+// normalize rewrites the timestamp of p, which must not be shared with
+// consumers yet, and returns the extended output timestamp.
+func (n *normalizer) normalize(p *av.Packet) int64 {
+	if p.IsMetadata || isSeqHeader(p) {
+		if n.started {
+			p.TimeStamp = uint32(n.out)
+		}
+		return n.out
+	}
+
+	in, track := p.TimeStamp, trackOf(p)
+	if !n.started {
+		n.start(in, int64(in))
+	} else {
+		d := int64(int32(in - n.lastIn))
+		if n.maxGap > 0 && d > n.maxGap || d < -maxTimestampBackward {
+			n.out = max(n.lastOut[trackVideo], n.lastOut[trackAudio]) + n.frameDur[track]
+			n.discontinuities++
+		} else {
+			if n.trackSet[track] {
+				if fd := int64(int32(in - n.trackIn[track])); fd > 0 && fd <= maxTimestampBackward {
+					n.frameDur[track] = fd
+				}
+			}
+			n.out += d
+		}
+		n.lastIn = in
+	}
+	n.trackIn[track], n.trackSet[track] = in, true
+
+	out := max(n.out, n.lastOut[track])
+	n.lastOut[track] = out
+	p.TimeStamp = uint32(out)
+	return out
+}
+
+// zeroStart shifts the timestamps of a player so that its first frame is
+// sent at zero.
+type zeroStart struct {
+	started bool
+	base    uint32
+}
+
+// shift returns a copy of p with the shifted timestamp, which takes over
+// the reference held on p.
+func (z *zeroStart) shift(p *av.Packet) *av.Packet {
+	if !z.started && !p.IsMetadata && !isSeqHeader(p) {
+		z.started = true
+		z.base = p.TimeStamp
+	}
+	shifted := p.Clone()
+	if z.started {
+		shifted.TimeStamp -= z.base
+	} else {
+		shifted.TimeStamp = 0
+	}
+	return shifted
+}
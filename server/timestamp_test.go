@@ -0,0 +1,78 @@
+package server
+
+import (
+	"testing"
+	"time"
+)
+
+func TestNormalizer(t *testing.T) {
+	type in struct {
+		kind int
+		ts   uint32
+	}
+	tests := []struct {
+		name string
+		pkts []in
+		want []int64
+	}{
+		{
+			name: "interleaved",
+			pkts: []in{{pktKey, 1000}, {pktAudio, 990}, {pktInter, 1040}, {pktAudio, 1013}, {pktAudio, 1036}},
+			want: []int64{1000, 1000, 1040, 1013, 1036},
+		},
+		{
+			name: "encoder restart",
+			pkts: []in{{pktKey, 5000}, {pktInter, 5040}, {pktInter, 5080}, {pktKey, 0}, {pktInter, 40}},
+			want: []int64{5000, 5040, 5080, 5120, 5160},
+		},
+		{
+			name: "clock jump",
+			pkts: []in{{pktKey, 0}, {pktInter, 33}, {pktInter, 3600033}, {pktInter, 3600066}},
+			want: []int64{0, 33, 66, 99},
+		},
+		{
+			name: "wrap",
+			pkts: []in{{pktKey, 0xffffffd8}, {pktInter, 0}, {pktInter, 40}},
+			want: []int64{0xffffffd8, 1 << 32, 1<<32 + 40},
+		},
+		{
+			name: "headers do not move the clock",
+			pkts: []in{{pktKey, 200}, {pktSeq, 0}, {pktInter, 240}},
+			want: []int64{200, 200, 240},
+		},
+		{
+			name: "small backward jitter",
+			pkts: []in{{pktKey, 200}, {pktInter, 240}, {pktInter, 230}, {pktInter, 280}},
+			want: []int64{200, 240, 240, 280},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			n := newNormalizer(DefaultMaxTimestampGap)
+			for i, p := range tt.pkts {
+				pkt := newPacket(p.kind, p.ts)
+				if got := n.normalize(pkt); got != tt.want[i] || pkt.TimeStamp != uint32(tt.want[i]) {
+					t.Fatalf("packet %d: got %d (%d), want %d", i, got, pkt.TimeStamp, tt.want[i])
+				}
+			}
+		})
+	}
+}
+
+func TestZeroStart(t *testing.T) {
+	ch := NewChannel(WithStallTimeout(0), WithMaxTimestampGap(time.Minute))
+	r, _ := startPublisher(ch)
+	first := addPlayer(t, ch)
+	r.send(newPacket(pktSeq, 0), newPacket(pktKey, 7000), newPacket(pktInter, 7040))
+	first.wait(t, 3)
+
+	rec := new(recorder)
+	if err := ch.AddPlayer(rec, WithZeroStart()); err != nil {
+		t.Fatal(err)
+	}
+	r.send(newPacket(pktInter, 7080), newPacket(pktKey, 7120), newPacket(pktInter, 7160))
+	checkReceived(t, rec.wait(t, 6), []received{
+		{pktSeq, 0}, {pktKey, 0}, {pktInter, 40}, {pktInter, 80}, {pktKey, 120}, {pktInter, 160},
+	})
+	r.Close()
+}
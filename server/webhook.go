@@ -0,0 +1,344 @@
+package server
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"sync"
+	"time"
+
+	"github.com/zijiren233/livelib/av"
+	"github.com/zijiren233/livelib/protocol/hls"
+)
+
+const DefaultHookTimeout = 5 * time.Second
+
+// HookEvent names a callback, after the nginx-rtmp directives.
+type HookEvent string
+
+const (
+	HookConnect     HookEvent = "on_connect"
+	HookPublish     HookEvent = "on_publish"
+	HookPublishDone HookEvent = "on_publish_done"
+	HookPlay        HookEvent = "on_play"
+	HookPlayDone    HookEvent = "on_play_done"
+	HookRecordDone  HookEvent = "on_record_done"
+	HookHLSSegment  HookEvent = "on_hls_segment"
+)
+
+// HookError is returned when a callback fails or does not answer with a
+// 2xx status, StatusCode is zero in the first case.
+type HookError struct {
+	Event      HookEvent
+	StatusCode int
+	Err        error
+}
+
+func (e *HookError) Error() string {
+	if e.Err != nil {
+		return fmt.Sprintf("%s: %v", e.Event, e.Err)
+	}
+	return fmt.Sprintf("%s: rejected with status %d", e.Event, e.StatusCode)
+}
+
+func (e *HookError) Unwrap() error {
+	return e.Err
+}
+
+// HookRequest is the JSON body posted to a callback.
+type HookRequest struct {
+	Call     HookEvent `json:"call"`
+	Protocol string    `json:"protocol"`
+	Addr     string    `json:"addr"`
+	App      string    `json:"app"`
+	Name     string    `json:"name,omitempty"`
+	TcUrl    string    `json:"tcUrl,omitempty"`
+	FlashVer string    `json:"flashVer,omitempty"`
+	// Type is the publish type of rtmp publishers, live, record or append.
+	Type string     `json:"type,omitempty"`
+	Args url.Values `json:"args,omitempty"`
+	// Stats is sent with on_publish_done and on_play_done.
+	Stats *HookStats `json:"stats,omitempty"`
+	// Segment is sent with on_hls_segment.
+	Segment *HookSegment `json:"segment,omitempty"`
+	// Path is the recorded file of on_record_done.
+	Path string `json:"path,omitempty"`
+}
+
+type HookStats struct {
+	// Duration is in seconds.
+	Duration float64 `json:"duration"`
+	BytesIn  uint64  `json:"bytesIn"`
+	BytesOut uint64  `json:"bytesOut"`
+	Dropped  uint64  `json:"dropped"`
+}
+
+type HookSegment struct {
+	Name string `json:"name"`
+	Seq  int64  `json:"seq"`
+	// Duration is in seconds.
+	Duration      float64 `json:"duration"`
+	Discontinuity bool    `json:"discontinuity,omitempty"`
+}
+
+// NewHookRequest describes an http client of a stream.
+func NewHookRequest(protocol, app, name string, r *http.Request) *HookRequest {
+	scheme := "http"
+	if r.TLS != nil {
+		scheme = "https"
+	}
+	return &HookRequest{
+		Protocol: protocol,
+		Addr:     r.RemoteAddr,
+		App:      app,
+		Name:     name,
+		TcUrl:    scheme + "://" + r.Host + "/" + app,
+		Args:     r.URL.Query(),
+	}
+}
+
+func newRtmpHookRequest(req *AuthRequest) *HookRequest {
+	return &HookRequest{
+		Protocol: "rtmp",
+		Addr:     req.RemoteAddr.String(),
+		App:      req.App,
+		Name:     req.Name,
+		TcUrl:    req.TcUrl,
+		FlashVer: req.FlashVer,
+		Type:     req.PublishType,
+		Args:     req.Query,
+	}
+}
+
+// Webhooks posts the lifecycle events of streams to http callbacks, the way
+// nginx-rtmp does. A nil *Webhooks calls nothing.
+type Webhooks struct {
+	urls    map[HookEvent]string
+	client  *http.Client
+	timeout time.Duration
+}
+
+type WebhookConf func(*Webhooks)
+
+// WithHook posts event to url.
+func WithHook(event HookEvent, url string) WebhookConf {
+	return func(h *Webhooks) {
+		h.urls[event] = url
+	}
+}
+
+func WithHookClient(client *http.Client) WebhookConf {
+	return func(h *Webhooks) {
+		h.client = client
+	}
+}
+
+// WithHookTimeout bounds each call, DefaultHookTimeout by default.
+func WithHookTimeout(d time.Duration) WebhookConf {
+	return func(h *Webhooks) {
+		h.timeout = d
+	}
+}
+
+func NewWebhooks(conf ...WebhookConf) *Webhooks {
+	h := &Webhooks{
+		urls:    make(map[HookEvent]string),
+		client:  http.DefaultClient,
+		timeout: DefaultHookTimeout,
+	}
+	for _, c := range conf {
+		c(h)
+	}
+	return h
+}
+
+// Call posts req to the callback of event and waits for the answer. It
+// returns a *HookError if the callback fails or answers with a status other
+// than 2xx, and nil if event has no callback.
+func (h *Webhooks) Call(ctx context.Context, event HookEvent, req *HookRequest) error {
+	if h == nil {
+		return nil
+	}
+	u, ok := h.urls[event]
+	if !ok {
+		return nil
+	}
+	req.Call = event
+	body, err := json.Marshal(req)
+	if err != nil {
+		return &HookError{Event: event, Err: err}
+	}
+	ctx, cancel := context.WithTimeout(ctx, h.timeout)
+	defer cancel()
+	hr, err := http.NewRequestWithContext(ctx, http.MethodPost, u, bytes.NewReader(body))
+	if err != nil {
+		return &HookError{Event: event, Err: err}
+	}
+	hr.Header.Set("Content-Type", "application/json")
+	resp, err := h.client.Do(hr)
+	if err != nil {
+		return &HookError{Event: event, Err: err}
+	}
+	io.Copy(io.Discard, resp.Body)
+	resp.Body.Close()
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		return &HookError{Event: event, StatusCode: resp.StatusCode}
+	}
+	return nil
+}
+
+// Notify posts req to the callback of event in the background, for the
+// events that cannot be rejected.
+func (h *Webhooks) Notify(event HookEvent, req *HookRequest) {
+	if h == nil || h.urls[event] == "" {
+		return
+	}
+	go h.Call(context.Background(), event, req)
+}
+
+// HLSSegmentFunc returns an hls.SourceConf that notifies on_hls_segment for
+// the segments of the stream.
+func (h *Webhooks) HLSSegmentFunc(app, name string) hls.SourceConf {
+	return hls.WithSegmentFunc(func(item *hls.TSItem) {
+		h.Notify(HookHLSSegment, &HookRequest{
+			Protocol: "hls",
+			App:      app,
+			Name:     name,
+			Segment: &HookSegment{
+				Name:          item.TsName,
+				Seq:           item.SeqNum,
+				Duration:      float64(item.Duration) / 1000,
+				Discontinuity: item.Discontinuity,
+			},
+		})
+	})
+}
+
+// PlayDone notifies on_play_done for a player that joined at start and was
+// written to through w.
+func (h *Webhooks) PlayDone(req *HookRequest, start time.Time, w av.WriteCloser) {
+	stats := &HookStats{Duration: time.Since(start).Seconds()}
+	if sw, ok := w.(av.StatsWriter); ok {
+		ws := sw.Stats()
+		stats.BytesOut, stats.Dropped = ws.BytesSent, ws.Dropped
+	}
+	req.Stats = stats
+	h.Notify(HookPlayDone, req)
+}
+
+// countingReader counts the bytes of the packets read from r.
+type countingReader struct {
+	av.ReadCloser
+	bytes uint64
+}
+
+func (r *countingReader) Read() (*av.Packet, error) {
+	p, err := r.ReadCloser.Read()
+	if err == nil {
+		r.bytes += uint64(len(p.Data))
+	}
+	return p, err
+}
+
+// DefaultHLSSessionTimeout is how long an hls session lasts after its last
+// playlist request.
+const DefaultHLSSessionTimeout = 30 * time.Second
+
+// HLSSessions tells the playlist requests of new hls players from the ones
+// of players that poll, so that on_play is called once per player and
+// on_play_done once it stopped polling. A session is identified by the
+// session query value of the requests, or by the host of the client.
+type HLSSessions struct {
+	hooks   *Webhooks
+	timeout time.Duration
+
+	mu       sync.Mutex
+	sessions map[hlsSessionKey]*hlsSession
+}
+
+type hlsSessionKey struct {
+	app, name, id string
+}
+
+type hlsSession struct {
+	req   *HookRequest
+	start time.Time
+	last  time.Time
+	timer *time.Timer
+	// ready is closed once on_play answered with err.
+	ready chan struct{}
+	err   error
+}
+
+type HLSSessionsConf func(*HLSSessions)
+
+// WithHLSSessionTimeout ends a session d after its last playlist request,
+// DefaultHLSSessionTimeout by default.
+func WithHLSSessionTimeout(d time.Duration) HLSSessionsConf {
+	return func(s *HLSSessions) {
+		s.timeout = d
+	}
+}
+
+func NewHLSSessions(hooks *Webhooks, conf ...HLSSessionsConf) *HLSSessions {
+	s := &HLSSessions{
+		hooks:    hooks,
+		timeout:  DefaultHLSSessionTimeout,
+		sessions: make(map[hlsSessionKey]*hlsSession),
+	}
+	for _, c := range conf {
+		c(s)
+	}
+	return s
+}
+
+// Play calls on_play with req for the first playlist request r of a
+// session and returns its answer, later requests extend the session.
+func (s *HLSSessions) Play(req *HookRequest, r *http.Request) error {
+	key := hlsSessionKey{app: req.App, name: req.Name, id: r.URL.Query().Get("session")}
+	if key.id == "" {
+		key.id, _, _ = net.SplitHostPort(r.RemoteAddr)
+	}
+	now := time.Now()
+	s.mu.Lock()
+	sess, ok := s.sessions[key]
+	if ok {
+		sess.last = now
+		s.mu.Unlock()
+		<-sess.ready
+		return sess.err
+	}
+	sess = &hlsSession{req: req, start: now, last: now, ready: make(chan struct{})}
+	s.sessions[key] = sess
+	s.mu.Unlock()
+
+	sess.err = s.hooks.Call(r.Context(), HookPlay, req)
+	s.mu.Lock()
+	if sess.err != nil {
+		delete(s.sessions, key)
+	} else {
+		sess.timer = time.AfterFunc(s.timeout, func() { s.expire(key, sess) })
+	}
+	s.mu.Unlock()
+	close(sess.ready)
+	return sess.err
+}
+
+// expire ends sess unless it was requested again within the timeout.
+func (s *HLSSessions) expire(key hlsSessionKey, sess *hlsSession) {
+	s.mu.Lock()
+	if idle := time.Since(sess.last); idle < s.timeout {
+		sess.timer.Reset(s.timeout - idle)
+		s.mu.Unlock()
+		return
+	}
+	delete(s.sessions, key)
+	s.mu.Unlock()
+	sess.req.Stats = &HookStats{Duration: sess.last.Sub(sess.start).Seconds()}
+	s.hooks.Notify(HookPlayDone, sess.req)
+}
@@ -0,0 +1,171 @@
+package server
+
+import (
+	"encoding/json"
+	"errors"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/zijiren233/livelib/av"
+	"github.com/zijiren233/livelib/protocol/rtmp/core"
+)
+
+// hookServer answers the callbacks with 403 for the names in reject and
+// reports every request it gets.
+func hookServer(t *testing.T, reject ...string) (string, <-chan HookRequest) {
+	t.Helper()
+	calls := make(chan HookRequest, 16)
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var req HookRequest
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			t.Error(err)
+		}
+		calls <- req
+		for _, name := range reject {
+			if req.Name == name || req.App == name {
+				w.WriteHeader(http.StatusForbidden)
+				return
+			}
+		}
+	}))
+	t.Cleanup(srv.Close)
+	return srv.URL, calls
+}
+
+func nextCall(t *testing.T, calls <-chan HookRequest) HookRequest {
+	t.Helper()
+	select {
+	case req := <-calls:
+		return req
+	case <-time.After(5 * time.Second):
+		t.Fatal("no callback")
+	}
+	return HookRequest{}
+}
+
+func TestWebhooksCall(t *testing.T) {
+	url, calls := hookServer(t, "denied")
+	h := NewWebhooks(WithHook(HookPublish, url))
+
+	req := &HookRequest{App: "live", Name: "ok", Args: map[string][]string{"token": {"1"}}}
+	if err := h.Call(t.Context(), HookPublish, req); err != nil {
+		t.Fatal(err)
+	}
+	got := nextCall(t, calls)
+	if got.Call != HookPublish || got.App != "live" || got.Args.Get("token") != "1" {
+		t.Errorf("got %+v", got)
+	}
+
+	var hookErr *HookError
+	err := h.Call(t.Context(), HookPublish, &HookRequest{App: "live", Name: "denied"})
+	if !errors.As(err, &hookErr) || hookErr.StatusCode != http.StatusForbidden {
+		t.Errorf("err = %v, want status 403", err)
+	}
+	if err := h.Call(t.Context(), HookPlay, &HookRequest{}); err != nil {
+		t.Errorf("event without callback: %v", err)
+	}
+}
+
+func TestWebhooksRtmp(t *testing.T) {
+	url, calls := hookServer(t, "denied", "closed")
+	hooks := NewWebhooks(
+		WithHook(HookConnect, url),
+		WithHook(HookPublish, url),
+		WithHook(HookPublishDone, url),
+	)
+	mgr := NewManager()
+	defer mgr.Close()
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+	go NewRtmpServer(mgr.AuthFunc(), WithWebhooks(hooks)).Serve(l)
+	base := "rtmp://" + l.Addr().String()
+
+	tests := []struct {
+		url, code string
+		calls     []HookEvent
+	}{
+		{base + "/closed/stream", core.CodeConnectRejected, []HookEvent{HookConnect}},
+		{base + "/live/denied", core.CodePublishBadName, []HookEvent{HookConnect, HookPublish}},
+	}
+	for _, tt := range tests {
+		cc := core.NewConnClient()
+		err := cc.Start(tt.url, av.PUBLISH)
+		var status *core.StatusError
+		if !errors.As(err, &status) || status.Code != tt.code {
+			t.Errorf("%s: err = %v, want %s", tt.url, err, tt.code)
+		}
+		cc.Close()
+		for _, event := range tt.calls {
+			if got := nextCall(t, calls); got.Call != event {
+				t.Errorf("%s: got %s, want %s", tt.url, got.Call, event)
+			}
+		}
+	}
+	if _, ok := mgr.Get("live", "denied"); ok {
+		t.Error("stream of a rejected publisher kept")
+	}
+
+	cc := core.NewConnClient()
+	if err := cc.Start(base+"/live/stream?token=1", av.PUBLISH); err != nil {
+		t.Fatal(err)
+	}
+	nextCall(t, calls)
+	got := nextCall(t, calls)
+	if got.Call != HookPublish || got.Protocol != "rtmp" || got.Name != "stream" || got.Args.Get("token") != "1" {
+		t.Errorf("on_publish = %+v", got)
+	}
+	cc.Close()
+	if got := nextCall(t, calls); got.Call != HookPublishDone || got.Stats == nil {
+		t.Errorf("on_publish_done = %+v", got)
+	}
+}
+
+func TestHLSSessions(t *testing.T) {
+	url, calls := hookServer(t, "denied")
+	sessions := NewHLSSessions(
+		NewWebhooks(WithHook(HookPlay, url), WithHook(HookPlayDone, url)),
+		WithHLSSessionTimeout(100*time.Millisecond),
+	)
+	play := func(name, target string) error {
+		r := httptest.NewRequest(http.MethodGet, target, nil)
+		return sessions.Play(NewHookRequest("hls", "live", name, r), r)
+	}
+
+	for range 3 {
+		if err := play("stream", "/live/stream.m3u8"); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := play("stream", "/live/stream.m3u8?session=2"); err != nil {
+		t.Fatal(err)
+	}
+	for range 2 {
+		if got := nextCall(t, calls); got.Call != HookPlay {
+			t.Fatalf("got %s, want on_play", got.Call)
+		}
+	}
+	for range 2 {
+		if got := nextCall(t, calls); got.Call != HookPlayDone || got.Stats == nil {
+			t.Fatalf("got %+v, want on_play_done", got)
+		}
+	}
+	select {
+	case got := <-calls:
+		t.Fatalf("unexpected %s", got.Call)
+	default:
+	}
+
+	// a rejected session is asked again
+	for range 2 {
+		if err := play("denied", "/live/denied.m3u8"); err == nil {
+			t.Fatal("rejected session played")
+		}
+		nextCall(t, calls)
+	}
+}